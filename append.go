@@ -0,0 +1,168 @@
+package rhizome
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+// Allocation-free encoding.
+// -----------------------------------------------------------------------------
+// EncodeFrame and EncodeResponseV1 return a new slice on every call. Hot paths
+// that encode many objects can instead append to a buffer they reuse with
+// AppendFrame and AppendResponse, or write an object straight to a connection
+// with Object.WriteTo, which sends the payload from the object itself instead
+// of copying it behind the header.
+//
+// Compressing a v2 payload still allocates the compressed copy.
+// -----------------------------------------------------------------------------
+
+// AppendFrame appends the encoding of obj, as returned by EncodeFrame, to dst
+// and returns the extended slice. dst is returned unchanged on error.
+func AppendFrame(dst []byte, obj *Object) ([]byte, error) {
+	obj.checkReleased()
+
+	var out []byte
+	var err error
+
+	switch obj.Version {
+	case ProtocolV1:
+		out, err = appendV1(dst, obj)
+	case ProtocolV2:
+		out, err = appendV2(dst, obj, defaultLimits())
+	default:
+		err = fmt.Errorf("unsupported protocol version: %d", obj.Version)
+	}
+	if err != nil {
+		return dst, err
+	}
+	return out, nil
+}
+
+// EncodedSize returns the length of the frame EncodeFrame returns for obj, or
+// an error if obj can not be encoded, without encoding it. A v2 payload that
+// would be compressed is compressed to learn its size.
+func EncodedSize(obj *Object) (int, error) {
+	obj.checkReleased()
+
+	if obj.UID == "" {
+		return 0, errors.New("UID must not be empty")
+	}
+	size := 0
+	for _, s := range [...]string{obj.UID, obj.Arg1, obj.Arg2, obj.Arg3, obj.Arg4} {
+		if len(s) > 255 {
+			return 0, fmt.Errorf("string too long for u8 prefix: %d", len(s))
+		}
+		size += 1 + len(s)
+	}
+
+	switch obj.Version {
+	case ProtocolV1:
+		if len(obj.Payload) > maxPayloadSize {
+			return 0, fmt.Errorf("payload too large: %d bytes", len(obj.Payload))
+		}
+		// Version, three header bytes, encoding and the u16 payload length.
+		return size + 4 + 1 + 2 + len(obj.Payload), nil
+
+	case ProtocolV2:
+		flags, payload, err := prepareV2(obj, defaultLimits())
+		if err != nil {
+			return 0, err
+		}
+		// Version, flags, three header bytes, encoding and the u32 payload
+		// length.
+		size += 5 + 1 + 4 + len(payload)
+		if flags&FlagFragment != 0 {
+			size += 4
+		}
+		if flags&FlagCompressed != 0 {
+			size += 5
+		}
+		return size, nil
+
+	default:
+		return 0, fmt.Errorf("unsupported protocol version: %d", obj.Version)
+	}
+}
+
+// AppendResponse appends the encoding of response, as returned by
+// EncodeResponseV1, to dst and returns the extended slice.
+func AppendResponse(dst []byte, response Response) []byte {
+	// A UID too long for its u8 prefix has always been left out.
+	if len(response.UID) > 255 {
+		return append(dst, 0, 1, response.Ack)
+	}
+
+	dst = binary.BigEndian.AppendUint16(dst, uint16(1+len(response.UID)+1))
+	dst = append(dst, uint8(len(response.UID)))
+	dst = append(dst, response.UID...)
+	return append(dst, response.Ack)
+}
+
+// frameWriter holds the buffers Object.WriteTo reuses between calls.
+type frameWriter struct {
+	header []byte
+	vec    [2][]byte
+	bufs   net.Buffers
+}
+
+var frameWriters = sync.Pool{
+	New: func() any {
+		return &frameWriter{header: make([]byte, 0, 64)}
+	},
+}
+
+// WriteTo writes obj to w as a length prefixed frame, the same bytes as
+// WriteFrame(w, EncodeFrame(obj)), without copying the payload. The header and
+// payload are handed to w together through net.Buffers, which connections
+// supporting vectored I/O, like *net.TCPConn, send in a single system call.
+//
+// Other writers receive a Write for the header and another for the payload,
+// so writers shared between goroutines must be locked around WriteTo.
+func (obj *Object) WriteTo(w io.Writer) (int64, error) {
+	obj.checkReleased()
+
+	fw := frameWriters.Get().(*frameWriter)
+	defer frameWriters.Put(fw)
+
+	// Room for the length prefix, filled in once the size is known.
+	header := append(fw.header[:0], 0, 0, 0, 0)
+	payload := obj.Payload
+
+	var err error
+	switch obj.Version {
+	case ProtocolV1:
+		header, err = appendV1Header(header, obj)
+	case ProtocolV2:
+		var flags uint8
+		if flags, payload, err = prepareV2(obj, defaultLimits()); err == nil {
+			header, err = appendV2Header(header, obj, flags, payload)
+		}
+	default:
+		err = fmt.Errorf("unsupported protocol version: %d", obj.Version)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	size := uint64(len(header)) - 4 + uint64(len(payload))
+	if size > math.MaxUint32 {
+		return 0, fmt.Errorf("write frame: frame too large: %d bytes", size)
+	}
+	binary.BigEndian.PutUint32(header, uint32(size))
+	fw.header = header
+
+	fw.vec = [2][]byte{header, payload}
+	fw.bufs = fw.vec[:]
+	n, err := fw.bufs.WriteTo(w)
+
+	// Do not keep the payload alive in the pool.
+	fw.vec = [2][]byte{}
+	fw.bufs = nil
+	return n, err
+}
@@ -0,0 +1,221 @@
+package rhizome
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// newAppendObject returns a delivery of version with an empty argument between
+// set ones, and a payload large enough to be compressed.
+func newAppendObject(version uint8) *Object {
+	obj := newDelivery("uid-append", EncodingCsv, bytes.Repeat([]byte("1,2,3\n"), 100))
+	obj.Arg2, obj.Arg4 = "b", "d"
+	obj.Version = version
+	return obj
+}
+
+func TestAppendFrame_MatchesEncodeFrame(t *testing.T) {
+	compressed := newAppendObject(ProtocolV2)
+	compressed.Compression = CompressionGzip
+	fragment := newAppendObject(ProtocolV2)
+	fragment.FragIndex, fragment.FragCount = 1, 3
+
+	for name, obj := range map[string]*Object{
+		"v1":         newAppendObject(ProtocolV1),
+		"v2":         newAppendObject(ProtocolV2),
+		"compressed": compressed,
+		"fragment":   fragment,
+	} {
+		want, err := EncodeFrame(obj)
+		if err != nil {
+			t.Fatalf("%s: EncodeFrame error: %v", name, err)
+		}
+
+		prefix := []byte("prefix")
+		got, err := AppendFrame(prefix, obj)
+		if err != nil {
+			t.Fatalf("%s: AppendFrame error: %v", name, err)
+		}
+		if !bytes.Equal(got[:len(prefix)], prefix) || !bytes.Equal(got[len(prefix):], want) {
+			t.Fatalf("%s: AppendFrame differs from EncodeFrame", name)
+		}
+
+		decoded, err := DecodeFrame(got[len(prefix):], newResponder())
+		if err != nil {
+			t.Fatalf("%s: DecodeFrame error: %v", name, err)
+		}
+		assertObjectsEqual(t, obj, decoded)
+	}
+}
+
+func TestAppendFrame_ErrorLeavesDst(t *testing.T) {
+	obj := newAppendObject(ProtocolV1)
+	obj.Arg4 = string(make([]byte, 256))
+
+	dst := []byte("keep")
+	got, err := AppendFrame(dst, obj)
+	if err == nil {
+		t.Fatalf("expected error for an oversized argument")
+	}
+	if string(got) != "keep" {
+		t.Fatalf("AppendFrame returned %q on error, want dst unchanged", got)
+	}
+}
+
+func TestAppendResponse_MatchesEncodeResponseV1(t *testing.T) {
+	for _, resp := range []Response{
+		{UID: "uid-1", Ack: AckSent},
+		{UID: "", Ack: AckRouteNotFound},
+	} {
+		got := AppendResponse([]byte{0xAA}, resp)
+		want := append([]byte{0xAA}, EncodeResponseV1(resp)...)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("AppendResponse(%+v) = %v, want %v", resp, got, want)
+		}
+
+		decoded, _, err := DecodeResponseV1(got[1:])
+		if err != nil || decoded != resp {
+			t.Fatalf("DecodeResponseV1 = %+v, %v, want %+v", decoded, err, resp)
+		}
+	}
+}
+
+func TestObject_WriteTo_MatchesWriteFrame(t *testing.T) {
+	compressed := newAppendObject(ProtocolV2)
+	compressed.Compression = CompressionGzip
+
+	for _, obj := range []*Object{
+		newAppendObject(ProtocolV1), newAppendObject(ProtocolV2), compressed,
+	} {
+		frame, err := EncodeFrame(obj)
+		if err != nil {
+			t.Fatalf("EncodeFrame error: %v", err)
+		}
+		var want bytes.Buffer
+		if err := WriteFrame(&want, frame); err != nil {
+			t.Fatalf("WriteFrame error: %v", err)
+		}
+
+		var got bytes.Buffer
+		n, err := obj.WriteTo(&got)
+		if err != nil {
+			t.Fatalf("WriteTo error: %v", err)
+		}
+		if n != int64(want.Len()) || !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatalf("v%d: WriteTo wrote %d bytes that differ from WriteFrame", obj.Version, n)
+		}
+	}
+
+	obj := newAppendObject(ProtocolV1)
+	obj.UID = ""
+	if n, err := obj.WriteTo(io.Discard); err == nil || n != 0 {
+		t.Fatalf("WriteTo = %d, %v, want an error before writing", n, err)
+	}
+}
+
+func TestAppend_DoesNotAllocate(t *testing.T) {
+	obj := newAppendObject(ProtocolV1)
+	buf := make([]byte, 0, 4*BytesInKilobyte)
+	resp := Response{UID: obj.UID, Ack: AckSent}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, _ = AppendFrame(buf[:0], obj)
+		buf = AppendResponse(buf, resp)
+	})
+	if allocs != 0 {
+		t.Fatalf("AppendFrame and AppendResponse made %v allocations", allocs)
+	}
+}
+
+//--------Benchmarks------------------------------------------------------------
+
+func BenchmarkEncodeFrame_V1(b *testing.B) {
+	obj := newAppendObject(ProtocolV1)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := EncodeFrame(obj); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendFrame_V1(b *testing.B) {
+	obj := newAppendObject(ProtocolV1)
+	buf := make([]byte, 0, 4*BytesInKilobyte)
+	b.ReportAllocs()
+	for b.Loop() {
+		var err error
+		if buf, err = AppendFrame(buf[:0], obj); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodeResponseV1(b *testing.B) {
+	resp := Response{UID: "uid-append", Ack: AckSent}
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = EncodeResponseV1(resp)
+	}
+}
+
+func BenchmarkAppendResponse(b *testing.B) {
+	resp := Response{UID: "uid-append", Ack: AckSent}
+	buf := make([]byte, 0, 64)
+	b.ReportAllocs()
+	for b.Loop() {
+		buf = AppendResponse(buf[:0], resp)
+	}
+}
+
+func BenchmarkWriteFrame_V1(b *testing.B) {
+	obj := newAppendObject(ProtocolV1)
+	b.ReportAllocs()
+	for b.Loop() {
+		frame, err := EncodeFrame(obj)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := WriteFrame(io.Discard, frame); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkObjectWriteTo_V1(b *testing.B) {
+	obj := newAppendObject(ProtocolV1)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := obj.WriteTo(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEncodedSize_RejectsWhatEncodeFrameRejects(t *testing.T) {
+	noUID := newAppendObject(ProtocolV1)
+	noUID.UID = ""
+	longArg := newAppendObject(ProtocolV2)
+	longArg.Arg3 = string(bytes.Repeat([]byte("a"), 256))
+	largeV1 := newAppendObject(ProtocolV1)
+	largeV1.Payload = make([]byte, maxPayloadSize+1)
+	badFragment := newAppendObject(ProtocolV2)
+	badFragment.FragIndex, badFragment.FragCount = 3, 3
+	unknown := newAppendObject(9)
+
+	for name, obj := range map[string]*Object{
+		"no uid":       noUID,
+		"long arg":     longArg,
+		"large v1":     largeV1,
+		"bad fragment": badFragment,
+		"version":      unknown,
+	} {
+		if _, err := EncodeFrame(obj); err == nil {
+			t.Fatalf("%s: EncodeFrame succeeded", name)
+		}
+		if size, err := EncodedSize(obj); err == nil {
+			t.Fatalf("%s: EncodedSize = %d, want an error", name, size)
+		}
+	}
+}
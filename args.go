@@ -0,0 +1,488 @@
+package rhizome
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Typed arguments.
+// -----------------------------------------------------------------------------
+// Arguments travel as strings. The accessors below read them as other types,
+// and the setters write them in the format the accessors read, so producers
+// and consumers agree on it:
+//
+//	int, uint, float  strconv formatting, floats in the shortest form that
+//	                  reads back exactly
+//	bool              strconv.ParseBool, written as "true" or "false"
+//	time.Duration     time.ParseDuration, like "1m30s"
+//	time.Time         RFC 3339 with nanoseconds
+//	map[string]string comma separated key=value pairs, sorted by key, with
+//	                  keys and values escaped as in URL queries
+//
+// Positions count from 1, for Arg1 through Arg4, and panic outside of that
+// range. Arguments that do not parse fail with an *ArgError naming their
+// position.
+//
+// UnmarshalArgs and MarshalArgs map the arguments onto the fields of a struct
+// instead, see UnmarshalArgs.
+// -----------------------------------------------------------------------------
+
+// Arg returns the argument at pos.
+func (obj *Object) Arg(pos int) string {
+	return *obj.argPtr(pos)
+}
+
+// SetArg sets the argument at pos.
+func (obj *Object) SetArg(pos int, value string) {
+	*obj.argPtr(pos) = value
+}
+
+func (obj *Object) argPtr(pos int) *string {
+	switch pos {
+	case 1:
+		return &obj.Arg1
+	case 2:
+		return &obj.Arg2
+	case 3:
+		return &obj.Arg3
+	case 4:
+		return &obj.Arg4
+	}
+	panic(fmt.Sprintf("rhizome: argument position %d out of range [1, 4]", pos))
+}
+
+// ArgInt returns the argument at pos as an int64.
+func (obj *Object) ArgInt(pos int) (int64, error) {
+	return parseArg(pos, obj.Arg(pos), "int", func(s string) (int64, error) {
+		return strconv.ParseInt(s, 10, 64)
+	})
+}
+
+// ArgUint returns the argument at pos as a uint64.
+func (obj *Object) ArgUint(pos int) (uint64, error) {
+	return parseArg(pos, obj.Arg(pos), "uint", func(s string) (uint64, error) {
+		return strconv.ParseUint(s, 10, 64)
+	})
+}
+
+// ArgFloat returns the argument at pos as a float64.
+func (obj *Object) ArgFloat(pos int) (float64, error) {
+	return parseArg(pos, obj.Arg(pos), "float", func(s string) (float64, error) {
+		return strconv.ParseFloat(s, 64)
+	})
+}
+
+// ArgBool returns the argument at pos as a bool.
+func (obj *Object) ArgBool(pos int) (bool, error) {
+	return parseArg(pos, obj.Arg(pos), "bool", strconv.ParseBool)
+}
+
+// ArgDuration returns the argument at pos as a time.Duration.
+func (obj *Object) ArgDuration(pos int) (time.Duration, error) {
+	return parseArg(pos, obj.Arg(pos), "duration", time.ParseDuration)
+}
+
+// ArgTime returns the argument at pos as a time.Time.
+func (obj *Object) ArgTime(pos int) (time.Time, error) {
+	return parseArg(pos, obj.Arg(pos), "time", parseTime)
+}
+
+// ArgMap returns the argument at pos as key=value pairs. An empty argument is
+// an empty map.
+func (obj *Object) ArgMap(pos int) (map[string]string, error) {
+	return parseArg(pos, obj.Arg(pos), "key=value list", parseMap)
+}
+
+// SetArgInt sets the argument at pos to v.
+func (obj *Object) SetArgInt(pos int, v int64) {
+	obj.SetArg(pos, strconv.FormatInt(v, 10))
+}
+
+// SetArgUint sets the argument at pos to v.
+func (obj *Object) SetArgUint(pos int, v uint64) {
+	obj.SetArg(pos, strconv.FormatUint(v, 10))
+}
+
+// SetArgFloat sets the argument at pos to v.
+func (obj *Object) SetArgFloat(pos int, v float64) {
+	obj.SetArg(pos, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// SetArgBool sets the argument at pos to v.
+func (obj *Object) SetArgBool(pos int, v bool) {
+	obj.SetArg(pos, strconv.FormatBool(v))
+}
+
+// SetArgDuration sets the argument at pos to v.
+func (obj *Object) SetArgDuration(pos int, v time.Duration) {
+	obj.SetArg(pos, v.String())
+}
+
+// SetArgTime sets the argument at pos to v.
+func (obj *Object) SetArgTime(pos int, v time.Time) {
+	obj.SetArg(pos, v.Format(time.RFC3339Nano))
+}
+
+// SetArgMap sets the argument at pos to the pairs of m.
+func (obj *Object) SetArgMap(pos int, m map[string]string) {
+	obj.SetArg(pos, formatMap(m))
+}
+
+// parseArg parses the argument at pos, wrapping failures in an *ArgError.
+func parseArg[T any](pos int, s, kind string, parse func(string) (T, error)) (T, error) {
+	v, err := parse(s)
+	if err != nil {
+		return v, &ArgError{Pos: pos, Err: invalid(kind, s, err)}
+	}
+	return v, nil
+}
+
+// invalid describes a value that failed to parse as kind.
+func invalid(kind, s string, err error) error {
+	// strconv errors repeat the value and the function, only keep the
+	// reason.
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		err = numErr.Err
+	}
+	return fmt.Errorf("invalid %s %q: %w", kind, s, err)
+}
+
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return t, errors.New("want RFC 3339")
+	}
+	return t, nil
+}
+
+func parseMap(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	if s == "" {
+		return m, nil
+	}
+	for pair := range strings.SplitSeq(s, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("pair %q has no '='", pair)
+		}
+		key, err := url.QueryUnescape(k)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k, err)
+		}
+		value, err := url.QueryUnescape(v)
+		if err != nil {
+			return nil, fmt.Errorf("value %q: %w", v, err)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("duplicate key %q", key)
+		}
+		m[key] = value
+	}
+	return m, nil
+}
+
+func formatMap(m map[string]string) string {
+	var b strings.Builder
+	for i, k := range slices.Sorted(maps.Keys(m)) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(url.QueryEscape(k))
+		b.WriteByte('=')
+		b.WriteString(url.QueryEscape(m[k]))
+	}
+	return b.String()
+}
+
+// -----------------------------------------------------------------------------
+// Binding arguments to structs.
+// -----------------------------------------------------------------------------
+
+// UnmarshalArgs sets the fields of the struct v points to from the arguments
+// of obj. Fields are bound to an argument with a tag naming its position:
+//
+//	type Resize struct {
+//		Width  uint16        `rhizome:"arg1"`
+//		Height uint16        `rhizome:"arg2"`
+//		Within time.Duration `rhizome:"arg3,optional"`
+//	}
+//
+// Fields may be strings, integers, floats, bools, time.Durations, time.Times,
+// maps from string to string, or implement encoding.TextUnmarshaler, and are
+// parsed as described at the top of args.go. An empty argument bound to an
+// optional field leaves the field zero. Untagged fields are left alone.
+//
+// Arguments that do not parse fail with an *ArgError named after the field.
+func UnmarshalArgs(obj *Object, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("unmarshal args: want a non-nil pointer to a struct, got %T", v)
+	}
+	rv = rv.Elem()
+
+	fields, err := argFields(rv.Type())
+	if err != nil {
+		return fmt.Errorf("unmarshal args: %w", err)
+	}
+	for _, f := range fields {
+		fv := rv.FieldByIndex(f.index)
+		s := obj.Arg(f.pos)
+		if s == "" && f.optional {
+			fv.SetZero()
+			continue
+		}
+		if err := decodeArg(fv, s); err != nil {
+			return &ArgError{
+				Pos:  f.pos,
+				Name: f.name,
+				Err:  invalid(argKind(fv.Type()), s, err),
+			}
+		}
+	}
+	return nil
+}
+
+// MarshalArgs sets the arguments of obj from the fields of the struct v, or
+// the struct v points to, as bound by their tags, see UnmarshalArgs. Zero
+// optional fields leave their argument empty, and arguments without a field
+// are left alone.
+func MarshalArgs(obj *Object, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("marshal args: want a struct or pointer to one, got %T", v)
+	}
+
+	fields, err := argFields(rv.Type())
+	if err != nil {
+		return fmt.Errorf("marshal args: %w", err)
+	}
+	for _, f := range fields {
+		fv := rv.FieldByIndex(f.index)
+		if f.optional && fv.IsZero() {
+			obj.SetArg(f.pos, "")
+			continue
+		}
+		s, err := encodeArg(fv)
+		if err != nil {
+			return &ArgError{Pos: f.pos, Name: f.name, Err: err}
+		}
+		obj.SetArg(f.pos, s)
+	}
+	return nil
+}
+
+// argField is a struct field bound to an argument.
+type argField struct {
+	name     string
+	index    []int
+	pos      int
+	optional bool
+}
+
+var argFieldCache sync.Map // reflect.Type -> []argField
+
+// argFields returns the fields of t bound to arguments.
+func argFields(t reflect.Type) ([]argField, error) {
+	if cached, ok := argFieldCache.Load(t); ok {
+		return cached.([]argField), nil
+	}
+
+	var fields []argField
+	var bound [5]string
+	for _, sf := range reflect.VisibleFields(t) {
+		tag, ok := sf.Tag.Lookup("rhizome")
+		if !ok || tag == "-" {
+			continue
+		}
+		if !sf.IsExported() {
+			return nil, fmt.Errorf("field %s is not exported", sf.Name)
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		f := argField{name: sf.Name, index: sf.Index}
+		switch name {
+		case "arg1", "arg2", "arg3", "arg4":
+			f.pos = int(name[3] - '0')
+		default:
+			return nil, fmt.Errorf("field %s: tag %q does not name arg1 to arg4", sf.Name, tag)
+		}
+		switch opts {
+		case "":
+		case "optional":
+			f.optional = true
+		default:
+			return nil, fmt.Errorf("field %s: unknown tag option %q", sf.Name, opts)
+		}
+
+		if prev := bound[f.pos]; prev != "" {
+			return nil, fmt.Errorf("fields %s and %s are both bound to %s", prev, sf.Name, name)
+		}
+		bound[f.pos] = sf.Name
+		if !argSupported(sf.Type) {
+			return nil, fmt.Errorf("field %s: unsupported type %s", sf.Name, sf.Type)
+		}
+		fields = append(fields, f)
+	}
+
+	argFieldCache.Store(t, fields)
+	return fields, nil
+}
+
+var (
+	durationType        = reflect.TypeFor[time.Duration]()
+	timeType            = reflect.TypeFor[time.Time]()
+	textMarshalerType   = reflect.TypeFor[encoding.TextMarshaler]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+func isText(t reflect.Type) bool {
+	return t.Implements(textMarshalerType) && reflect.PointerTo(t).Implements(textUnmarshalerType)
+}
+
+func argSupported(t reflect.Type) bool {
+	if t == durationType || t == timeType || isText(t) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String && t.Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+// argKind names what an argument bound to a field of type t is parsed as.
+func argKind(t reflect.Type) string {
+	switch {
+	case t == durationType:
+		return "duration"
+	case t == timeType:
+		return "time"
+	case isText(t):
+		return t.String()
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "int"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "uint"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.Map:
+		return "key=value list"
+	}
+	return t.Kind().String()
+}
+
+func decodeArg(fv reflect.Value, s string) error {
+	t := fv.Type()
+	switch {
+	case t == durationType:
+		d, err := time.ParseDuration(s)
+		if err == nil {
+			fv.SetInt(int64(d))
+		}
+		return err
+	case t == timeType:
+		tm, err := parseTime(s)
+		if err == nil {
+			fv.Set(reflect.ValueOf(tm))
+		}
+		return err
+	case isText(t):
+		return fv.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(f)
+	case reflect.Map:
+		m, err := parseMap(s)
+		if err != nil {
+			return err
+		}
+		// The key and element types may be named string types, which a
+		// map[string]string does not convert to.
+		mv := reflect.MakeMapWithSize(t, len(m))
+		for k, v := range m {
+			mv.SetMapIndex(reflect.ValueOf(k).Convert(t.Key()), reflect.ValueOf(v).Convert(t.Elem()))
+		}
+		fv.Set(mv)
+	}
+	return nil
+}
+
+func encodeArg(fv reflect.Value) (string, error) {
+	t := fv.Type()
+	switch {
+	case t == durationType:
+		return time.Duration(fv.Int()).String(), nil
+	case t == timeType:
+		return fv.Interface().(time.Time).Format(time.RFC3339Nano), nil
+	case isText(t):
+		b, err := fv.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(b), err
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return fv.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(fv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(fv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(fv.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(fv.Float(), 'g', -1, t.Bits()), nil
+	case reflect.Map:
+		m := make(map[string]string, fv.Len())
+		for iter := fv.MapRange(); iter.Next(); {
+			m[iter.Key().String()] = iter.Value().String()
+		}
+		return formatMap(m), nil
+	}
+	return "", fmt.Errorf("unsupported type %s", t)
+}
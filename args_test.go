@@ -0,0 +1,235 @@
+package rhizome
+
+import (
+	"errors"
+	"math"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArgs_SettersRoundTripThroughAccessors(t *testing.T) {
+	at := time.Date(2025, 3, 4, 5, 6, 7, 890, time.UTC)
+	obj := NewObject(ObjAction, CmdUpdate, AckPlcyOnsent, "u", "", "", "", "", EncodingNA, nil)
+
+	obj.SetArgInt(1, math.MinInt64)
+	if got, err := obj.ArgInt(1); err != nil || got != math.MinInt64 {
+		t.Errorf("ArgInt = %d, %v", got, err)
+	}
+	obj.SetArgUint(2, math.MaxUint64)
+	if got, err := obj.ArgUint(2); err != nil || got != math.MaxUint64 {
+		t.Errorf("ArgUint = %d, %v", got, err)
+	}
+	obj.SetArgFloat(3, 0.1)
+	if got, err := obj.ArgFloat(3); err != nil || got != 0.1 || obj.Arg3 != "0.1" {
+		t.Errorf("ArgFloat = %v, %v from %q", got, err, obj.Arg3)
+	}
+	obj.SetArgBool(4, true)
+	if got, err := obj.ArgBool(4); err != nil || !got {
+		t.Errorf("ArgBool = %v, %v", got, err)
+	}
+	obj.SetArgDuration(1, 90*time.Second)
+	if got, err := obj.ArgDuration(1); err != nil || got != 90*time.Second || obj.Arg1 != "1m30s" {
+		t.Errorf("ArgDuration = %v, %v from %q", got, err, obj.Arg1)
+	}
+	obj.SetArgTime(2, at)
+	if got, err := obj.ArgTime(2); err != nil || !got.Equal(at) {
+		t.Errorf("ArgTime = %v, %v", got, err)
+	}
+
+	m := map[string]string{"b": "2", "a": "x=y,z", "": "empty key", "sp ace": ""}
+	obj.SetArgMap(3, m)
+	if want := "=empty+key,a=x%3Dy%2Cz,b=2,sp+ace="; obj.Arg3 != want {
+		t.Errorf("SetArgMap wrote %q, want %q", obj.Arg3, want)
+	}
+	if got, err := obj.ArgMap(3); err != nil || !reflect.DeepEqual(got, m) {
+		t.Errorf("ArgMap = %v, %v", got, err)
+	}
+	obj.SetArgMap(4, nil)
+	if got, err := obj.ArgMap(4); err != nil || len(got) != 0 || obj.Arg4 != "" {
+		t.Errorf("empty ArgMap = %v, %v from %q", got, err, obj.Arg4)
+	}
+}
+
+func TestArgs_AccessorErrorsNamePosition(t *testing.T) {
+	obj := NewObject(ObjAction, CmdUpdate, AckPlcyOnsent, "u", "x", "-1", "99999999999999999999", "a=1,a=2", EncodingNA, nil)
+
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{second(obj.ArgInt(1)), `arg1: invalid int "x": invalid syntax`},
+		{second(obj.ArgUint(2)), `arg2: invalid uint "-1": invalid syntax`},
+		{second(obj.ArgInt(3)), `arg3: invalid int "99999999999999999999": value out of range`},
+		{second(obj.ArgFloat(1)), `arg1: invalid float "x": invalid syntax`},
+		{second(obj.ArgBool(1)), `arg1: invalid bool "x": invalid syntax`},
+		{second(obj.ArgDuration(2)), `arg2: invalid duration "-1": time: missing unit in duration "-1"`},
+		{second(obj.ArgTime(1)), `arg1: invalid time "x": want RFC 3339`},
+		{second(obj.ArgMap(4)), `arg4: invalid key=value list "a=1,a=2": duplicate key "a"`},
+		{second(obj.ArgMap(1)), `arg1: invalid key=value list "x": pair "x" has no '='`},
+	} {
+		if tc.err == nil || tc.err.Error() != tc.want {
+			t.Errorf("error = %v, want %s", tc.err, tc.want)
+		}
+		var argErr *ArgError
+		if !errors.As(tc.err, &argErr) {
+			t.Errorf("error %v is not an *ArgError", tc.err)
+		}
+	}
+
+	if _, err := obj.ArgInt(3); !errors.Is(err, strconv.ErrRange) {
+		t.Errorf("ArgInt error %v does not wrap strconv.ErrRange", err)
+	}
+}
+
+func TestArgs_PositionOutOfRangePanics(t *testing.T) {
+	obj := NewObject(ObjAction, CmdUpdate, AckPlcyOnsent, "u", "", "", "", "", EncodingNA, nil)
+	for _, pos := range []int{0, 5} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Arg(%d) did not panic", pos)
+				}
+			}()
+			obj.Arg(pos)
+		}()
+	}
+}
+
+type resize struct {
+	Width   uint16            `rhizome:"arg1"`
+	Height  uint16            `rhizome:"arg2"`
+	Within  time.Duration     `rhizome:"arg3,optional"`
+	Labels  map[string]string `rhizome:"arg4,optional"`
+	Ignored string
+}
+
+type bindAll struct {
+	Name  string     `rhizome:"arg1"`
+	Ratio float32    `rhizome:"arg2"`
+	Addr  netip.Addr `rhizome:"arg3"`
+	At    time.Time  `rhizome:"arg4"`
+}
+
+type (
+	labelKey string
+	label    string
+)
+
+// labeled binds a map with named key and element types, which
+// map[string]string does not convert to.
+type labeled struct {
+	Labels map[labelKey]label `rhizome:"arg1"`
+}
+
+func TestArgs_MarshalUnmarshalRoundTrip(t *testing.T) {
+	for _, v := range []any{
+		&resize{Width: 640, Height: 480, Within: time.Second, Labels: map[string]string{"k": "v"}},
+		&resize{Width: 1, Height: 2},
+		&bindAll{Name: "n", Ratio: 0.25, Addr: netip.MustParseAddr("10.0.0.1"), At: time.Unix(1700000000, 5).UTC()},
+		&labeled{Labels: map[labelKey]label{"env": "prod", "tier": "db"}},
+	} {
+		obj := NewObject(ObjAction, CmdUpdate, AckPlcyOnsent, "u", "", "", "", "", EncodingNA, nil)
+		if err := MarshalArgs(obj, v); err != nil {
+			t.Fatalf("MarshalArgs(%+v) error: %v", v, err)
+		}
+
+		// Through the wire and back.
+		frame, err := EncodeFrame(obj)
+		if err != nil {
+			t.Fatalf("EncodeFrame error: %v", err)
+		}
+		decoded, err := DecodeFrame(frame, nil)
+		if err != nil {
+			t.Fatalf("DecodeFrame error: %v", err)
+		}
+
+		got := reflect.New(reflect.TypeOf(v).Elem())
+		if err := UnmarshalArgs(decoded, got.Interface()); err != nil {
+			t.Fatalf("UnmarshalArgs error: %v", err)
+		}
+		if !reflect.DeepEqual(got.Interface(), v) {
+			t.Errorf("round trip of %+v gave %+v", v, got.Elem())
+		}
+	}
+}
+
+func TestArgs_MarshalArgsLeavesUnboundAndZeroOptional(t *testing.T) {
+	obj := NewObject(ObjAction, CmdUpdate, AckPlcyOnsent, "u", "", "", "old", "", EncodingNA, nil)
+	type partial struct {
+		Count int    `rhizome:"arg1"`
+		Note  string `rhizome:"arg3,optional"`
+	}
+	if err := MarshalArgs(obj, partial{Count: -3}); err != nil {
+		t.Fatalf("MarshalArgs error: %v", err)
+	}
+	if got := [4]string{obj.Arg1, obj.Arg2, obj.Arg3, obj.Arg4}; got != [4]string{"-3"} {
+		t.Fatalf("args = %q", got)
+	}
+
+	obj.Arg2 = "kept"
+	if err := MarshalArgs(obj, &partial{Count: 7, Note: "n"}); err != nil {
+		t.Fatalf("MarshalArgs error: %v", err)
+	}
+	if got := [4]string{obj.Arg1, obj.Arg2, obj.Arg3, obj.Arg4}; got != [4]string{"7", "kept", "n"} {
+		t.Fatalf("args = %q", got)
+	}
+}
+
+func TestArgs_UnmarshalArgsErrorsNameField(t *testing.T) {
+	for _, tc := range []struct {
+		args [4]string
+		want string
+	}{
+		{[4]string{"640", "70000"}, `arg2 (Height): invalid uint "70000": value out of range`},
+		{[4]string{"", "1"}, `arg1 (Width): invalid uint "": invalid syntax`},
+		{[4]string{"1", "1", "soon"}, `arg3 (Within): invalid duration "soon": time: invalid duration "soon"`},
+		{[4]string{"1", "1", "", "k"}, `arg4 (Labels): invalid key=value list "k": pair "k" has no '='`},
+	} {
+		obj := NewObject(ObjAction, CmdUpdate, AckPlcyOnsent, "u", tc.args[0], tc.args[1], tc.args[2], tc.args[3], EncodingNA, nil)
+		err := UnmarshalArgs(obj, &resize{})
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("UnmarshalArgs(%q) error = %v, want %s", tc.args, err, tc.want)
+		}
+	}
+}
+
+func TestArgs_BinderRejectsBadStructs(t *testing.T) {
+	obj := NewObject(ObjAction, CmdUpdate, AckPlcyOnsent, "u", "1", "", "", "", EncodingNA, nil)
+
+	for _, tc := range []struct {
+		v    any
+		want string
+	}{
+		{resize{}, "want a non-nil pointer to a struct"},
+		{(*resize)(nil), "want a non-nil pointer to a struct"},
+		{&struct {
+			A int `rhizome:"arg5"`
+		}{}, `tag "arg5" does not name arg1 to arg4`},
+		{&struct {
+			A int `rhizome:"arg1,required"`
+		}{}, `unknown tag option "required"`},
+		{&struct {
+			A int `rhizome:"arg1"`
+			B int `rhizome:"arg1"`
+		}{}, "fields A and B are both bound to arg1"},
+		{&struct {
+			A []int `rhizome:"arg1"`
+		}{}, "unsupported type []int"},
+		{&struct {
+			a int `rhizome:"arg1"`
+		}{}, "field a is not exported"},
+	} {
+		err := UnmarshalArgs(obj, tc.v)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("UnmarshalArgs(%T) error = %v, want %s", tc.v, err, tc.want)
+		}
+	}
+
+	if err := MarshalArgs(obj, 3); err == nil {
+		t.Errorf("MarshalArgs of an int succeeded")
+	}
+}
@@ -0,0 +1,679 @@
+package rhizome
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Batch frames carrying many small objects or responses.
+// -----------------------------------------------------------------------------
+// Producers sending many tiny objects pay for a frame and a write per object.
+// A batch frame packs them together instead. Fields that hold the same value
+// for every object in the batch are written once in a shared header and left
+// out of the individual entries.
+
+// # Batch frame
+// +---------------+---------------+-----------+
+// | u8 FrameBatch | u8 batch kind | u16 count |
+// +---------------+---------------+-----------+
+
+// # Object batch, shared header
+// +----------------+--------------------------------------------+
+// | u8 shared mask | shared fields, in the order of an entry    |
+// +----------------+--------------------------------------------+
+
+// # Object batch entry, shared fields left out
+// +-------------+-------------+---------------+-------------+
+// | u8 obj_type | u8 cmd_type | u8 ack policy | u8 len uid  |
+// +-------------+-------------+---------------+-------------+
+
+// +-------------+-------------+-------------+-------------+
+// | u8 len arg1 | u8 len arg2 | u8 len arg3 | u8 len arg4 |
+// +-------------+-------------+-------------+-------------+
+
+// +------------------+-----------------+
+// | u8 encoding type | u16 len payload |
+// +------------------+-----------------+
+
+// # Response batch
+// +----------------+---------------------------+
+// | u8 shared mask | u8 ack, if the ack shared |
+// +----------------+---------------------------+
+
+// # Response batch entry
+// +-------------------------------+------------+
+// | u8 ack, unless the ack shared | u8 len uid |
+// +-------------------------------+------------+
+
+// Objects in a batch decode as protocol v2 objects. Batches carry neither
+// compressed, fragmented nor streamed payloads, those are sent as regular
+// frames.
+// -----------------------------------------------------------------------------
+
+// Batch kinds, the byte following FrameBatch.
+const (
+	batchObjects   uint8 = 1
+	batchResponses uint8 = 2
+)
+
+// Shared header mask bits. The UID and payload are never shared.
+const (
+	sharedObjType uint8 = 1 << iota
+	sharedCmdType
+	sharedAckPlcy
+	sharedArg1
+	sharedArg2
+	sharedArg3
+	sharedArg4
+	sharedEncoding
+)
+
+// sharedAck marks the ack of a response batch as shared.
+const sharedAck uint8 = 1 << 0
+
+// batchOverhead is the size of the batch frame header and shared mask.
+const batchOverhead = 1 + 1 + 2 + 1
+
+//--------Objects---------------------------------------------------------------
+
+// EncodeBatch packs objs into a single batch frame, sharing every header field
+// the objects agree on. The objects' Version and Compression are ignored.
+func EncodeBatch(objs []*Object) ([]byte, error) {
+	if len(objs) == 0 {
+		return nil, errors.New("encode batch: no objects")
+	}
+	if len(objs) > math.MaxUint16 {
+		return nil, fmt.Errorf("encode batch: too many objects: %d", len(objs))
+	}
+
+	for _, obj := range objs {
+		if err := checkBatchable(obj); err != nil {
+			return nil, fmt.Errorf("encode batch: %w", err)
+		}
+	}
+
+	first := objs[0]
+
+	// Start from everything shared and drop the fields that differ.
+	mask := sharedObjType | sharedCmdType | sharedAckPlcy | sharedArg1 |
+		sharedArg2 | sharedArg3 | sharedArg4 | sharedEncoding
+	for _, obj := range objs[1:] {
+		if obj.ObjType != first.ObjType {
+			mask &^= sharedObjType
+		}
+		if obj.CmdType != first.CmdType {
+			mask &^= sharedCmdType
+		}
+		if obj.AckPlcy != first.AckPlcy {
+			mask &^= sharedAckPlcy
+		}
+		if obj.Arg1 != first.Arg1 {
+			mask &^= sharedArg1
+		}
+		if obj.Arg2 != first.Arg2 {
+			mask &^= sharedArg2
+		}
+		if obj.Arg3 != first.Arg3 {
+			mask &^= sharedArg3
+		}
+		if obj.Arg4 != first.Arg4 {
+			mask &^= sharedArg4
+		}
+		if obj.PayloadEncoding != first.PayloadEncoding {
+			mask &^= sharedEncoding
+		}
+	}
+
+	body := bytes.NewBuffer(nil)
+	writeU8(body, FrameBatch)
+	writeU8(body, batchObjects)
+	writeU16(body, uint16(len(objs)))
+	writeU8(body, mask)
+
+	// Shared fields are the fields left out of every entry.
+	if err := writeBatchFields(body, first, ^mask, false); err != nil {
+		return nil, fmt.Errorf("encode batch %s: %w", first.UID, err)
+	}
+	for _, obj := range objs {
+		if err := writeBatchFields(body, obj, mask, true); err != nil {
+			return nil, fmt.Errorf("encode batch %s: %w", obj.UID, err)
+		}
+	}
+
+	return body.Bytes(), nil
+}
+
+// checkBatchable returns an error if obj can not be part of a batch.
+func checkBatchable(obj *Object) error {
+	switch {
+	case obj.UID == "":
+		return errors.New("UID must not be empty")
+	case obj.FragCount != 0:
+		return fmt.Errorf("%s: fragments can not be batched", obj.UID)
+	case obj.streamed:
+		return fmt.Errorf("%s: streamed objects can not be batched", obj.UID)
+	case len(obj.Payload) > maxPayloadSize:
+		return fmt.Errorf(
+			"%s: payload too large: %d bytes", obj.UID, len(obj.Payload),
+		)
+	}
+	return nil
+}
+
+// batchEntrySize is the most bytes obj takes up in a batch, as an entry and as
+// the source of the shared header.
+func batchEntrySize(obj *Object) int {
+	return 3 + 5 + 1 + 2 + len(obj.UID) + len(obj.Arg1) + len(obj.Arg2) +
+		len(obj.Arg3) + len(obj.Arg4) + len(obj.Payload)
+}
+
+// writeBatchFields writes the header fields of obj whose mask bit is not in
+// skip, plus the UID and payload if it is writing an entry.
+func writeBatchFields(body *bytes.Buffer, obj *Object, skip uint8, entry bool) error {
+	if skip&sharedObjType == 0 {
+		writeU8(body, obj.ObjType)
+	}
+	if skip&sharedCmdType == 0 {
+		writeU8(body, obj.CmdType)
+	}
+	if skip&sharedAckPlcy == 0 {
+		writeU8(body, obj.AckPlcy)
+	}
+	if entry {
+		if err := writeString8(body, obj.UID); err != nil {
+			return fmt.Errorf("uid: %w", err)
+		}
+	}
+
+	args := [...]string{obj.Arg1, obj.Arg2, obj.Arg3, obj.Arg4}
+	for i, arg := range args {
+		if skip&(sharedArg1<<i) != 0 {
+			continue
+		}
+		if err := writeString8(body, arg); err != nil {
+			return fmt.Errorf("arg%d: %w", i+1, err)
+		}
+	}
+
+	if skip&sharedEncoding == 0 {
+		writeU8(body, uint8(obj.PayloadEncoding))
+	}
+	if entry {
+		writeU16(body, uint16(len(obj.Payload)))
+		body.Write(obj.Payload)
+	}
+	return nil
+}
+
+// DecodeBatch expands an object batch frame into its objects, each carrying
+// resp as its Responder and a Response of its own.
+func DecodeBatch(frame []byte, resp *ConnResponder) ([]*Object, error) {
+	r := bytes.NewReader(frame)
+	count, err := readBatchHeader(r, batchObjects)
+	if err != nil {
+		return nil, err
+	}
+
+	var mask uint8
+	if err := readU8(r, &mask); err != nil {
+		return nil, fmt.Errorf("decode batch: shared mask: %w", err)
+	}
+	shared := &Object{}
+	if err := readBatchFields(r, shared, ^mask, false); err != nil {
+		return nil, fmt.Errorf("decode batch: shared header: %w", err)
+	}
+
+	objs := make([]*Object, 0, count)
+	for i := range int(count) {
+		obj := *shared
+		obj.Version = ProtocolV2
+		obj.Responder = resp
+		if err := readBatchFields(r, &obj, mask, true); err != nil {
+			return nil, fmt.Errorf("decode batch: entry %d: %w", i, err)
+		}
+		obj.Response = &Response{
+			UID: obj.UID,
+			Ack: AckUnknown,
+		}
+		objs = append(objs, &obj)
+	}
+
+	if r.Len() != 0 {
+		return nil, errors.New("decode batch: unaccounted data in reader")
+	}
+	return objs, nil
+}
+
+// readBatchFields is the reverse of writeBatchFields.
+func readBatchFields(r *bytes.Reader, obj *Object, skip uint8, entry bool) error {
+	if skip&sharedObjType == 0 {
+		if err := readU8(r, &obj.ObjType); err != nil {
+			return fmt.Errorf("obj type: %w", err)
+		}
+	}
+	if skip&sharedCmdType == 0 {
+		if err := readU8(r, &obj.CmdType); err != nil {
+			return fmt.Errorf("cmd type: %w", err)
+		}
+	}
+	if skip&sharedAckPlcy == 0 {
+		if err := readU8(r, &obj.AckPlcy); err != nil {
+			return fmt.Errorf("ack policy: %w", err)
+		}
+	}
+	if entry {
+		uid, err := readStringU8(r)
+		if err != nil {
+			return fmt.Errorf("uid: %w", err)
+		}
+		if uid == "" {
+			return errors.New("empty uid")
+		}
+		obj.UID = uid
+	}
+
+	args := [...]*string{&obj.Arg1, &obj.Arg2, &obj.Arg3, &obj.Arg4}
+	for i, arg := range args {
+		if skip&(sharedArg1<<i) != 0 {
+			continue
+		}
+		s, err := readStringU8(r)
+		if err != nil {
+			return fmt.Errorf("arg%d: %w", i+1, err)
+		}
+		*arg = s
+	}
+
+	if skip&sharedEncoding == 0 {
+		if err := readU8(r, (*uint8)(&obj.PayloadEncoding)); err != nil {
+			return fmt.Errorf("payload encoding: %w", err)
+		}
+	}
+	if entry {
+		payload, err := readBytesU16(r)
+		if err != nil {
+			return fmt.Errorf("payload: %w", err)
+		}
+		obj.Payload = payload
+	}
+	return nil
+}
+
+func readBatchHeader(r *bytes.Reader, kind uint8) (uint16, error) {
+	var frameKind, batchKind uint8
+	if err := readU8(r, &frameKind); err != nil {
+		return 0, fmt.Errorf("decode batch: frame kind: %w", err)
+	}
+	if err := readU8(r, &batchKind); err != nil {
+		return 0, fmt.Errorf("decode batch: batch kind: %w", err)
+	}
+	if frameKind != FrameBatch || batchKind != kind {
+		return 0, fmt.Errorf(
+			"decode batch: expected batch kind %d, got frame kind %d batch kind %d",
+			kind, frameKind, batchKind,
+		)
+	}
+
+	var count uint16
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return 0, fmt.Errorf("decode batch: count: %w", err)
+	}
+	if count == 0 {
+		return 0, errors.New("decode batch: empty batch")
+	}
+	return count, nil
+}
+
+//--------Responses-------------------------------------------------------------
+
+// EncodeResponseBatch packs resps into a single batch frame, sharing the ack if
+// every response carries the same one.
+func EncodeResponseBatch(resps []Response) ([]byte, error) {
+	if len(resps) == 0 {
+		return nil, errors.New("encode response batch: no responses")
+	}
+	if len(resps) > math.MaxUint16 {
+		return nil, fmt.Errorf(
+			"encode response batch: too many responses: %d", len(resps),
+		)
+	}
+
+	mask := sharedAck
+	for _, resp := range resps[1:] {
+		if resp.Ack != resps[0].Ack {
+			mask = 0
+			break
+		}
+	}
+
+	body := bytes.NewBuffer(nil)
+	writeU8(body, FrameBatch)
+	writeU8(body, batchResponses)
+	writeU16(body, uint16(len(resps)))
+	writeU8(body, mask)
+	if mask&sharedAck != 0 {
+		writeU8(body, resps[0].Ack)
+	}
+
+	for _, resp := range resps {
+		if mask&sharedAck == 0 {
+			writeU8(body, resp.Ack)
+		}
+		if err := writeString8(body, resp.UID); err != nil {
+			return nil, fmt.Errorf("encode response batch %s: %w", resp.UID, err)
+		}
+	}
+
+	return body.Bytes(), nil
+}
+
+// DecodeResponseBatch expands a response batch frame into its responses.
+func DecodeResponseBatch(frame []byte) ([]Response, error) {
+	r := bytes.NewReader(frame)
+	count, err := readBatchHeader(r, batchResponses)
+	if err != nil {
+		return nil, err
+	}
+
+	var mask, ack uint8
+	if err := readU8(r, &mask); err != nil {
+		return nil, fmt.Errorf("decode response batch: shared mask: %w", err)
+	}
+	if mask&sharedAck != 0 {
+		if err := readU8(r, &ack); err != nil {
+			return nil, fmt.Errorf("decode response batch: shared ack: %w", err)
+		}
+	}
+
+	resps := make([]Response, 0, count)
+	for i := range int(count) {
+		resp := Response{Ack: ack}
+		if mask&sharedAck == 0 {
+			if err := readU8(r, &resp.Ack); err != nil {
+				return nil, fmt.Errorf(
+					"decode response batch: entry %d: ack: %w", i, err,
+				)
+			}
+		}
+		if resp.UID, err = readStringU8(r); err != nil {
+			return nil, fmt.Errorf(
+				"decode response batch: entry %d: uid: %w", i, err,
+			)
+		}
+		resps = append(resps, resp)
+	}
+
+	if r.Len() != 0 {
+		return nil, errors.New("decode response batch: unaccounted data in reader")
+	}
+	return resps, nil
+}
+
+//--------Writer----------------------------------------------------------------
+
+// ErrBatchWriterClosed is returned by BatchWriter.Add after Close.
+var ErrBatchWriterClosed = errors.New("batch writer closed")
+
+// BatchConfig controls when a batch writer sends what it collected so far.
+// A batch goes out as soon as any of the limits is reached.
+type BatchConfig struct {
+	// The most objects, or responses, in a single batch. Defaults to 256 and
+	// can not exceed 65535.
+	MaxCount int
+
+	// The largest batch frame, in bytes. Defaults to 64KB.
+	MaxBytes int
+
+	// How long the first entry of a batch may wait for others to join it.
+	// Defaults to 1 millisecond.
+	Linger time.Duration
+}
+
+func (cfg BatchConfig) withDefaults() BatchConfig {
+	if cfg.MaxCount <= 0 {
+		cfg.MaxCount = 256
+	}
+	cfg.MaxCount = min(cfg.MaxCount, math.MaxUint16)
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 64 * BytesInKilobyte
+	}
+	if cfg.Linger <= 0 {
+		cfg.Linger = time.Millisecond
+	}
+	return cfg
+}
+
+// batcher collects entries and writes them as batch frames. It is shared by
+// object and response batching.
+//
+// Batches are written without holding mu, so a slow write only holds up the
+// batches after it, not the entries joining the next one.
+type batcher[T any] struct {
+	cfg    BatchConfig
+	size   func(T) int
+	encode func([]T) ([]byte, error)
+	write  func([]byte) error
+
+	mu      sync.Mutex
+	pending []T
+	bytes   int
+	timer   *time.Timer
+	err     error // from a flush triggered by the linger timer
+	closed  bool
+
+	// Closed once the last batch taken from pending has been written.
+	written chan struct{}
+}
+
+// batch is a frame taken from pending, waiting for the batch before it to be
+// written so batches go out in order.
+type batch struct {
+	frame []byte
+	err   error // from encoding
+	prev  chan struct{}
+	done  chan struct{}
+}
+
+func (b *batcher[T]) add(v T) error {
+	n := b.size(v)
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return ErrBatchWriterClosed
+		}
+		if err := b.err; err != nil {
+			b.err = nil
+			b.mu.Unlock()
+			return err
+		}
+		if len(b.pending) == 0 || b.bytes+n <= b.cfg.MaxBytes {
+			break
+		}
+		full := b.takeLocked()
+		b.mu.Unlock()
+		if err := b.send(full); err != nil {
+			return err
+		}
+	}
+
+	if len(b.pending) == 0 {
+		// The first entry also supplies the shared header.
+		b.bytes = batchOverhead
+	}
+	b.pending = append(b.pending, v)
+	b.bytes += n
+
+	var full *batch
+	if len(b.pending) >= b.cfg.MaxCount || b.bytes >= b.cfg.MaxBytes {
+		full = b.takeLocked()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(b.cfg.Linger, b.linger)
+	}
+	b.mu.Unlock()
+	return b.send(full)
+}
+
+func (b *batcher[T]) linger() {
+	b.mu.Lock()
+	bt := b.takeLocked()
+	b.mu.Unlock()
+
+	if err := b.send(bt); err != nil {
+		b.mu.Lock()
+		if b.err == nil {
+			b.err = err
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *batcher[T]) flush() error {
+	return b.flushWith(false)
+}
+
+func (b *batcher[T]) close() error {
+	return b.flushWith(true)
+}
+
+// flushWith writes the pending entries, closing the batcher first if closing
+// is set, and waits for every batch taken before them to be written too.
+func (b *batcher[T]) flushWith(closing bool) error {
+	b.mu.Lock()
+	if closing {
+		if b.closed {
+			b.mu.Unlock()
+			return nil
+		}
+		b.closed = true
+	}
+	bt := b.takeLocked()
+	written := b.written
+	b.mu.Unlock()
+
+	err := b.send(bt)
+	if written != nil {
+		<-written
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		err = b.err
+		b.err = nil
+	}
+	return err
+}
+
+// takeLocked encodes the pending entries into a batch, or returns nil if there
+// are none.
+func (b *batcher[T]) takeLocked() *batch {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.pending) == 0 {
+		return nil
+	}
+
+	frame, err := b.encode(b.pending)
+	clear(b.pending)
+	b.pending = b.pending[:0]
+	b.bytes = 0
+
+	bt := &batch{frame: frame, err: err, prev: b.written, done: make(chan struct{})}
+	b.written = bt.done
+	return bt
+}
+
+// send writes bt once the batch before it was written. Call it without
+// holding mu.
+func (b *batcher[T]) send(bt *batch) error {
+	if bt == nil {
+		return nil
+	}
+	defer close(bt.done)
+
+	if bt.prev != nil {
+		<-bt.prev
+	}
+	if bt.err != nil {
+		return bt.err
+	}
+	return b.write(bt.frame)
+}
+
+// BatchWriter collects objects and writes them as batch frames, once enough
+// of them piled up or the first one has lingered long enough. It is safe for
+// concurrent use.
+//
+// Objects are encoded when their batch is written, so they must not be
+// modified after Add. An error writing a batch on the linger timer is returned
+// by the next call to Add or Flush.
+type BatchWriter struct {
+	b *batcher[*Object]
+
+	// check, if set, vets objects before they join a batch.
+	check func(*Object) error
+
+	// oversize, if set, sends objects too large for a batch of their own
+	// instead of batching them.
+	oversize func(*Object) error
+}
+
+// NewBatchWriter returns a BatchWriter that writes each batch to w as a
+// transport frame, see WriteFrame.
+func NewBatchWriter(w io.Writer, cfg BatchConfig) *BatchWriter {
+	return newBatchWriter(cfg, func(frame []byte) error {
+		return WriteFrame(w, frame)
+	})
+}
+
+func newBatchWriter(cfg BatchConfig, write func([]byte) error) *BatchWriter {
+	return &BatchWriter{
+		b: &batcher[*Object]{
+			cfg:    cfg.withDefaults(),
+			size:   batchEntrySize,
+			encode: EncodeBatch,
+			write:  write,
+		},
+	}
+}
+
+// Add queues obj for the next batch, writing the batch if obj fills it.
+func (bw *BatchWriter) Add(obj *Object) error {
+	if err := checkBatchable(obj); err != nil {
+		return fmt.Errorf("batch writer: %w", err)
+	}
+	if bw.oversize != nil && batchOverhead+batchEntrySize(obj) > bw.b.cfg.MaxBytes {
+		// Sent after the batch queued before it, to keep objects in order.
+		if err := bw.b.flush(); err != nil {
+			return err
+		}
+		return bw.oversize(obj)
+	}
+	if bw.check != nil {
+		if err := bw.check(obj); err != nil {
+			return fmt.Errorf("batch writer: %w", err)
+		}
+	}
+	return bw.b.add(obj)
+}
+
+// Flush writes the queued objects right away.
+func (bw *BatchWriter) Flush() error {
+	return bw.b.flush()
+}
+
+// Close flushes the queued objects. Later calls to Add fail with
+// ErrBatchWriterClosed. The underlying writer is left open.
+func (bw *BatchWriter) Close() error {
+	return bw.b.close()
+}
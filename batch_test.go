@@ -0,0 +1,400 @@
+package rhizome
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+// newBatchObjects returns n v2 deliveries, each with a UID and payload of its
+// own.
+func newBatchObjects(n int) []*Object {
+	objs := make([]*Object, 0, n)
+	for i := range n {
+		obj := newDelivery(
+			fmt.Sprintf("uid-%d", i), EncodingCsv, []byte(fmt.Sprintf("%d,%d", i, i*i)),
+		)
+		obj.Version = ProtocolV2
+		objs = append(objs, obj)
+	}
+	return objs
+}
+
+func TestBatch_RoundTrip_SharedHeader(t *testing.T) {
+	objs := newBatchObjects(100)
+
+	frame, err := EncodeBatch(objs)
+	if err != nil {
+		t.Fatalf("EncodeBatch error: %v", err)
+	}
+
+	separate := 0
+	for _, obj := range objs {
+		f, err := EncodeFrame(obj)
+		if err != nil {
+			t.Fatalf("EncodeFrame error: %v", err)
+		}
+		separate += 4 + len(f)
+	}
+	if len(frame)+4 >= separate/2 {
+		t.Fatalf("batch of %d bytes barely beats %d bytes of separate frames", len(frame), separate)
+	}
+
+	resp := newResponder()
+	got, err := DecodeBatch(frame, resp)
+	if err != nil {
+		t.Fatalf("DecodeBatch error: %v", err)
+	}
+	if len(got) != len(objs) {
+		t.Fatalf("got %d objects, want %d", len(got), len(objs))
+	}
+	for i := range objs {
+		assertObjectsEqual(t, objs[i], got[i])
+		if got[i].Responder != resp || got[i].Response.UID != objs[i].UID {
+			t.Fatalf("object %d lacks its responder or response", i)
+		}
+	}
+}
+
+func TestBatch_RoundTrip_MixedFields(t *testing.T) {
+	objs := newBatchObjects(4)
+	objs[1].ObjType = ObjChannel
+	objs[1].Arg3 = "only-here"
+	objs[2].CmdType = CmdAdd
+	objs[2].AckPlcy = AckPlcyNoreply
+	objs[3].PayloadEncoding = EncodingJson
+	objs[3].Arg1 = ""
+	objs[3].Payload = nil
+
+	frame, err := EncodeBatch(objs)
+	if err != nil {
+		t.Fatalf("EncodeBatch error: %v", err)
+	}
+	got, err := DecodeBatch(frame, newResponder())
+	if err != nil {
+		t.Fatalf("DecodeBatch error: %v", err)
+	}
+	for i := range objs {
+		assertObjectsEqual(t, objs[i], got[i])
+	}
+}
+
+func TestBatch_Rejections(t *testing.T) {
+	if _, err := EncodeBatch(nil); err == nil {
+		t.Fatalf("expected error for empty batch")
+	}
+
+	frag := newBatchObjects(1)[0]
+	frag.FragCount = 2
+	streamed := newBatchObjects(1)[0]
+	streamed.streamed = true
+	large := newBatchObjects(1)[0]
+	large.Payload = make([]byte, maxPayloadSize+1)
+	noUID := newBatchObjects(1)[0]
+	noUID.UID = ""
+
+	for name, obj := range map[string]*Object{
+		"fragment": frag, "streamed": streamed, "large": large, "no uid": noUID,
+	} {
+		if _, err := EncodeBatch([]*Object{obj}); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func TestDecodeBatch_Malformed(t *testing.T) {
+	frame, err := EncodeBatch(newBatchObjects(3))
+	if err != nil {
+		t.Fatalf("EncodeBatch error: %v", err)
+	}
+
+	for i := range len(frame) {
+		if _, err := DecodeBatch(frame[:i], newResponder()); err == nil {
+			t.Fatalf("expected error for frame truncated to %d bytes", i)
+		}
+	}
+	if _, err := DecodeBatch(append(frame, 0), newResponder()); err == nil {
+		t.Fatalf("expected error for trailing data")
+	}
+	if _, err := DecodeFrame(frame, newResponder()); err == nil {
+		t.Fatalf("expected DecodeFrame to refuse a batch frame")
+	}
+
+	resps, err := EncodeResponseBatch([]Response{{UID: "uid", Ack: AckSent}})
+	if err != nil {
+		t.Fatalf("EncodeResponseBatch error: %v", err)
+	}
+	if _, err := DecodeBatch(resps, newResponder()); err == nil {
+		t.Fatalf("expected error decoding a response batch as objects")
+	}
+}
+
+func TestResponseBatch_RoundTrip(t *testing.T) {
+	shared := []Response{{UID: "a", Ack: AckSent}, {UID: "b", Ack: AckSent}}
+	mixed := []Response{{UID: "a", Ack: AckSent}, {UID: "b", Ack: AckRouteNotFound}}
+
+	for _, want := range [][]Response{shared, mixed} {
+		frame, err := EncodeResponseBatch(want)
+		if err != nil {
+			t.Fatalf("EncodeResponseBatch error: %v", err)
+		}
+		got, err := DecodeResponseBatch(frame)
+		if err != nil {
+			t.Fatalf("DecodeResponseBatch error: %v", err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+// frameRecorder collects the frames written by a batch writer.
+type frameRecorder struct {
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+func (fr *frameRecorder) write(frame []byte) error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.frames = append(fr.frames, bytes.Clone(frame))
+	return nil
+}
+
+func (fr *frameRecorder) count() int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return len(fr.frames)
+}
+
+func TestBatchWriter_FlushesOnCount(t *testing.T) {
+	rec := &frameRecorder{}
+	bw := newBatchWriter(BatchConfig{MaxCount: 10, Linger: time.Hour}, rec.write)
+
+	for _, obj := range newBatchObjects(25) {
+		if err := bw.Add(obj); err != nil {
+			t.Fatalf("Add error: %v", err)
+		}
+	}
+	if rec.count() != 2 {
+		t.Fatalf("got %d batches before Flush, want 2", rec.count())
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if rec.count() != 3 {
+		t.Fatalf("got %d batches after Close, want 3", rec.count())
+	}
+
+	last, err := DecodeBatch(rec.frames[2], newResponder())
+	if err != nil || len(last) != 5 || last[4].UID != "uid-24" {
+		t.Fatalf("last batch = %d objects, %v", len(last), err)
+	}
+	if err := bw.Add(newBatchObjects(1)[0]); err != ErrBatchWriterClosed {
+		t.Fatalf("Add after Close = %v, want ErrBatchWriterClosed", err)
+	}
+}
+
+func TestBatchWriter_FlushesOnBytes(t *testing.T) {
+	rec := &frameRecorder{}
+	bw := newBatchWriter(BatchConfig{MaxBytes: 1000, Linger: time.Hour}, rec.write)
+
+	objs := newBatchObjects(20)
+	for _, obj := range objs {
+		obj.Payload = make([]byte, 100)
+		if err := bw.Add(obj); err != nil {
+			t.Fatalf("Add error: %v", err)
+		}
+	}
+	_ = bw.Flush()
+
+	total := 0
+	for _, frame := range rec.frames {
+		if len(frame) > 1000 {
+			t.Fatalf("batch of %d bytes exceeds MaxBytes", len(frame))
+		}
+		got, err := DecodeBatch(frame, newResponder())
+		if err != nil {
+			t.Fatalf("DecodeBatch error: %v", err)
+		}
+		total += len(got)
+	}
+	if total != len(objs) || len(rec.frames) < 2 {
+		t.Fatalf("got %d objects in %d batches", total, len(rec.frames))
+	}
+}
+
+func TestBatchWriter_FlushesAfterLinger(t *testing.T) {
+	rec := &frameRecorder{}
+	bw := newBatchWriter(BatchConfig{Linger: 10 * time.Millisecond}, rec.write)
+
+	for _, obj := range newBatchObjects(3) {
+		if err := bw.Add(obj); err != nil {
+			t.Fatalf("Add error: %v", err)
+		}
+	}
+	if rec.count() != 0 {
+		t.Fatalf("batch written before linger elapsed")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for rec.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if rec.count() != 1 {
+		t.Fatalf("got %d batches after linger, want 1", rec.count())
+	}
+}
+
+func TestSession_BatchedObjectsAndResponses(t *testing.T) {
+	cfg := SessionConfig{ResponseBatch: &BatchConfig{Linger: 5 * time.Millisecond}}
+	client, server := newSessionPair(t, cfg, cfg)
+
+	bw, err := client.NewBatchWriter(BatchConfig{Linger: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewBatchWriter error: %v", err)
+	}
+
+	objs := newBatchObjects(50)
+	go func() {
+		for _, obj := range objs {
+			_ = bw.Add(obj)
+		}
+	}()
+
+	for i := range objs {
+		got, err := server.Receive()
+		if err != nil {
+			t.Fatalf("Receive error: %v", err)
+		}
+		if got.UID != objs[i].UID {
+			t.Fatalf("object %d: got UID %q, want %q", i, got.UID, objs[i].UID)
+		}
+		if err := got.RespondWithAck(AckSent); err != nil {
+			t.Fatalf("RespondWithAck error: %v", err)
+		}
+	}
+
+	for i := range objs {
+		resp, err := client.ReceiveResponse()
+		if err != nil {
+			t.Fatalf("ReceiveResponse error: %v", err)
+		}
+		if resp.UID != objs[i].UID || resp.Ack != AckSent {
+			t.Fatalf("response %d = %+v", i, resp)
+		}
+	}
+}
+
+func TestSession_NewBatchWriter_Rejections(t *testing.T) {
+	v1 := SessionConfig{Capabilities: DefaultCapabilities()}
+	v1.Capabilities.MaxVersion = ProtocolV1
+	client, _ := newSessionPair(t, v1, SessionConfig{})
+	if _, err := client.NewBatchWriter(BatchConfig{}); err == nil {
+		t.Fatalf("expected error batching over a v1 session")
+	}
+
+	jsonOnly := SessionConfig{Capabilities: DefaultCapabilities()}
+	jsonOnly.Capabilities.Encodings = []PayloadEncoding{EncodingJson}
+	client, _ = newSessionPair(t, jsonOnly, SessionConfig{})
+	bw, err := client.NewBatchWriter(BatchConfig{})
+	if err != nil {
+		t.Fatalf("NewBatchWriter error: %v", err)
+	}
+	if err := bw.Add(newBatchObjects(1)[0]); err == nil {
+		t.Fatalf("expected error adding an object with an unagreed encoding")
+	}
+}
+
+func TestSession_BatchWriter_SendsObjectsTooLargeForABatchOnTheirOwn(t *testing.T) {
+	cfg := SessionConfig{Capabilities: DefaultCapabilities()}
+	cfg.Capabilities.MaxFrameSize = 4096
+	client, server := newSessionPair(t, cfg, cfg)
+
+	bw, err := client.NewBatchWriter(BatchConfig{})
+	if err != nil {
+		t.Fatalf("NewBatchWriter error: %v", err)
+	}
+	objs := newBatchObjects(3)
+	objs[1].Payload = bytes.Repeat([]byte{'x'}, 10000)
+	go func() {
+		for _, obj := range objs {
+			if err := bw.Add(obj); err != nil {
+				t.Errorf("Add error: %v", err)
+			}
+		}
+		_ = bw.Flush()
+	}()
+
+	for i := range objs {
+		got, err := server.Receive()
+		if err != nil {
+			t.Fatalf("Receive error: %v", err)
+		}
+		if got.UID != objs[i].UID || !bytes.Equal(got.Payload, objs[i].Payload) {
+			t.Fatalf("object %d: got %s with %d bytes", i, got.UID, len(got.Payload))
+		}
+	}
+	if err := server.Err(); err != nil {
+		t.Fatalf("session stopped: %v", err)
+	}
+}
+
+func TestSession_CloseGivesUpOnBatchedResponsesToAPeerThatStoppedReading(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		c, s := net.Pipe()
+		defer c.Close()
+
+		sessions := make(chan *Session, 1)
+		go func() {
+			server, err := NewSession(s, SessionConfig{
+				ResponseBatch: &BatchConfig{},
+				CloseTimeout:  time.Second,
+			})
+			if err != nil {
+				t.Errorf("NewSession error: %v", err)
+			}
+			sessions <- server
+		}()
+
+		// The peer sends an object and never reads again.
+		agreement, err := Handshake(c, DefaultCapabilities())
+		if err != nil {
+			t.Fatalf("Handshake error: %v", err)
+		}
+		frame, err := agreement.EncodeFrame(newBatchObjects(1)[0])
+		if err != nil {
+			t.Fatalf("EncodeFrame error: %v", err)
+		}
+		if err := WriteFrame(c, frame); err != nil {
+			t.Fatalf("WriteFrame error: %v", err)
+		}
+
+		server := <-sessions
+		obj, err := server.Receive()
+		if err != nil {
+			t.Fatalf("Receive error: %v", err)
+		}
+		if err := obj.RespondWithAck(AckSent); err != nil {
+			t.Fatalf("RespondWithAck error: %v", err)
+		}
+		// Let the batch linger out and get stuck writing.
+		time.Sleep(10 * time.Millisecond)
+		synctest.Wait()
+
+		start := time.Now()
+		_ = server.Close()
+		if elapsed := time.Since(start); elapsed != time.Second {
+			t.Fatalf("Close took %v, want the CloseTimeout", elapsed)
+		}
+		<-server.Done()
+		if !errors.Is(server.Err(), ErrSessionClosed) {
+			t.Fatalf("Err() = %v, want ErrSessionClosed", server.Err())
+		}
+	})
+}
@@ -0,0 +1,557 @@
+// Package broker is a reference broker for the standard broker commands of
+// globals.go. It documents what the object types, commands and acks mean, and
+// gives client libraries something real to test against.
+//
+// # Model
+//
+// A route is an address producers send deliveries to, like "orders". Channels
+// are named and live on a route, and every channel on a route receives what is
+// sent to it. Subscribers are connections that asked to receive what arrives on
+// a channel, and transformers are functions a channel passes deliveries
+// through before handing them to its subscribers. A route exists for as long
+// as it has a channel.
+//
+// Every connection to the broker is a rhizome.Session. Commands are objects
+// the client sends, deliveries are objects the broker sends to subscribers,
+// and acks travel back as responses on the same session.
+//
+// # Commands
+//
+// Arg1 always holds the route, and Arg2 the channel, as laid out by
+// rhizome.NewChannelAdd and the other command builders:
+//
+//	ObjType         CmdType    Arg1   Arg2     Arg3
+//	ObjChannel      CmdAdd     route  channel
+//	ObjChannel      CmdRemove  route  channel
+//	ObjSubscriber   CmdAdd     route  channel  subscriber name
+//	ObjSubscriber   CmdRemove  route  channel  subscriber name
+//	ObjTransformer  CmdAdd     route  channel  transformer name
+//	ObjTransformer  CmdRemove  route  channel  transformer name
+//	ObjDelivery     CmdSend    route  channel, or "" for all of them
+//
+// Adding a channel fails with AckChannelAlreadyExists if the route already has
+// a channel of that name. Every other command fails with AckRouteNotFound if
+// the route has no channels, and with AckChannelNotFound if it lacks the
+// channel named in Arg2. Removing a channel also removes its subscribers and
+// transformers.
+//
+// A subscriber is the session that added it, under a name of its choosing, so
+// it can be removed again from any session. Adding a name that is already
+// subscribed moves the subscription to the session adding it. Removing a name
+// that is not subscribed succeeds without doing anything, as does removing a
+// transformer the channel does not use.
+//
+// Transformers are registered with the broker by name, see Config. Adding one
+// the broker does not know, a command whose arguments do not fit the layout,
+// see rhizome.ParseChannelAdd and the other command parsers, and any command
+// the broker does not implement are answered with AckUnknown.
+//
+// # Deliveries
+//
+// A delivery is forwarded to every subscriber of the channels it is sent to, in
+// the order they subscribed, after the channel's transformers have been
+// applied in the order they were added. The forwarded object is the delivery
+// with Arg2 set to the channel it arrived on and AckPlcy set to
+// AckPlcyNoreply, subscribers never ack the broker.
+//
+// With AckPlcyOnsent the producer is acked with AckSent once the delivery has
+// been sent to the final subscriber, even if there were none. A subscriber
+// whose session failed is dropped. A subscriber the delivery can not be
+// encoded for, as it did not agree on its payload encoding or the frame is
+// larger than it accepts, is skipped but stays subscribed, and the producer is
+// acked with AckUnknown. A transformer that fails drops the delivery for its
+// channel, and the producer is acked with AckUnknown too.
+//
+// With AckPlcyNoreply the broker never responds, not even to report a failure.
+// This holds for every command, not only deliveries.
+package broker
+
+import (
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// ErrBrokerClosed is returned by Serve and ServeConn after Close was called.
+var ErrBrokerClosed = errors.New("broker closed")
+
+// Transformer changes a delivery before it is handed to the subscribers of a
+// channel. obj is the broker's own copy, but its Payload is shared with the
+// original, so transformers replace it rather than writing to it.
+// Returning an error drops the delivery for the channel.
+type Transformer func(obj *rhizome.Object) error
+
+// Config configures a Broker.
+type Config struct {
+	// Session configures the session of every connection.
+	Session rhizome.SessionConfig
+
+	// Transformers channels can add by name.
+	Transformers map[string]Transformer
+}
+
+// Broker routes deliveries from producers to subscribers as described in the
+// package documentation.
+type Broker struct {
+	cfg Config
+
+	mu        sync.Mutex
+	routes    map[string]map[string]*channel
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+type channel struct {
+	subscribers  []subscriber
+	transformers []string
+}
+
+type subscriber struct {
+	name    string
+	session *rhizome.Session
+}
+
+// New returns a Broker without any routes.
+func New(cfg Config) *Broker {
+	return &Broker{
+		cfg:       cfg,
+		routes:    make(map[string]map[string]*channel),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on l and serves each of them on a goroutine of its
+// own, until l fails or the broker is closed. It closes l before returning.
+func (b *Broker) Serve(l net.Listener) error {
+	if !b.track(l, nil) {
+		l.Close()
+		return ErrBrokerClosed
+	}
+	defer b.untrack(l, nil)
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if b.isClosed() {
+				return ErrBrokerClosed
+			}
+			return err
+		}
+		go b.ServeConn(conn)
+	}
+}
+
+// ServeConn performs the session handshake over conn and then handles the
+// commands it receives until the peer hangs up, which is reported as nil.
+// Subscriptions made over conn end with it. ServeConn closes conn before
+// returning.
+func (b *Broker) ServeConn(conn net.Conn) error {
+	if !b.track(nil, conn) {
+		conn.Close()
+		return ErrBrokerClosed
+	}
+	defer b.untrack(nil, conn)
+	defer conn.Close()
+
+	s, err := rhizome.NewSession(conn, b.cfg.Session)
+	if err != nil {
+		return err
+	}
+	defer b.unsubscribe(s)
+	defer s.Close()
+
+	// Subscribers are told not to ack deliveries, but a session that leaves
+	// responses unread eventually stops reading altogether.
+	go func() {
+		for {
+			if _, err := s.ReceiveResponse(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		obj, err := s.Receive()
+		if err != nil {
+			if s.Err() == nil {
+				// The object failed to decode, the session goes on.
+				continue
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if b.isClosed() {
+				return ErrBrokerClosed
+			}
+			return err
+		}
+		b.handle(s, obj)
+	}
+}
+
+// Close stops every Serve and ServeConn and waits for them to return.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	for l := range b.listeners {
+		l.Close()
+	}
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	return nil
+}
+
+func (b *Broker) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// track registers l or conn so Close can reach it and wait for it to be
+// untracked, unless the broker is already closed.
+func (b *Broker) track(l net.Listener, conn net.Conn) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false
+	}
+	b.wg.Add(1)
+	if l != nil {
+		b.listeners[l] = struct{}{}
+	}
+	if conn != nil {
+		b.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (b *Broker) untrack(l net.Listener, conn net.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.listeners, l)
+	delete(b.conns, conn)
+	b.wg.Done()
+}
+
+// -----------------------------------------------------------------------------
+// Commands.
+// -----------------------------------------------------------------------------
+
+func (b *Broker) handle(s *rhizome.Session, obj *rhizome.Object) {
+	if obj.Stream != nil {
+		// Streamed payloads are not forwarded.
+		obj.Stream.Close()
+		respond(obj, rhizome.AckUnknown)
+		return
+	}
+
+	var ack uint8
+	switch [2]uint8{obj.ObjType, obj.CmdType} {
+	case [2]uint8{rhizome.ObjChannel, rhizome.CmdAdd}:
+		ack = run(obj, rhizome.ParseChannelAdd, func(c rhizome.ChannelAdd) uint8 {
+			return b.addChannel(c.Route, c.Channel)
+		})
+	case [2]uint8{rhizome.ObjChannel, rhizome.CmdRemove}:
+		ack = run(obj, rhizome.ParseChannelRemove, func(c rhizome.ChannelRemove) uint8 {
+			return b.removeChannel(c.Route, c.Channel)
+		})
+	case [2]uint8{rhizome.ObjSubscriber, rhizome.CmdAdd}:
+		ack = run(obj, rhizome.ParseSubscriberAdd, func(c rhizome.SubscriberAdd) uint8 {
+			return b.addSubscriber(c.Route, c.Channel, subscriber{c.Subscriber, s})
+		})
+	case [2]uint8{rhizome.ObjSubscriber, rhizome.CmdRemove}:
+		ack = run(obj, rhizome.ParseSubscriberRemove, func(c rhizome.SubscriberRemove) uint8 {
+			return b.removeSubscriber(c.Route, c.Channel, c.Subscriber)
+		})
+	case [2]uint8{rhizome.ObjTransformer, rhizome.CmdAdd}:
+		ack = run(obj, rhizome.ParseTransformerAdd, func(c rhizome.TransformerAdd) uint8 {
+			return b.addTransformer(c.Route, c.Channel, c.Transformer)
+		})
+	case [2]uint8{rhizome.ObjTransformer, rhizome.CmdRemove}:
+		ack = run(obj, rhizome.ParseTransformerRemove, func(c rhizome.TransformerRemove) uint8 {
+			return b.removeTransformer(c.Route, c.Channel, c.Transformer)
+		})
+	case [2]uint8{rhizome.ObjDelivery, rhizome.CmdSend}:
+		ack = run(obj, rhizome.ParseDeliverySend, func(c rhizome.DeliverySend) uint8 {
+			return b.deliver(obj, c.Route, c.Channel)
+		})
+	default:
+		ack = rhizome.AckUnknown
+	}
+	respond(obj, ack)
+}
+
+// run parses a command and carries it out, answering commands that do not
+// fit their layout with AckUnknown.
+func run[T any](
+	obj *rhizome.Object,
+	parse func(*rhizome.Object) (T, error),
+	do func(T) uint8) uint8 {
+
+	cmd, err := parse(obj)
+	if err != nil {
+		return rhizome.AckUnknown
+	}
+	return do(cmd)
+}
+
+// respond acks obj, if its sender asked for it. A failure to respond shows up
+// as the session ending.
+func respond(obj *rhizome.Object, ack uint8) {
+	if obj.AckPlcy == rhizome.AckPlcyNoreply {
+		return
+	}
+	_ = obj.RespondWithAck(ack)
+}
+
+// channel looks up a channel, returning the ack to fail with if it is not
+// there. b.mu must be held.
+func (b *Broker) channel(route, name string) (*channel, uint8) {
+	channels, ok := b.routes[route]
+	if !ok {
+		return nil, rhizome.AckRouteNotFound
+	}
+	ch, ok := channels[name]
+	if !ok {
+		return nil, rhizome.AckChannelNotFound
+	}
+	return ch, rhizome.AckSent
+}
+
+func (b *Broker) addChannel(route, name string) uint8 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	channels, ok := b.routes[route]
+	if !ok {
+		channels = make(map[string]*channel)
+		b.routes[route] = channels
+	}
+	if _, ok := channels[name]; ok {
+		return rhizome.AckChannelAlreadyExists
+	}
+	channels[name] = &channel{}
+	return rhizome.AckSent
+}
+
+func (b *Broker) removeChannel(route, name string) uint8 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ack := b.channel(route, name); ack != rhizome.AckSent {
+		return ack
+	}
+	delete(b.routes[route], name)
+	if len(b.routes[route]) == 0 {
+		delete(b.routes, route)
+	}
+	return rhizome.AckSent
+}
+
+func (b *Broker) addSubscriber(route, name string, sub subscriber) uint8 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch, ack := b.channel(route, name)
+	if ack != rhizome.AckSent {
+		return ack
+	}
+	for i := range ch.subscribers {
+		if ch.subscribers[i].name == sub.name {
+			ch.subscribers[i].session = sub.session
+			return rhizome.AckSent
+		}
+	}
+	ch.subscribers = append(ch.subscribers, sub)
+	return rhizome.AckSent
+}
+
+func (b *Broker) removeSubscriber(route, name, subscriberName string) uint8 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch, ack := b.channel(route, name)
+	if ack != rhizome.AckSent {
+		return ack
+	}
+	for i, sub := range ch.subscribers {
+		if sub.name == subscriberName {
+			ch.subscribers = append(ch.subscribers[:i:i], ch.subscribers[i+1:]...)
+			break
+		}
+	}
+	return rhizome.AckSent
+}
+
+// unsubscribe removes every subscription of s.
+func (b *Broker) unsubscribe(s *rhizome.Session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, channels := range b.routes {
+		for _, ch := range channels {
+			kept := ch.subscribers[:0:0]
+			for _, sub := range ch.subscribers {
+				if sub.session != s {
+					kept = append(kept, sub)
+				}
+			}
+			ch.subscribers = kept
+		}
+	}
+}
+
+func (b *Broker) addTransformer(route, name, transformer string) uint8 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch, ack := b.channel(route, name)
+	if ack != rhizome.AckSent {
+		return ack
+	}
+	if _, ok := b.cfg.Transformers[transformer]; !ok {
+		return rhizome.AckUnknown
+	}
+	ch.transformers = append(ch.transformers, transformer)
+	return rhizome.AckSent
+}
+
+func (b *Broker) removeTransformer(route, name, transformer string) uint8 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch, ack := b.channel(route, name)
+	if ack != rhizome.AckSent {
+		return ack
+	}
+	for i, t := range ch.transformers {
+		if t == transformer {
+			ch.transformers = append(ch.transformers[:i:i], ch.transformers[i+1:]...)
+			break
+		}
+	}
+	return rhizome.AckSent
+}
+
+// -----------------------------------------------------------------------------
+// Deliveries.
+// -----------------------------------------------------------------------------
+
+// target is a channel a delivery is sent to, as it was when the delivery
+// arrived.
+type target struct {
+	name         string
+	subscribers  []subscriber
+	transformers []string
+}
+
+func (b *Broker) deliver(obj *rhizome.Object, route, name string) uint8 {
+	targets, ack := b.targets(route, name)
+	if ack != rhizome.AckSent {
+		return ack
+	}
+
+	// Sending happens without the lock, a slow subscriber only holds up the
+	// producer it is receiving from.
+	var failed []*rhizome.Session
+	for _, t := range targets {
+		fwd, err := b.transform(forward(obj, t.name), t.transformers)
+		if err != nil {
+			ack = rhizome.AckUnknown
+			continue
+		}
+		for _, sub := range t.subscribers {
+			err := sub.session.Send(fwd)
+			switch {
+			case err == nil:
+			case sessionFailed(sub.session, err):
+				failed = append(failed, sub.session)
+			default:
+				// The delivery can not be sent to this subscriber, say in
+				// an encoding it did not agree on, but others may take it.
+				ack = rhizome.AckUnknown
+			}
+		}
+	}
+
+	for _, s := range failed {
+		s.Close()
+		b.unsubscribe(s)
+	}
+	return ack
+}
+
+// sessionFailed reports whether err, returned by a send over s, means s can
+// no longer be sent to, rather than that the object could not be encoded.
+func sessionFailed(s *rhizome.Session, err error) bool {
+	return s.Err() != nil || errors.Is(err, rhizome.ErrSessionClosed)
+}
+
+// targets returns the channels a delivery to route and name, or all channels
+// of route if name is empty, is sent to.
+func (b *Broker) targets(route, name string) ([]target, uint8) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	snapshot := func(name string, ch *channel) target {
+		return target{
+			name:         name,
+			subscribers:  append([]subscriber(nil), ch.subscribers...),
+			transformers: append([]string(nil), ch.transformers...),
+		}
+	}
+
+	if name != "" {
+		ch, ack := b.channel(route, name)
+		if ack != rhizome.AckSent {
+			return nil, ack
+		}
+		return []target{snapshot(name, ch)}, rhizome.AckSent
+	}
+
+	channels, ok := b.routes[route]
+	if !ok {
+		return nil, rhizome.AckRouteNotFound
+	}
+	// In order of their names, so deliveries arrive in the same order every
+	// time.
+	targets := make([]target, 0, len(channels))
+	for _, name := range slices.Sorted(maps.Keys(channels)) {
+		targets = append(targets, snapshot(name, channels[name]))
+	}
+	return targets, rhizome.AckSent
+}
+
+func (b *Broker) transform(obj *rhizome.Object, transformers []string) (*rhizome.Object, error) {
+	for _, name := range transformers {
+		if err := b.cfg.Transformers[name](obj); err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+// forward returns the object sent to the subscribers of channel for obj.
+func forward(obj *rhizome.Object, channel string) *rhizome.Object {
+	fwd := rhizome.NewObject(
+		obj.ObjType, obj.CmdType, rhizome.AckPlcyNoreply,
+		obj.UID, obj.Arg1, channel, obj.Arg3, obj.Arg4,
+		obj.PayloadEncoding, obj.Payload,
+	)
+	fwd.Version = obj.Version
+	fwd.Compression = obj.Compression
+	return fwd
+}
@@ -0,0 +1,366 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+	"testing/synctest"
+
+	"github.com/signal-weave/rhizome"
+	"github.com/signal-weave/rhizome/rhizometest"
+)
+
+const brokerAddr = "broker:7000"
+
+// startBroker serves a broker on a simulated network. Call it inside a
+// synctest bubble.
+func startBroker(t *testing.T, cfg Config) (*Broker, *rhizometest.Network) {
+	t.Helper()
+
+	network := rhizometest.NewNetwork(rhizometest.NetworkConfig{})
+	l, err := network.Listen(brokerAddr)
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+
+	b := New(cfg)
+	served := make(chan error, 1)
+	go func() { served <- b.Serve(l) }()
+	t.Cleanup(func() {
+		b.Close()
+		if err := <-served; !errors.Is(err, ErrBrokerClosed) {
+			t.Errorf("Serve error = %v, want ErrBrokerClosed", err)
+		}
+	})
+	return b, network
+}
+
+// client is a session to the broker.
+type client struct {
+	t *testing.T
+	*rhizome.Session
+	uid int
+}
+
+func connect(t *testing.T, network *rhizometest.Network, host string) *client {
+	t.Helper()
+	return connectWith(t, network, host, rhizome.SessionConfig{})
+}
+
+func connectWith(t *testing.T, network *rhizometest.Network, host string, cfg rhizome.SessionConfig) *client {
+	t.Helper()
+
+	conn, err := network.Dial(host, brokerAddr)
+	if err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	s, err := rhizome.NewSession(conn, cfg)
+	if err != nil {
+		t.Fatalf("NewSession error: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return &client{t: t, Session: s}
+}
+
+// send sends a command without waiting for its ack, and returns its UID.
+func (c *client) send(ackPlcy, objType, cmdType uint8, args ...string) string {
+	c.t.Helper()
+
+	c.uid++
+	uid := "uid-" + strconv.Itoa(c.uid)
+	args = append(args, "", "", "", "")
+	obj := rhizome.NewObject(
+		objType, cmdType, ackPlcy,
+		uid, args[0], args[1], args[2], args[3],
+		rhizome.EncodingNA, []byte("payload of "+uid),
+	)
+	if err := c.Send(obj); err != nil {
+		c.t.Fatalf("Send error: %v", err)
+	}
+	return uid
+}
+
+// do sends a command and returns its ack.
+func (c *client) do(objType, cmdType uint8, args ...string) uint8 {
+	c.t.Helper()
+
+	uid := c.send(rhizome.AckPlcyOnsent, objType, cmdType, args...)
+	resp, err := c.ReceiveResponse()
+	if err != nil {
+		c.t.Fatalf("ReceiveResponse error: %v", err)
+	}
+	if resp.UID != uid {
+		c.t.Fatalf("response for %q, want %q", resp.UID, uid)
+	}
+	return resp.Ack
+}
+
+func (c *client) mustDo(objType, cmdType uint8, args ...string) {
+	c.t.Helper()
+
+	if ack := c.do(objType, cmdType, args...); ack != rhizome.AckSent {
+		c.t.Fatalf("ack = %d, want AckSent", ack)
+	}
+}
+
+func (c *client) receive() *rhizome.Object {
+	c.t.Helper()
+
+	obj, err := c.Receive()
+	if err != nil {
+		c.t.Fatalf("Receive error: %v", err)
+	}
+	return obj
+}
+
+func TestBroker_Channels(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		_, network := startBroker(t, Config{})
+		c := connect(t, network, "client")
+
+		for _, tc := range []struct {
+			name    string
+			cmdType uint8
+			args    []string
+			want    uint8
+		}{
+			{"add", rhizome.CmdAdd, []string{"orders", "audit"}, rhizome.AckSent},
+			{"add again", rhizome.CmdAdd, []string{"orders", "audit"}, rhizome.AckChannelAlreadyExists},
+			{"add to same route", rhizome.CmdAdd, []string{"orders", "billing"}, rhizome.AckSent},
+			{"same name on other route", rhizome.CmdAdd, []string{"invoices", "audit"}, rhizome.AckSent},
+			{"remove", rhizome.CmdRemove, []string{"orders", "audit"}, rhizome.AckSent},
+			{"remove again", rhizome.CmdRemove, []string{"orders", "audit"}, rhizome.AckChannelNotFound},
+			{"remove last of route", rhizome.CmdRemove, []string{"orders", "billing"}, rhizome.AckSent},
+			{"remove from missing route", rhizome.CmdRemove, []string{"orders", "billing"}, rhizome.AckRouteNotFound},
+			{"empty channel", rhizome.CmdAdd, []string{"orders", ""}, rhizome.AckUnknown},
+			{"unused argument", rhizome.CmdAdd, []string{"orders", "audit", "extra"}, rhizome.AckUnknown},
+			{"unknown command", rhizome.CmdSigterm, []string{"invoices", "audit"}, rhizome.AckUnknown},
+		} {
+			if got := c.do(rhizome.ObjChannel, tc.cmdType, tc.args...); got != tc.want {
+				t.Errorf("%s: ack = %d, want %d", tc.name, got, tc.want)
+			}
+		}
+	})
+}
+
+func TestBroker_DeliversToSubscribers(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		_, network := startBroker(t, Config{})
+		producer := connect(t, network, "producer")
+		first := connect(t, network, "first")
+		second := connect(t, network, "second")
+
+		producer.mustDo(rhizome.ObjChannel, rhizome.CmdAdd, "orders", "audit")
+		producer.mustDo(rhizome.ObjChannel, rhizome.CmdAdd, "orders", "billing")
+		first.mustDo(rhizome.ObjSubscriber, rhizome.CmdAdd, "orders", "audit", "first")
+		first.mustDo(rhizome.ObjSubscriber, rhizome.CmdAdd, "orders", "billing", "first")
+		second.mustDo(rhizome.ObjSubscriber, rhizome.CmdAdd, "orders", "billing", "second")
+
+		uid := producer.send(rhizome.AckPlcyOnsent, rhizome.ObjDelivery, rhizome.CmdSend, "orders", "", "a3", "a4")
+		resp, err := producer.ReceiveResponse()
+		if err != nil {
+			t.Fatalf("ReceiveResponse error: %v", err)
+		}
+		if resp != (rhizome.Response{UID: uid, Ack: rhizome.AckSent}) {
+			t.Fatalf("response = %+v, want %s acked with AckSent", resp, uid)
+		}
+
+		want := func(channel string) *rhizome.Object {
+			obj := rhizome.NewObject(
+				rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyNoreply,
+				uid, "orders", channel, "a3", "a4",
+				rhizome.EncodingNA, []byte("payload of "+uid),
+			)
+			obj.Version = rhizome.ProtocolLatest
+			return obj
+		}
+		// Channels of a route are delivered to in order of their names.
+		rhizometest.AssertObjectsEqual(t, want("audit"), first.receive())
+		rhizometest.AssertObjectsEqual(t, want("billing"), first.receive())
+		rhizometest.AssertObjectsEqual(t, want("billing"), second.receive())
+
+		// Only to billing.
+		uid = producer.send(rhizome.AckPlcyNoreply, rhizome.ObjDelivery, rhizome.CmdSend, "orders", "billing")
+		if ack := producer.do(rhizome.ObjDelivery, rhizome.CmdSend, "orders", "missing"); ack != rhizome.AckChannelNotFound {
+			t.Errorf("delivery to missing channel: ack = %d, want AckChannelNotFound", ack)
+		}
+		if ack := producer.do(rhizome.ObjDelivery, rhizome.CmdSend, "missing"); ack != rhizome.AckRouteNotFound {
+			t.Errorf("delivery to missing route: ack = %d, want AckRouteNotFound", ack)
+		}
+		for _, c := range []*client{first, second} {
+			if got := c.receive(); got.UID != uid || got.Arg2 != "billing" {
+				t.Errorf("%s received %s on %q, want %s on billing", c.C.LocalAddr(), got.UID, got.Arg2, uid)
+			}
+		}
+	})
+}
+
+func TestBroker_SubscriberThatCanNotTakeADeliveryStaysSubscribed(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		_, network := startBroker(t, Config{})
+		producer := connect(t, network, "producer")
+		wide := connect(t, network, "wide")
+		caps := rhizome.DefaultCapabilities()
+		caps.Encodings = []rhizome.PayloadEncoding{rhizome.EncodingNA}
+		narrow := connectWith(t, network, "narrow", rhizome.SessionConfig{Capabilities: caps})
+
+		producer.mustDo(rhizome.ObjChannel, rhizome.CmdAdd, "orders", "audit")
+		wide.mustDo(rhizome.ObjSubscriber, rhizome.CmdAdd, "orders", "audit", "wide")
+		narrow.mustDo(rhizome.ObjSubscriber, rhizome.CmdAdd, "orders", "audit", "narrow")
+
+		// The narrow subscriber did not agree on CSV payloads.
+		csv := rhizome.NewObject(
+			rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyOnsent,
+			"uid-csv", "orders", "audit", "", "",
+			rhizome.EncodingCsv, []byte("a,b\n"),
+		)
+		if err := producer.Send(csv); err != nil {
+			t.Fatalf("Send error: %v", err)
+		}
+		resp, err := producer.ReceiveResponse()
+		if err != nil {
+			t.Fatalf("ReceiveResponse error: %v", err)
+		}
+		if resp.UID != csv.UID || resp.Ack != rhizome.AckUnknown {
+			t.Fatalf("response = %+v, want %s acked with AckUnknown", resp, csv.UID)
+		}
+		if got := wide.receive(); got.UID != csv.UID {
+			t.Fatalf("wide received %s, want %s", got.UID, csv.UID)
+		}
+
+		uid := producer.send(rhizome.AckPlcyNoreply, rhizome.ObjDelivery, rhizome.CmdSend, "orders", "audit")
+		for _, c := range []*client{wide, narrow} {
+			if got := c.receive(); got.UID != uid {
+				t.Errorf("%s received %s, want %s", c.C.LocalAddr(), got.UID, uid)
+			}
+		}
+	})
+}
+
+func TestBroker_Subscribers(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		_, network := startBroker(t, Config{})
+		producer := connect(t, network, "producer")
+		sub := connect(t, network, "subscriber")
+		moved := connect(t, network, "moved")
+
+		if ack := sub.do(rhizome.ObjSubscriber, rhizome.CmdAdd, "orders", "audit", "sub"); ack != rhizome.AckRouteNotFound {
+			t.Errorf("subscribing to missing route: ack = %d, want AckRouteNotFound", ack)
+		}
+		producer.mustDo(rhizome.ObjChannel, rhizome.CmdAdd, "orders", "audit")
+		if ack := sub.do(rhizome.ObjSubscriber, rhizome.CmdAdd, "orders", "billing", "sub"); ack != rhizome.AckChannelNotFound {
+			t.Errorf("subscribing to missing channel: ack = %d, want AckChannelNotFound", ack)
+		}
+
+		// Subscribing a name again moves it to the new session.
+		sub.mustDo(rhizome.ObjSubscriber, rhizome.CmdAdd, "orders", "audit", "sub")
+		moved.mustDo(rhizome.ObjSubscriber, rhizome.CmdAdd, "orders", "audit", "sub")
+		uid := producer.send(rhizome.AckPlcyNoreply, rhizome.ObjDelivery, rhizome.CmdSend, "orders")
+		if got := moved.receive(); got.UID != uid {
+			t.Fatalf("received %s, want %s", got.UID, uid)
+		}
+
+		// Subscriptions can be removed from any session, more than once.
+		producer.mustDo(rhizome.ObjSubscriber, rhizome.CmdRemove, "orders", "audit", "sub")
+		producer.mustDo(rhizome.ObjSubscriber, rhizome.CmdRemove, "orders", "audit", "sub")
+		producer.mustDo(rhizome.ObjDelivery, rhizome.CmdSend, "orders")
+
+		// Subscriptions end with the session that made them.
+		sub.mustDo(rhizome.ObjSubscriber, rhizome.CmdAdd, "orders", "audit", "sub")
+		sub.Close()
+		synctest.Wait()
+		producer.mustDo(rhizome.ObjDelivery, rhizome.CmdSend, "orders")
+
+		synctest.Wait()
+		select {
+		case <-moved.Done():
+			t.Fatalf("session stopped: %v", moved.Err())
+		default:
+		}
+		moved.Close()
+		if obj, err := moved.Receive(); err == nil {
+			t.Errorf("removed subscriber received %s", obj.UID)
+		}
+	})
+}
+
+func TestBroker_Transformers(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		_, network := startBroker(t, Config{Transformers: map[string]Transformer{
+			"upper": func(obj *rhizome.Object) error {
+				obj.Payload = bytes.ToUpper(obj.Payload)
+				return nil
+			},
+			"tag": func(obj *rhizome.Object) error {
+				obj.Arg3 = "tagged " + string(obj.Payload)
+				return nil
+			},
+			"fail": func(obj *rhizome.Object) error {
+				return errors.New("refused")
+			},
+		}})
+		producer := connect(t, network, "producer")
+		sub := connect(t, network, "subscriber")
+
+		producer.mustDo(rhizome.ObjChannel, rhizome.CmdAdd, "orders", "audit")
+		sub.mustDo(rhizome.ObjSubscriber, rhizome.CmdAdd, "orders", "audit", "sub")
+		if ack := producer.do(rhizome.ObjTransformer, rhizome.CmdAdd, "orders", "audit", "missing"); ack != rhizome.AckUnknown {
+			t.Errorf("adding unknown transformer: ack = %d, want AckUnknown", ack)
+		}
+		if ack := producer.do(rhizome.ObjTransformer, rhizome.CmdAdd, "orders", "billing", "upper"); ack != rhizome.AckChannelNotFound {
+			t.Errorf("adding transformer to missing channel: ack = %d, want AckChannelNotFound", ack)
+		}
+
+		// Applied in the order they were added.
+		producer.mustDo(rhizome.ObjTransformer, rhizome.CmdAdd, "orders", "audit", "upper")
+		producer.mustDo(rhizome.ObjTransformer, rhizome.CmdAdd, "orders", "audit", "tag")
+		producer.mustDo(rhizome.ObjDelivery, rhizome.CmdSend, "orders")
+		got := sub.receive()
+		if string(got.Payload) != "PAYLOAD OF UID-6" || got.Arg3 != "tagged PAYLOAD OF UID-6" {
+			t.Errorf("transformed payload %q, arg3 %q", got.Payload, got.Arg3)
+		}
+
+		producer.mustDo(rhizome.ObjTransformer, rhizome.CmdRemove, "orders", "audit", "upper")
+		producer.mustDo(rhizome.ObjTransformer, rhizome.CmdAdd, "orders", "audit", "fail")
+		if ack := producer.do(rhizome.ObjDelivery, rhizome.CmdSend, "orders"); ack != rhizome.AckUnknown {
+			t.Errorf("delivery through failing transformer: ack = %d, want AckUnknown", ack)
+		}
+		producer.mustDo(rhizome.ObjTransformer, rhizome.CmdRemove, "orders", "audit", "fail")
+		producer.mustDo(rhizome.ObjDelivery, rhizome.CmdSend, "orders")
+		if got := sub.receive(); string(got.Payload) != "payload of uid-11" || got.Arg3 != "tagged payload of uid-11" {
+			t.Errorf("transformed payload %q, arg3 %q", got.Payload, got.Arg3)
+		}
+	})
+}
+
+func TestBroker_NoreplyIsNeverAcked(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		_, network := startBroker(t, Config{})
+		c := connect(t, network, "client")
+
+		c.send(rhizome.AckPlcyNoreply, rhizome.ObjChannel, rhizome.CmdAdd, "orders", "audit")
+		c.send(rhizome.AckPlcyNoreply, rhizome.ObjChannel, rhizome.CmdAdd, "orders", "audit")
+		c.send(rhizome.AckPlcyNoreply, rhizome.ObjDelivery, rhizome.CmdSend, "missing")
+		c.send(rhizome.AckPlcyNoreply, rhizome.ObjAction, rhizome.CmdSigterm)
+
+		// The first response is for the first command that asked for one.
+		if ack := c.do(rhizome.ObjChannel, rhizome.CmdRemove, "orders", "audit"); ack != rhizome.AckSent {
+			t.Errorf("ack = %d, want AckSent", ack)
+		}
+	})
+}
+
+func TestBroker_ServeConnAfterClose(t *testing.T) {
+	b := New(Config{})
+	b.Close()
+
+	client, server := rhizometest.NewConnPair(rhizometest.ConnConfig{})
+	defer client.Close()
+	if err := b.ServeConn(server); !errors.Is(err, ErrBrokerClosed) {
+		t.Fatalf("ServeConn error = %v, want ErrBrokerClosed", err)
+	}
+	if _, err := server.Write([]byte{0}); err == nil {
+		t.Fatalf("connection was left open")
+	}
+}
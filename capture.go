@@ -0,0 +1,173 @@
+package rhizome
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Capture files.
+// -----------------------------------------------------------------------------
+// A capture file records frames as they were sent or received, for replaying
+// traffic in tests or looking into it after the fact. It starts with a header:
+
+// # Capture Header
+// +--------------+------------+
+// | "RHZCAP" x6  | u8 version |
+// +--------------+------------+
+
+// followed by one record per frame, holding the frame as ReadFrame returns it:
+
+// # Capture Record
+// +---------------+--------------+---------+-------+
+// | i64 unix nano | u8 direction | u32 len | frame |
+// +---------------+--------------+---------+-------+
+
+// Captures iterates over the records of a capture file.
+// -----------------------------------------------------------------------------
+
+const (
+	captureMagic   = "RHZCAP"
+	captureVersion = uint8(1)
+
+	// The fixed size part of a record, before the frame.
+	captureRecordHeaderLen = 8 + 1 + 4
+)
+
+// CaptureDirection tells whether a captured frame was received or sent.
+type CaptureDirection uint8
+
+const (
+	CaptureInbound  CaptureDirection = 1
+	CaptureOutbound CaptureDirection = 2
+)
+
+func (d CaptureDirection) String() string {
+	switch d {
+	case CaptureInbound:
+		return "inbound"
+	case CaptureOutbound:
+		return "outbound"
+	default:
+		return fmt.Sprintf("direction(%d)", uint8(d))
+	}
+}
+
+// CaptureRecord is a single frame in a capture file.
+type CaptureRecord struct {
+	Time      time.Time
+	Direction CaptureDirection
+	Frame     []byte
+}
+
+// CaptureWriter writes a capture file. It is safe for concurrent use.
+type CaptureWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	now func() time.Time
+}
+
+// NewCaptureWriter writes the capture header to w and returns a CaptureWriter
+// appending records to it.
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	header := append([]byte(captureMagic), captureVersion)
+	if _, err := w.Write(header); err != nil {
+		return nil, fmt.Errorf("write capture header: %w", err)
+	}
+	return &CaptureWriter{w: w, now: time.Now}, nil
+}
+
+// Write appends rec to the capture. Records without a time are stamped with
+// the current time.
+func (cw *CaptureWriter) Write(rec CaptureRecord) error {
+	if len(rec.Frame) == 0 {
+		return errors.New("write capture: empty frame")
+	}
+	if rec.Direction != CaptureInbound && rec.Direction != CaptureOutbound {
+		return fmt.Errorf("write capture: unknown %s", rec.Direction)
+	}
+	if rec.Time.IsZero() {
+		rec.Time = cw.now()
+	}
+
+	buf := make([]byte, 0, captureRecordHeaderLen+len(rec.Frame))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(rec.Time.UnixNano()))
+	buf = append(buf, uint8(rec.Direction))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(rec.Frame)))
+	buf = append(buf, rec.Frame...)
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	_, err := cw.w.Write(buf)
+	return err
+}
+
+// malformedRecordError is a record that was read whole but makes no sense.
+// The records after it can still be read.
+type malformedRecordError struct {
+	err error
+}
+
+func (e *malformedRecordError) Error() string { return e.err.Error() }
+func (e *malformedRecordError) Unwrap() error { return e.err }
+
+func readCaptureHeader(r io.Reader) error {
+	var header [len(captureMagic) + 1]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return fmt.Errorf("read capture header: %w", err)
+	}
+	if !bytes.Equal(header[:len(captureMagic)], []byte(captureMagic)) {
+		return errors.New("read capture header: not a capture file")
+	}
+	if v := header[len(captureMagic)]; v != captureVersion {
+		return fmt.Errorf("read capture header: unsupported version %d", v)
+	}
+	return nil
+}
+
+// readCaptureRecord reads the next record from r. A clean end of the file
+// between records is returned as io.EOF.
+func readCaptureRecord(r io.Reader, limit uint32) (CaptureRecord, error) {
+	var header [captureRecordHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("read capture record: %w", err)
+		}
+		return CaptureRecord{}, err
+	}
+
+	rec := CaptureRecord{
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[:8]))),
+		Direction: CaptureDirection(header[8]),
+	}
+	n := binary.BigEndian.Uint32(header[9:])
+	if n == 0 {
+		return CaptureRecord{}, errors.New("read capture record: empty frame")
+	}
+	if n > limit {
+		return CaptureRecord{}, fmt.Errorf(
+			"read capture record: declared length %d exceeds %d byte limit",
+			n, limit,
+		)
+	}
+
+	rec.Frame = make([]byte, n)
+	if _, err := io.ReadFull(r, rec.Frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return CaptureRecord{}, fmt.Errorf("read capture record: %w", err)
+	}
+
+	if rec.Direction != CaptureInbound && rec.Direction != CaptureOutbound {
+		return CaptureRecord{}, &malformedRecordError{
+			fmt.Errorf("read capture record: unknown %s", rec.Direction),
+		}
+	}
+	return rec, nil
+}
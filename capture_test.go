@@ -0,0 +1,134 @@
+package rhizome
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestCapture_RoundTrip(t *testing.T) {
+	var file bytes.Buffer
+	cw, err := NewCaptureWriter(&file)
+	if err != nil {
+		t.Fatalf("NewCaptureWriter error: %v", err)
+	}
+
+	at := time.Unix(1700000000, 42)
+	obj, err := EncodeFrame(newBatchObjects(1)[0])
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+	response := append([]byte{FrameResponse}, EncodeResponseV1(Response{UID: "uid-0", Ack: AckSent})...)
+	want := []CaptureRecord{
+		{Time: at, Direction: CaptureInbound, Frame: obj},
+		{Time: at.Add(time.Millisecond), Direction: CaptureOutbound, Frame: response},
+	}
+	for _, rec := range want {
+		if err := cw.Write(rec); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+	}
+
+	var got []CaptureRecord
+	for rec, err := range Captures(&file) {
+		if err != nil {
+			t.Fatalf("Captures error: %v", err)
+		}
+		got = append(got, rec)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !got[i].Time.Equal(want[i].Time) || got[i].Direction != want[i].Direction ||
+			!bytes.Equal(got[i].Frame, want[i].Frame) {
+			t.Fatalf("record %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	decoded, err := DecodeFrame(got[0].Frame, nil)
+	if err != nil || decoded.UID != "uid-0" {
+		t.Fatalf("DecodeFrame of captured frame = %v, %v", decoded, err)
+	}
+}
+
+func TestCapture_Write_StampsTime(t *testing.T) {
+	var file bytes.Buffer
+	cw, err := NewCaptureWriter(&file)
+	if err != nil {
+		t.Fatalf("NewCaptureWriter error: %v", err)
+	}
+	before := time.Now()
+	if err := cw.Write(CaptureRecord{Direction: CaptureInbound, Frame: []byte{1}}); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if err := cw.Write(CaptureRecord{Direction: 9, Frame: []byte{1}}); err == nil {
+		t.Fatalf("expected error for an unknown direction")
+	}
+
+	for rec, err := range Captures(&file) {
+		if err != nil || rec.Time.Before(before) {
+			t.Fatalf("record = %+v, %v, want it stamped after %v", rec, err, before)
+		}
+	}
+}
+
+func TestCaptures_Malformed(t *testing.T) {
+	for _, header := range []string{"", "RHZ", "NOTCAP\x01", "RHZCAP\x02"} {
+		n := 0
+		for _, err := range Captures(bytes.NewReader([]byte(header))) {
+			n++
+			if err == nil {
+				t.Fatalf("header %q: expected error", header)
+			}
+		}
+		if n != 1 {
+			t.Fatalf("header %q: got %d results, want a single error", header, n)
+		}
+	}
+
+	var file bytes.Buffer
+	cw, err := NewCaptureWriter(&file)
+	if err != nil {
+		t.Fatalf("NewCaptureWriter error: %v", err)
+	}
+	_ = cw.Write(CaptureRecord{Direction: CaptureInbound, Frame: []byte{1}})
+	// A record with an unknown direction, written by hand.
+	file.Write([]byte{0, 0, 0, 0, 0, 0, 0, 0, 9, 0, 0, 0, 1, 1})
+	_ = cw.Write(CaptureRecord{Direction: CaptureOutbound, Frame: []byte{2}})
+	capture := file.Bytes()
+
+	var records, errs int
+	for _, err := range Captures(bytes.NewReader(capture), ContinueOnError()) {
+		if err != nil {
+			errs++
+			continue
+		}
+		records++
+	}
+	if records != 2 || errs != 1 {
+		t.Fatalf("got %d records and %d errors, want 2 and 1", records, errs)
+	}
+
+	records, errs = 0, 0
+	for _, err := range Captures(bytes.NewReader(capture)) {
+		if err != nil {
+			errs++
+			continue
+		}
+		records++
+	}
+	if records != 1 || errs != 1 {
+		t.Fatalf("got %d records and %d errors, want to stop at the error", records, errs)
+	}
+
+	var last error
+	for _, err := range Captures(bytes.NewReader(capture[:len(capture)-1]), ContinueOnError()) {
+		last = err
+	}
+	if !errors.Is(last, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated capture ended with %v, want io.ErrUnexpectedEOF", last)
+	}
+}
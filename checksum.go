@@ -0,0 +1,309 @@
+package rhizome
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// -----------------------------------------------------------------------------
+// Checksummed framing for unreliable links.
+// -----------------------------------------------------------------------------
+// TCP already guarantees ordered, uncorrupted bytes, but serial lines and pipes
+// do not. On those links every write can be wrapped in a checksummed frame that
+// starts with a sync marker, so a reader can detect corrupted or partial frames
+// and skip forward to the next good one.
+
+// # Checksummed frame
+// +-----------------+---------+----------------+------------+-------------+
+// | u32 sync marker | u32 len | u32 len crc32c | data (len) | u32 crc32c  |
+// +-----------------+---------+----------------+------------+-------------+
+
+// The first CRC32C (Castagnoli) covers the len field alone, so a corrupted
+// length is caught before the reader waits for that much data. The second
+// covers the len field and the data.
+//
+// A frame cut short on the link is given up as soon as a complete frame with
+// valid checksums follows it, instead of holding back every frame after it
+// until enough bytes arrived to fill it.
+//
+// Everything above this layer is unchanged: a Session or ConnResponder works
+// the same over a ChecksumConn as over the bare net.Conn.
+// -----------------------------------------------------------------------------
+
+// syncMarker starts every checksummed frame.
+var syncMarker = [4]byte{0xF3, 'R', 'H', 'Z'}
+
+// checksumHeader is the length of everything before a frame's data.
+const checksumHeader = len(syncMarker) + 4 + 4
+
+const checksumOverhead = checksumHeader + 4
+
+// DefaultChecksumFrameSize is the largest amount of data carried by a single
+// checksummed frame. It fits one transport frame of DefaultMaxFrameSize.
+const DefaultChecksumFrameSize = DefaultMaxFrameSize + 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+//--------Writer----------------------------------------------------------------
+
+// ChecksumWriter wraps every Write in one or more checksummed frames.
+type ChecksumWriter struct {
+	w io.Writer
+
+	// Writes larger than MaxFrameSize are split over several frames.
+	MaxFrameSize uint32
+}
+
+func NewChecksumWriter(w io.Writer) *ChecksumWriter {
+	return &ChecksumWriter{
+		w:            w,
+		MaxFrameSize: DefaultChecksumFrameSize,
+	}
+}
+
+// Write sends p as checksummed frames. Each frame goes out in a single Write
+// call on the underlying writer.
+func (cw *ChecksumWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), int(cw.MaxFrameSize))
+		if _, err := cw.w.Write(appendChecksumFrame(nil, p[:n])); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func appendChecksumFrame(dst, data []byte) []byte {
+	dst = append(dst, syncMarker[:]...)
+	start := len(dst)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(data)))
+	dst = binary.BigEndian.AppendUint32(dst, crc32.Checksum(dst[start:], castagnoli))
+	dst = append(dst, data...)
+	sum := crc32.Update(crc32.Checksum(dst[start:start+4], castagnoli), castagnoli, data)
+	return binary.BigEndian.AppendUint32(dst, sum)
+}
+
+//--------Reader----------------------------------------------------------------
+
+// ChecksumReader reads the data of checksummed frames written by a
+// ChecksumWriter. Frames with a bad checksum, an impossible length, or no sync
+// marker are skipped and the reader resynchronises on the next marker.
+type ChecksumReader struct {
+	r io.Reader
+
+	// Frames declaring more data than MaxFrameSize are treated as corrupt.
+	MaxFrameSize uint32
+
+	// OnDrop, if set, is called with the number of bytes skipped each time the
+	// reader has to resynchronise.
+	OnDrop func(dropped int)
+
+	pending []byte // bytes read from r but not yet parsed
+	data    []byte // data of the current frame not yet returned
+	err     error  // sticky error from r
+
+	dropped   atomic.Uint64
+	corrupted atomic.Uint64
+}
+
+func NewChecksumReader(r io.Reader) *ChecksumReader {
+	return &ChecksumReader{
+		r:            r,
+		MaxFrameSize: DefaultChecksumFrameSize,
+	}
+}
+
+// Dropped returns the total number of bytes skipped while resynchronising.
+func (cr *ChecksumReader) Dropped() uint64 {
+	return cr.dropped.Load()
+}
+
+// Corrupted returns the number of frames that failed their checksum.
+func (cr *ChecksumReader) Corrupted() uint64 {
+	return cr.corrupted.Load()
+}
+
+// Read returns data from the current good frame, reading the next one if
+// needed.
+func (cr *ChecksumReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(cr.data) == 0 {
+		if err := cr.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cr.data)
+	cr.data = cr.data[n:]
+	return n, nil
+}
+
+// nextFrame scans pending input for the next frame with a valid checksum.
+func (cr *ChecksumReader) nextFrame() error {
+	skipped := 0
+	defer func() {
+		if skipped > 0 {
+			cr.dropped.Add(uint64(skipped))
+			if cr.OnDrop != nil {
+				cr.OnDrop(skipped)
+			}
+		}
+	}()
+
+	skip := func(n int) {
+		cr.pending = cr.pending[n:]
+		skipped += n
+	}
+
+	for {
+		idx := bytes.Index(cr.pending, syncMarker[:])
+		if idx < 0 {
+			// Keep a possible partial marker at the end.
+			skip(max(0, len(cr.pending)-(len(syncMarker)-1)))
+			if err := cr.fill(); err != nil {
+				skip(len(cr.pending))
+				return err
+			}
+			continue
+		}
+		skip(idx)
+
+		data, state := cr.frameAt(cr.pending)
+		switch state {
+		case frameShort:
+			if next := cr.nextGoodFrame(); next > 0 {
+				skip(next)
+				continue
+			}
+			if err := cr.fill(); err != nil {
+				skip(len(cr.pending))
+				return err
+			}
+		case frameInvalid:
+			skip(1)
+		case frameCorrupt:
+			cr.corrupted.Add(1)
+			skip(1)
+		case frameGood:
+			cr.data = bytes.Clone(data)
+			cr.pending = cr.pending[checksumOverhead+len(data):]
+			return nil
+		}
+	}
+}
+
+// frameState is what frameAt found at the start of its input.
+type frameState int
+
+const (
+	// More input is needed to tell.
+	frameShort frameState = iota
+
+	// The length is out of range.
+	frameInvalid
+
+	// The length or the data failed their checksum.
+	frameCorrupt
+
+	frameGood
+)
+
+// frameAt checks the frame at the start of b, which starts with a sync marker,
+// and returns its data if it is good.
+func (cr *ChecksumReader) frameAt(b []byte) ([]byte, frameState) {
+	if len(b) < checksumHeader {
+		return nil, frameShort
+	}
+	length := b[len(syncMarker) : len(syncMarker)+4]
+	if crc32.Checksum(length, castagnoli) != binary.BigEndian.Uint32(b[len(syncMarker)+4:checksumHeader]) {
+		return nil, frameCorrupt
+	}
+
+	n := binary.BigEndian.Uint32(length)
+	if n == 0 || n > cr.MaxFrameSize {
+		return nil, frameInvalid
+	}
+	total := checksumOverhead + int(n)
+	if len(b) < total {
+		return nil, frameShort
+	}
+
+	data := b[checksumHeader : checksumHeader+int(n)]
+	sum := crc32.Update(crc32.Checksum(length, castagnoli), castagnoli, data)
+	if sum != binary.BigEndian.Uint32(b[checksumHeader+int(n):total]) {
+		return nil, frameCorrupt
+	}
+	return data, frameGood
+}
+
+// nextGoodFrame returns where in pending the first good frame after the one
+// pending starts with begins, or 0 if none has fully arrived yet.
+func (cr *ChecksumReader) nextGoodFrame() int {
+	for off := 1; off < len(cr.pending); off++ {
+		idx := bytes.Index(cr.pending[off:], syncMarker[:])
+		if idx < 0 {
+			return 0
+		}
+		off += idx
+		if _, state := cr.frameAt(cr.pending[off:]); state == frameGood {
+			return off
+		}
+	}
+	return 0
+}
+
+// fill appends more input to pending. A read error is kept until the bytes
+// read along with it are used up, and a stream ending inside a frame is
+// reported as io.ErrUnexpectedEOF.
+func (cr *ChecksumReader) fill() error {
+	if cr.err == nil {
+		var buf [32 * BytesInKilobyte]byte
+		n, err := cr.r.Read(buf[:])
+		cr.pending = append(cr.pending, buf[:n]...)
+		cr.err = err
+		if n > 0 || err == nil {
+			return nil
+		}
+	}
+
+	if cr.err == io.EOF && len(cr.pending) > 0 {
+		cr.err = io.ErrUnexpectedEOF
+	}
+	return cr.err
+}
+
+//--------Conn------------------------------------------------------------------
+
+// ChecksumConn is a net.Conn whose reads and writes go through checksummed
+// framing.
+type ChecksumConn struct {
+	net.Conn
+	*ChecksumReader
+	w *ChecksumWriter
+}
+
+// NewChecksumConn wraps c so every Write is sent as checksummed frames and
+// Read only returns data from frames with a valid checksum.
+func NewChecksumConn(c net.Conn) *ChecksumConn {
+	return &ChecksumConn{
+		Conn:           c,
+		ChecksumReader: NewChecksumReader(c),
+		w:              NewChecksumWriter(c),
+	}
+}
+
+func (cc *ChecksumConn) Read(p []byte) (int, error) {
+	return cc.ChecksumReader.Read(p)
+}
+
+func (cc *ChecksumConn) Write(p []byte) (int, error) {
+	return cc.w.Write(p)
+}
@@ -0,0 +1,273 @@
+package rhizome
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func checksumFrames(t *testing.T, msgs ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewChecksumWriter(&buf)
+	for _, m := range msgs {
+		if _, err := w.Write(m); err != nil {
+			t.Fatalf("ChecksumWriter.Write error: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func readFrames(t *testing.T, cr *ChecksumReader) [][]byte {
+	t.Helper()
+	var out [][]byte
+	for {
+		// Every frame is returned by a single Read when p is large enough.
+		buf := make([]byte, 1024)
+		n, err := cr.Read(buf)
+		if err != nil {
+			return out
+		}
+		out = append(out, buf[:n])
+	}
+}
+
+func TestChecksum_RoundTrip(t *testing.T) {
+	msgs := [][]byte{[]byte("first"), []byte("second"), bytes.Repeat([]byte{0xEE}, 300)}
+	cr := NewChecksumReader(bytes.NewReader(checksumFrames(t, msgs...)))
+
+	got := readFrames(t, cr)
+	if len(got) != len(msgs) {
+		t.Fatalf("read %d frames, want %d", len(got), len(msgs))
+	}
+	for i := range msgs {
+		if !bytes.Equal(got[i], msgs[i]) {
+			t.Fatalf("frame %d = %q, want %q", i, got[i], msgs[i])
+		}
+	}
+	if cr.Dropped() != 0 || cr.Corrupted() != 0 {
+		t.Fatalf("clean stream reported dropped=%d corrupted=%d", cr.Dropped(), cr.Corrupted())
+	}
+}
+
+func TestChecksum_CorruptedFrameIsSkipped(t *testing.T) {
+	stream := checksumFrames(t, []byte("one"), []byte("two"), []byte("three"))
+
+	// Flip a data byte in the second frame.
+	frameLen := checksumOverhead + len("one")
+	stream[frameLen+checksumHeader] ^= 0xFF
+
+	var reported int
+	cr := NewChecksumReader(bytes.NewReader(stream))
+	cr.OnDrop = func(n int) { reported += n }
+
+	got := readFrames(t, cr)
+	if len(got) != 2 || string(got[0]) != "one" || string(got[1]) != "three" {
+		t.Fatalf("frames = %q, want [one three]", got)
+	}
+	wantDropped := uint64(checksumOverhead + len("two"))
+	if cr.Dropped() != wantDropped {
+		t.Fatalf("Dropped() = %d, want %d", cr.Dropped(), wantDropped)
+	}
+	if uint64(reported) != wantDropped {
+		t.Fatalf("OnDrop reported %d bytes, want %d", reported, wantDropped)
+	}
+	if cr.Corrupted() != 1 {
+		t.Fatalf("Corrupted() = %d, want 1", cr.Corrupted())
+	}
+}
+
+func TestChecksum_GarbageAndPartialFramesAreSkipped(t *testing.T) {
+	good := checksumFrames(t, []byte("good"))
+	partial := checksumFrames(t, []byte("partial write"))[:10]
+
+	var stream []byte
+	stream = append(stream, []byte("noise before")...)
+	stream = append(stream, partial...)
+	stream = append(stream, good...)
+
+	cr := NewChecksumReader(bytes.NewReader(stream))
+	got := readFrames(t, cr)
+	if len(got) != 1 || string(got[0]) != "good" {
+		t.Fatalf("frames = %q, want [good]", got)
+	}
+	wantDropped := uint64(len("noise before") + len(partial))
+	if cr.Dropped() != wantDropped {
+		t.Fatalf("Dropped() = %d, want %d", cr.Dropped(), wantDropped)
+	}
+}
+
+func TestChecksum_ImpossibleLengthIsSkipped(t *testing.T) {
+	bad := append(syncMarker[:], 0xFF, 0xFF, 0xFF, 0xFF)
+	bad = binary.BigEndian.AppendUint32(bad, crc32.Checksum(bad[len(syncMarker):], castagnoli))
+	stream := append(bad, checksumFrames(t, []byte("after"))...)
+
+	cr := NewChecksumReader(bytes.NewReader(stream))
+	got := readFrames(t, cr)
+	if len(got) != 1 || string(got[0]) != "after" {
+		t.Fatalf("frames = %q, want [after]", got)
+	}
+}
+
+func TestChecksum_TruncatedStreamEndsWithUnexpectedEOF(t *testing.T) {
+	stream := checksumFrames(t, []byte("whole"), []byte("cut short"))
+	stream = stream[:len(stream)-3]
+
+	cr := NewChecksumReader(bytes.NewReader(stream))
+	buf := make([]byte, 64)
+	if n, err := cr.Read(buf); err != nil || string(buf[:n]) != "whole" {
+		t.Fatalf("first Read = %q, %v", buf[:n], err)
+	}
+	if _, err := cr.Read(buf); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("second Read error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestChecksum_CorruptedLengthDoesNotHoldBackLaterFrames(t *testing.T) {
+	stream := checksumFrames(t, []byte("lost"), []byte("next"))
+	// Still within MaxFrameSize, but far more than will ever arrive.
+	stream[len(syncMarker)+1] ^= 0x01
+
+	// The link goes quiet after the two frames.
+	r, w := io.Pipe()
+	defer w.Close()
+	go w.Write(stream)
+
+	got := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 64)
+		n, _ := NewChecksumReader(r).Read(buf)
+		got <- buf[:n]
+	}()
+
+	select {
+	case data := <-got:
+		if string(data) != "next" {
+			t.Fatalf("Read = %q, want next", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the frame after a corrupted length was held back")
+	}
+}
+
+func TestChecksum_FrameCutShortDoesNotHoldBackLaterFrames(t *testing.T) {
+	cut := checksumFrames(t, bytes.Repeat([]byte{'x'}, 500))[:100]
+	stream := append(cut, checksumFrames(t, []byte("next"))...)
+
+	r, w := io.Pipe()
+	defer w.Close()
+	go w.Write(stream)
+
+	got := make(chan []byte, 1)
+	cr := NewChecksumReader(r)
+	go func() {
+		buf := make([]byte, 64)
+		n, _ := cr.Read(buf)
+		got <- buf[:n]
+	}()
+
+	select {
+	case data := <-got:
+		if string(data) != "next" {
+			t.Fatalf("Read = %q, want next", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the frame after a truncated one was held back")
+	}
+	if cr.Dropped() != uint64(len(cut)) {
+		t.Fatalf("Dropped() = %d, want %d", cr.Dropped(), len(cut))
+	}
+}
+
+// dataErrReader returns all of data together with err, then io.EOF.
+type dataErrReader struct {
+	data []byte
+	err  error
+}
+
+func (r *dataErrReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	err := r.err
+	r.err = io.EOF
+	return n, err
+}
+
+func TestChecksum_ErrorReadWithDataIsKept(t *testing.T) {
+	errLink := errors.New("link down")
+	cr := NewChecksumReader(&dataErrReader{
+		data: checksumFrames(t, []byte("one"), []byte("two")),
+		err:  errLink,
+	})
+
+	got := readFrames(t, cr)
+	if len(got) != 2 || string(got[0]) != "one" || string(got[1]) != "two" {
+		t.Fatalf("frames = %q, want [one two]", got)
+	}
+	if _, err := cr.Read(make([]byte, 64)); !errors.Is(err, errLink) {
+		t.Fatalf("Read error = %v, want %v", err, errLink)
+	}
+}
+
+func TestChecksumWriter_SplitsLargeWrites(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewChecksumWriter(&buf)
+	w.MaxFrameSize = 4
+
+	if n, err := w.Write([]byte("abcdefghij")); err != nil || n != 10 {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if want := 3*checksumOverhead + 10; buf.Len() != want {
+		t.Fatalf("wrote %d bytes, want %d", buf.Len(), want)
+	}
+
+	got, err := io.ReadAll(NewChecksumReader(&buf))
+	if err != nil || string(got) != "abcdefghij" {
+		t.Fatalf("ReadAll = %q, %v", got, err)
+	}
+}
+
+func TestChecksumConn_CarriesSession(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ca, cb := NewChecksumConn(a), NewChecksumConn(b)
+
+	done := make(chan *Session, 1)
+	go func() {
+		s, err := NewSession(cb, SessionConfig{})
+		if err != nil {
+			t.Errorf("server NewSession error: %v", err)
+		}
+		done <- s
+	}()
+	client, err := NewSession(ca, SessionConfig{})
+	if err != nil {
+		t.Fatalf("client NewSession error: %v", err)
+	}
+	server := <-done
+	if server == nil {
+		t.FailNow()
+	}
+
+	obj := NewObject(
+		ObjDelivery, CmdSend, AckPlcyNoreply,
+		"uid-crc", "", "", "", "",
+		EncodingNA, []byte("over a checksummed link"),
+	)
+	go func() { _ = client.Send(obj) }()
+
+	got, err := server.Receive()
+	if err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	if !bytes.Equal(got.Payload, obj.Payload) {
+		t.Fatalf("payload = %q, want %q", got.Payload, obj.Payload)
+	}
+}
@@ -0,0 +1,46 @@
+// Command rhizome-broker runs the reference broker of package broker over TCP.
+//
+// Usage:
+//
+//	rhizome-broker [-addr host:port]
+//
+// It serves until interrupted.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/signal-weave/rhizome/broker"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:7000", "listen on `host:port`")
+	flag.Parse()
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("rhizome-broker: listening on %s\n", l.Addr())
+
+	b := broker.New(broker.Config{})
+	go func() {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		<-interrupt
+		b.Close()
+	}()
+
+	if err := b.Serve(l); err != nil && err != broker.ErrBrokerClosed {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "rhizome-broker:", err)
+	os.Exit(2)
+}
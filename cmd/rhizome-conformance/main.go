@@ -0,0 +1,85 @@
+// Command rhizome-conformance checks rhizome wire format implementations
+// against the golden vectors of package conformance.
+//
+// Usage:
+//
+//	rhizome-conformance [-vectors file] [-v] [command [args...]]
+//	rhizome-conformance -serve
+//
+// Given a command, it starts it and drives it over stdio as described in
+// package conformance. Without one, it checks this module. With -serve, it
+// answers requests for this module over its own stdio instead, as a reference
+// to compare other implementations' drivers with.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/signal-weave/rhizome/conformance"
+)
+
+func main() {
+	vectorsPath := flag.String("vectors", "", "read vectors from `file` instead of the built in ones")
+	serve := flag.Bool("serve", false, "serve this module over stdio")
+	verbose := flag.Bool("v", false, "list every vector checked")
+	flag.Parse()
+
+	if *serve {
+		if err := conformance.Serve(os.Stdin, os.Stdout, conformance.Local()); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	vectors := conformance.Vectors()
+	if *vectorsPath != "" {
+		f, err := os.Open(*vectorsPath)
+		if err != nil {
+			fatal(err)
+		}
+		vectors, err = conformance.LoadVectors(f)
+		f.Close()
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	impl := conformance.Local()
+	if flag.NArg() > 0 {
+		stdio, err := conformance.Command(flag.Arg(0), flag.Args()[1:]...)
+		if err != nil {
+			fatal(err)
+		}
+		defer stdio.Close()
+		impl = stdio
+	}
+
+	failures := conformance.Run(impl, vectors)
+	failed := make(map[string]bool, len(failures))
+	for _, f := range failures {
+		failed[f.Vector.Name] = true
+		fmt.Printf("FAIL %s\n", f)
+	}
+	if *verbose {
+		for _, v := range vectors {
+			if !failed[v.Name] {
+				fmt.Printf("ok   %s\n", v.Name)
+			}
+		}
+	}
+	fmt.Printf("%d of %d vectors passed\n", len(vectors)-len(failures), len(vectors))
+
+	if len(failures) > 0 {
+		if impl, ok := impl.(*conformance.Stdio); ok {
+			impl.Close()
+		}
+		os.Exit(1)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "rhizome-conformance:", err)
+	os.Exit(2)
+}
@@ -0,0 +1,64 @@
+// Command rhizomegen generates typed Go code for the commands described by a
+// schema, see package schema.
+//
+// Usage:
+//
+//	rhizomegen [-o file] schema.json
+//
+// The code is written next to the schema, to a file named after it with a
+// _gen.go suffix, unless -o names another. It is meant to be run by go
+// generate:
+//
+//	//go:generate go run github.com/signal-weave/rhizome/cmd/rhizomegen imaging.json
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/signal-weave/rhizome/schema"
+)
+
+func main() {
+	out := flag.String("o", "", "write the code to `file`")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: rhizomegen [-o file] schema.json")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+
+	f, err := os.Open(path)
+	if err != nil {
+		fatal(err)
+	}
+	s, err := schema.Load(f)
+	f.Close()
+	if err != nil {
+		fatal(fmt.Errorf("%s: %w", path, err))
+	}
+
+	code, err := schema.Generate(s, filepath.Base(path))
+	if err != nil {
+		fatal(fmt.Errorf("%s: %w", path, err))
+	}
+
+	if *out == "" {
+		*out = strings.TrimSuffix(path, filepath.Ext(path)) + "_gen.go"
+	}
+	if err := os.WriteFile(*out, code, 0o644); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "rhizomegen:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,323 @@
+package rhizome
+
+import (
+	"errors"
+	"fmt"
+)
+
+// -----------------------------------------------------------------------------
+// Standard broker commands.
+// -----------------------------------------------------------------------------
+// The combinations of ObjChannel, ObjSubscriber, ObjTransformer and ObjDelivery
+// with CmdAdd, CmdRemove and CmdSend are the commands every Signal Weave broker
+// understands. Their arguments are laid out as follows, see package broker for
+// what they do:
+//
+//	Command            Arg1   Arg2     Arg3         Arg4
+//	ChannelAdd         route  channel
+//	ChannelRemove      route  channel
+//	SubscriberAdd      route  channel  subscriber
+//	SubscriberRemove   route  channel  subscriber
+//	TransformerAdd     route  channel  transformer
+//	TransformerRemove  route  channel  transformer
+//	DeliverySend       route  channel  (free)       (free)
+//
+// Every argument in the table must be set, except the channel of a delivery,
+// which is left empty to send to every channel on the route. Arguments left out
+// of the table must be empty, apart from Arg3 and Arg4 of a delivery, which the
+// broker passes on to subscribers untouched.
+//
+// The New functions build these objects with AckPlcyOnsent, and the Parse
+// functions check an object against its layout and return its arguments.
+// Both fail with an *ArgError for arguments that do not fit the layout.
+// -----------------------------------------------------------------------------
+
+// ErrWrongCommand is returned by the Parse functions for objects of another
+// ObjType or CmdType.
+var ErrWrongCommand = errors.New("wrong object or command type")
+
+// ArgError reports an argument that is not what a command expects.
+type ArgError struct {
+	// Position of the argument, 1 for Arg1 through 4 for Arg4.
+	Pos int
+
+	// What the argument holds, like "route". Empty for arguments without a
+	// name.
+	Name string
+
+	Err error
+}
+
+func (e *ArgError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("arg%d: %v", e.Pos, e.Err)
+	}
+	return fmt.Sprintf("arg%d (%s): %v", e.Pos, e.Name, e.Err)
+}
+
+func (e *ArgError) Unwrap() error {
+	return e.Err
+}
+
+// ChannelAdd creates a channel on a route.
+type ChannelAdd struct {
+	Route, Channel string
+}
+
+// ChannelRemove removes a channel, its subscribers and transformers.
+type ChannelRemove struct {
+	Route, Channel string
+}
+
+// SubscriberAdd subscribes the sending connection to a channel under the name
+// Subscriber.
+type SubscriberAdd struct {
+	Route, Channel, Subscriber string
+}
+
+// SubscriberRemove ends the subscription named Subscriber.
+type SubscriberRemove struct {
+	Route, Channel, Subscriber string
+}
+
+// TransformerAdd adds the transformer named Transformer to a channel.
+type TransformerAdd struct {
+	Route, Channel, Transformer string
+}
+
+// TransformerRemove removes the transformer named Transformer from a channel.
+type TransformerRemove struct {
+	Route, Channel, Transformer string
+}
+
+// DeliverySend sends a payload to the subscribers of a channel, or of every
+// channel on the route if Channel is empty.
+type DeliverySend struct {
+	Route, Channel  string
+	PayloadEncoding PayloadEncoding
+	Payload         []byte
+}
+
+// commandArg describes an argument of a command.
+type commandArg struct {
+	name     string
+	optional bool
+}
+
+// command describes the argument layout of a standard command.
+type command struct {
+	name             string
+	objType, cmdType uint8
+	args             []commandArg
+
+	// Whether arguments past args are free for the application to use.
+	open bool
+}
+
+var (
+	argRoute   = commandArg{name: "route"}
+	argChannel = commandArg{name: "channel"}
+
+	cmdChannelAdd = command{
+		name: "channel add", objType: ObjChannel, cmdType: CmdAdd,
+		args: []commandArg{argRoute, argChannel},
+	}
+	cmdChannelRemove = command{
+		name: "channel remove", objType: ObjChannel, cmdType: CmdRemove,
+		args: []commandArg{argRoute, argChannel},
+	}
+	cmdSubscriberAdd = command{
+		name: "subscriber add", objType: ObjSubscriber, cmdType: CmdAdd,
+		args: []commandArg{argRoute, argChannel, {name: "subscriber"}},
+	}
+	cmdSubscriberRemove = command{
+		name: "subscriber remove", objType: ObjSubscriber, cmdType: CmdRemove,
+		args: []commandArg{argRoute, argChannel, {name: "subscriber"}},
+	}
+	cmdTransformerAdd = command{
+		name: "transformer add", objType: ObjTransformer, cmdType: CmdAdd,
+		args: []commandArg{argRoute, argChannel, {name: "transformer"}},
+	}
+	cmdTransformerRemove = command{
+		name: "transformer remove", objType: ObjTransformer, cmdType: CmdRemove,
+		args: []commandArg{argRoute, argChannel, {name: "transformer"}},
+	}
+	cmdDeliverySend = command{
+		name: "delivery send", objType: ObjDelivery, cmdType: CmdSend,
+		args: []commandArg{argRoute, {name: "channel", optional: true}},
+		open: true,
+	}
+)
+
+// check validates the arguments of a command.
+func (c command) check(args [4]string) error {
+	for i, arg := range args {
+		var err error
+		switch {
+		case len(arg) > 255:
+			err = fmt.Errorf("%d bytes, longer than 255", len(arg))
+		case i >= len(c.args):
+			if !c.open && arg != "" {
+				err = fmt.Errorf("unused, must be empty, got %q", arg)
+			}
+		case arg == "" && !c.args[i].optional:
+			err = errors.New("must not be empty")
+		}
+		if err != nil {
+			argErr := &ArgError{Pos: i + 1, Err: err}
+			if i < len(c.args) {
+				argErr.Name = c.args[i].name
+			}
+			return fmt.Errorf("%s: %w", c.name, argErr)
+		}
+	}
+	return nil
+}
+
+func (c command) build(uid string, args ...string) (*Object, error) {
+	var all [4]string
+	copy(all[:], args)
+	if err := c.check(all); err != nil {
+		return nil, err
+	}
+	return NewObject(
+		c.objType, c.cmdType, AckPlcyOnsent,
+		uid, all[0], all[1], all[2], all[3],
+		EncodingNA, nil,
+	), nil
+}
+
+func (c command) parse(obj *Object) ([4]string, error) {
+	if obj.ObjType != c.objType || obj.CmdType != c.cmdType {
+		return [4]string{}, fmt.Errorf(
+			"%s: %w: got object type %d and command type %d, want %d and %d",
+			c.name, ErrWrongCommand, obj.ObjType, obj.CmdType, c.objType, c.cmdType,
+		)
+	}
+	args := [4]string{obj.Arg1, obj.Arg2, obj.Arg3, obj.Arg4}
+	return args, c.check(args)
+}
+
+//--------Builders--------------------------------------------------------------
+
+// NewChannelAdd returns the object creating channel on route.
+func NewChannelAdd(uid, route, channel string) (*Object, error) {
+	return cmdChannelAdd.build(uid, route, channel)
+}
+
+// NewChannelRemove returns the object removing channel from route.
+func NewChannelRemove(uid, route, channel string) (*Object, error) {
+	return cmdChannelRemove.build(uid, route, channel)
+}
+
+// NewSubscriberAdd returns the object subscribing the connection it is sent
+// over to channel, under the name subscriber.
+func NewSubscriberAdd(uid, route, channel, subscriber string) (*Object, error) {
+	return cmdSubscriberAdd.build(uid, route, channel, subscriber)
+}
+
+// NewSubscriberRemove returns the object ending the subscription named
+// subscriber.
+func NewSubscriberRemove(uid, route, channel, subscriber string) (*Object, error) {
+	return cmdSubscriberRemove.build(uid, route, channel, subscriber)
+}
+
+// NewTransformerAdd returns the object adding the transformer named
+// transformer to channel.
+func NewTransformerAdd(uid, route, channel, transformer string) (*Object, error) {
+	return cmdTransformerAdd.build(uid, route, channel, transformer)
+}
+
+// NewTransformerRemove returns the object removing the transformer named
+// transformer from channel.
+func NewTransformerRemove(uid, route, channel, transformer string) (*Object, error) {
+	return cmdTransformerRemove.build(uid, route, channel, transformer)
+}
+
+// NewDeliverySend returns the object sending payload to the subscribers of
+// channel, or of every channel on route if channel is empty. Arg3 and Arg4
+// are left for the application to fill in.
+func NewDeliverySend(
+	uid, route, channel string,
+	payloadEncoding PayloadEncoding,
+	payload []byte) (*Object, error) {
+
+	obj, err := cmdDeliverySend.build(uid, route, channel)
+	if err != nil {
+		return nil, err
+	}
+	obj.PayloadEncoding = payloadEncoding
+	obj.Payload = payload
+	return obj, nil
+}
+
+//--------Parsers---------------------------------------------------------------
+
+// ParseChannelAdd returns the arguments of a channel add.
+func ParseChannelAdd(obj *Object) (ChannelAdd, error) {
+	args, err := cmdChannelAdd.parse(obj)
+	if err != nil {
+		return ChannelAdd{}, err
+	}
+	return ChannelAdd{Route: args[0], Channel: args[1]}, nil
+}
+
+// ParseChannelRemove returns the arguments of a channel remove.
+func ParseChannelRemove(obj *Object) (ChannelRemove, error) {
+	args, err := cmdChannelRemove.parse(obj)
+	if err != nil {
+		return ChannelRemove{}, err
+	}
+	return ChannelRemove{Route: args[0], Channel: args[1]}, nil
+}
+
+// ParseSubscriberAdd returns the arguments of a subscriber add.
+func ParseSubscriberAdd(obj *Object) (SubscriberAdd, error) {
+	args, err := cmdSubscriberAdd.parse(obj)
+	if err != nil {
+		return SubscriberAdd{}, err
+	}
+	return SubscriberAdd{Route: args[0], Channel: args[1], Subscriber: args[2]}, nil
+}
+
+// ParseSubscriberRemove returns the arguments of a subscriber remove.
+func ParseSubscriberRemove(obj *Object) (SubscriberRemove, error) {
+	args, err := cmdSubscriberRemove.parse(obj)
+	if err != nil {
+		return SubscriberRemove{}, err
+	}
+	return SubscriberRemove{Route: args[0], Channel: args[1], Subscriber: args[2]}, nil
+}
+
+// ParseTransformerAdd returns the arguments of a transformer add.
+func ParseTransformerAdd(obj *Object) (TransformerAdd, error) {
+	args, err := cmdTransformerAdd.parse(obj)
+	if err != nil {
+		return TransformerAdd{}, err
+	}
+	return TransformerAdd{Route: args[0], Channel: args[1], Transformer: args[2]}, nil
+}
+
+// ParseTransformerRemove returns the arguments of a transformer remove.
+func ParseTransformerRemove(obj *Object) (TransformerRemove, error) {
+	args, err := cmdTransformerRemove.parse(obj)
+	if err != nil {
+		return TransformerRemove{}, err
+	}
+	return TransformerRemove{Route: args[0], Channel: args[1], Transformer: args[2]}, nil
+}
+
+// ParseDeliverySend returns the arguments and payload of a delivery. The
+// payload is not copied.
+func ParseDeliverySend(obj *Object) (DeliverySend, error) {
+	args, err := cmdDeliverySend.parse(obj)
+	if err != nil {
+		return DeliverySend{}, err
+	}
+	return DeliverySend{
+		Route:           args[0],
+		Channel:         args[1],
+		PayloadEncoding: obj.PayloadEncoding,
+		Payload:         obj.Payload,
+	}, nil
+}
@@ -0,0 +1,184 @@
+package rhizome
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommands_BuildAndParseRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		build            func() (*Object, error)
+		parse            func(*Object) (any, error)
+		objType, cmdType uint8
+		args             [4]string
+		want             any
+	}{
+		{
+			name:    "channel add",
+			build:   func() (*Object, error) { return NewChannelAdd("u", "orders", "audit") },
+			parse:   func(o *Object) (any, error) { return ParseChannelAdd(o) },
+			objType: ObjChannel, cmdType: CmdAdd,
+			args: [4]string{"orders", "audit"},
+			want: ChannelAdd{Route: "orders", Channel: "audit"},
+		},
+		{
+			name:    "channel remove",
+			build:   func() (*Object, error) { return NewChannelRemove("u", "orders", "audit") },
+			parse:   func(o *Object) (any, error) { return ParseChannelRemove(o) },
+			objType: ObjChannel, cmdType: CmdRemove,
+			args: [4]string{"orders", "audit"},
+			want: ChannelRemove{Route: "orders", Channel: "audit"},
+		},
+		{
+			name:    "subscriber add",
+			build:   func() (*Object, error) { return NewSubscriberAdd("u", "orders", "audit", "svc") },
+			parse:   func(o *Object) (any, error) { return ParseSubscriberAdd(o) },
+			objType: ObjSubscriber, cmdType: CmdAdd,
+			args: [4]string{"orders", "audit", "svc"},
+			want: SubscriberAdd{Route: "orders", Channel: "audit", Subscriber: "svc"},
+		},
+		{
+			name:    "subscriber remove",
+			build:   func() (*Object, error) { return NewSubscriberRemove("u", "orders", "audit", "svc") },
+			parse:   func(o *Object) (any, error) { return ParseSubscriberRemove(o) },
+			objType: ObjSubscriber, cmdType: CmdRemove,
+			args: [4]string{"orders", "audit", "svc"},
+			want: SubscriberRemove{Route: "orders", Channel: "audit", Subscriber: "svc"},
+		},
+		{
+			name:    "transformer add",
+			build:   func() (*Object, error) { return NewTransformerAdd("u", "orders", "audit", "gzip") },
+			parse:   func(o *Object) (any, error) { return ParseTransformerAdd(o) },
+			objType: ObjTransformer, cmdType: CmdAdd,
+			args: [4]string{"orders", "audit", "gzip"},
+			want: TransformerAdd{Route: "orders", Channel: "audit", Transformer: "gzip"},
+		},
+		{
+			name:    "transformer remove",
+			build:   func() (*Object, error) { return NewTransformerRemove("u", "orders", "audit", "gzip") },
+			parse:   func(o *Object) (any, error) { return ParseTransformerRemove(o) },
+			objType: ObjTransformer, cmdType: CmdRemove,
+			args: [4]string{"orders", "audit", "gzip"},
+			want: TransformerRemove{Route: "orders", Channel: "audit", Transformer: "gzip"},
+		},
+		{
+			name: "delivery send",
+			build: func() (*Object, error) {
+				return NewDeliverySend("u", "orders", "", EncodingJson, []byte(`{}`))
+			},
+			parse:   func(o *Object) (any, error) { return ParseDeliverySend(o) },
+			objType: ObjDelivery, cmdType: CmdSend,
+			args: [4]string{"orders"},
+			want: DeliverySend{Route: "orders", PayloadEncoding: EncodingJson, Payload: []byte(`{}`)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			obj, err := tc.build()
+			if err != nil {
+				t.Fatalf("build error: %v", err)
+			}
+			if obj.ObjType != tc.objType || obj.CmdType != tc.cmdType {
+				t.Fatalf("types = %d/%d, want %d/%d", obj.ObjType, obj.CmdType, tc.objType, tc.cmdType)
+			}
+			if obj.AckPlcy != AckPlcyOnsent || obj.UID != "u" {
+				t.Fatalf("ack policy %d and UID %q, want AckPlcyOnsent and u", obj.AckPlcy, obj.UID)
+			}
+			if got := [4]string{obj.Arg1, obj.Arg2, obj.Arg3, obj.Arg4}; got != tc.args {
+				t.Fatalf("args = %q, want %q", got, tc.args)
+			}
+
+			// Through the wire and back.
+			frame, err := EncodeFrame(obj)
+			if err != nil {
+				t.Fatalf("EncodeFrame error: %v", err)
+			}
+			decoded, err := DecodeFrame(frame, nil)
+			if err != nil {
+				t.Fatalf("DecodeFrame error: %v", err)
+			}
+			got, err := tc.parse(decoded)
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("parsed %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCommands_ArgErrors(t *testing.T) {
+	long := strings.Repeat("x", 256)
+
+	for _, tc := range []struct {
+		name    string
+		err     error
+		pos     int
+		argName string
+	}{
+		{"empty route", second(NewChannelAdd("u", "", "audit")), 1, "route"},
+		{"empty channel", second(NewChannelRemove("u", "orders", "")), 2, "channel"},
+		{"empty subscriber", second(NewSubscriberAdd("u", "orders", "audit", "")), 3, "subscriber"},
+		{"long transformer", second(NewTransformerAdd("u", "orders", "audit", long)), 3, "transformer"},
+		{"long delivery channel", second(NewDeliverySend("u", "orders", long, EncodingNA, nil)), 2, "channel"},
+		{
+			"unused arg set",
+			second(ParseChannelAdd(NewObject(ObjChannel, CmdAdd, AckPlcyOnsent, "u", "orders", "audit", "", "x", EncodingNA, nil))),
+			4, "",
+		},
+		{
+			"long free arg",
+			second(ParseDeliverySend(NewObject(ObjDelivery, CmdSend, AckPlcyOnsent, "u", "orders", "", long, "", EncodingNA, nil))),
+			3, "",
+		},
+	} {
+		var argErr *ArgError
+		if !errors.As(tc.err, &argErr) {
+			t.Errorf("%s: error %v is not an *ArgError", tc.name, tc.err)
+			continue
+		}
+		if argErr.Pos != tc.pos || argErr.Name != tc.argName {
+			t.Errorf("%s: error for arg%d (%q), want arg%d (%q)", tc.name, argErr.Pos, argErr.Name, tc.pos, tc.argName)
+		}
+	}
+}
+
+func TestCommands_DeliveryLeavesFreeArgsAlone(t *testing.T) {
+	obj, err := NewDeliverySend("u", "orders", "audit", EncodingNA, nil)
+	if err != nil {
+		t.Fatalf("NewDeliverySend error: %v", err)
+	}
+	obj.Arg3, obj.Arg4 = "trace-id", "tenant"
+	if _, err := ParseDeliverySend(obj); err != nil {
+		t.Fatalf("ParseDeliverySend error: %v", err)
+	}
+}
+
+func TestCommands_ParseRejectsOtherCommands(t *testing.T) {
+	obj, err := NewChannelAdd("u", "orders", "audit")
+	if err != nil {
+		t.Fatalf("NewChannelAdd error: %v", err)
+	}
+	_, err = ParseChannelRemove(obj)
+	if !errors.Is(err, ErrWrongCommand) {
+		t.Fatalf("ParseChannelRemove error = %v, want ErrWrongCommand", err)
+	}
+	if want := "channel remove: wrong object or command type: got object type 4 and command type 2, want 4 and 3"; err.Error() != want {
+		t.Fatalf("error = %q, want %q", err, want)
+	}
+}
+
+func TestArgError_Message(t *testing.T) {
+	_, err := NewSubscriberAdd("u", "orders", "audit", "")
+	if want := "subscriber add: arg3 (subscriber): must not be empty"; err == nil || err.Error() != want {
+		t.Fatalf("error = %v, want %q", err, want)
+	}
+}
+
+// second returns the error of a call returning a value and an error.
+func second[T any](_ T, err error) error {
+	return err
+}
@@ -0,0 +1,239 @@
+package rhizome
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+)
+
+// Compression denotes which algorithm, if any, was used to compress a payload.
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionFlate
+	CompressionZlib
+)
+
+var CompressionName = map[Compression]string{
+	CompressionNone:  "none",
+	CompressionGzip:  "gzip",
+	CompressionFlate: "flate",
+	CompressionZlib:  "zlib",
+}
+
+func (c Compression) String() string {
+	if name, ok := CompressionName[c]; ok {
+		return name
+	}
+
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	return compressors[c].name
+}
+
+// The defaults for encoding and decoding compressed payloads. Sessions and
+// DecodeOptions can set limits of their own, and sessions read these once, in
+// NewSession. Change them before encoding or decoding anything, as they are
+// read without synchronization.
+var (
+	// CompressionThreshold is the payload size, in bytes, below which payloads
+	// are sent uncompressed even if the Object asks for compression.
+	CompressionThreshold = 512
+
+	// MaxDecompressedSize is the largest payload, in bytes, a compressed frame
+	// may inflate to. Frames declaring more are rejected before decompressing,
+	// and decompression stops as soon as the limit is crossed.
+	MaxDecompressedSize = 16 * 1024 * BytesInKilobyte
+)
+
+// compressionLimits are the limits a single encode or decode works with.
+type compressionLimits struct {
+	threshold   int
+	maxInflated int
+}
+
+// defaultLimits returns the limits of CompressionThreshold and
+// MaxDecompressedSize.
+func defaultLimits() compressionLimits {
+	return compressionLimits{
+		threshold:   CompressionThreshold,
+		maxInflated: MaxDecompressedSize,
+	}
+}
+
+// withDefaults fills in the limits left zero.
+func (lim compressionLimits) withDefaults() compressionLimits {
+	if lim.threshold <= 0 {
+		lim.threshold = CompressionThreshold
+	}
+	if lim.maxInflated <= 0 {
+		lim.maxInflated = MaxDecompressedSize
+	}
+	return lim
+}
+
+//--------Registry--------------------------------------------------------------
+
+// Compressor is implemented by payload compression algorithms.
+type Compressor interface {
+	// NewWriter returns a writer compressing into w. Close flushes any
+	// buffered data but must not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader returns a reader decompressing from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+type registeredCompressor struct {
+	name string
+	Compressor
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[Compression]registeredCompressor{
+		CompressionGzip:  {"gzip", gzipCompressor{}},
+		CompressionFlate: {"flate", flateCompressor{}},
+		CompressionZlib:  {"zlib", zlibCompressor{}},
+	}
+)
+
+// RegisterCompression makes a custom compression algorithm available under id.
+// IDs are written to the wire, so both peers must register the same algorithm
+// under the same ID. IDs from 128 upwards are left for applications.
+func RegisterCompression(id Compression, name string, c Compressor) error {
+	if id == CompressionNone || c == nil {
+		return fmt.Errorf("register compression %d: invalid compressor", id)
+	}
+
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	if _, ok := compressors[id]; ok {
+		return fmt.Errorf("register compression %d: already registered", id)
+	}
+	compressors[id] = registeredCompressor{name, c}
+	return nil
+}
+
+// SupportedCompression lists every registered compression algorithm.
+func SupportedCompression() []Compression {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	ids := make([]Compression, 0, len(compressors))
+	for id := range compressors {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func lookupCompressor(id Compression) (Compressor, error) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	c, ok := compressors[id]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression algorithm: %d", id)
+	}
+	return c.Compressor, nil
+}
+
+//--------Compress / Decompress-------------------------------------------------
+
+func compress(id Compression, payload []byte) ([]byte, error) {
+	c, err := lookupCompressor(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w, err := c.NewWriter(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("compress %s: %w", id, err)
+	}
+	if _, err := w.Write(payload); err != nil {
+		return nil, fmt.Errorf("compress %s: %w", id, err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("compress %s: %w", id, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// inflateChunk caps the buffer decompress allocates before any data inflated.
+const inflateChunk = 64 * BytesInKilobyte
+
+// decompress inflates data, which must inflate to exactly size bytes.
+// Reading stops one byte past size so a lying peer cannot make us inflate more
+// than it declared.
+func decompress(id Compression, data []byte, size int) ([]byte, error) {
+	c, err := lookupCompressor(id)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := c.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decompress %s: %w", id, err)
+	}
+	defer r.Close()
+
+	// The declared size is the peer's word, so the buffer only grows as the
+	// payload actually inflates.
+	var buf bytes.Buffer
+	buf.Grow(min(size, inflateChunk))
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(size)+1))
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("decompress %s: %w", id, err)
+	case n > int64(size):
+		return nil, fmt.Errorf(
+			"decompress %s: payload inflates past declared %d bytes", id, size,
+		)
+	case n != int64(size):
+		return nil, fmt.Errorf(
+			"decompress %s: inflated %d bytes, declared %d", id, n, size,
+		)
+	}
+	return buf.Bytes(), nil
+}
+
+//--------Built-in Algorithms---------------------------------------------------
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+type flateCompressor struct{}
+
+func (flateCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+func (flateCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+type zlibCompressor struct{}
+
+func (zlibCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriter(w), nil
+}
+
+func (zlibCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
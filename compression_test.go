@@ -0,0 +1,266 @@
+package rhizome
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newV2Object(payload []byte, c Compression) *Object {
+	obj := NewObject(
+		ObjDelivery, CmdSend, AckPlcyOnsent,
+		"uid-compress", "a1", "a2", "a3", "a4",
+		EncodingCsv, payload,
+	)
+	obj.Version = ProtocolV2
+	obj.Compression = c
+	return obj
+}
+
+func TestCompression_RoundTrip_BuiltIns(t *testing.T) {
+	payload := []byte(strings.Repeat("name,value\nalpha,1\n", 200))
+
+	for _, c := range []Compression{CompressionGzip, CompressionFlate, CompressionZlib} {
+		obj := newV2Object(payload, c)
+
+		frame, err := EncodeFrame(obj)
+		if err != nil {
+			t.Fatalf("%s: EncodeFrame error: %v", c, err)
+		}
+		if frame[1]&FlagCompressed == 0 {
+			t.Fatalf("%s: expected FlagCompressed to be set", c)
+		}
+		if len(frame) >= len(payload) {
+			t.Fatalf("%s: frame of %d bytes is not smaller than payload of %d", c, len(frame), len(payload))
+		}
+
+		got, err := DecodeFrame(frame, newResponder())
+		if err != nil {
+			t.Fatalf("%s: DecodeFrame error: %v", c, err)
+		}
+		assertObjectsEqual(t, obj, got)
+		if got.Compression != c {
+			t.Fatalf("%s: decoded Compression = %s", c, got.Compression)
+		}
+	}
+}
+
+func TestCompression_BelowThresholdIsLeftUncompressed(t *testing.T) {
+	payload := bytes.Repeat([]byte{'a'}, CompressionThreshold-1)
+	obj := newV2Object(payload, CompressionGzip)
+
+	frame, err := EncodeFrame(obj)
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+	if frame[1]&FlagCompressed != 0 {
+		t.Fatalf("payload below threshold was compressed")
+	}
+
+	got, err := DecodeFrame(frame, newResponder())
+	if err != nil {
+		t.Fatalf("DecodeFrame error: %v", err)
+	}
+	if got.Compression != CompressionNone {
+		t.Fatalf("decoded Compression = %s, want none", got.Compression)
+	}
+	assertObjectsEqual(t, obj, got)
+}
+
+func TestCompression_IncompressiblePayloadIsSentAsIs(t *testing.T) {
+	payload := make([]byte, 2048)
+	for i := range payload {
+		payload[i] = byte(i*7919 + i>>3)
+	}
+	obj := newV2Object(payload, CompressionFlate)
+
+	frame, err := EncodeFrame(obj)
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+	got, err := DecodeFrame(frame, newResponder())
+	if err != nil {
+		t.Fatalf("DecodeFrame error: %v", err)
+	}
+	assertObjectsEqual(t, obj, got)
+}
+
+func TestCompression_LargeCompressiblePayloadExceedsU16(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"k":"v"},`), 20000) // 200KB
+	obj := newV2Object(payload, CompressionZlib)
+
+	frame, err := EncodeFrame(obj)
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+	got, err := DecodeFrame(frame, newResponder())
+	if err != nil {
+		t.Fatalf("DecodeFrame error: %v", err)
+	}
+	if !bytes.Equal(got.Payload, payload) {
+		t.Fatalf("payload mismatch after decompression")
+	}
+
+	// Without compression the same payload is too big for one frame.
+	obj.Compression = CompressionNone
+	if _, err := EncodeFrame(obj); err == nil {
+		t.Fatalf("expected error for uncompressed payload over 64KB")
+	}
+}
+
+// compressedFrame builds a v2 frame by hand so tests can lie about sizes.
+func compressedFrame(t *testing.T, declared uint32, compressed []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writeU8(&buf, ProtocolV2)
+	writeU8(&buf, FlagCompressed)
+	writeU8(&buf, ObjDelivery)
+	writeU8(&buf, CmdSend)
+	writeU8(&buf, AckPlcyNoreply)
+	_ = writeString8(&buf, "uid-bomb")
+	for range 4 {
+		_ = writeString8(&buf, "")
+	}
+	writeU8(&buf, EncodingNA)
+	writeU8(&buf, uint8(CompressionGzip))
+	writeU32(&buf, declared)
+	writeU32(&buf, uint32(len(compressed)))
+	buf.Write(compressed)
+	return buf.Bytes()
+}
+
+func TestCompression_DecompressionBombProtection(t *testing.T) {
+	bomb, err := compress(CompressionGzip, make([]byte, 1024*BytesInKilobyte))
+	if err != nil {
+		t.Fatalf("compress error: %v", err)
+	}
+
+	// Declared size over the limit is rejected up front.
+	frame := compressedFrame(t, uint32(MaxDecompressedSize)+1, bomb)
+	if _, err := DecodeFrame(frame, newResponder()); err == nil {
+		t.Fatalf("expected error for declared size over MaxDecompressedSize")
+	}
+
+	// A payload that inflates past its declared size is rejected.
+	frame = compressedFrame(t, 1024, bomb)
+	if _, err := DecodeFrame(frame, newResponder()); err == nil {
+		t.Fatalf("expected error for payload inflating past declared size")
+	}
+
+	// A payload that inflates to less than declared is rejected.
+	frame = compressedFrame(t, 2*1024*BytesInKilobyte, bomb)
+	if _, err := DecodeFrame(frame, newResponder()); err == nil {
+		t.Fatalf("expected error for payload inflating short of declared size")
+	}
+}
+
+func TestCompression_DeclaredSizeIsNotAllocatedUpFront(t *testing.T) {
+	small, err := compress(CompressionGzip, []byte("tiny"))
+	if err != nil {
+		t.Fatalf("compress error: %v", err)
+	}
+	frame := compressedFrame(t, uint32(MaxDecompressedSize), small)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := DecodeFrame(frame, newResponder()); err == nil {
+		t.Fatalf("expected error for payload inflating short of declared size")
+	}
+	runtime.ReadMemStats(&after)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*BytesInKilobyte {
+		t.Fatalf("decoding a %d byte frame allocated %d bytes", len(frame), allocated)
+	}
+}
+
+func TestCompression_SessionsHaveLimitsOfTheirOwn(t *testing.T) {
+	client, server := newSessionPair(t,
+		SessionConfig{CompressionThreshold: 64},
+		SessionConfig{MaxDecompressedSize: 1024},
+	)
+
+	small := newV2Object(bytes.Repeat([]byte{'a'}, 100), CompressionGzip)
+	if err := client.Send(small); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	got, err := server.Receive()
+	if err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	if got.Compression != CompressionGzip {
+		t.Fatalf("payload above the session's threshold was not compressed")
+	}
+
+	large := newV2Object(bytes.Repeat([]byte{'a'}, 2048), CompressionGzip)
+	if err := client.Send(large); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	if _, err := server.Receive(); err == nil || !strings.Contains(err.Error(), "exceeds 1024 byte limit") {
+		t.Fatalf("Receive error = %v, want the session's limit", err)
+	}
+
+	frame, err := EncodeFrame(large)
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+	if err := DecodeInto(&Object{}, frame, nil, DecodeOptions{MaxDecompressedSize: 1024}); err == nil {
+		t.Fatalf("DecodeInto ignored MaxDecompressedSize")
+	}
+	if err := DecodeInto(&Object{}, frame, nil, DecodeOptions{}); err != nil {
+		t.Fatalf("DecodeInto error: %v", err)
+	}
+}
+
+type identityCompressor struct{}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (identityCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (identityCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+func TestRegisterCompression(t *testing.T) {
+	const id Compression = 200
+	if err := RegisterCompression(id, "identity", identityCompressor{}); err != nil {
+		t.Fatalf("RegisterCompression error: %v", err)
+	}
+	t.Cleanup(func() {
+		compressorsMu.Lock()
+		delete(compressors, id)
+		compressorsMu.Unlock()
+	})
+
+	if id.String() != "identity" {
+		t.Fatalf("String() = %q, want identity", id.String())
+	}
+	if !slices.Contains(SupportedCompression(), id) {
+		t.Fatalf("SupportedCompression() does not list the custom algorithm")
+	}
+	if err := RegisterCompression(id, "again", identityCompressor{}); err == nil {
+		t.Fatalf("expected error registering the same ID twice")
+	}
+	if err := RegisterCompression(CompressionNone, "none", identityCompressor{}); err == nil {
+		t.Fatalf("expected error registering CompressionNone")
+	}
+
+	out, err := compress(id, []byte("abc"))
+	if err != nil || string(out) != "abc" {
+		t.Fatalf("compress via custom algorithm = %q, %v", out, err)
+	}
+}
+
+func TestCompression_UnknownAlgorithm(t *testing.T) {
+	obj := newV2Object(bytes.Repeat([]byte{'x'}, 1024), 99)
+	if _, err := EncodeFrame(obj); err == nil {
+		t.Fatalf("expected error encoding with unregistered algorithm")
+	}
+}
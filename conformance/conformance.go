@@ -0,0 +1,173 @@
+// Package conformance checks implementations of the rhizome wire format
+// against a set of golden vectors.
+//
+// The vectors live in vectors.json, meant to be shared with Signal Weave
+// clients written in other languages. Each describes an object or response
+// and the exact bytes it encodes to, or bytes that must fail to decode. Object
+// bytes are a single frame without its u32 length prefix, response bytes
+// include their u16 length prefix.
+//
+// Run checks an Implementation against the vectors. Local is this package's
+// implementation, and Stdio drives any other over its standard input and
+// output, see cmd/rhizome-conformance.
+package conformance
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// What a Vector expects of an implementation.
+const (
+	// ExpectRoundTrip vectors encode to Bytes, which decode back to the same
+	// object or response.
+	ExpectRoundTrip = "round_trip"
+
+	// ExpectDecode vectors only decode, as their bytes are one of several
+	// valid encodings, such as a compressed payload.
+	ExpectDecode = "decode"
+
+	// ExpectDecodeError vectors hold bytes that must fail to decode.
+	ExpectDecodeError = "decode_error"
+
+	// ExpectEncodeError vectors hold an object that must fail to encode.
+	ExpectEncodeError = "encode_error"
+)
+
+// What a Vector holds.
+const (
+	KindObject   = "object"
+	KindResponse = "response"
+)
+
+// Vector is a golden test vector.
+type Vector struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Kind        string `json:"kind"`
+	Expect      string `json:"expect"`
+
+	// Object or Response, depending on Kind, for every vector but decode
+	// errors.
+	Object   *Object   `json:"object,omitempty"`
+	Response *Response `json:"response,omitempty"`
+
+	// Bytes for every vector but encode errors.
+	Bytes HexBytes `json:"bytes"`
+
+	// Error says why decode and encode error vectors fail. It documents the
+	// vector, implementations are not expected to report the same message.
+	Error string `json:"error,omitempty"`
+}
+
+// Object describes an object independently of any implementation.
+type Object struct {
+	Version         uint8     `json:"version"`
+	ObjType         uint8     `json:"obj_type"`
+	CmdType         uint8     `json:"cmd_type"`
+	AckPlcy         uint8     `json:"ack_policy"`
+	UID             string    `json:"uid"`
+	Args            [4]string `json:"args"`
+	PayloadEncoding uint8     `json:"payload_encoding"`
+	Payload         HexBytes  `json:"payload"`
+
+	// Version 2 only.
+	FragIndex   uint16 `json:"frag_index,omitempty"`
+	FragCount   uint16 `json:"frag_count,omitempty"`
+	Streamed    bool   `json:"streamed,omitempty"`
+	Compression uint8  `json:"compression,omitempty"`
+}
+
+// Equal reports whether o and other describe the same object. Nil and empty
+// payloads are equal.
+func (o Object) Equal(other Object) bool {
+	a, b := o, other
+	a.Payload, b.Payload = nil, nil
+	return reflect.DeepEqual(a, b) && bytes.Equal(o.Payload, other.Payload)
+}
+
+// Response describes a response.
+type Response struct {
+	UID string `json:"uid"`
+	Ack uint8  `json:"ack"`
+}
+
+// HexBytes is a byte slice written to JSON as a hex string.
+type HexBytes []byte
+
+func (b HexBytes) String() string {
+	return hex.EncodeToString(b)
+}
+
+func (b HexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(b))
+}
+
+func (b *HexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("hex bytes: %w", err)
+	}
+	*b = decoded
+	return nil
+}
+
+//go:embed vectors.json
+var vectorsJSON []byte
+
+// Vectors returns the golden vectors.
+func Vectors() []Vector {
+	vectors, err := LoadVectors(bytes.NewReader(vectorsJSON))
+	if err != nil {
+		panic("conformance: embedded vectors: " + err.Error())
+	}
+	return vectors
+}
+
+// LoadVectors reads vectors in the format of vectors.json.
+func LoadVectors(r io.Reader) ([]Vector, error) {
+	var file struct {
+		Vectors []Vector `json:"vectors"`
+	}
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, fmt.Errorf("load vectors: %w", err)
+	}
+	for i, v := range file.Vectors {
+		if err := v.validate(); err != nil {
+			return nil, fmt.Errorf("load vectors: vector %d, %q: %w", i, v.Name, err)
+		}
+	}
+	return file.Vectors, nil
+}
+
+func (v Vector) validate() error {
+	switch v.Kind {
+	case KindObject, KindResponse:
+	default:
+		return fmt.Errorf("unknown kind %q", v.Kind)
+	}
+
+	described := v.Object != nil
+	if v.Kind == KindResponse {
+		described = v.Response != nil
+	}
+	switch v.Expect {
+	case ExpectRoundTrip, ExpectDecode, ExpectEncodeError:
+		if !described {
+			return fmt.Errorf("%s vector without %s", v.Expect, v.Kind)
+		}
+	case ExpectDecodeError:
+	default:
+		return fmt.Errorf("unknown expectation %q", v.Expect)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package conformance
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestVectors_CoverEveryExpectation(t *testing.T) {
+	seen := map[string]bool{}
+	for _, v := range Vectors() {
+		seen[v.Kind+"/"+v.Expect] = true
+	}
+	for _, want := range []string{
+		KindObject + "/" + ExpectRoundTrip,
+		KindObject + "/" + ExpectDecode,
+		KindObject + "/" + ExpectDecodeError,
+		KindObject + "/" + ExpectEncodeError,
+		KindResponse + "/" + ExpectRoundTrip,
+		KindResponse + "/" + ExpectDecodeError,
+	} {
+		if !seen[want] {
+			t.Errorf("no %s vector", want)
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	for _, f := range Run(Local(), Vectors()) {
+		t.Errorf("%s", f)
+	}
+}
+
+func TestStdio(t *testing.T) {
+	requests, requestsW := io.Pipe()
+	replies, repliesW := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(requests, repliesW, Local())
+		repliesW.Close()
+	}()
+
+	for _, f := range Run(NewStdio(replies, requestsW), Vectors()) {
+		t.Errorf("%s", f)
+	}
+
+	requestsW.Close()
+	if err := <-served; err != nil {
+		t.Fatalf("Serve error: %v", err)
+	}
+}
+
+func TestStdio_TransportErrorsFailVectors(t *testing.T) {
+	// Nothing ever replies, which must not pass as a decode error.
+	stdio := NewStdio(strings.NewReader(""), io.Discard)
+
+	vectors := Vectors()
+	if failures := Run(stdio, vectors); len(failures) != len(vectors) {
+		t.Fatalf("%d of %d vectors failed", len(failures), len(vectors))
+	}
+}
+
+// lenient accepts everything and gets the bytes of objects wrong.
+type lenient struct{ Implementation }
+
+func (l lenient) EncodeObject(o Object) ([]byte, error) {
+	b, err := l.Implementation.EncodeObject(o)
+	if err != nil {
+		return []byte{o.Version}, nil
+	}
+	b[len(b)-1] ^= 0xFF
+	return b, nil
+}
+
+func (l lenient) DecodeObject(b []byte) (Object, error) {
+	obj, _ := l.Implementation.DecodeObject(b)
+	return obj, nil
+}
+
+func TestRun_ReportsFailures(t *testing.T) {
+	failed := map[string]string{}
+	for _, f := range Run(lenient{Local()}, Vectors()) {
+		failed[f.Vector.Name] = f.Reason
+	}
+
+	for _, v := range Vectors() {
+		_, got := failed[v.Name]
+		want := v.Kind == KindObject && v.Expect != ExpectDecode
+		if got != want {
+			t.Errorf("%s: failed %v, want %v (%s)", v.Name, got, want, failed[v.Name])
+		}
+	}
+	if reason := failed["v1_delivery"]; !strings.HasPrefix(reason, "encoded ") {
+		t.Fatalf("v1_delivery failed with %q", reason)
+	}
+}
+
+func TestLoadVectors_Rejects(t *testing.T) {
+	for name, file := range map[string]string{
+		"syntax":      `{"vectors": [`,
+		"kind":        `{"vectors": [{"name": "x", "kind": "batch", "expect": "decode"}]}`,
+		"expectation": `{"vectors": [{"name": "x", "kind": "object", "expect": "maybe"}]}`,
+		"no object":   `{"vectors": [{"name": "x", "kind": "object", "expect": "round_trip"}]}`,
+		"hex":         `{"vectors": [{"name": "x", "kind": "object", "expect": "decode_error", "bytes": "zz"}]}`,
+		"no response": `{"vectors": [{"name": "x", "kind": "response", "expect": "encode_error", "object": {}}]}`,
+	} {
+		if _, err := LoadVectors(strings.NewReader(file)); err == nil {
+			t.Errorf("%s: LoadVectors succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package conformance
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// Implementation is a rhizome wire format implementation under test.
+type Implementation interface {
+	EncodeObject(Object) ([]byte, error)
+	DecodeObject([]byte) (Object, error)
+	EncodeResponse(Response) ([]byte, error)
+	DecodeResponse([]byte) (Response, error)
+}
+
+// -----------------------------------------------------------------------------
+// This package.
+// -----------------------------------------------------------------------------
+
+// Local returns the implementation of this module.
+func Local() Implementation {
+	return local{}
+}
+
+type local struct{}
+
+func (local) EncodeObject(o Object) ([]byte, error) {
+	if o.Streamed {
+		return nil, errors.New("streamed objects are sent with Session.SendStream")
+	}
+
+	obj := rhizome.NewObject(
+		o.ObjType, o.CmdType, o.AckPlcy,
+		o.UID, o.Args[0], o.Args[1], o.Args[2], o.Args[3],
+		rhizome.PayloadEncoding(o.PayloadEncoding), o.Payload,
+	)
+	obj.Version = o.Version
+	obj.FragIndex, obj.FragCount = o.FragIndex, o.FragCount
+	obj.Compression = rhizome.Compression(o.Compression)
+	return rhizome.EncodeFrame(obj)
+}
+
+func (local) DecodeObject(b []byte) (Object, error) {
+	obj, err := rhizome.DecodeFrame(b, nil)
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{
+		Version:         obj.Version,
+		ObjType:         obj.ObjType,
+		CmdType:         obj.CmdType,
+		AckPlcy:         obj.AckPlcy,
+		UID:             obj.UID,
+		Args:            [4]string{obj.Arg1, obj.Arg2, obj.Arg3, obj.Arg4},
+		PayloadEncoding: uint8(obj.PayloadEncoding),
+		Payload:         obj.Payload,
+		FragIndex:       obj.FragIndex,
+		FragCount:       obj.FragCount,
+		Streamed:        obj.Streamed(),
+		Compression:     uint8(obj.Compression),
+	}, nil
+}
+
+func (local) EncodeResponse(r Response) ([]byte, error) {
+	return rhizome.EncodeResponseV1(rhizome.Response{UID: r.UID, Ack: r.Ack}), nil
+}
+
+func (local) DecodeResponse(b []byte) (Response, error) {
+	response, n, err := rhizome.DecodeResponseV1(b)
+	if err != nil {
+		return Response{}, err
+	}
+	if n != len(b) {
+		return Response{}, fmt.Errorf("%d bytes after the response", len(b)-n)
+	}
+	return Response{UID: response.UID, Ack: response.Ack}, nil
+}
+
+// -----------------------------------------------------------------------------
+// Implementations driven over stdio.
+// -----------------------------------------------------------------------------
+// An implementation under test reads one JSON request per line from its
+// standard input and writes one JSON reply per line to its standard output:
+//
+//	{"op":"encode_object","object":{...}}     {"bytes":"01..."}
+//	{"op":"decode_object","bytes":"01..."}    {"object":{...}}
+//	{"op":"encode_response","response":{...}} {"bytes":"0007..."}
+//	{"op":"decode_response","bytes":"0007..."} {"response":{...}}
+//
+// Objects and responses are written as in vectors.json. A request that fails
+// is answered with {"error":"..."}. The implementation exits once its standard
+// input is closed.
+// -----------------------------------------------------------------------------
+
+// Stdio operations.
+const (
+	OpEncodeObject   = "encode_object"
+	OpDecodeObject   = "decode_object"
+	OpEncodeResponse = "encode_response"
+	OpDecodeResponse = "decode_response"
+)
+
+// ErrTransport marks errors talking to an implementation over stdio, as
+// opposed to errors the implementation reported.
+var ErrTransport = errors.New("conformance: transport")
+
+type request struct {
+	Op       string    `json:"op"`
+	Object   *Object   `json:"object,omitempty"`
+	Response *Response `json:"response,omitempty"`
+	Bytes    HexBytes  `json:"bytes,omitempty"`
+}
+
+type reply struct {
+	Object   *Object   `json:"object,omitempty"`
+	Response *Response `json:"response,omitempty"`
+	Bytes    HexBytes  `json:"bytes,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Stdio is an implementation driven over a pair of streams.
+type Stdio struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	dec *json.Decoder
+	err error
+
+	cmd   *exec.Cmd
+	stdin io.Closer
+}
+
+// NewStdio returns the implementation that answers the requests written to w
+// with replies read from r.
+func NewStdio(r io.Reader, w io.Writer) *Stdio {
+	return &Stdio{enc: json.NewEncoder(w), dec: json.NewDecoder(bufio.NewReader(r))}
+}
+
+// Command starts the named program and drives it over its standard input and
+// output. Its standard error is passed through. Close ends the program.
+func Command(name string, args ...string) (*Stdio, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	s := NewStdio(stdout, stdin)
+	s.cmd, s.stdin = cmd, stdin
+	return s, nil
+}
+
+// Close closes the standard input of a program started by Command and waits
+// for it to exit.
+func (s *Stdio) Close() error {
+	if s.cmd == nil {
+		return nil
+	}
+	_ = s.stdin.Close()
+	return s.cmd.Wait()
+}
+
+// call sends req and returns the reply, or the error the implementation
+// reported. Once the streams fail, every call fails with ErrTransport.
+func (s *Stdio) call(req request) (reply, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return reply{}, s.err
+	}
+
+	var rep reply
+	if err := s.enc.Encode(req); err != nil {
+		s.err = fmt.Errorf("%w: send %s: %v", ErrTransport, req.Op, err)
+		return reply{}, s.err
+	}
+	if err := s.dec.Decode(&rep); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		s.err = fmt.Errorf("%w: receive %s: %v", ErrTransport, req.Op, err)
+		return reply{}, s.err
+	}
+	if rep.Error != "" {
+		return reply{}, errors.New(rep.Error)
+	}
+	return rep, nil
+}
+
+func (s *Stdio) EncodeObject(o Object) ([]byte, error) {
+	rep, err := s.call(request{Op: OpEncodeObject, Object: &o})
+	return rep.Bytes, err
+}
+
+func (s *Stdio) DecodeObject(b []byte) (Object, error) {
+	rep, err := s.call(request{Op: OpDecodeObject, Bytes: b})
+	if err != nil {
+		return Object{}, err
+	}
+	if rep.Object == nil {
+		return Object{}, fmt.Errorf("%w: %s reply without object", ErrTransport, OpDecodeObject)
+	}
+	return *rep.Object, nil
+}
+
+func (s *Stdio) EncodeResponse(r Response) ([]byte, error) {
+	rep, err := s.call(request{Op: OpEncodeResponse, Response: &r})
+	return rep.Bytes, err
+}
+
+func (s *Stdio) DecodeResponse(b []byte) (Response, error) {
+	rep, err := s.call(request{Op: OpDecodeResponse, Bytes: b})
+	if err != nil {
+		return Response{}, err
+	}
+	if rep.Response == nil {
+		return Response{}, fmt.Errorf("%w: %s reply without response", ErrTransport, OpDecodeResponse)
+	}
+	return *rep.Response, nil
+}
+
+// Serve answers the requests read from r with impl, writing the replies to w,
+// until r ends. It lets an Implementation be driven over stdio.
+func Serve(r io.Reader, w io.Writer, impl Implementation) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	enc := json.NewEncoder(w)
+
+	for {
+		var req request
+		if err := dec.Decode(&req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("serve: %w", err)
+		}
+
+		var (
+			rep reply
+			err error
+		)
+		switch {
+		case req.Op == OpEncodeObject && req.Object != nil:
+			rep.Bytes, err = impl.EncodeObject(*req.Object)
+		case req.Op == OpDecodeObject:
+			var obj Object
+			obj, err = impl.DecodeObject(req.Bytes)
+			rep.Object = &obj
+		case req.Op == OpEncodeResponse && req.Response != nil:
+			rep.Bytes, err = impl.EncodeResponse(*req.Response)
+		case req.Op == OpDecodeResponse:
+			var response Response
+			response, err = impl.DecodeResponse(req.Bytes)
+			rep.Response = &response
+		default:
+			err = fmt.Errorf("malformed %q request", req.Op)
+		}
+		if err != nil {
+			rep = reply{Error: err.Error()}
+		}
+
+		if err := enc.Encode(rep); err != nil {
+			return fmt.Errorf("serve: %w", err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Failure is a vector an implementation got wrong.
+type Failure struct {
+	Vector Vector
+	Reason string
+}
+
+func (f Failure) String() string {
+	return fmt.Sprintf("%s: %s", f.Vector.Name, f.Reason)
+}
+
+// Run checks impl against vectors and returns the vectors it got wrong.
+// Errors talking to an implementation over stdio fail every vector they
+// affect.
+func Run(impl Implementation, vectors []Vector) []Failure {
+	var failures []Failure
+	for _, v := range vectors {
+		var reason string
+		if v.Kind == KindResponse {
+			reason = checkResponse(impl, v)
+		} else {
+			reason = checkObject(impl, v)
+		}
+		if reason != "" {
+			failures = append(failures, Failure{Vector: v, Reason: reason})
+		}
+	}
+	return failures
+}
+
+func checkObject(impl Implementation, v Vector) string {
+	switch v.Expect {
+	case ExpectEncodeError:
+		b, err := impl.EncodeObject(*v.Object)
+		return expectError("encoded", HexBytes(b), err)
+
+	case ExpectDecodeError:
+		obj, err := impl.DecodeObject(v.Bytes)
+		return expectError("decoded", obj, err)
+	}
+
+	if v.Expect == ExpectRoundTrip {
+		b, err := impl.EncodeObject(*v.Object)
+		if reason := expectBytes(v.Bytes, b, err); reason != "" {
+			return reason
+		}
+	}
+	obj, err := impl.DecodeObject(v.Bytes)
+	if err != nil {
+		return fmt.Sprintf("decode error: %v", err)
+	}
+	if !obj.Equal(*v.Object) {
+		return fmt.Sprintf("decoded %+v, want %+v", obj, *v.Object)
+	}
+	return ""
+}
+
+func checkResponse(impl Implementation, v Vector) string {
+	switch v.Expect {
+	case ExpectEncodeError:
+		b, err := impl.EncodeResponse(*v.Response)
+		return expectError("encoded", HexBytes(b), err)
+
+	case ExpectDecodeError:
+		response, err := impl.DecodeResponse(v.Bytes)
+		return expectError("decoded", response, err)
+	}
+
+	if v.Expect == ExpectRoundTrip {
+		b, err := impl.EncodeResponse(*v.Response)
+		if reason := expectBytes(v.Bytes, b, err); reason != "" {
+			return reason
+		}
+	}
+	response, err := impl.DecodeResponse(v.Bytes)
+	if err != nil {
+		return fmt.Sprintf("decode error: %v", err)
+	}
+	if response != *v.Response {
+		return fmt.Sprintf("decoded %+v, want %+v", response, *v.Response)
+	}
+	return ""
+}
+
+func expectBytes(want, got []byte, err error) string {
+	if err != nil {
+		return fmt.Sprintf("encode error: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Sprintf("encoded %x, want %x", got, want)
+	}
+	return ""
+}
+
+func expectError(did string, got any, err error) string {
+	if errors.Is(err, ErrTransport) {
+		return err.Error()
+	}
+	if err == nil {
+		return fmt.Sprintf("%s %v, want an error", did, got)
+	}
+	return ""
+}
@@ -0,0 +1,324 @@
+package rhizome
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+// Credit-based flow control.
+// -----------------------------------------------------------------------------
+// A receiver that can not keep up should not have to stop reading to slow its
+// peer down. With credits the receiver decides how much the sender may send:
+// every object costs the sender one object credit and its payload length in
+// byte credits, and the sender waits once it runs out. Both peers advertise an
+// initial window in their hello and grant more credits as their application
+// receives objects, or whenever it decides to if credits are granted manually.
+//
+// Credits are independent of acks. An object is paid for once it is handed to
+// the application, whether or not it is ever acknowledged. Objects that fail to
+// decode are never paid back, so a peer sending broken objects eventually runs
+// out of credits.
+//
+// A streamed object costs one object credit for its header, and each chunk of
+// its payload costs its length in byte credits. Chunks are paid back as the
+// application reads them from the stream, or once they are discarded because
+// the stream was closed.
+
+// # Credit grant control frame
+// +-----------------+-------------+-------------+-----------+
+// | u8 FrameControl | u8 ctrl ID  | u32 objects | u32 bytes |
+// +-----------------+-------------+-------------+-----------+
+
+// A sender may overdraw its byte credits with a single object, as long as it
+// has some left, so payloads larger than the peer's window can still be sent.
+// Object credits are never overdrawn, and a peer that does so breaks the
+// protocol.
+// -----------------------------------------------------------------------------
+
+const (
+	ctrlCredit uint8 = 5
+)
+
+// ErrNoCredits is returned by Send when the peer has not granted enough
+// credits and the session is configured not to wait for them.
+var ErrNoCredits = errors.New("session: out of credits")
+
+// CreditWindow is an amount of credits.
+type CreditWindow struct {
+	Objects uint32
+	Bytes   uint32
+}
+
+// DefaultCreditWindow is the initial window advertised by
+// DefaultCapabilities.
+var DefaultCreditWindow = CreditWindow{
+	Objects: 1024,
+	Bytes:   64 * 1024 * BytesInKilobyte,
+}
+
+func (w CreditWindow) empty() bool {
+	return w.Objects == 0 || w.Bytes == 0
+}
+
+// CreditStats is a snapshot of a session's credits, for metrics.
+type CreditStats struct {
+	// Whether both peers agreed on credit-based flow control. The other
+	// fields are zero if not.
+	Enabled bool
+
+	// Credits for objects sent to the peer.
+	Send CreditCounters
+
+	// Credits for objects the peer sends to this side.
+	Receive CreditCounters
+
+	// How many sends had to wait, or failed, for lack of credits.
+	Stalls uint64
+}
+
+// CreditCounters describes the credits in one direction of a session.
+type CreditCounters struct {
+	// Credits the sender has left. Bytes may be negative after an overdraft.
+	Objects, Bytes int64
+
+	// Credits granted since the handshake, the initial window included.
+	GrantedObjects, GrantedBytes uint64
+}
+
+// credits is the flow control state of a session.
+type credits struct {
+	mu      sync.Mutex
+	send    CreditCounters
+	receive CreditCounters
+	stalls  uint64
+
+	// granted is closed and replaced whenever the peer grants credits.
+	granted chan struct{}
+
+	// Credits given back by the application and not yet granted to the peer,
+	// and whether a goroutine is busy granting them.
+	pending  CreditWindow
+	granting bool
+
+	window CreditWindow
+	manual bool
+	fail   bool
+}
+
+func newCredits(a Agreement, cfg SessionConfig) *credits {
+	c := &credits{
+		granted: make(chan struct{}),
+		window:  a.ReceiveWindow,
+		manual:  cfg.ManualCredits,
+		fail:    cfg.FailWithoutCredits,
+	}
+	c.send.grant(a.SendWindow)
+	c.receive.grant(a.ReceiveWindow)
+	return c
+}
+
+func (cc *CreditCounters) grant(w CreditWindow) {
+	cc.Objects += int64(w.Objects)
+	cc.Bytes += int64(w.Bytes)
+	cc.GrantedObjects += uint64(w.Objects)
+	cc.GrantedBytes += uint64(w.Bytes)
+}
+
+// Credits returns a snapshot of the session's credits.
+func (s *Session) Credits() CreditStats {
+	if s.credits == nil {
+		return CreditStats{}
+	}
+
+	c := s.credits
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CreditStats{
+		Enabled: true,
+		Send:    c.send,
+		Receive: c.receive,
+		Stalls:  c.stalls,
+	}
+}
+
+// GrantCredits lets the peer send that many more objects and payload bytes.
+// Sessions configured with ManualCredits rely on it, others grant credits on
+// their own as the application receives objects.
+func (s *Session) GrantCredits(w CreditWindow) error {
+	if s.credits == nil {
+		return errors.New("session: credit-based flow control was not agreed on")
+	}
+
+	s.credits.mu.Lock()
+	s.credits.receive.grant(w)
+	s.credits.mu.Unlock()
+	return s.writeCredit(w)
+}
+
+// acquireCredit pays for an object with a payload of size bytes, waiting for
+// the peer to grant credits if needed.
+func (s *Session) acquireCredit(size int) error {
+	return s.acquire(1, size)
+}
+
+// acquireChunkCredit pays for a chunk of a streamed payload, which only costs
+// byte credits.
+func (s *Session) acquireChunkCredit(size int) error {
+	return s.acquire(0, size)
+}
+
+func (s *Session) acquire(objects int64, size int) error {
+	if s.credits == nil {
+		return nil
+	}
+
+	c := s.credits
+	stalled := false
+	for {
+		c.mu.Lock()
+		if (objects == 0 || c.send.Objects > 0) && c.send.Bytes > 0 {
+			c.send.Objects -= objects
+			c.send.Bytes -= int64(size)
+			c.mu.Unlock()
+			return nil
+		}
+		if !stalled {
+			stalled = true
+			c.stalls++
+		}
+		granted := c.granted
+		c.mu.Unlock()
+
+		if c.fail {
+			return ErrNoCredits
+		}
+		select {
+		case <-granted:
+		case <-s.stopped:
+			return s.err
+		}
+	}
+}
+
+// consumeCredit accounts for an object arriving from the peer.
+func (s *Session) consumeCredit(obj *Object) error {
+	if s.credits == nil {
+		return nil
+	}
+
+	c := s.credits
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.receive.Objects <= 0 {
+		return errors.New("session: peer sent an object without credits")
+	}
+	c.receive.Objects--
+	c.receive.Bytes -= int64(len(obj.Payload))
+	return nil
+}
+
+// consumeChunkCredit accounts for a chunk of a streamed payload arriving from
+// the peer.
+func (s *Session) consumeChunkCredit(size int) {
+	if s.credits == nil {
+		return
+	}
+
+	c := s.credits
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.receive.Bytes -= int64(size)
+}
+
+// replenishCredit gives the credits of an object handed to the application
+// back to the peer. Grants are gathered until half the window is used up, so
+// the peer is not sent a frame per object, and are written on a goroutine of
+// their own so Receive does not hang on a peer that stopped reading.
+func (s *Session) replenishCredit(obj *Object) {
+	s.replenish(1, len(obj.Payload))
+}
+
+// replenishChunkCredit gives the credits of a chunk read by the application,
+// or discarded, back to the peer.
+func (s *Session) replenishChunkCredit(size int) {
+	s.replenish(0, size)
+}
+
+func (s *Session) replenish(objects uint32, size int) {
+	if s.credits == nil || s.credits.manual {
+		return
+	}
+
+	c := s.credits
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending.Objects += objects
+	c.pending.Bytes += uint32(size)
+	if c.granting || !c.grantDue() {
+		return
+	}
+	c.granting = true
+	go s.grantPending()
+}
+
+func (s *Session) grantPending() {
+	c := s.credits
+	for {
+		c.mu.Lock()
+		if !c.grantDue() {
+			c.granting = false
+			c.mu.Unlock()
+			return
+		}
+		w := c.pending
+		c.pending = CreditWindow{}
+		c.receive.grant(w)
+		c.mu.Unlock()
+
+		if err := s.writeCredit(w); err != nil {
+			// The session is going down.
+			return
+		}
+	}
+}
+
+func (c *credits) grantDue() bool {
+	return c.pending.Objects >= max(c.window.Objects/2, 1) ||
+		c.pending.Bytes >= max(c.window.Bytes/2, 1)
+}
+
+func (s *Session) writeCredit(w CreditWindow) error {
+	body := bytes.NewBuffer(make([]byte, 0, 10))
+	writeU8(body, FrameControl)
+	writeU8(body, ctrlCredit)
+	writeU32(body, w.Objects)
+	writeU32(body, w.Bytes)
+	return s.writeFrame(body.Bytes())
+}
+
+func (s *Session) handleCredit(body []byte) error {
+	if s.credits == nil {
+		return errors.New("session: credit grant without agreed flow control")
+	}
+	if len(body) != 8 {
+		return fmt.Errorf("session: malformed credit grant of %d bytes", len(body))
+	}
+	w := CreditWindow{
+		Objects: binary.BigEndian.Uint32(body),
+		Bytes:   binary.BigEndian.Uint32(body[4:]),
+	}
+
+	c := s.credits
+	c.mu.Lock()
+	c.send.grant(w)
+	close(c.granted)
+	c.granted = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,229 @@
+package rhizome
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withWindow returns a config advertising w as its credit window.
+func withWindow(w CreditWindow) SessionConfig {
+	cfg := SessionConfig{Capabilities: DefaultCapabilities()}
+	cfg.Capabilities.CreditWindow = w
+	return cfg
+}
+
+func waitForStalls(t *testing.T, s *Session, want uint64) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Credits().Stalls != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d stalls, want %d", s.Credits().Stalls, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNegotiate_CreditWindow(t *testing.T) {
+	local := DefaultCapabilities()
+	remote := DefaultCapabilities()
+	remote.CreditWindow = CreditWindow{Objects: 7, Bytes: 99}
+
+	a, err := Negotiate(local, remote)
+	if err != nil {
+		t.Fatalf("Negotiate error: %v", err)
+	}
+	if a.SendWindow != remote.CreditWindow || a.ReceiveWindow != local.CreditWindow {
+		t.Fatalf("windows = %+v / %+v", a.SendWindow, a.ReceiveWindow)
+	}
+
+	remote.CreditWindow.Bytes = 0
+	if _, err := Negotiate(local, remote); err == nil {
+		t.Fatalf("expected error for an empty credit window")
+	}
+	remote.Features = 0
+	if _, err := Negotiate(local, remote); err != nil {
+		t.Fatalf("empty window without credits feature: %v", err)
+	}
+}
+
+func TestSession_Credits_SendWaitsForGrant(t *testing.T) {
+	client, server := newSessionPair(t, SessionConfig{}, withWindow(CreditWindow{Objects: 2, Bytes: 1 << 20}))
+
+	sent := make(chan error, 3)
+	go func() {
+		for i := range 3 {
+			sent <- client.Send(newDelivery(string(rune('a'+i)), EncodingNA, nil))
+		}
+	}()
+	for range 2 {
+		if err := <-sent; err != nil {
+			t.Fatalf("Send error: %v", err)
+		}
+	}
+
+	waitForStalls(t, client, 1)
+	select {
+	case err := <-sent:
+		t.Fatalf("third Send returned %v without credits", err)
+	default:
+	}
+
+	// Receiving, not acking, pays the credit back.
+	if _, err := server.Receive(); err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+
+	stats := client.Credits()
+	if !stats.Enabled || stats.Send.GrantedObjects < 3 {
+		t.Fatalf("client credits = %+v", stats)
+	}
+}
+
+func TestSession_Credits_FailWithoutCredits(t *testing.T) {
+	clientCfg := SessionConfig{FailWithoutCredits: true}
+	client, _ := newSessionPair(t, clientCfg, withWindow(CreditWindow{Objects: 1, Bytes: 1 << 20}))
+
+	go func() { _ = client.Send(newDelivery("first", EncodingNA, nil)) }()
+	waitForCredits(t, client, 0)
+
+	if err := client.Send(newDelivery("second", EncodingNA, nil)); !errors.Is(err, ErrNoCredits) {
+		t.Fatalf("Send error = %v, want ErrNoCredits", err)
+	}
+	if client.Credits().Stalls != 1 {
+		t.Fatalf("stalls = %d, want 1", client.Credits().Stalls)
+	}
+}
+
+func TestSession_Credits_Manual(t *testing.T) {
+	serverCfg := withWindow(CreditWindow{Objects: 1, Bytes: 1 << 20})
+	serverCfg.ManualCredits = true
+	client, server := newSessionPair(t, SessionConfig{}, serverCfg)
+
+	sent := make(chan error, 2)
+	go func() {
+		sent <- client.Send(newDelivery("first", EncodingNA, nil))
+		sent <- client.Send(newDelivery("second", EncodingNA, nil))
+	}()
+	if err := <-sent; err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	if _, err := server.Receive(); err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+
+	// Receiving alone grants nothing.
+	waitForStalls(t, client, 1)
+	if err := server.GrantCredits(CreditWindow{Objects: 1, Bytes: 100}); err != nil {
+		t.Fatalf("GrantCredits error: %v", err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+
+	stats := server.Credits()
+	if stats.Receive.GrantedObjects != 2 || stats.Receive.GrantedBytes != 1<<20+100 {
+		t.Fatalf("server credits = %+v", stats)
+	}
+}
+
+func TestSession_Credits_ByteOverdraft(t *testing.T) {
+	client, _ := newSessionPair(t, SessionConfig{}, withWindow(CreditWindow{Objects: 100, Bytes: 10}))
+
+	// One object may overdraw the byte credits.
+	go func() { _ = client.Send(newDelivery("big", EncodingNA, make([]byte, 1000))) }()
+	waitForCredits(t, client, 99)
+	if got := client.Credits().Send.Bytes; got != 10-1000 {
+		t.Fatalf("byte credits = %d, want %d", got, 10-1000)
+	}
+
+	go func() { _ = client.Send(newDelivery("next", EncodingNA, nil)) }()
+	waitForStalls(t, client, 1)
+}
+
+func TestSession_Credits_PeerOverrunClosesSession(t *testing.T) {
+	cfg := withWindow(CreditWindow{Objects: 1, Bytes: 1 << 20})
+	cfg.ManualCredits = true
+	s, peer := newRawPeer(t, cfg, DefaultCapabilities())
+
+	go func() {
+		for _, uid := range []string{"one", "two"} {
+			obj := newDelivery(uid, EncodingNA, nil)
+			obj.Version = ProtocolV2
+			frame, _ := EncodeFrame(obj)
+			_ = WriteFrame(peer, frame)
+		}
+	}()
+
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("session survived a peer without credits")
+	}
+	if obj, err := s.Receive(); err != nil || obj.UID != "one" {
+		t.Fatalf("Receive = %v, %v, want the paid for object", obj, err)
+	}
+	if err := s.Err(); err == nil || !strings.Contains(err.Error(), "credits") {
+		t.Fatalf("Err = %v, want a credits error", err)
+	}
+}
+
+func waitForCredits(t *testing.T, s *Session, objects int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Credits().Send.Objects != objects {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d object credits, want %d", s.Credits().Send.Objects, objects)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSession_Credits_StreamChunksCostByteCredits(t *testing.T) {
+	clientCfg := SessionConfig{ChunkSize: 1000}
+	serverCfg := withWindow(CreditWindow{Objects: 100, Bytes: 4000})
+	// Room for the whole payload, so only credits can hold the sender back.
+	serverCfg.StreamBuffer = 100
+	client, server := newSessionPair(t, clientCfg, serverCfg)
+
+	payload := bytes.Repeat([]byte{'s'}, 20*1000)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- client.SendStream(context.Background(), newDelivery("stream", EncodingNA, nil), bytes.NewReader(payload))
+	}()
+
+	obj, err := server.Receive()
+	if err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	waitForStalls(t, client, 1)
+	if got := client.Credits().Send.Bytes; got > 0 {
+		t.Fatalf("byte credits = %d while stalled", got)
+	}
+	select {
+	case err := <-sent:
+		t.Fatalf("SendStream returned %v without credits", err)
+	default:
+	}
+
+	// Reading the stream pays the chunks back.
+	got, err := io.ReadAll(obj.Stream)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("ReadAll = %d bytes, %v", len(got), err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("SendStream error: %v", err)
+	}
+	if granted := server.Credits().Receive.GrantedBytes; granted < uint64(len(payload)) {
+		t.Fatalf("granted %d bytes for a %d byte stream", granted, len(payload))
+	}
+}
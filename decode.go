@@ -42,6 +42,22 @@ func readStringU8(r io.Reader) (string, error) {
 
 //--------Bytes-----------------------------------------------------------------
 
+// Read bytes up to 255 bytes long.
+func readBytesU8(r io.Reader) ([]byte, error) {
+	n, err := readU8Len(r)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("read bytes: %w", err)
+	}
+	return buf, nil
+}
+
 // Read bytes up to 65535 bytes long.
 func readBytesU16(r io.Reader) ([]byte, error) {
 	n, err := readU16Len(r)
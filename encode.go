@@ -20,6 +20,13 @@ func writeU16(buf *bytes.Buffer, n uint16) {
 	buf.Write(tmp[:])
 }
 
+// writeU32 converts uint32 value n into bytes, inserting it into buf.
+func writeU32(buf *bytes.Buffer, n uint32) {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], n)
+	buf.Write(tmp[:])
+}
+
 //--------String----------------------------------------------------------------
 
 // writeString8 converts uint8 len string s into a byte array.
@@ -33,6 +40,15 @@ func writeString8(buf *bytes.Buffer, s string) error {
 	return nil
 }
 
+// appendString8 appends s to dst behind its u8 length.
+func appendString8(dst []byte, s string) ([]byte, error) {
+	if len(s) > 255 {
+		return dst, fmt.Errorf("string too long for u8 prefix: %d", len(s))
+	}
+	dst = append(dst, uint8(len(s)))
+	return append(dst, s...), nil
+}
+
 //--------Field Prefixes--------------------------------------------------------
 
 // WriteU16Len prefixes with total length (u16 big-endian).
@@ -0,0 +1,230 @@
+package rhizome
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// -----------------------------------------------------------------------------
+// Slice decoding.
+// -----------------------------------------------------------------------------
+// DecodeFrame reads every field through an io.Reader, allocating a copy of each
+// string and of the payload. DecodeInto parses the same v1 and v2 objects
+// straight from the frame into an Object the caller may reuse:
+//
+//   - Strings equal to the ones already held by the object are kept, so objects
+//     decoded over and over for the same UIDs and arguments do not allocate
+//     them again.
+//   - The payload is copied into the capacity the object already has, or with
+//     AliasPayload set, not copied at all.
+//   - The Response the object already has is reused.
+//
+// ObjectPool hands out objects to decode into and takes them back once the
+// application is done with them.
+// -----------------------------------------------------------------------------
+
+// DecodeOptions tunes DecodeInto.
+type DecodeOptions struct {
+	// AliasPayload makes Payload share memory with the frame instead of being
+	// copied out of it. The frame must then not be modified or reused for as
+	// long as the object is in use. Compressed payloads are inflated into a
+	// buffer of their own either way.
+	AliasPayload bool
+
+	// The largest payload, in bytes, a compressed frame may inflate to.
+	// Defaults to MaxDecompressedSize.
+	MaxDecompressedSize int
+}
+
+// DecodeInto decodes frame into obj, replacing every field obj had, and
+// returns obj's fields to zero values it does not find in the frame. resp
+// becomes the object's responder.
+//
+// obj is left in an undefined state if an error is returned.
+func DecodeInto(obj *Object, frame []byte, resp *ConnResponder, opts DecodeOptions) error {
+	if len(frame) == 0 {
+		return fmt.Errorf("read protocol version: %v", io.ErrUnexpectedEOF)
+	}
+
+	switch frame[0] {
+	case ProtocolV1, ProtocolV2:
+	case FrameBatch:
+		return errors.New(
+			"batch frames hold several objects, decode them with DecodeBatch",
+		)
+	default:
+		return fmt.Errorf("unsupported protocol version: %d", frame[0])
+	}
+
+	obj.checkReleased()
+	response := obj.Response
+	if response == nil {
+		response = &Response{}
+	}
+	payload := obj.Payload[:0]
+	if obj.payloadAliased {
+		payload = nil
+	}
+
+	*obj = Object{
+		Version:   frame[0],
+		Responder: resp,
+		Response:  response,
+		UID:       obj.UID,
+		Arg1:      obj.Arg1,
+		Arg2:      obj.Arg2,
+		Arg3:      obj.Arg3,
+		Arg4:      obj.Arg4,
+		pool:      obj.pool,
+	}
+
+	r := sliceReader{b: frame[1:]}
+	var flags uint8
+	if obj.Version == ProtocolV2 {
+		flags = r.u8("flags")
+		if flags&^knownFlagsV2 != 0 {
+			return fmt.Errorf("unknown v2 flags: %08b", flags&^knownFlagsV2)
+		}
+	}
+
+	obj.ObjType = r.u8("ObjType")
+	obj.CmdType = r.u8("CmdType")
+	obj.AckPlcy = r.u8("AckPolicy")
+	r.string8(&obj.UID, "UID")
+	r.string8(&obj.Arg1, "argument 1")
+	r.string8(&obj.Arg2, "argument 2")
+	r.string8(&obj.Arg3, "argument 3")
+	r.string8(&obj.Arg4, "argument 4")
+	obj.PayloadEncoding = PayloadEncoding(r.u8("payload encoding"))
+	if r.err != nil {
+		return r.err
+	}
+	if obj.UID == "" {
+		return errors.New("empty UID field from message")
+	}
+
+	var n, size uint32
+	if obj.Version == ProtocolV1 {
+		n = uint32(r.u16("payload length"))
+	} else {
+		if flags&FlagFragment != 0 {
+			obj.FragIndex = r.u16("fragment index")
+			obj.FragCount = r.u16("fragment count")
+			if r.err == nil && obj.FragIndex >= obj.FragCount {
+				return fmt.Errorf(
+					"fragment index %d out of range for count %d",
+					obj.FragIndex, obj.FragCount,
+				)
+			}
+		}
+		if flags&FlagCompressed != 0 {
+			obj.Compression = Compression(r.u8("compression algorithm"))
+			size = r.u32("decompressed length")
+			limit := opts.MaxDecompressedSize
+			if limit <= 0 {
+				limit = MaxDecompressedSize
+			}
+			if uint64(size) > uint64(limit) {
+				return fmt.Errorf(
+					"declared decompressed length %d exceeds %d byte limit",
+					size, limit,
+				)
+			}
+		}
+		n = r.u32("payload length")
+		if flags&FlagCompressed == 0 && n > maxPayloadSize {
+			return errors.New("declared length exceeds 64KB safety limit")
+		}
+	}
+	raw := r.take(int(n), "payload")
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.b) != 0 {
+		return errors.New("unaccounted data in reader")
+	}
+
+	switch {
+	case flags&FlagCompressed != 0:
+		inflated, err := decompress(obj.Compression, raw, int(size))
+		if err != nil {
+			return err
+		}
+		obj.Payload = inflated
+	case n == 0:
+		// Matches DecodeFrame, which leaves an empty payload nil.
+	case opts.AliasPayload:
+		obj.Payload = raw[:n:n]
+		obj.payloadAliased = true
+	default:
+		obj.Payload = append(payload, raw...)
+	}
+
+	if flags&FlagStream != 0 {
+		if len(obj.Payload) != 0 {
+			return errors.New("streamed object carries an inline payload")
+		}
+		obj.streamed = true
+	}
+
+	*response = Response{UID: obj.UID, Ack: AckUnknown}
+	return nil
+}
+
+// sliceReader reads big-endian fields off the front of a byte slice. The first
+// short read sticks in err and every read after it returns zero values.
+type sliceReader struct {
+	b   []byte
+	err error
+}
+
+func (r *sliceReader) take(n int, field string) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = fmt.Errorf(
+			"unable to parse %s field from message: %w", field, io.ErrUnexpectedEOF,
+		)
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *sliceReader) u8(field string) uint8 {
+	if b := r.take(1, field); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *sliceReader) u16(field string) uint16 {
+	if b := r.take(2, field); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *sliceReader) u32(field string) uint32 {
+	if b := r.take(4, field); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// string8 reads a u8 length prefixed string into dst, keeping the string dst
+// already holds if it is the same.
+func (r *sliceReader) string8(dst *string, field string) {
+	n := r.u8(field)
+	b := r.take(int(n), field)
+	if r.err != nil {
+		return
+	}
+	if string(b) != *dst {
+		*dst = string(b)
+	}
+}
@@ -0,0 +1,214 @@
+package rhizome
+
+import (
+	"testing"
+)
+
+func newDecodeFrames(t testing.TB) map[string][]byte {
+	t.Helper()
+
+	compressed := newAppendObject(ProtocolV2)
+	compressed.Compression = CompressionGzip
+	fragment := newAppendObject(ProtocolV2)
+	fragment.FragIndex, fragment.FragCount = 2, 3
+	streamed := newAppendObject(ProtocolV2)
+	streamed.Payload = nil
+	streamed.streamed = true
+	empty := newAppendObject(ProtocolV1)
+	empty.Payload = nil
+
+	frames := map[string][]byte{}
+	for name, obj := range map[string]*Object{
+		"v1":         newAppendObject(ProtocolV1),
+		"v2":         newAppendObject(ProtocolV2),
+		"compressed": compressed,
+		"fragment":   fragment,
+		"streamed":   streamed,
+		"empty":      empty,
+	} {
+		frame, err := EncodeFrame(obj)
+		if err != nil {
+			t.Fatalf("%s: EncodeFrame error: %v", name, err)
+		}
+		frames[name] = frame
+	}
+	return frames
+}
+
+func TestDecodeInto_MatchesDecodeFrame(t *testing.T) {
+	resp := newResponder()
+	for name, frame := range newDecodeFrames(t) {
+		want, err := DecodeFrame(frame, resp)
+		if err != nil {
+			t.Fatalf("%s: DecodeFrame error: %v", name, err)
+		}
+
+		for _, alias := range []bool{false, true} {
+			got := &Object{}
+			if err := DecodeInto(got, frame, resp, DecodeOptions{AliasPayload: alias}); err != nil {
+				t.Fatalf("%s: DecodeInto error: %v", name, err)
+			}
+			assertObjectsEqual(t, want, got)
+			if got.Responder != resp || *got.Response != *want.Response ||
+				got.Streamed() != want.Streamed() ||
+				(got.Payload == nil) != (want.Payload == nil) {
+				t.Fatalf("%s: DecodeInto = %+v, want %+v", name, got, want)
+			}
+		}
+	}
+}
+
+func TestDecodeInto_Malformed(t *testing.T) {
+	for name, frame := range newDecodeFrames(t) {
+		for i := range len(frame) {
+			if err := DecodeInto(&Object{}, frame[:i], nil, DecodeOptions{}); err == nil {
+				t.Fatalf("%s: expected error for frame truncated to %d bytes", name, i)
+			}
+		}
+		if err := DecodeInto(&Object{}, append(frame, 0), nil, DecodeOptions{}); err == nil {
+			t.Fatalf("%s: expected error for trailing data", name)
+		}
+	}
+
+	batch, err := EncodeBatch(newBatchObjects(2))
+	if err != nil {
+		t.Fatalf("EncodeBatch error: %v", err)
+	}
+	if err := DecodeInto(&Object{}, batch, nil, DecodeOptions{}); err == nil {
+		t.Fatalf("expected DecodeInto to refuse a batch frame")
+	}
+}
+
+func TestDecodeInto_AliasPayload(t *testing.T) {
+	frame := newDecodeFrames(t)["v1"]
+
+	copied, aliased := &Object{}, &Object{}
+	if err := DecodeInto(copied, frame, nil, DecodeOptions{}); err != nil {
+		t.Fatalf("DecodeInto error: %v", err)
+	}
+	if err := DecodeInto(aliased, frame, nil, DecodeOptions{AliasPayload: true}); err != nil {
+		t.Fatalf("DecodeInto error: %v", err)
+	}
+
+	frame[len(frame)-1] = '!'
+	if aliased.Payload[len(aliased.Payload)-1] != '!' {
+		t.Fatalf("aliased payload does not share the frame's memory")
+	}
+	if copied.Payload[len(copied.Payload)-1] == '!' {
+		t.Fatalf("copied payload shares the frame's memory")
+	}
+
+	// Appending to an aliased payload must not write into the frame.
+	if cap(aliased.Payload) != len(aliased.Payload) {
+		t.Fatalf("aliased payload has spare capacity into the frame")
+	}
+}
+
+func TestDecodeInto_ReusedObjectKeepsNothingStale(t *testing.T) {
+	frames := newDecodeFrames(t)
+	obj := &Object{}
+	if err := DecodeInto(obj, frames["fragment"], newResponder(), DecodeOptions{AliasPayload: true}); err != nil {
+		t.Fatalf("DecodeInto error: %v", err)
+	}
+	if err := DecodeInto(obj, frames["empty"], nil, DecodeOptions{}); err != nil {
+		t.Fatalf("DecodeInto error: %v", err)
+	}
+
+	want, err := DecodeFrame(frames["empty"], newResponder())
+	if err != nil {
+		t.Fatalf("DecodeFrame error: %v", err)
+	}
+	assertObjectsEqual(t, want, obj)
+	if obj.Responder != nil || obj.payloadAliased || obj.Payload != nil {
+		t.Fatalf("reused object kept state from its previous frame: %+v", obj)
+	}
+}
+
+func TestDecodeInto_ReuseDoesNotAllocate(t *testing.T) {
+	frame := newDecodeFrames(t)["v1"]
+	resp := newResponder()
+	obj := &Object{}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := DecodeInto(obj, frame, resp, DecodeOptions{}); err != nil {
+			t.Fatalf("DecodeInto error: %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("DecodeInto made %v allocations decoding into a reused object", allocs)
+	}
+}
+
+//--------Benchmarks------------------------------------------------------------
+
+func BenchmarkDecodeFrame_V1(b *testing.B) {
+	frame := newDecodeFrames(b)["v1"]
+	resp := newResponder()
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := DecodeFrame(frame, resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeInto_V1(b *testing.B) {
+	frame := newDecodeFrames(b)["v1"]
+	resp := newResponder()
+	obj := &Object{}
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := DecodeInto(obj, frame, resp, DecodeOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeInto_V1_AliasPayload(b *testing.B) {
+	frame := newDecodeFrames(b)["v1"]
+	resp := newResponder()
+	obj := &Object{}
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := DecodeInto(obj, frame, resp, DecodeOptions{AliasPayload: true}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkObjectPool_Decode_V1(b *testing.B) {
+	var pool ObjectPool
+	frame := newDecodeFrames(b)["v1"]
+	resp := newResponder()
+	b.ReportAllocs()
+	for b.Loop() {
+		obj, err := pool.Decode(frame, resp, DecodeOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		pool.Put(obj)
+	}
+}
+
+func BenchmarkDecodeFrame_V2(b *testing.B) {
+	frame := newDecodeFrames(b)["v2"]
+	resp := newResponder()
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := DecodeFrame(frame, resp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeInto_V2(b *testing.B) {
+	frame := newDecodeFrames(b)["v2"]
+	resp := newResponder()
+	obj := &Object{}
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := DecodeInto(obj, frame, resp, DecodeOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package rhizome
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Fragmentation and reassembly of payloads larger than a single frame.
+// -----------------------------------------------------------------------------
+// A large Object is split into fragments that share its UID and header fields,
+// each carrying a slice of the payload along with its index and the total
+// fragment count (see the fragment sub-header in two.go). The receiver buffers
+// fragments per UID until all of them arrived and hands the application one
+// reassembled Object, which is also the only one that gets acknowledged.
+// -----------------------------------------------------------------------------
+
+// Fragment splits obj into fragments carrying at most size payload bytes each.
+// Objects whose payload already fits are returned unsplit.
+//
+// Fragments share obj's payload memory, and always use protocol version 2 or
+// later since v1 has no fragment header.
+func Fragment(obj *Object, size int) ([]*Object, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("fragment %s: invalid fragment size %d", obj.UID, size)
+	}
+	if len(obj.Payload) <= size {
+		return []*Object{obj}, nil
+	}
+
+	count := (len(obj.Payload) + size - 1) / size
+	if count > math.MaxUint16 {
+		return nil, fmt.Errorf(
+			"fragment %s: payload of %d bytes needs %d fragments, limit is %d",
+			obj.UID, len(obj.Payload), count, math.MaxUint16,
+		)
+	}
+
+	fragments := make([]*Object, 0, count)
+	for i := range count {
+		frag := *obj
+		frag.Version = max(obj.Version, ProtocolV2)
+		frag.Response = &Response{UID: obj.UID, Ack: AckUnknown}
+		frag.FragIndex = uint16(i)
+		frag.FragCount = uint16(count)
+		frag.Payload = obj.Payload[i*size : min((i+1)*size, len(obj.Payload))]
+		fragments = append(fragments, &frag)
+	}
+	return fragments, nil
+}
+
+//--------Reassembly------------------------------------------------------------
+
+// ReassemblyConfig bounds the time and memory a Reassembler may spend on
+// partially received objects.
+type ReassemblyConfig struct {
+	// How long after its first fragment an object may stay incomplete.
+	// Defaults to 30 seconds.
+	Timeout time.Duration
+
+	// The largest payload, in bytes, a single reassembled object may have.
+	// Defaults to MaxDecompressedSize.
+	MaxObjectSize int
+
+	// The most bytes held across all incomplete objects, counting their
+	// payloads and a slot for every fragment they expect.
+	// Defaults to 4 times MaxObjectSize.
+	MaxBufferedBytes int
+}
+
+// fragSlotSize is what an incomplete object costs per fragment it expects
+// before any arrived, the slice header holding its part.
+const fragSlotSize = 24
+
+// partialObject collects the fragments received so far for one UID.
+type partialObject struct {
+	parts    [][]byte
+	received int
+	size     int
+	slots    int
+	started  time.Time
+}
+
+// Reassembler rebuilds fragmented objects. It is safe for concurrent use.
+type Reassembler struct {
+	cfg ReassemblyConfig
+
+	mu       sync.Mutex
+	partial  map[string]*partialObject
+	buffered int
+
+	now func() time.Time
+}
+
+func NewReassembler(cfg ReassemblyConfig) *Reassembler {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	if cfg.MaxObjectSize <= 0 {
+		cfg.MaxObjectSize = MaxDecompressedSize
+	}
+	if cfg.MaxBufferedBytes <= 0 {
+		cfg.MaxBufferedBytes = 4 * cfg.MaxObjectSize
+	}
+
+	return &Reassembler{
+		cfg:     cfg,
+		partial: make(map[string]*partialObject),
+		now:     time.Now,
+	}
+}
+
+// Add takes a decoded object and returns the complete object once its last
+// fragment has arrived, or nil while fragments are still missing.
+// Objects that are not fragments are returned as is.
+//
+// The reassembled object carries the responder of its last fragment. On error
+// every fragment buffered for that UID is discarded.
+func (ra *Reassembler) Add(obj *Object) (*Object, error) {
+	if obj.FragCount == 0 {
+		return obj, nil
+	}
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	ra.expireLocked()
+
+	p, ok := ra.partial[obj.UID]
+	if !ok {
+		// The fragment count is the peer's word, so its slots are accounted
+		// for before they are allocated.
+		slots := int(obj.FragCount) * fragSlotSize
+		if ra.buffered+slots+len(obj.Payload) > ra.cfg.MaxBufferedBytes {
+			return nil, fmt.Errorf(
+				"reassemble %s: buffered fragments exceed %d byte limit",
+				obj.UID, ra.cfg.MaxBufferedBytes,
+			)
+		}
+		p = &partialObject{
+			parts:   make([][]byte, obj.FragCount),
+			slots:   slots,
+			started: ra.now(),
+		}
+		ra.partial[obj.UID] = p
+		ra.buffered += slots
+	}
+
+	switch {
+	case int(obj.FragCount) != len(p.parts):
+		ra.dropLocked(obj.UID)
+		return nil, fmt.Errorf(
+			"reassemble %s: fragment count changed from %d to %d",
+			obj.UID, len(p.parts), obj.FragCount,
+		)
+	case int(obj.FragIndex) >= len(p.parts):
+		ra.dropLocked(obj.UID)
+		return nil, fmt.Errorf(
+			"reassemble %s: fragment index %d out of range for count %d",
+			obj.UID, obj.FragIndex, obj.FragCount,
+		)
+	case p.parts[obj.FragIndex] != nil:
+		ra.dropLocked(obj.UID)
+		return nil, fmt.Errorf(
+			"reassemble %s: duplicate fragment %d", obj.UID, obj.FragIndex,
+		)
+	case p.size+len(obj.Payload) > ra.cfg.MaxObjectSize:
+		ra.dropLocked(obj.UID)
+		return nil, fmt.Errorf(
+			"reassemble %s: payload exceeds %d byte limit",
+			obj.UID, ra.cfg.MaxObjectSize,
+		)
+	case ra.buffered+len(obj.Payload) > ra.cfg.MaxBufferedBytes:
+		ra.dropLocked(obj.UID)
+		return nil, fmt.Errorf(
+			"reassemble %s: buffered fragments exceed %d byte limit",
+			obj.UID, ra.cfg.MaxBufferedBytes,
+		)
+	}
+
+	// A fragment without payload still has to be marked as received.
+	part := obj.Payload
+	if part == nil {
+		part = []byte{}
+	}
+	p.parts[obj.FragIndex] = part
+	p.received++
+	p.size += len(part)
+	ra.buffered += len(part)
+
+	if p.received < len(p.parts) {
+		return nil, nil
+	}
+
+	ra.dropLocked(obj.UID)
+
+	payload := make([]byte, 0, p.size)
+	for _, part := range p.parts {
+		payload = append(payload, part...)
+	}
+
+	whole := *obj
+	whole.FragIndex = 0
+	whole.FragCount = 0
+	whole.Payload = payload
+	whole.Response = &Response{UID: obj.UID, Ack: AckUnknown}
+	return &whole, nil
+}
+
+// Expire discards incomplete objects older than the configured timeout and
+// returns their UIDs. Add also expires stale objects as it goes, but objects
+// nobody adds to are only discarded by Expire, so callers outside a Session
+// should call it periodically.
+func (ra *Reassembler) Expire() []string {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	return ra.expireLocked()
+}
+
+// Pending returns the number of incomplete objects being buffered.
+func (ra *Reassembler) Pending() int {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	return len(ra.partial)
+}
+
+// Buffered returns the number of bytes held for incomplete objects, counted
+// as for MaxBufferedBytes.
+func (ra *Reassembler) Buffered() int {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	return ra.buffered
+}
+
+func (ra *Reassembler) expireLocked() []string {
+	var expired []string
+	deadline := ra.now().Add(-ra.cfg.Timeout)
+	for uid, p := range ra.partial {
+		if p.started.Before(deadline) {
+			expired = append(expired, uid)
+			ra.dropLocked(uid)
+		}
+	}
+	return expired
+}
+
+func (ra *Reassembler) dropLocked(uid string) {
+	if p, ok := ra.partial[uid]; ok {
+		ra.buffered -= p.size + p.slots
+		delete(ra.partial, uid)
+	}
+}
+
+// fragmentSize returns how many payload bytes fit in one frame of obj when
+// frames may not exceed maxFrame bytes.
+func fragmentSize(obj *Object, maxFrame uint32, want int) (int, error) {
+	// Version, flags, three header bytes, five u8 lengths, encoding, fragment
+	// and compression sub-headers, and the u32 payload length.
+	overhead := 1 + 1 + 3 + 5 + 1 + 4 + 5 + 4
+	overhead += len(obj.UID) + len(obj.Arg1) + len(obj.Arg2) +
+		len(obj.Arg3) + len(obj.Arg4)
+
+	room := int(min(uint64(maxFrame), math.MaxInt32)) - overhead
+	if room <= 0 {
+		return 0, errors.New("max frame size leaves no room for payload")
+	}
+	return min(want, maxPayloadSize, room), nil
+}
@@ -0,0 +1,259 @@
+package rhizome
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+// patterned returns size bytes that differ from their neighbours, so a payload
+// put back together out of order does not compare equal.
+func patterned(size int) []byte {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	return payload
+}
+
+// roundTripFragments encodes and decodes each fragment as a receiver would see
+// it.
+func roundTripFragments(t *testing.T, frags []*Object) []*Object {
+	t.Helper()
+	out := make([]*Object, 0, len(frags))
+	for _, f := range frags {
+		frame, err := EncodeFrame(f)
+		if err != nil {
+			t.Fatalf("EncodeFrame error: %v", err)
+		}
+		decoded, err := DecodeFrame(frame, newResponder())
+		if err != nil {
+			t.Fatalf("DecodeFrame error: %v", err)
+		}
+		out = append(out, decoded)
+	}
+	return out
+}
+
+func TestFragment_SplitsAndReassembles(t *testing.T) {
+	obj := newDelivery("uid-big", EncodingNA, patterned(3*maxPayloadSize+10))
+	obj.Version = ProtocolV2
+
+	frags, err := Fragment(obj, maxPayloadSize)
+	if err != nil {
+		t.Fatalf("Fragment error: %v", err)
+	}
+	if len(frags) != 4 {
+		t.Fatalf("got %d fragments, want 4", len(frags))
+	}
+	for i, f := range frags {
+		if f.UID != obj.UID || int(f.FragIndex) != i || f.FragCount != 4 {
+			t.Fatalf("fragment %d header = %s %d/%d", i, f.UID, f.FragIndex, f.FragCount)
+		}
+	}
+
+	decoded := roundTripFragments(t, frags)
+
+	ra := NewReassembler(ReassemblyConfig{})
+	// Deliver out of order.
+	order := []int{2, 0, 3, 1}
+	var whole *Object
+	for n, i := range order {
+		got, err := ra.Add(decoded[i])
+		if err != nil {
+			t.Fatalf("Add error: %v", err)
+		}
+		if n < len(order)-1 && got != nil {
+			t.Fatalf("object returned before all fragments arrived")
+		}
+		whole = got
+	}
+
+	if whole == nil {
+		t.Fatalf("no object returned after the last fragment")
+	}
+	assertObjectsEqual(t, obj, whole)
+	if whole.FragCount != 0 || whole.Response.UID != obj.UID {
+		t.Fatalf("reassembled object still looks like a fragment")
+	}
+	if ra.Pending() != 0 || ra.Buffered() != 0 {
+		t.Fatalf("reassembler still holds %d objects / %d bytes", ra.Pending(), ra.Buffered())
+	}
+}
+
+func TestFragment_SmallPayloadIsNotSplit(t *testing.T) {
+	obj := newDelivery("uid-small", EncodingNA, make([]byte, 100))
+	frags, err := Fragment(obj, 1000)
+	if err != nil {
+		t.Fatalf("Fragment error: %v", err)
+	}
+	if len(frags) != 1 || frags[0] != obj {
+		t.Fatalf("small payload was split")
+	}
+
+	ra := NewReassembler(ReassemblyConfig{})
+	got, err := ra.Add(obj)
+	if err != nil || got != obj {
+		t.Fatalf("Add of a whole object = %v, %v", got, err)
+	}
+}
+
+func TestFragment_Rejections(t *testing.T) {
+	if _, err := Fragment(newDelivery("uid", EncodingNA, make([]byte, 10)), 0); err == nil {
+		t.Fatalf("expected error for zero fragment size")
+	}
+	if _, err := Fragment(newDelivery("uid", EncodingNA, make([]byte, 1<<17)), 1); err == nil {
+		t.Fatalf("expected error for more than 65535 fragments")
+	}
+}
+
+func TestFragment_RespondWithAckRefusesFragments(t *testing.T) {
+	frags, _ := Fragment(newDelivery("uid", EncodingNA, make([]byte, 10)), 4)
+	frags[0].Responder = newResponder()
+	if err := frags[0].RespondWithAck(AckSent); err == nil {
+		t.Fatalf("expected error acknowledging a single fragment")
+	}
+}
+
+func TestReassembler_Limits(t *testing.T) {
+	frags, _ := Fragment(newDelivery("uid-1", EncodingNA, make([]byte, 300)), 100)
+
+	ra := NewReassembler(ReassemblyConfig{MaxObjectSize: 250})
+	_, _ = ra.Add(frags[0])
+	_, _ = ra.Add(frags[1])
+	if _, err := ra.Add(frags[2]); err == nil {
+		t.Fatalf("expected error for object over MaxObjectSize")
+	}
+	if ra.Pending() != 0 || ra.Buffered() != 0 {
+		t.Fatalf("failed object was not discarded")
+	}
+
+	// Each object holds its first 100 byte fragment and slots for 3.
+	held := 100 + 3*fragSlotSize
+	other, _ := Fragment(newDelivery("uid-2", EncodingNA, make([]byte, 300)), 100)
+	ra = NewReassembler(ReassemblyConfig{MaxBufferedBytes: 2*held - 1})
+	_, _ = ra.Add(frags[0])
+	if _, err := ra.Add(other[0]); err == nil {
+		t.Fatalf("expected error for buffered bytes over MaxBufferedBytes")
+	}
+	if ra.Pending() != 1 || ra.Buffered() != held {
+		t.Fatalf("other objects should be kept: pending=%d buffered=%d", ra.Pending(), ra.Buffered())
+	}
+}
+
+func TestReassembler_EmptyFirstFragmentsCountTowardLimit(t *testing.T) {
+	ra := NewReassembler(ReassemblyConfig{})
+	perObject := math.MaxUint16 * fragSlotSize
+	fits := 4 * MaxDecompressedSize / perObject
+
+	rejected := 0
+	for i := range 10 * fits {
+		frag := newDelivery("uid-"+strconv.Itoa(i), EncodingNA, nil)
+		frag.FragCount = math.MaxUint16
+		if _, err := ra.Add(frag); err != nil {
+			rejected++
+		}
+	}
+
+	if ra.Pending() != fits || rejected != 9*fits {
+		t.Fatalf("pending=%d rejected=%d, want %d pending", ra.Pending(), rejected, fits)
+	}
+	if ra.Buffered() != fits*perObject {
+		t.Fatalf("buffered=%d, want %d", ra.Buffered(), fits*perObject)
+	}
+}
+
+func TestReassembler_RejectsInconsistentFragments(t *testing.T) {
+	frags, _ := Fragment(newDelivery("uid", EncodingNA, make([]byte, 300)), 100)
+
+	ra := NewReassembler(ReassemblyConfig{})
+	_, _ = ra.Add(frags[0])
+	if _, err := ra.Add(frags[0]); err == nil {
+		t.Fatalf("expected error for duplicate fragment")
+	}
+
+	_, _ = ra.Add(frags[0])
+	changed := *frags[1]
+	changed.FragCount = 5
+	if _, err := ra.Add(&changed); err == nil {
+		t.Fatalf("expected error for changed fragment count")
+	}
+}
+
+func TestReassembler_Timeout(t *testing.T) {
+	frags, _ := Fragment(newDelivery("uid-slow", EncodingNA, make([]byte, 300)), 100)
+
+	now := time.Unix(1000, 0)
+	ra := NewReassembler(ReassemblyConfig{Timeout: time.Second})
+	ra.now = func() time.Time { return now }
+
+	_, _ = ra.Add(frags[0])
+	now = now.Add(2 * time.Second)
+
+	expired := ra.Expire()
+	if len(expired) != 1 || expired[0] != "uid-slow" {
+		t.Fatalf("Expire() = %v, want [uid-slow]", expired)
+	}
+
+	// Late fragments start a fresh object that never completes.
+	_, _ = ra.Add(frags[1])
+	got, err := ra.Add(frags[2])
+	if err != nil || got != nil {
+		t.Fatalf("late fragments completed an expired object: %v, %v", got, err)
+	}
+}
+
+func TestSession_ExpiresAbandonedFragmentsWhileIdle(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		client, server := newSessionPair(t,
+			SessionConfig{},
+			SessionConfig{Reassembly: ReassemblyConfig{Timeout: time.Second}},
+		)
+
+		frags, _ := Fragment(newDelivery("uid-abandoned", EncodingNA, make([]byte, 300)), 100)
+		frame, err := client.agreement.EncodeFrame(frags[0])
+		if err != nil {
+			t.Fatalf("EncodeFrame error: %v", err)
+		}
+		if err := client.writeFrame(frame); err != nil {
+			t.Fatalf("writeFrame error: %v", err)
+		}
+		synctest.Wait()
+		if server.reassembler.Pending() != 1 {
+			t.Fatalf("pending = %d, want 1", server.reassembler.Pending())
+		}
+
+		time.Sleep(2 * time.Second)
+		synctest.Wait()
+		if server.reassembler.Pending() != 0 || server.reassembler.Buffered() != 0 {
+			t.Fatalf("idle session kept pending=%d buffered=%d",
+				server.reassembler.Pending(), server.reassembler.Buffered())
+		}
+	})
+}
+
+func TestSession_FragmentsLargePayloads(t *testing.T) {
+	cfg := SessionConfig{FragmentSize: 1000}
+	client, server := newSessionPair(t, cfg, cfg)
+
+	obj := newDelivery("uid-session", EncodingNA, patterned(10*1000+1))
+	go func() { _ = client.Send(obj) }()
+
+	got, err := server.Receive()
+	if err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	if !bytes.Equal(got.Payload, obj.Payload) {
+		t.Fatalf("reassembled payload differs")
+	}
+
+	// Only the whole object is acknowledged.
+	go func() { _ = got.RespondWithAck(AckSent) }()
+	resp, err := client.ReceiveResponse()
+	if err != nil || resp.UID != obj.UID {
+		t.Fatalf("ReceiveResponse = %+v, %v", resp, err)
+	}
+}
@@ -0,0 +1,69 @@
+package rhizome
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// -----------------------------------------------------------------------------
+// Transport framing.
+// -----------------------------------------------------------------------------
+// Encoded objects do not carry their own length, so on a byte stream every
+// frame is prefixed with the u32 len field shown at the top of the v1 header in
+// one.go.
+
+// +---------+-----------------------------------+
+// | u32 len | u8 version or frame kind | body   |
+// +---------+-----------------------------------+
+
+// The first byte of the frame tells the reader how to handle the rest of it,
+// see the frame kinds in globals.go.
+// -----------------------------------------------------------------------------
+
+// WriteFrame writes frame to w behind a u32 big-endian length prefix.
+// The prefix and frame go out in a single Write call so writers that hold their
+// own lock never interleave partial frames.
+func WriteFrame(w io.Writer, frame []byte) error {
+	if len(frame) == 0 {
+		return errors.New("write frame: empty frame")
+	}
+	if uint64(len(frame)) > math.MaxUint32 {
+		return fmt.Errorf("write frame: frame too large: %d bytes", len(frame))
+	}
+
+	buf := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	copy(buf[4:], frame)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads a single length prefixed frame from r.
+// Frames declaring more than limit bytes are rejected before any of the body is
+// read. A clean end of stream between frames is returned as io.EOF.
+func ReadFrame(r io.Reader, limit uint32) ([]byte, error) {
+	var tmp [4]byte
+	if _, err := io.ReadFull(r, tmp[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(tmp[:])
+	if n == 0 {
+		return nil, errors.New("read frame: empty frame")
+	}
+	if n > limit {
+		return nil, fmt.Errorf(
+			"read frame: declared length %d exceeds %d byte limit", n, limit,
+		)
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("read frame body: %w", err)
+	}
+	return buf, nil
+}
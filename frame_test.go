@@ -0,0 +1,65 @@
+package rhizome
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestWriteFrame_ReadFrame_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	frames := [][]byte{
+		{ProtocolV1, 1, 2, 3},
+		bytes.Repeat([]byte{0xCD}, 300),
+	}
+	for _, f := range frames {
+		if err := WriteFrame(&buf, f); err != nil {
+			t.Fatalf("WriteFrame error: %v", err)
+		}
+	}
+
+	for i, want := range frames {
+		got, err := ReadFrame(&buf, DefaultMaxFrameSize)
+		if err != nil {
+			t.Fatalf("ReadFrame[%d] error: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("ReadFrame[%d] = %v, want %v", i, got, want)
+		}
+	}
+
+	if _, err := ReadFrame(&buf, DefaultMaxFrameSize); err != io.EOF {
+		t.Fatalf("ReadFrame at end of stream = %v, want io.EOF", err)
+	}
+}
+
+func TestWriteFrame_RejectsEmptyFrame(t *testing.T) {
+	if err := WriteFrame(io.Discard, nil); err == nil {
+		t.Fatalf("WriteFrame(nil) expected error, got nil")
+	}
+}
+
+func TestReadFrame_RejectsOversizedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	_ = WriteFrame(&buf, make([]byte, 64))
+
+	if _, err := ReadFrame(&buf, 63); err == nil {
+		t.Fatalf("ReadFrame expected limit error, got nil")
+	}
+}
+
+func TestReadFrame_RejectsEmptyFrame(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{0, 0, 0, 0})
+	if _, err := ReadFrame(buf, DefaultMaxFrameSize); err == nil {
+		t.Fatalf("ReadFrame expected error for zero length, got nil")
+	}
+}
+
+func TestReadFrame_TruncatedBody(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{0, 0, 0, 5, 1, 2})
+	_, err := ReadFrame(buf, DefaultMaxFrameSize)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("ReadFrame error = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
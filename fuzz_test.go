@@ -0,0 +1,158 @@
+package rhizome
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// -----------------------------------------------------------------------------
+// Fuzz targets.
+// -----------------------------------------------------------------------------
+// The seed corpus lives in testdata/fuzz and runs with every go test. Fuzz a
+// target with:
+//
+//	go test -run '^$' -fuzz '^FuzzDecodeFrame$' -fuzztime 1m
+//
+// Crashers found this way belong in testdata/fuzz too, and get a regression
+// test below once fixed.
+// -----------------------------------------------------------------------------
+
+// FuzzDecodeFrame decodes untrusted frames. Decoding may fail but never panic,
+// DecodeInto must agree with DecodeFrame, and whatever decodes must survive a
+// round-trip.
+func FuzzDecodeFrame(f *testing.F) {
+	for _, frame := range newDecodeFrames(f) {
+		f.Add(frame)
+	}
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		// No responder, as a malformed frame must not need one to be reported.
+		obj, err := DecodeFrame(frame, nil)
+
+		into := &Object{}
+		intoErr := DecodeInto(into, frame, nil, DecodeOptions{})
+		if (err == nil) != (intoErr == nil) {
+			t.Fatalf("DecodeFrame error %v, DecodeInto error %v", err, intoErr)
+		}
+		if err != nil {
+			return
+		}
+		assertObjectsEqual(t, obj, into)
+
+		encoded, err := EncodeFrame(obj)
+		if err != nil {
+			t.Fatalf("EncodeFrame of decoded object error: %v", err)
+		}
+		// v1 has one encoding per object, v2 may compress differently.
+		if obj.Version == ProtocolV1 && !bytes.Equal(encoded, frame) {
+			t.Fatalf("re-encoded frame %x, want %x", encoded, frame)
+		}
+		again, err := DecodeFrame(encoded, nil)
+		if err != nil {
+			t.Fatalf("DecodeFrame of re-encoded frame error: %v", err)
+		}
+		assertObjectsEqual(t, obj, again)
+		if again.FragIndex != obj.FragIndex || again.FragCount != obj.FragCount ||
+			again.Streamed() != obj.Streamed() {
+			t.Fatalf("re-decoded %+v, want %+v", again, obj)
+		}
+	})
+}
+
+// FuzzDecodeResponseV1 decodes untrusted responses, which must re-encode to
+// the bytes they were decoded from.
+func FuzzDecodeResponseV1(f *testing.F) {
+	f.Add(EncodeResponseV1(Response{UID: "uid-1", Ack: AckSent}))
+	f.Add(EncodeResponseV1(Response{UID: strings.Repeat("u", 255), Ack: AckUnknown}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		response, n, err := DecodeResponseV1(data)
+		if err != nil {
+			return
+		}
+		if n > len(data) {
+			t.Fatalf("consumed %d of %d bytes", n, len(data))
+		}
+		if encoded := EncodeResponseV1(response); !bytes.Equal(encoded, data[:n]) {
+			t.Fatalf("re-encoded response %x, want %x", encoded, data[:n])
+		}
+	})
+}
+
+// FuzzRoundTrip encodes arbitrary objects, which must either fail to encode
+// because a field is empty or too long, or decode back to an equal object.
+func FuzzRoundTrip(f *testing.F) {
+	long := strings.Repeat("a", 255)
+	f.Add(ProtocolV1, ObjDelivery, CmdSend, AckPlcyOnsent,
+		"uid", "topic", "", "", "", uint8(EncodingJson), []byte(`{"n":1}`), false)
+	f.Add(ProtocolV2, ObjDelivery, CmdSend, AckPlcyOnsent,
+		long, long, long, long, long, uint8(EncodingNA), []byte{}, false)
+	f.Add(ProtocolV1, ObjDelivery, CmdSend, AckPlcyNoreply,
+		"uid", "", "", "", "", uint8(EncodingNA), bytes.Repeat([]byte{0xFF}, 1024), false)
+	f.Add(ProtocolV2, ObjDelivery, CmdSend, AckPlcyNoreply,
+		"uid", "", "", "", "", uint8(EncodingCsv), bytes.Repeat([]byte("1,2\n"), 1024), true)
+
+	f.Fuzz(func(t *testing.T,
+		version, objType, cmdType, ackPlcy uint8,
+		uid, arg1, arg2, arg3, arg4 string,
+		encoding uint8, payload []byte, compress bool,
+	) {
+		obj := NewObject(
+			objType, cmdType, ackPlcy, uid, arg1, arg2, arg3, arg4,
+			PayloadEncoding(encoding), payload,
+		)
+		obj.Version = ProtocolV1 + version%2
+		if compress {
+			obj.Compression = CompressionGzip
+		}
+
+		invalid := uid == ""
+		for _, s := range [...]string{uid, arg1, arg2, arg3, arg4} {
+			invalid = invalid || len(s) > 255
+		}
+		// Only v2 compression may shrink a large payload enough to fit.
+		large := len(payload) > maxPayloadSize
+		mayFit := obj.Version == ProtocolV2 && compress
+
+		frame, err := EncodeFrame(obj)
+		if invalid || large && !mayFit {
+			if err == nil {
+				t.Fatalf("EncodeFrame accepted an object it cannot carry")
+			}
+			return
+		}
+		if err != nil {
+			// A large payload may not compress well enough after all.
+			if large {
+				return
+			}
+			t.Fatalf("EncodeFrame error: %v", err)
+		}
+
+		got, err := DecodeFrame(frame, nil)
+		if err != nil {
+			t.Fatalf("DecodeFrame error: %v", err)
+		}
+		assertObjectsEqual(t, obj, got)
+	})
+}
+
+// -----------------------------------------------------------------------------
+// Regression tests.
+// -----------------------------------------------------------------------------
+
+// Decoding errors name the sender, which used to panic without a responder.
+func TestDecodeFrame_MalformedWithoutResponder(t *testing.T) {
+	frame, err := EncodeFrame(newAppendObject(ProtocolV1))
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+
+	// Every truncation fails somewhere else in the decoder.
+	for n := range len(frame) {
+		if _, err := DecodeFrame(frame[:n], nil); err == nil {
+			t.Fatalf("DecodeFrame of %d of %d bytes succeeded", n, len(frame))
+		}
+	}
+}
@@ -6,19 +6,53 @@ const (
 	BytesInKilobyte = 1024
 )
 
+// -------Frames----------------------------------------------------------------
+
+// DefaultMaxFrameSize is the largest frame a peer will read unless a smaller
+// limit is agreed on during the handshake.
+const DefaultMaxFrameSize uint32 = 1024 * BytesInKilobyte
+
+// The first byte of every frame is either the protocol version of an encoded
+// Object or one of the reserved frame kinds below.
+// Versions count upwards from 1 and reserved kinds count downwards from 255.
+const (
+	FrameMux      uint8 = 0xFB
+	FrameBatch    uint8 = 0xFC
+	FrameChunk    uint8 = 0xFD
+	FrameResponse uint8 = 0xFE
+	FrameControl  uint8 = 0xFF
+)
+
 // -------Objects---------------------------------------------------------------
 
 const (
 	ProtocolV1 = uint8(1)
+	ProtocolV2 = uint8(2)
+
+	// ProtocolLatest is the highest object protocol version this package can
+	// encode and decode.
+	ProtocolLatest = ProtocolV2
 )
 
+// Object and command types. The broker commands are the combinations of
+// ObjDelivery, ObjTransformer, ObjSubscriber and ObjChannel with CmdSend,
+// CmdAdd and CmdRemove, see package broker for their reference behaviour.
 const (
 	ObjUnknown uint8 = 0
 
-	ObjDelivery    uint8 = 1
+	// ObjDelivery is a message producers send to a route, for the broker to
+	// hand to subscribers.
+	ObjDelivery uint8 = 1
+
+	// ObjTransformer is a transformation a channel applies to deliveries
+	// before they reach its subscribers.
 	ObjTransformer uint8 = 2
-	ObjSubscriber  uint8 = 3
-	ObjChannel     uint8 = 4
+
+	// ObjSubscriber is a connection receiving the deliveries of a channel.
+	ObjSubscriber uint8 = 3
+
+	// ObjChannel is a named channel on a route.
+	ObjChannel uint8 = 4
 
 	ObjGlobals uint8 = 20
 
@@ -61,7 +95,13 @@ const (
 	// the timeout time elapsed.
 	AckTimeout uint8 = 10
 
-	AckChannelNotFound      uint8 = 20
+	// AckChannelNotFound means the route has no channel of the name given.
+	AckChannelNotFound uint8 = 20
+
+	// AckChannelAlreadyExists means the route already has a channel of the
+	// name given.
 	AckChannelAlreadyExists uint8 = 21
-	AckRouteNotFound        uint8 = 30
+
+	// AckRouteNotFound means there is no channel on the route given.
+	AckRouteNotFound uint8 = 30
 )
@@ -0,0 +1,113 @@
+package rhizome
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Heartbeats.
+// -----------------------------------------------------------------------------
+// A dead peer is otherwise only noticed once a write to it fails, which may
+// take long or never happen on an idle connection. A session with a heartbeat
+// interval pings its peer every interval, and the peer answers with a pong
+// carrying the same sequence number. Any frame from the peer counts as a sign
+// of life, so pings only make a difference on idle connections. While the read
+// loop waits for the application to take what it read, the peer's frames are
+// left unread and no heartbeats are missed.
+
+// # Ping and pong control frames
+// +-----------------+-------------+--------------+
+// | u8 FrameControl | u8 ctrl ID  | u64 sequence |
+// +-----------------+-------------+--------------+
+
+// Peers only ping each other if both advertised FeatureHeartbeat. Heartbeats
+// are handled by the session and never reach the application.
+// -----------------------------------------------------------------------------
+
+const (
+	ctrlPing uint8 = 3
+	ctrlPong uint8 = 4
+)
+
+// ErrHeartbeatTimeout is the reason a session closes after its peer missed
+// too many heartbeats.
+var ErrHeartbeatTimeout = errors.New("session: peer missed too many heartbeats")
+
+// heartbeatLoop pings the peer every interval and closes the session once
+// missedHeartbeats intervals passed without a single frame from the peer, not
+// counting intervals the read loop spent stalled on the application.
+func (s *Session) heartbeatLoop() {
+	ticker := time.NewTicker(s.heartbeat)
+	defer ticker.Stop()
+
+	var seq, seen uint64
+	missed := 0
+	for {
+		s.sendHeartbeat(ctrlPing, seq, &s.pinging)
+		seq++
+
+		select {
+		case <-ticker.C:
+		case <-s.stopped:
+			return
+		}
+
+		if n := s.framesRead.Load(); n != seen || s.stalled.Load() {
+			seen = n
+			missed = 0
+		} else {
+			missed++
+		}
+		if missed >= s.missedHeartbeats {
+			_ = s.closeWith(ErrHeartbeatTimeout)
+			return
+		}
+	}
+}
+
+// stall marks the read loop as waiting on the application until the returned
+// func is called.
+func (s *Session) stall() (resume func()) {
+	s.stalled.Store(true)
+	return func() { s.stalled.Store(false) }
+}
+
+// sendHeartbeat writes a ping or pong without blocking the caller. A write to
+// a peer that stopped reading may hang, so only one of each kind is in flight
+// at a time.
+func (s *Session) sendHeartbeat(id uint8, seq uint64, inFlight *atomic.Bool) {
+	if !inFlight.CompareAndSwap(false, true) {
+		return
+	}
+
+	body := bytes.NewBuffer(make([]byte, 0, 10))
+	writeU8(body, FrameControl)
+	writeU8(body, id)
+	_ = binary.Write(body, binary.BigEndian, seq)
+
+	go func() {
+		defer inFlight.Store(false)
+		_ = s.writeFrame(body.Bytes())
+	}()
+}
+
+func (s *Session) handlePing(body []byte) error {
+	if len(body) != 8 {
+		return fmt.Errorf("session: malformed ping of %d bytes", len(body))
+	}
+	s.sendHeartbeat(ctrlPong, binary.BigEndian.Uint64(body), &s.ponging)
+	return nil
+}
+
+func (s *Session) handlePong(body []byte) error {
+	if len(body) != 8 {
+		return fmt.Errorf("session: malformed pong of %d bytes", len(body))
+	}
+	// Reading the frame was the point.
+	return nil
+}
@@ -0,0 +1,175 @@
+package rhizome
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newRawPeer handshakes with a session over a pipe and returns the raw end,
+// which does nothing unless the test makes it.
+func newRawPeer(t *testing.T, cfg SessionConfig, peerCaps Capabilities) (*Session, net.Conn) {
+	t.Helper()
+
+	c, p := net.Pipe()
+	t.Cleanup(func() {
+		c.Close()
+		p.Close()
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := Handshake(p, peerCaps)
+		done <- err
+	}()
+	s, err := NewSession(c, cfg)
+	if err != nil {
+		t.Fatalf("NewSession error: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("peer Handshake error: %v", err)
+	}
+	return s, p
+}
+
+func TestSession_Heartbeat_KeepsIdleSessionAlive(t *testing.T) {
+	cfg := SessionConfig{HeartbeatInterval: 5 * time.Millisecond, MissedHeartbeats: 2}
+	client, server := newSessionPair(t, cfg, cfg)
+
+	time.Sleep(100 * time.Millisecond)
+	if err := client.Err(); err != nil {
+		t.Fatalf("client stopped while idle: %v", err)
+	}
+	if err := server.Err(); err != nil {
+		t.Fatalf("server stopped while idle: %v", err)
+	}
+
+	// Pings and pongs never reach the application.
+	obj := NewObject(
+		ObjDelivery, CmdSend, AckPlcyNoreply,
+		"uid-after-idle", "", "", "", "",
+		EncodingNA, nil,
+	)
+	go func() { _ = client.Send(obj) }()
+	got, err := server.Receive()
+	if err != nil || got.UID != obj.UID {
+		t.Fatalf("Receive = %v, %v", got, err)
+	}
+}
+
+func TestSession_Heartbeat_ClosesOnSilentPeer(t *testing.T) {
+	closed := make(chan error, 1)
+	cfg := SessionConfig{
+		HeartbeatInterval: 5 * time.Millisecond,
+		MissedHeartbeats:  3,
+		OnClose:           func(err error) { closed <- err },
+	}
+	s, _ := newRawPeer(t, cfg, DefaultCapabilities())
+
+	select {
+	case err := <-closed:
+		if !errors.Is(err, ErrHeartbeatTimeout) {
+			t.Fatalf("OnClose error = %v, want ErrHeartbeatTimeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("session outlived a silent peer")
+	}
+
+	select {
+	case <-s.Done():
+	default:
+		t.Fatalf("Done not closed after OnClose")
+	}
+	if _, err := s.Receive(); !errors.Is(err, ErrHeartbeatTimeout) {
+		t.Fatalf("Receive error = %v, want ErrHeartbeatTimeout", err)
+	}
+	if _, err := s.ReceiveResponse(); !errors.Is(err, ErrHeartbeatTimeout) {
+		t.Fatalf("ReceiveResponse error = %v, want ErrHeartbeatTimeout", err)
+	}
+}
+
+func TestSession_Heartbeat_SurvivesReceiverThatStopsReading(t *testing.T) {
+	// Without credits nothing holds the sender back, so the receiving session
+	// fills its queue and stops reading from the connection.
+	caps := DefaultCapabilities()
+	caps.Features &^= FeatureCredits
+	cfg := SessionConfig{
+		Capabilities:      caps,
+		HeartbeatInterval: 5 * time.Millisecond,
+		MissedHeartbeats:  2,
+	}
+	client, server := newSessionPair(t, cfg, cfg)
+
+	const n = 100
+	sent := make(chan error, 1)
+	go func() {
+		for i := range n {
+			obj := NewObject(
+				ObjDelivery, CmdSend, AckPlcyNoreply,
+				"uid-"+strconv.Itoa(i), "", "", "", "",
+				EncodingNA, nil,
+			)
+			if err := client.Send(obj); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- nil
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := server.Err(); err != nil {
+		t.Fatalf("server stopped while the application was not reading: %v", err)
+	}
+
+	for i := range n {
+		obj, err := server.Receive()
+		if err != nil {
+			t.Fatalf("Receive %d error: %v", i, err)
+		}
+		if want := "uid-" + strconv.Itoa(i); obj.UID != want {
+			t.Fatalf("Receive %d = %s, want %s", i, obj.UID, want)
+		}
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+}
+
+func TestSession_Heartbeat_NotSentToPeersWithoutSupport(t *testing.T) {
+	caps := DefaultCapabilities()
+	caps.Features = 0
+	cfg := SessionConfig{HeartbeatInterval: 5 * time.Millisecond, MissedHeartbeats: 1}
+	s, peer := newRawPeer(t, cfg, caps)
+
+	frames := make(chan []byte, 1)
+	go func() {
+		if frame, err := ReadFrame(peer, DefaultMaxFrameSize); err == nil {
+			frames <- frame
+		}
+	}()
+
+	select {
+	case frame := <-frames:
+		t.Fatalf("peer without heartbeat support got frame %v", frame)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("session stopped: %v", err)
+	}
+}
+
+func TestSession_OnClose_PeerHangsUp(t *testing.T) {
+	closed := make(chan error, 1)
+	client, _ := newSessionPair(t, SessionConfig{}, SessionConfig{
+		OnClose: func(err error) { closed <- err },
+	})
+
+	_ = client.Close()
+	if err := <-closed; err != io.EOF {
+		t.Fatalf("OnClose error = %v, want io.EOF", err)
+	}
+}
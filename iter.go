@@ -0,0 +1,186 @@
+package rhizome
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+)
+
+// -----------------------------------------------------------------------------
+// Iterators.
+// -----------------------------------------------------------------------------
+// Frames, Responses and Captures let consumers range over what arrives on a
+// connection or is stored in a file:
+//
+//	for obj, err := range rhizome.Frames(conn) {
+//		if err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// Iteration ends quietly at a clean end of input. Errors reading the input end
+// it after being yielded, as the position of the next frame is then unknown.
+// Errors decoding a frame that was read intact also end it by default, or are
+// skipped past with ContinueOnError.
+// -----------------------------------------------------------------------------
+
+// IterOption configures Frames, Responses and Captures.
+type IterOption func(*iterConfig)
+
+type iterConfig struct {
+	maxFrameSize    uint32
+	responder       *ConnResponder
+	continueOnError bool
+}
+
+func newIterConfig(opts []IterOption) iterConfig {
+	cfg := iterConfig{maxFrameSize: DefaultMaxFrameSize}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithMaxFrameSize rejects frames larger than n bytes. Defaults to
+// DefaultMaxFrameSize.
+func WithMaxFrameSize(n uint32) IterOption {
+	return func(cfg *iterConfig) {
+		cfg.maxFrameSize = n
+	}
+}
+
+// WithResponder gives decoded objects resp as their responder, so they can be
+// acked. Objects are decoded without one otherwise.
+func WithResponder(resp *ConnResponder) IterOption {
+	return func(cfg *iterConfig) {
+		cfg.responder = resp
+	}
+}
+
+// ContinueOnError keeps iterating after a frame fails to decode, yielding its
+// error in place of the frame.
+func ContinueOnError() IterOption {
+	return func(cfg *iterConfig) {
+		cfg.continueOnError = true
+	}
+}
+
+// Frames iterates over the objects in the length prefixed frames read from r,
+// see ReadFrame. Object batches yield each of their objects in turn.
+func Frames(r io.Reader, opts ...IterOption) iter.Seq2[*Object, error] {
+	cfg := newIterConfig(opts)
+
+	return func(yield func(*Object, error) bool) {
+		for {
+			frame, err := ReadFrame(r, cfg.maxFrameSize)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			objs, err := decodeObjects(frame, cfg.responder)
+			if err != nil {
+				if !yield(nil, err) || !cfg.continueOnError {
+					return
+				}
+				continue
+			}
+			for _, obj := range objs {
+				if !yield(obj, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// decodeObjects decodes an object frame or object batch frame.
+func decodeObjects(frame []byte, resp *ConnResponder) ([]*Object, error) {
+	if frame[0] == FrameBatch {
+		return DecodeBatch(frame, resp)
+	}
+	obj, err := DecodeFrame(frame, resp)
+	if err != nil {
+		return nil, err
+	}
+	return []*Object{obj}, nil
+}
+
+// Responses iterates over the responses read from r, as written by a
+// ConnResponder that is not part of a session.
+func Responses(r io.Reader, opts ...IterOption) iter.Seq2[Response, error] {
+	cfg := newIterConfig(opts)
+
+	return func(yield func(Response, error) bool) {
+		var prefix [2]byte
+		for {
+			if _, err := io.ReadFull(r, prefix[:]); err != nil {
+				if err != io.EOF {
+					yield(Response{}, err)
+				}
+				return
+			}
+
+			buf := make([]byte, 2+binary.BigEndian.Uint16(prefix[:]))
+			copy(buf, prefix[:])
+			if _, err := io.ReadFull(r, buf[2:]); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				yield(Response{}, fmt.Errorf("read response: %w", err))
+				return
+			}
+
+			response, _, err := DecodeResponseV1(buf)
+			if err != nil {
+				if !yield(Response{}, err) || !cfg.continueOnError {
+					return
+				}
+				continue
+			}
+			if !yield(response, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Captures iterates over the records of a capture file written by a
+// CaptureWriter. The header is checked before the first record.
+func Captures(r io.Reader, opts ...IterOption) iter.Seq2[CaptureRecord, error] {
+	cfg := newIterConfig(opts)
+
+	return func(yield func(CaptureRecord, error) bool) {
+		if err := readCaptureHeader(r); err != nil {
+			yield(CaptureRecord{}, err)
+			return
+		}
+
+		for {
+			rec, err := readCaptureRecord(r, cfg.maxFrameSize)
+			if err == io.EOF {
+				return
+			}
+			var malformed *malformedRecordError
+			if errors.As(err, &malformed) && cfg.continueOnError {
+				if !yield(CaptureRecord{}, err) {
+					return
+				}
+				continue
+			}
+			if err != nil {
+				yield(CaptureRecord{}, err)
+				return
+			}
+			if !yield(rec, nil) {
+				return
+			}
+		}
+	}
+}
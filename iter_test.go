@@ -0,0 +1,188 @@
+package rhizome
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// framedStream writes frames behind their length prefixes.
+func framedStream(t *testing.T, frames ...[]byte) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for _, frame := range frames {
+		if err := WriteFrame(&buf, frame); err != nil {
+			t.Fatalf("WriteFrame error: %v", err)
+		}
+	}
+	return &buf
+}
+
+// brokenFrame is an intact frame holding an object without UID.
+var brokenFrame = []byte{ProtocolV1, ObjDelivery, CmdSend, AckPlcyNoreply, 0, 0, 0, 0, 0, 0, 0, 0}
+
+func TestFrames(t *testing.T) {
+	objs := newBatchObjects(3)
+	single, err := EncodeFrame(objs[0])
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+	batch, err := EncodeBatch(objs[1:])
+	if err != nil {
+		t.Fatalf("EncodeBatch error: %v", err)
+	}
+
+	resp := newResponder()
+	var got []*Object
+	for obj, err := range Frames(framedStream(t, single, batch), WithResponder(resp)) {
+		if err != nil {
+			t.Fatalf("Frames error: %v", err)
+		}
+		got = append(got, obj)
+	}
+	if len(got) != len(objs) {
+		t.Fatalf("got %d objects, want %d", len(got), len(objs))
+	}
+	for i := range objs {
+		assertObjectsEqual(t, objs[i], got[i])
+		if got[i].Responder != resp {
+			t.Fatalf("object %d lacks the responder", i)
+		}
+	}
+}
+
+func TestFrames_DecodeErrors(t *testing.T) {
+	good, err := EncodeFrame(newBatchObjects(1)[0])
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+
+	// Objects decoded without a responder must not panic on errors.
+	var uids, errs []string
+	for obj, err := range Frames(framedStream(t, brokenFrame, good)) {
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		uids = append(uids, obj.UID)
+	}
+	if len(errs) != 1 || len(uids) != 0 {
+		t.Fatalf("got objects %v and errors %v, want to stop at the first error", uids, errs)
+	}
+
+	uids, errs = nil, nil
+	for obj, err := range Frames(framedStream(t, brokenFrame, good), ContinueOnError()) {
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		uids = append(uids, obj.UID)
+	}
+	if len(errs) != 1 || len(uids) != 1 || uids[0] != "uid-0" {
+		t.Fatalf("got objects %v and errors %v, want to carry on past the error", uids, errs)
+	}
+	if !strings.Contains(errs[0], "unknown sender") {
+		t.Fatalf("error %q does not say the sender is unknown", errs[0])
+	}
+}
+
+func TestFrames_TruncatedStream(t *testing.T) {
+	good, err := EncodeFrame(newBatchObjects(1)[0])
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+	stream := framedStream(t, good, good)
+	stream.Truncate(stream.Len() - 3)
+
+	var n int
+	var last error
+	for _, err := range Frames(stream, ContinueOnError()) {
+		n++
+		last = err
+	}
+	if n != 2 || !errors.Is(last, io.ErrUnexpectedEOF) {
+		t.Fatalf("got %d results ending in %v, want an object and io.ErrUnexpectedEOF", n, last)
+	}
+}
+
+func TestFrames_Break(t *testing.T) {
+	frame, err := EncodeBatch(newBatchObjects(5))
+	if err != nil {
+		t.Fatalf("EncodeBatch error: %v", err)
+	}
+
+	n := 0
+	for range Frames(framedStream(t, frame)) {
+		n++
+		if n == 2 {
+			break
+		}
+	}
+	if n != 2 {
+		t.Fatalf("iterated %d times after break", n)
+	}
+}
+
+func TestResponses(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(EncodeResponseV1(Response{UID: "a", Ack: AckSent}))
+	stream.Write([]byte{0, 1, 7}) // a body too short to hold a response
+	stream.Write(EncodeResponseV1(Response{UID: "b", Ack: AckRouteNotFound}))
+
+	var got []Response
+	var errs int
+	for resp, err := range Responses(bytes.NewReader(stream.Bytes()), ContinueOnError()) {
+		if err != nil {
+			errs++
+			continue
+		}
+		got = append(got, resp)
+	}
+	if errs != 1 || len(got) != 2 || got[0].UID != "a" || got[1].Ack != AckRouteNotFound {
+		t.Fatalf("got %v with %d errors", got, errs)
+	}
+
+	got = nil
+	for resp, err := range Responses(bytes.NewReader(stream.Bytes())) {
+		if err != nil {
+			break
+		}
+		got = append(got, resp)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d responses before the error, want 1", len(got))
+	}
+}
+
+func TestResponses_FromConnResponder(t *testing.T) {
+	var buf bytes.Buffer
+	obj := newBatchObjects(1)[0]
+	obj.Responder = NewConnResponder(&bufferConn{fakeConn: newFakeConn("1.2.3.4:5"), buf: &buf})
+	for _, ack := range []uint8{AckSent, AckRouteNotFound} {
+		if err := obj.RespondWithAck(ack); err != nil {
+			t.Fatalf("RespondWithAck error: %v", err)
+		}
+	}
+
+	var acks []uint8
+	for resp, err := range Responses(&buf) {
+		if err != nil {
+			t.Fatalf("Responses error: %v", err)
+		}
+		acks = append(acks, resp.Ack)
+	}
+	if len(acks) != 2 || acks[0] != AckSent || acks[1] != AckRouteNotFound {
+		t.Fatalf("got acks %v", acks)
+	}
+}
+
+// bufferConn is a fakeConn writing to a buffer the test reads from.
+type bufferConn struct {
+	*fakeConn
+	buf *bytes.Buffer
+}
+
+func (c *bufferConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
@@ -0,0 +1,708 @@
+package rhizome
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Multiplexing logical streams over a single connection.
+// -----------------------------------------------------------------------------
+// A Mux carries any number of independent byte streams over one net.Conn. Each
+// MuxStream is a net.Conn of its own, so anything that runs over a connection,
+// a Session or a ConnResponder, runs over a stream just the same.
+//
+// Streams opened by the client side of the mux have odd IDs and streams opened
+// by the server side even IDs, so both sides may open streams without
+// coordinating. IDs are never reused.
+
+// # Mux frame
+// +-------------+---------+---------------+----------------------+
+// | u8 FrameMux | u8 type | u32 stream ID | body (rest of frame) |
+// +-------------+---------+---------------+----------------------+
+
+// Open, fin and reset frames have no body. Data frames carry stream bytes and
+// window frames a u32 increment of the receiver's window.
+//
+// Flow control is per stream: a sender may only have as many unread bytes in
+// flight as the receiver's window allows, which starts at muxInitialWindow and
+// grows as the receiver reads. A stream whose reader falls behind therefore
+// stalls its own writer without holding up the other streams.
+// -----------------------------------------------------------------------------
+
+// Mux frame types, the byte following FrameMux.
+const (
+	muxOpen   uint8 = 1
+	muxData   uint8 = 2
+	muxWindow uint8 = 3
+	muxFin    uint8 = 4
+	muxReset  uint8 = 5
+)
+
+const (
+	muxHeaderSize = 1 + 1 + 4
+
+	// muxInitialWindow is the window every stream starts out with, before the
+	// receiver announces a larger one.
+	muxInitialWindow uint32 = 256 * BytesInKilobyte
+
+	// muxChunkSize is the most data a single data frame carries.
+	muxChunkSize = 32 * BytesInKilobyte
+)
+
+var (
+	// ErrMuxClosed is returned by mux and stream methods after Close was
+	// called.
+	ErrMuxClosed = errors.New("mux closed")
+
+	// ErrMuxStreamReset is returned by MuxStream methods after the peer reset
+	// the stream, or closed it while there was still data to send.
+	ErrMuxStreamReset = errors.New("mux stream reset by peer")
+)
+
+// MuxConfig controls the streams of a Mux.
+type MuxConfig struct {
+	// How many unread bytes the peer may send on each stream.
+	// Defaults to, and can not be lower than, 256KB.
+	Window uint32
+
+	// How many streams opened by the peer may wait for AcceptStream. Streams
+	// beyond that are refused. Defaults to 64.
+	AcceptBacklog int
+
+	// The largest frame the mux reads. Defaults to DefaultMaxFrameSize.
+	MaxFrameSize uint32
+}
+
+// Mux multiplexes logical streams over a net.Conn. It implements
+// net.Listener, accepting the streams opened by the peer.
+type Mux struct {
+	conn net.Conn
+	cfg  MuxConfig
+
+	wmu sync.Mutex
+
+	mu         sync.Mutex
+	streams    map[uint32]*MuxStream
+	nextID     uint32
+	lastRemote uint32
+	remoteOdd  bool
+
+	accept chan *MuxStream
+
+	// done is closed by Close, stopped once the read loop has exited, at
+	// which point err holds the reason.
+	done      chan struct{}
+	closeOnce sync.Once
+	stopped   chan struct{}
+	err       error
+}
+
+// NewClientMux starts a Mux over conn for the side that dialed it.
+// The other side should use NewServerMux.
+func NewClientMux(conn net.Conn, cfg MuxConfig) *Mux {
+	return newMux(conn, cfg, 1)
+}
+
+// NewServerMux starts a Mux over conn for the side that accepted it.
+func NewServerMux(conn net.Conn, cfg MuxConfig) *Mux {
+	return newMux(conn, cfg, 2)
+}
+
+func newMux(conn net.Conn, cfg MuxConfig, firstID uint32) *Mux {
+	cfg.Window = max(cfg.Window, muxInitialWindow)
+	if cfg.AcceptBacklog <= 0 {
+		cfg.AcceptBacklog = 64
+	}
+	if cfg.MaxFrameSize == 0 {
+		cfg.MaxFrameSize = DefaultMaxFrameSize
+	}
+
+	m := &Mux{
+		conn:      conn,
+		cfg:       cfg,
+		streams:   make(map[uint32]*MuxStream),
+		nextID:    firstID,
+		remoteOdd: firstID%2 == 0,
+		accept:    make(chan *MuxStream, cfg.AcceptBacklog),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go m.readLoop()
+	return m
+}
+
+// OpenStream opens a new stream to the peer. The peer learns about it right
+// away, and may read what is written before it accepted the stream.
+func (m *Mux) OpenStream() (*MuxStream, error) {
+	select {
+	case <-m.stopped:
+		return nil, m.err
+	default:
+	}
+
+	m.mu.Lock()
+	if m.nextID > math.MaxUint32-2 {
+		m.mu.Unlock()
+		return nil, errors.New("mux: stream IDs exhausted")
+	}
+	st := m.newStream(m.nextID)
+	m.nextID += 2
+	m.streams[st.id] = st
+	m.mu.Unlock()
+
+	if err := m.writeMux(muxOpen, st.id, nil); err != nil {
+		m.forget(st.id)
+		return nil, err
+	}
+	if err := st.announceWindow(); err != nil {
+		m.forget(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for the next stream opened by the peer.
+func (m *Mux) AcceptStream() (*MuxStream, error) {
+	select {
+	case st := <-m.accept:
+		return st, nil
+	case <-m.stopped:
+		return nil, m.err
+	}
+}
+
+// Accept implements net.Listener by calling AcceptStream.
+func (m *Mux) Accept() (net.Conn, error) {
+	st, err := m.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Addr returns the local address of the underlying connection.
+func (m *Mux) Addr() net.Addr {
+	return m.conn.LocalAddr()
+}
+
+// NumStreams returns the number of streams that are still open.
+func (m *Mux) NumStreams() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.streams)
+}
+
+// Close closes the mux and its connection, failing every open stream.
+func (m *Mux) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		err = m.conn.Close()
+	})
+	return err
+}
+
+func (m *Mux) newStream(id uint32) *MuxStream {
+	st := &MuxStream{
+		m:          m,
+		id:         id,
+		recvWindow: m.cfg.Window,
+		sendWindow: muxInitialWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+	st.responder = NewConnResponder(st)
+	return st
+}
+
+func (m *Mux) forget(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.streams, id)
+}
+
+func (m *Mux) writeMux(typ uint8, id uint32, body []byte) error {
+	frame := make([]byte, muxHeaderSize, muxHeaderSize+len(body))
+	frame[0] = FrameMux
+	frame[1] = typ
+	binary.BigEndian.PutUint32(frame[2:], id)
+	frame = append(frame, body...)
+
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	if err := WriteFrame(m.conn, frame); err != nil {
+		select {
+		case <-m.done:
+			return ErrMuxClosed
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+//--------Read Loop-------------------------------------------------------------
+
+func (m *Mux) readLoop() {
+	err := m.readFrames()
+
+	select {
+	case <-m.done:
+		err = ErrMuxClosed
+	default:
+	}
+	m.err = err
+	_ = m.conn.Close()
+
+	// Streams cut short by the connection must not look like they ended.
+	streamErr := err
+	if streamErr == io.EOF {
+		streamErr = io.ErrUnexpectedEOF
+	}
+	m.mu.Lock()
+	for id, st := range m.streams {
+		st.fail(streamErr)
+		delete(m.streams, id)
+	}
+	m.mu.Unlock()
+
+	close(m.stopped)
+}
+
+// readFrames dispatches frames until the connection fails or the peer breaks
+// the protocol.
+func (m *Mux) readFrames() error {
+	for {
+		frame, err := ReadFrame(m.conn, m.cfg.MaxFrameSize)
+		if err != nil {
+			return err
+		}
+		if len(frame) < muxHeaderSize || frame[0] != FrameMux {
+			return errors.New("mux: malformed frame")
+		}
+
+		typ := frame[1]
+		id := binary.BigEndian.Uint32(frame[2:])
+		body := frame[muxHeaderSize:]
+
+		if typ == muxOpen {
+			if err := m.handleOpen(id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		m.mu.Lock()
+		st := m.streams[id]
+		m.mu.Unlock()
+		if st == nil {
+			// Closed or reset on this side, the peer has not caught up yet.
+			continue
+		}
+
+		switch typ {
+		case muxData:
+			err = st.receive(body)
+		case muxWindow:
+			err = st.grow(body)
+		case muxFin:
+			st.remoteFin()
+		case muxReset:
+			st.remoteReset()
+		default:
+			err = fmt.Errorf("mux: unknown frame type %d", typ)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (m *Mux) handleOpen(id uint32) error {
+	m.mu.Lock()
+	if (id%2 == 1) != m.remoteOdd || id <= m.lastRemote {
+		m.mu.Unlock()
+		return fmt.Errorf("mux: peer opened invalid stream ID %d", id)
+	}
+	m.lastRemote = id
+	st := m.newStream(id)
+	m.streams[id] = st
+	m.mu.Unlock()
+
+	select {
+	case m.accept <- st:
+	default:
+		m.forget(id)
+		return m.writeMux(muxReset, id, nil)
+	}
+	return st.announceWindow()
+}
+
+//--------Streams---------------------------------------------------------------
+
+// MuxStream is a logical stream of a Mux. It is a net.Conn of its own.
+type MuxStream struct {
+	m   *Mux
+	id  uint32
+	wmu sync.Mutex // keeps the chunks of one Write together
+
+	mu   sync.Mutex
+	buf  []byte
+	err  error // the mux failed
+	read uint32
+
+	// recvWindow is how much more the peer may send, sendWindow how much more
+	// this side may.
+	recvWindow uint32
+	sendWindow uint32
+
+	finSent     bool
+	finReceived bool
+	closed      bool
+	reset       bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readable chan struct{}
+	writable chan struct{}
+
+	responder *ConnResponder
+}
+
+// ID returns the stream's ID, unique within its Mux.
+func (st *MuxStream) ID() uint32 {
+	return st.id
+}
+
+// Responder returns the ConnResponder of the stream. Acks written through it
+// reach the peer on this stream only.
+func (st *MuxStream) Responder() *ConnResponder {
+	return st.responder
+}
+
+// Read reads stream data, blocking until some arrives. It returns io.EOF once
+// the peer closed its side of the stream and everything sent before was read.
+func (st *MuxStream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return 0, io.ErrClosedPipe
+
+		case len(st.buf) > 0:
+			n := copy(p, st.buf)
+			st.buf = st.buf[n:]
+
+			// Give the window back once half of it has been read.
+			st.read += uint32(n)
+			var grant uint32
+			if st.read >= st.m.cfg.Window/2 && !st.finReceived && !st.reset {
+				grant, st.read = st.read, 0
+				st.recvWindow += grant
+			}
+			st.mu.Unlock()
+
+			if grant > 0 {
+				_ = st.m.writeMux(muxWindow, st.id, binary.BigEndian.AppendUint32(nil, grant))
+			}
+			return n, nil
+
+		case st.finReceived:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.reset:
+			st.mu.Unlock()
+			return 0, ErrMuxStreamReset
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes p to the stream, blocking while the peer's window is full.
+// The write deadline bounds that wait, not writes to the underlying
+// connection.
+func (st *MuxStream) Write(p []byte) (int, error) {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.closed || st.finSent:
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		case st.reset:
+			st.mu.Unlock()
+			return written, ErrMuxStreamReset
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		case st.sendWindow == 0:
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		n := min(len(p), int(st.sendWindow), muxChunkSize)
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.m.writeMux(muxData, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite closes the writing side of the stream. The peer reads io.EOF once
+// it read everything written before, and may keep writing to this side.
+func (st *MuxStream) CloseWrite() error {
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	st.mu.Lock()
+	if st.finSent || st.closed || st.reset || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finReceived
+	st.mu.Unlock()
+
+	if done {
+		st.m.forget(st.id)
+	}
+	return st.m.writeMux(muxFin, st.id, nil)
+}
+
+// Close closes both sides of the stream. Everything written so far still
+// reaches the peer, but if the peer has not closed its side yet the stream is
+// reset, since nobody is left to read what it sends.
+func (st *MuxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.buf = nil
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+
+	// Wait out a Write that is already sending, so its data precedes the fin.
+	st.wmu.Lock()
+	defer st.wmu.Unlock()
+
+	st.mu.Lock()
+	sendFin := !st.finSent && !st.reset && st.err == nil
+	sendReset := !st.finReceived && !st.reset && st.err == nil
+	st.finSent = true
+	st.mu.Unlock()
+
+	st.m.forget(st.id)
+
+	if sendFin {
+		if err := st.m.writeMux(muxFin, st.id, nil); err != nil {
+			return err
+		}
+	}
+	if sendReset {
+		return st.m.writeMux(muxReset, st.id, nil)
+	}
+	return nil
+}
+
+// Reset aborts the stream in both directions. The peer's reads and writes fail
+// with ErrMuxStreamReset, without waiting for data still in flight.
+func (st *MuxStream) Reset() error {
+	st.mu.Lock()
+	if st.closed || st.reset || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.reset = true
+	st.buf = nil
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+
+	st.m.forget(st.id)
+	return st.m.writeMux(muxReset, st.id, nil)
+}
+
+// LocalAddr returns the local address of the mux connection, tagged with the
+// stream ID.
+func (st *MuxStream) LocalAddr() net.Addr {
+	return muxAddr{st.m.conn.LocalAddr(), st.id}
+}
+
+// RemoteAddr returns the remote address of the mux connection, tagged with the
+// stream ID.
+func (st *MuxStream) RemoteAddr() net.Addr {
+	return muxAddr{st.m.conn.RemoteAddr(), st.id}
+}
+
+func (st *MuxStream) SetDeadline(t time.Time) error {
+	_ = st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *MuxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *MuxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writable)
+	return nil
+}
+
+// announceWindow tells the peer about a window larger than the initial one.
+func (st *MuxStream) announceWindow() error {
+	if st.m.cfg.Window == muxInitialWindow {
+		return nil
+	}
+	grant := st.m.cfg.Window - muxInitialWindow
+	return st.m.writeMux(muxWindow, st.id, binary.BigEndian.AppendUint32(nil, grant))
+}
+
+func (st *MuxStream) receive(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	switch {
+	case st.finReceived:
+		return fmt.Errorf("mux: data on stream %d after fin", st.id)
+	case uint64(len(data)) > uint64(st.recvWindow):
+		return fmt.Errorf(
+			"mux: stream %d sent %d bytes with %d left in its window",
+			st.id, len(data), st.recvWindow,
+		)
+	}
+	st.recvWindow -= uint32(len(data))
+
+	if !st.closed {
+		st.buf = append(st.buf, data...)
+		notify(st.readable)
+	}
+	return nil
+}
+
+func (st *MuxStream) grow(body []byte) error {
+	if len(body) != 4 {
+		return fmt.Errorf("mux: malformed window update on stream %d", st.id)
+	}
+	grant := binary.BigEndian.Uint32(body)
+
+	st.mu.Lock()
+	st.sendWindow = uint32(min(uint64(st.sendWindow)+uint64(grant), math.MaxUint32))
+	st.mu.Unlock()
+	notify(st.writable)
+	return nil
+}
+
+func (st *MuxStream) remoteFin() {
+	st.mu.Lock()
+	st.finReceived = true
+	done := st.finSent
+	st.mu.Unlock()
+	notify(st.readable)
+
+	if done {
+		st.m.forget(st.id)
+	}
+}
+
+func (st *MuxStream) remoteReset() {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+
+	st.m.forget(st.id)
+}
+
+func (st *MuxStream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+}
+
+// notify wakes up whoever waits on ch, if anybody.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is notified or deadline passes.
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// muxAddr is the address of a stream, the connection address and stream ID.
+type muxAddr struct {
+	net.Addr
+	id uint32
+}
+
+func (a muxAddr) String() string {
+	return fmt.Sprintf("%s#%d", a.Addr, a.id)
+}
@@ -0,0 +1,334 @@
+package rhizome
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newMuxPair starts a client and server mux over an in-memory pipe.
+func newMuxPair(t *testing.T, cfg MuxConfig) (client, server *Mux) {
+	t.Helper()
+
+	c, s := net.Pipe()
+	client = NewClientMux(c, cfg)
+	server = NewServerMux(s, cfg)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// openPair opens a stream on client and accepts it on server.
+func openPair(t *testing.T, client, server *Mux) (local, remote *MuxStream) {
+	t.Helper()
+
+	local, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream error: %v", err)
+	}
+	remote, err = server.AcceptStream()
+	if err != nil {
+		t.Fatalf("AcceptStream error: %v", err)
+	}
+	if local.ID() != remote.ID() {
+		t.Fatalf("stream IDs differ: %d and %d", local.ID(), remote.ID())
+	}
+	return local, remote
+}
+
+func TestMux_StreamsCarryIndependentData(t *testing.T) {
+	client, server := newMuxPair(t, MuxConfig{})
+
+	a, remoteA := openPair(t, client, server)
+	b, remoteB := openPair(t, client, server)
+	if a.ID()%2 != 1 || b.ID() != a.ID()+2 {
+		t.Fatalf("unexpected client stream IDs %d and %d", a.ID(), b.ID())
+	}
+
+	fromServer, err := server.OpenStream()
+	if err != nil {
+		t.Fatalf("server OpenStream error: %v", err)
+	}
+	toClient, err := client.AcceptStream()
+	if err != nil {
+		t.Fatalf("client AcceptStream error: %v", err)
+	}
+	if fromServer.ID()%2 != 0 || toClient.ID() != fromServer.ID() {
+		t.Fatalf("unexpected server stream ID %d", fromServer.ID())
+	}
+
+	go func() {
+		_, _ = a.Write([]byte("tenant a"))
+		_, _ = b.Write([]byte("tenant b"))
+		_, _ = fromServer.Write([]byte("from server"))
+	}()
+
+	for st, want := range map[*MuxStream]string{
+		remoteA: "tenant a", remoteB: "tenant b", toClient: "from server",
+	} {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(st, got); err != nil {
+			t.Fatalf("stream %d read error: %v", st.ID(), err)
+		}
+		if string(got) != want {
+			t.Fatalf("stream %d got %q, want %q", st.ID(), got, want)
+		}
+	}
+
+	if !strings.HasSuffix(remoteA.RemoteAddr().String(), "#1") {
+		t.Fatalf("RemoteAddr %q does not carry the stream ID", remoteA.RemoteAddr())
+	}
+}
+
+func TestMux_FlowControlIsPerStream(t *testing.T) {
+	client, server := newMuxPair(t, MuxConfig{})
+
+	slow, _ := openPair(t, client, server)
+	fast, remoteFast := openPair(t, client, server)
+
+	// Nobody reads the slow stream, so its writer stalls at the window.
+	_ = slow.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := slow.Write(make([]byte, 2*muxInitialWindow))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write error = %v, want deadline exceeded", err)
+	}
+	if n != int(muxInitialWindow) {
+		t.Fatalf("wrote %d bytes past a %d byte window", n, muxInitialWindow)
+	}
+
+	// The other stream is not held up.
+	data := bytes.Repeat([]byte("x"), 3*int(muxInitialWindow))
+	go func() { _, _ = fast.Write(data) }()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(remoteFast, got); err != nil {
+		t.Fatalf("fast stream read error: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("fast stream data differs")
+	}
+}
+
+func TestMux_LargerWindow(t *testing.T) {
+	client, server := newMuxPair(t, MuxConfig{Window: 4 * muxInitialWindow})
+	local, _ := openPair(t, client, server)
+
+	// Give the window update time to arrive.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		local.mu.Lock()
+		window := local.sendWindow
+		local.mu.Unlock()
+		if window == 4*muxInitialWindow {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("send window is %d, want %d", window, 4*muxInitialWindow)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMuxStream_CloseWrite(t *testing.T) {
+	client, server := newMuxPair(t, MuxConfig{})
+	local, remote := openPair(t, client, server)
+
+	go func() {
+		_, _ = local.Write([]byte("request"))
+		_ = local.CloseWrite()
+	}()
+
+	req, err := io.ReadAll(remote)
+	if err != nil || string(req) != "request" {
+		t.Fatalf("ReadAll = %q, %v", req, err)
+	}
+
+	// The other direction stays open.
+	go func() {
+		_, _ = remote.Write([]byte("reply"))
+		_ = remote.Close()
+	}()
+	reply, err := io.ReadAll(local)
+	if err != nil || string(reply) != "reply" {
+		t.Fatalf("ReadAll = %q, %v", reply, err)
+	}
+
+	if _, err := local.Write([]byte("late")); err != io.ErrClosedPipe {
+		t.Fatalf("Write after CloseWrite = %v, want io.ErrClosedPipe", err)
+	}
+	waitForStreams(t, client, 0)
+	waitForStreams(t, server, 0)
+}
+
+func TestMuxStream_CloseResetsUnfinishedPeer(t *testing.T) {
+	client, server := newMuxPair(t, MuxConfig{})
+	local, remote := openPair(t, client, server)
+
+	if _, err := local.Write([]byte("last words")); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	_ = local.Close()
+
+	// Data written before Close still arrives, then the stream is gone.
+	got, err := io.ReadAll(remote)
+	if err != nil || string(got) != "last words" {
+		t.Fatalf("ReadAll = %q, %v", got, err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err := remote.Write([]byte("anyone?"))
+		if errors.Is(err, ErrMuxStreamReset) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Write after peer Close = %v, want ErrMuxStreamReset", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := local.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Fatalf("Read after Close = %v, want io.ErrClosedPipe", err)
+	}
+}
+
+func TestMuxStream_Reset(t *testing.T) {
+	client, server := newMuxPair(t, MuxConfig{})
+	local, remote := openPair(t, client, server)
+
+	_ = remote.Reset()
+	if _, err := local.Read(make([]byte, 1)); !errors.Is(err, ErrMuxStreamReset) {
+		t.Fatalf("Read after Reset = %v, want ErrMuxStreamReset", err)
+	}
+	if _, err := local.Write([]byte("x")); !errors.Is(err, ErrMuxStreamReset) {
+		t.Fatalf("Write after Reset = %v, want ErrMuxStreamReset", err)
+	}
+}
+
+func TestMuxStream_ReadDeadline(t *testing.T) {
+	client, server := newMuxPair(t, MuxConfig{})
+	local, _ := openPair(t, client, server)
+
+	_ = local.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := local.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read error = %v, want deadline exceeded", err)
+	}
+}
+
+func TestMux_CloseFailsStreams(t *testing.T) {
+	client, server := newMuxPair(t, MuxConfig{})
+	local, remote := openPair(t, client, server)
+
+	_ = client.Close()
+	if _, err := local.Read(make([]byte, 1)); err != ErrMuxClosed {
+		t.Fatalf("Read after mux Close = %v, want ErrMuxClosed", err)
+	}
+	if _, err := remote.Read(make([]byte, 1)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("peer Read after mux Close = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if _, err := server.AcceptStream(); err != io.EOF {
+		t.Fatalf("AcceptStream after peer hang up = %v, want io.EOF", err)
+	}
+	if _, err := client.OpenStream(); err != ErrMuxClosed {
+		t.Fatalf("OpenStream after Close = %v, want ErrMuxClosed", err)
+	}
+}
+
+func TestMux_RefusesStreamsBeyondBacklog(t *testing.T) {
+	client, server := newMuxPair(t, MuxConfig{AcceptBacklog: 1})
+
+	first, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream error: %v", err)
+	}
+	second, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("OpenStream error: %v", err)
+	}
+	if _, err := second.Read(make([]byte, 1)); !errors.Is(err, ErrMuxStreamReset) {
+		t.Fatalf("Read on refused stream = %v, want ErrMuxStreamReset", err)
+	}
+
+	accepted, err := server.AcceptStream()
+	if err != nil || accepted.ID() != first.ID() {
+		t.Fatalf("AcceptStream = %v, %v", accepted, err)
+	}
+}
+
+func TestMuxStream_ResponsesRouteToTheirStream(t *testing.T) {
+	client, server := newMuxPair(t, MuxConfig{})
+	tenantA, remoteA := openPair(t, client, server)
+	tenantB, remoteB := openPair(t, client, server)
+
+	// Each tenant runs its own session over its stream.
+	sessions := make(chan *Session, 2)
+	for _, st := range []*MuxStream{remoteA, remoteB} {
+		go func() {
+			s, err := NewSession(st, SessionConfig{})
+			if err != nil {
+				t.Errorf("server NewSession error: %v", err)
+			}
+			sessions <- s
+		}()
+	}
+	a, err := NewSession(tenantA, SessionConfig{})
+	if err != nil {
+		t.Fatalf("NewSession error: %v", err)
+	}
+	b, err := NewSession(tenantB, SessionConfig{})
+	if err != nil {
+		t.Fatalf("NewSession error: %v", err)
+	}
+	for range 2 {
+		s := <-sessions
+		go func() {
+			for {
+				obj, err := s.Receive()
+				if err != nil {
+					return
+				}
+				_ = obj.RespondWithAck(AckSent)
+			}
+		}()
+	}
+
+	for _, tc := range []struct {
+		s   *Session
+		uid string
+	}{{a, "uid-a"}, {b, "uid-b"}} {
+		obj := NewObject(
+			ObjDelivery, CmdSend, AckPlcyOnsent,
+			tc.uid, "", "", "", "",
+			EncodingNA, nil,
+		)
+		if err := tc.s.Send(obj); err != nil {
+			t.Fatalf("Send error: %v", err)
+		}
+		resp, err := tc.s.ReceiveResponse()
+		if err != nil || resp.UID != tc.uid {
+			t.Fatalf("ReceiveResponse = %+v, %v, want UID %q", resp, err, tc.uid)
+		}
+	}
+
+	// The per-stream responder writes to its stream alone.
+	if remoteA.Responder().RemoteAddr() == remoteB.Responder().RemoteAddr() {
+		t.Fatalf("stream responders share the address %q", remoteA.Responder().RemoteAddr())
+	}
+}
+
+func waitForStreams(t *testing.T, m *Mux, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for m.NumStreams() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("mux has %d streams, want %d", m.NumStreams(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
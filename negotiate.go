@@ -0,0 +1,364 @@
+package rhizome
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// -----------------------------------------------------------------------------
+// Version and capability negotiation.
+// -----------------------------------------------------------------------------
+// Before any objects are exchanged both peers send a hello control frame that
+// advertises what they support. Each side then computes the Agreement from its
+// own Capabilities and the remote hello, so both sides end up with the same
+// protocol version, encodings, compression algorithms and frame size limit.
+
+// # Hello control frame
+// +-----------------+-------------+----------------+----------------+
+// | u8 FrameControl | u8 ctrl ID  | u8 max version | u8 n encodings |
+// +-----------------+-------------+----------------+----------------+
+
+// +-------------------+------------------+------------------+---------------+
+// | n x u8 encoding   | u8 n compression | n x u8 algorithm | u32 max frame |
+// +-------------------+------------------+------------------+---------------+
+
+// +--------------+---------------------+-------------------+
+// | u32 features | u32 credit objects  | u32 credit bytes  |
+// +--------------+---------------------+-------------------+
+
+// Newer peers may append fields to the hello. Trailing bytes are ignored so
+// that older peers can still negotiate with them, and fields missing from an
+// older peer's hello are taken as zero.
+// -----------------------------------------------------------------------------
+
+// Control frame IDs, the byte following FrameControl.
+const (
+	ctrlHello uint8 = 1
+)
+
+// maxHelloSize bounds the remote hello, which has to be read before any frame
+// size limit has been agreed on.
+const maxHelloSize uint32 = 4 * BytesInKilobyte
+
+// Features are optional protocol extensions a peer may support. A feature is
+// only used on a connection if both peers advertise it.
+type Features uint32
+
+const (
+	// FeatureHeartbeat means the peer answers ping control frames.
+	FeatureHeartbeat Features = 1 << iota
+
+	// FeatureCredits means the peer takes part in credit-based flow control,
+	// see credit.go.
+	FeatureCredits
+
+	// AllFeatures is every feature this package supports.
+	AllFeatures = FeatureHeartbeat | FeatureCredits
+)
+
+// Capabilities is what a peer advertises about itself during the handshake.
+type Capabilities struct {
+	// The highest object protocol version the peer can encode and decode.
+	MaxVersion uint8
+
+	// The payload encodings the peer is able to consume, in order of
+	// preference.
+	Encodings []PayloadEncoding
+
+	// The payload compression algorithms the peer supports, in order of
+	// preference. CompressionNone is always implied and need not be listed.
+	Compression []Compression
+
+	// The largest frame, in bytes, the peer is willing to read.
+	MaxFrameSize uint32
+
+	// The optional features the peer supports.
+	Features Features
+
+	// The credits the peer grants up front if FeatureCredits is agreed on.
+	// Both limits must be non-zero when advertising FeatureCredits.
+	CreditWindow CreditWindow
+}
+
+// DefaultCapabilities advertises everything this package supports.
+func DefaultCapabilities() Capabilities {
+	encodings := make([]PayloadEncoding, 0, len(EncodingName))
+	for pe := range EncodingName {
+		encodings = append(encodings, pe)
+	}
+	slices.Sort(encodings)
+
+	return Capabilities{
+		MaxVersion:   ProtocolLatest,
+		Encodings:    encodings,
+		Compression:  SupportedCompression(),
+		MaxFrameSize: DefaultMaxFrameSize,
+		Features:     AllFeatures,
+		CreditWindow: DefaultCreditWindow,
+	}
+}
+
+// Agreement is the common ground two peers settled on during the handshake.
+//
+// The sets are identical on both sides of the connection, but their order
+// follows the local preference, so each side encodes with the algorithm it
+// likes best out of those the other side is able to decode.
+type Agreement struct {
+	// The object protocol version used for every frame on the connection.
+	Version uint8
+
+	// Payload encodings both peers are able to consume.
+	Encodings []PayloadEncoding
+
+	// Compression algorithms both peers support, CompressionNone excluded.
+	Compression []Compression
+
+	// The largest frame either peer may send.
+	MaxFrameSize uint32
+
+	// Optional features both peers support.
+	Features Features
+
+	// The credits the peer granted this side up front, and this side the
+	// peer. Unlike the rest of the Agreement these are mirrored between the
+	// two sides. Only used if both peers support FeatureCredits.
+	SendWindow, ReceiveWindow CreditWindow
+}
+
+// Negotiate computes the Agreement between the local and remote Capabilities.
+func Negotiate(local, remote Capabilities) (Agreement, error) {
+	version := min(local.MaxVersion, remote.MaxVersion)
+	if version == 0 {
+		return Agreement{}, errors.New(
+			"negotiate: no common protocol version",
+		)
+	}
+
+	var encodings []PayloadEncoding
+	for _, pe := range local.Encodings {
+		if slices.Contains(remote.Encodings, pe) &&
+			!slices.Contains(encodings, pe) {
+			encodings = append(encodings, pe)
+		}
+	}
+	if len(encodings) == 0 {
+		return Agreement{}, errors.New(
+			"negotiate: no common payload encoding",
+		)
+	}
+
+	var compression []Compression
+	for _, c := range local.Compression {
+		if c != CompressionNone && slices.Contains(remote.Compression, c) &&
+			!slices.Contains(compression, c) {
+			compression = append(compression, c)
+		}
+	}
+
+	frameSize := min(local.MaxFrameSize, remote.MaxFrameSize)
+	if frameSize == 0 {
+		return Agreement{}, errors.New("negotiate: max frame size is zero")
+	}
+
+	features := local.Features & remote.Features
+	if features&FeatureCredits != 0 &&
+		(local.CreditWindow.empty() || remote.CreditWindow.empty()) {
+		return Agreement{}, errors.New(
+			"negotiate: credit window is zero, no objects could ever be sent",
+		)
+	}
+
+	return Agreement{
+		Version:       version,
+		Encodings:     encodings,
+		Compression:   compression,
+		MaxFrameSize:  frameSize,
+		Features:      features,
+		SendWindow:    remote.CreditWindow,
+		ReceiveWindow: local.CreditWindow,
+	}, nil
+}
+
+// SupportsEncoding reports whether both peers agreed to consume pe.
+func (a Agreement) SupportsEncoding(pe PayloadEncoding) bool {
+	return slices.Contains(a.Encodings, pe)
+}
+
+// SupportsFeature reports whether both peers support every feature in f.
+func (a Agreement) SupportsFeature(f Features) bool {
+	return a.Features&f == f
+}
+
+// EncodeFrame serializes obj with the agreed protocol version.
+// If obj asks for a compression algorithm the peer does not support, the
+// preferred agreed algorithm is used instead. The caller's object is left
+// untouched.
+func (a Agreement) EncodeFrame(obj *Object) ([]byte, error) {
+	return a.encodeFrame(obj, defaultLimits())
+}
+
+// encodeFrame is EncodeFrame with the compression limits of a session.
+func (a Agreement) encodeFrame(obj *Object, lim compressionLimits) ([]byte, error) {
+	if !a.SupportsEncoding(obj.PayloadEncoding) {
+		return nil, fmt.Errorf(
+			"payload encoding %s was not agreed on", obj.PayloadEncoding,
+		)
+	}
+
+	o := *obj
+	o.Version = a.Version
+	o.Compression = a.pickCompression(obj.Compression)
+	frame, err := encodeFrame(&o, lim)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(frame)) > uint64(a.MaxFrameSize) {
+		return nil, fmt.Errorf(
+			"frame of %d bytes exceeds agreed %d byte limit",
+			len(frame), a.MaxFrameSize,
+		)
+	}
+	return frame, nil
+}
+
+func (a Agreement) pickCompression(want Compression) Compression {
+	switch {
+	case want == CompressionNone || a.Version < ProtocolV2 || len(a.Compression) == 0:
+		return CompressionNone
+	case slices.Contains(a.Compression, want):
+		return want
+	default:
+		return a.Compression[0]
+	}
+}
+
+// Handshake exchanges hellos over rw and returns the resulting Agreement.
+// The local hello is written concurrently with reading the remote one, so both
+// peers may call Handshake at the same time over a synchronous connection.
+//
+// On error the caller should close the connection, which also releases the
+// pending write of the local hello.
+func Handshake(rw io.ReadWriter, local Capabilities) (Agreement, error) {
+	if local.MaxVersion == 0 || local.MaxVersion > ProtocolLatest {
+		return Agreement{}, fmt.Errorf(
+			"handshake: unsupported local max version: %d", local.MaxVersion,
+		)
+	}
+
+	hello, err := encodeHello(local)
+	if err != nil {
+		return Agreement{}, fmt.Errorf("handshake: %w", err)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		written <- WriteFrame(rw, hello)
+	}()
+
+	frame, err := ReadFrame(rw, maxHelloSize)
+	if err != nil {
+		return Agreement{}, fmt.Errorf("handshake: read hello: %w", err)
+	}
+	if err := <-written; err != nil {
+		return Agreement{}, fmt.Errorf("handshake: write hello: %w", err)
+	}
+
+	remote, err := decodeHello(frame)
+	if err != nil {
+		return Agreement{}, fmt.Errorf("handshake: %w", err)
+	}
+
+	return Negotiate(local, remote)
+}
+
+//--------Hello Frame-----------------------------------------------------------
+
+func encodeHello(caps Capabilities) ([]byte, error) {
+	if len(caps.Encodings) > 255 {
+		return nil, fmt.Errorf("too many encodings: %d", len(caps.Encodings))
+	}
+	if len(caps.Compression) > 255 {
+		return nil, fmt.Errorf(
+			"too many compression algorithms: %d", len(caps.Compression),
+		)
+	}
+
+	body := bytes.NewBuffer(nil)
+	writeU8(body, FrameControl)
+	writeU8(body, ctrlHello)
+	writeU8(body, caps.MaxVersion)
+
+	writeU8(body, uint8(len(caps.Encodings)))
+	for _, pe := range caps.Encodings {
+		writeU8(body, uint8(pe))
+	}
+
+	writeU8(body, uint8(len(caps.Compression)))
+	for _, c := range caps.Compression {
+		writeU8(body, uint8(c))
+	}
+
+	writeU32(body, caps.MaxFrameSize)
+	writeU32(body, uint32(caps.Features))
+	writeU32(body, caps.CreditWindow.Objects)
+	writeU32(body, caps.CreditWindow.Bytes)
+
+	return body.Bytes(), nil
+}
+
+func decodeHello(frame []byte) (Capabilities, error) {
+	var caps Capabilities
+	r := bytes.NewReader(frame)
+
+	var kind, id uint8
+	if err := readU8(r, &kind); err != nil {
+		return caps, fmt.Errorf("read hello frame kind: %w", err)
+	}
+	if err := readU8(r, &id); err != nil {
+		return caps, fmt.Errorf("read hello control ID: %w", err)
+	}
+	if kind != FrameControl || id != ctrlHello {
+		return caps, fmt.Errorf(
+			"expected hello frame, got kind %d control ID %d", kind, id,
+		)
+	}
+
+	if err := readU8(r, &caps.MaxVersion); err != nil {
+		return caps, fmt.Errorf("read hello max version: %w", err)
+	}
+
+	encodings, err := readBytesU8(r)
+	if err != nil {
+		return caps, fmt.Errorf("read hello encodings: %w", err)
+	}
+	for _, b := range encodings {
+		caps.Encodings = append(caps.Encodings, PayloadEncoding(b))
+	}
+
+	compression, err := readBytesU8(r)
+	if err != nil {
+		return caps, fmt.Errorf("read hello compression: %w", err)
+	}
+	for _, b := range compression {
+		caps.Compression = append(caps.Compression, Compression(b))
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &caps.MaxFrameSize); err != nil {
+		return caps, fmt.Errorf("read hello max frame size: %w", err)
+	}
+
+	// Features were added later, older peers do not send them.
+	if r.Len() >= 4 {
+		_ = binary.Read(r, binary.BigEndian, (*uint32)(&caps.Features))
+	}
+	if r.Len() >= 8 {
+		_ = binary.Read(r, binary.BigEndian, &caps.CreditWindow)
+	}
+
+	return caps, nil
+}
@@ -0,0 +1,294 @@
+package rhizome
+
+import (
+	"bytes"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestNegotiate_PicksLowestCommonVersionAndSmallestFrame(t *testing.T) {
+	local := Capabilities{
+		MaxVersion:   3,
+		Encodings:    []PayloadEncoding{EncodingJson, EncodingCsv, EncodingNA},
+		MaxFrameSize: 4096,
+	}
+	remote := Capabilities{
+		MaxVersion:   1,
+		Encodings:    []PayloadEncoding{EncodingNA, EncodingJson, EncodingXml},
+		MaxFrameSize: 8192,
+	}
+
+	a, err := Negotiate(local, remote)
+	if err != nil {
+		t.Fatalf("Negotiate error: %v", err)
+	}
+	if a.Version != 1 {
+		t.Fatalf("Version = %d, want 1", a.Version)
+	}
+	if a.MaxFrameSize != 4096 {
+		t.Fatalf("MaxFrameSize = %d, want 4096", a.MaxFrameSize)
+	}
+	want := []PayloadEncoding{EncodingJson, EncodingNA}
+	if !slices.Equal(a.Encodings, want) {
+		t.Fatalf("Encodings = %v, want %v", a.Encodings, want)
+	}
+}
+
+func TestNegotiate_CompressionIntersectionSkipsNone(t *testing.T) {
+	local := DefaultCapabilities()
+	local.Compression = []Compression{CompressionNone, 7, 9}
+	remote := DefaultCapabilities()
+	remote.Compression = []Compression{9, 8, CompressionNone}
+
+	a, err := Negotiate(local, remote)
+	if err != nil {
+		t.Fatalf("Negotiate error: %v", err)
+	}
+	if !slices.Equal(a.Compression, []Compression{9}) {
+		t.Fatalf("Compression = %v, want [9]", a.Compression)
+	}
+}
+
+func TestNegotiate_Errors(t *testing.T) {
+	base := DefaultCapabilities()
+
+	noVersion := base
+	noVersion.MaxVersion = 0
+	if _, err := Negotiate(base, noVersion); err == nil {
+		t.Fatalf("expected error for no common version")
+	}
+
+	noEncodings := base
+	noEncodings.Encodings = nil
+	if _, err := Negotiate(base, noEncodings); err == nil {
+		t.Fatalf("expected error for no common encoding")
+	}
+
+	noFrames := base
+	noFrames.MaxFrameSize = 0
+	if _, err := Negotiate(base, noFrames); err == nil {
+		t.Fatalf("expected error for zero frame size")
+	}
+}
+
+func TestAgreement_EncodeFrame_PicksAgreedCompression(t *testing.T) {
+	a := Agreement{
+		Version:      ProtocolV2,
+		Encodings:    []PayloadEncoding{EncodingCsv},
+		Compression:  []Compression{CompressionZlib, CompressionGzip},
+		MaxFrameSize: DefaultMaxFrameSize,
+	}
+	obj := NewObject(
+		ObjDelivery, CmdSend, AckPlcyNoreply,
+		"uid-1", "", "", "", "",
+		EncodingCsv, bytes.Repeat([]byte("a,b,c\n"), 1000),
+	)
+
+	for _, tc := range []struct {
+		want, got Compression
+	}{
+		{CompressionGzip, CompressionGzip},
+		{CompressionFlate, CompressionZlib},
+		{CompressionNone, CompressionNone},
+	} {
+		obj.Compression = tc.want
+		frame, err := a.EncodeFrame(obj)
+		if err != nil {
+			t.Fatalf("EncodeFrame error: %v", err)
+		}
+		decoded, err := DecodeFrame(frame, newResponder())
+		if err != nil {
+			t.Fatalf("DecodeFrame error: %v", err)
+		}
+		if decoded.Compression != tc.got {
+			t.Fatalf("asked for %s, compressed with %s, want %s", tc.want, decoded.Compression, tc.got)
+		}
+	}
+
+	a.Version = ProtocolV1
+	obj.Compression = CompressionGzip
+	frame, err := a.EncodeFrame(obj)
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+	if frame[0] != ProtocolV1 {
+		t.Fatalf("frame version = %d, want %d", frame[0], ProtocolV1)
+	}
+}
+
+func TestHello_RoundTrip_IgnoresTrailingFields(t *testing.T) {
+	caps := Capabilities{
+		MaxVersion:   ProtocolV1,
+		Encodings:    []PayloadEncoding{EncodingJson, EncodingNA},
+		Compression:  []Compression{5},
+		MaxFrameSize: 12345,
+	}
+	frame, err := encodeHello(caps)
+	if err != nil {
+		t.Fatalf("encodeHello error: %v", err)
+	}
+	// A newer peer may append fields.
+	frame = append(frame, 0xAA, 0xBB)
+
+	got, err := decodeHello(frame)
+	if err != nil {
+		t.Fatalf("decodeHello error: %v", err)
+	}
+	if got.MaxVersion != caps.MaxVersion ||
+		got.MaxFrameSize != caps.MaxFrameSize ||
+		!slices.Equal(got.Encodings, caps.Encodings) ||
+		!slices.Equal(got.Compression, caps.Compression) {
+		t.Fatalf("decodeHello = %+v, want %+v", got, caps)
+	}
+}
+
+func TestDecodeHello_RejectsOtherFrames(t *testing.T) {
+	if _, err := decodeHello([]byte{ProtocolV1, ctrlHello}); err == nil {
+		t.Fatalf("expected error for non-control frame")
+	}
+	if _, err := decodeHello([]byte{FrameControl, ctrlHello, 1, 3}); err == nil {
+		t.Fatalf("expected error for truncated hello")
+	}
+}
+
+func TestHandshake_BothSidesAgree(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	remoteCaps := DefaultCapabilities()
+	remoteCaps.Encodings = []PayloadEncoding{EncodingNA, EncodingYaml}
+	remoteCaps.MaxFrameSize = 2048
+
+	type result struct {
+		agreement Agreement
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		agreement, err := Handshake(b, remoteCaps)
+		done <- result{agreement, err}
+	}()
+
+	local, err := Handshake(a, DefaultCapabilities())
+	if err != nil {
+		t.Fatalf("local Handshake error: %v", err)
+	}
+	remote := <-done
+	if remote.err != nil {
+		t.Fatalf("remote Handshake error: %v", remote.err)
+	}
+
+	if local.Version != remote.agreement.Version ||
+		local.MaxFrameSize != 2048 ||
+		remote.agreement.MaxFrameSize != 2048 {
+		t.Fatalf("agreements differ: local=%+v remote=%+v", local, remote.agreement)
+	}
+	if !local.SupportsEncoding(EncodingYaml) || local.SupportsEncoding(EncodingJson) {
+		t.Fatalf("local encodings = %v, want NA and yaml", local.Encodings)
+	}
+}
+
+func TestHandshake_RejectsUnsupportedLocalVersion(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	caps := DefaultCapabilities()
+	caps.MaxVersion = ProtocolLatest + 1
+	if _, err := Handshake(a, caps); err == nil {
+		t.Fatalf("expected error for unsupported local version")
+	}
+}
+
+func TestAgreement_EncodeFrame_UsesAgreedVersion(t *testing.T) {
+	a := Agreement{
+		Version:      ProtocolV1,
+		Encodings:    []PayloadEncoding{EncodingJson},
+		MaxFrameSize: DefaultMaxFrameSize,
+	}
+	obj := NewObject(
+		ObjDelivery, CmdSend, AckPlcyNoreply,
+		"uid-1", "", "", "", "",
+		EncodingJson, []byte(`{}`),
+	)
+	obj.Version = 0
+
+	frame, err := a.EncodeFrame(obj)
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+	if frame[0] != ProtocolV1 {
+		t.Fatalf("frame version = %d, want %d", frame[0], ProtocolV1)
+	}
+	if obj.Version != 0 {
+		t.Fatalf("EncodeFrame modified the caller's object")
+	}
+}
+
+func TestAgreement_EncodeFrame_Rejections(t *testing.T) {
+	a := Agreement{
+		Version:      ProtocolV1,
+		Encodings:    []PayloadEncoding{EncodingJson},
+		MaxFrameSize: 32,
+	}
+
+	yaml := NewObject(
+		ObjDelivery, CmdSend, AckPlcyNoreply,
+		"uid-1", "", "", "", "",
+		EncodingYaml, nil,
+	)
+	if _, err := a.EncodeFrame(yaml); err == nil {
+		t.Fatalf("expected error for unagreed encoding")
+	}
+
+	big := NewObject(
+		ObjDelivery, CmdSend, AckPlcyNoreply,
+		"uid-1", "", "", "", "",
+		EncodingJson, make([]byte, 64),
+	)
+	if _, err := a.EncodeFrame(big); err == nil {
+		t.Fatalf("expected error for frame over agreed size")
+	}
+}
+
+func TestNegotiate_Features(t *testing.T) {
+	local := DefaultCapabilities()
+	remote := DefaultCapabilities()
+	remote.Features = 0
+
+	a, err := Negotiate(local, remote)
+	if err != nil {
+		t.Fatalf("Negotiate error: %v", err)
+	}
+	if a.SupportsFeature(FeatureHeartbeat) {
+		t.Fatalf("feature agreed on although the remote lacks it")
+	}
+
+	a, err = Negotiate(local, DefaultCapabilities())
+	if err != nil {
+		t.Fatalf("Negotiate error: %v", err)
+	}
+	if !a.SupportsFeature(FeatureHeartbeat) {
+		t.Fatalf("feature supported by both peers was not agreed on")
+	}
+}
+
+func TestDecodeHello_OlderPeerWithoutFeatures(t *testing.T) {
+	caps := DefaultCapabilities()
+	frame, err := encodeHello(caps)
+	if err != nil {
+		t.Fatalf("encodeHello error: %v", err)
+	}
+
+	// Features and the credit window came after the max frame size.
+	got, err := decodeHello(frame[:len(frame)-12])
+	if err != nil {
+		t.Fatalf("decodeHello error: %v", err)
+	}
+	if got.Features != 0 || got.CreditWindow != (CreditWindow{}) ||
+		got.MaxFrameSize != caps.MaxFrameSize {
+		t.Fatalf("decodeHello = %+v", got)
+	}
+}
@@ -1,6 +1,7 @@
 package rhizome
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -65,6 +66,36 @@ type Object struct {
 	// The currently denoted
 	PayloadEncoding PayloadEncoding
 
+	// Which algorithm to compress the payload with when encoding.
+	// Decoded objects report the algorithm the payload arrived with, the
+	// payload itself is always decompressed.
+	// Only used from protocol version 2 onwards.
+	Compression Compression
+
+	// The position of this object within a payload that was split with
+	// Fragment. FragCount is 0 for objects that are not fragments.
+	// Only used from protocol version 2 onwards.
+	FragIndex, FragCount uint16
+
+	// Stream delivers the payload of objects sent with Session.SendStream.
+	// Their payload follows the object in chunks instead of in Payload, and
+	// Stream can be read while the chunks are still arriving.
+	// Nil for regular objects.
+	Stream *PayloadStream
+
+	// Whether the payload follows as a stream, see Streamed.
+	streamed bool
+
+	// Whether Payload shares memory with the frame it was decoded from, see
+	// DecodeOptions.AliasPayload.
+	payloadAliased bool
+
+	// The pool the object was taken from, whether it was released to it, and
+	// where, if the pool is in Debug mode. See ObjectPool.
+	pool       *ObjectPool
+	released   bool
+	releasedBy []byte
+
 	// The generic information, if any, to forward to the subscribing system.
 	Payload []byte
 }
@@ -124,12 +155,28 @@ func (obj *Object) PrintValues() {
 	fmt.Println()
 
 	fmt.Println("Payload Encoding:", obj.PayloadEncoding.String())
+	fmt.Println("Compression:", obj.Compression.String())
 	fmt.Println()
 
 	fmt.Println("Raw Payload:", string(obj.Payload))
 	fmt.Println(strings.Repeat("-", 80))
 }
 
+// sender names where obj came from, for error messages. Objects decoded
+// without a responder, like those read from a capture file, have no sender.
+func (obj *Object) sender() string {
+	if obj.Responder == nil || obj.Responder.C == nil {
+		return "unknown sender"
+	}
+	return obj.Responder.RemoteAddr()
+}
+
+// Streamed reports whether the object's payload follows it as a stream of
+// chunks rather than in Payload. Sessions expose the stream as obj.Stream.
+func (obj *Object) Streamed() bool {
+	return obj.streamed
+}
+
 // RespondWithAck sends the ack value (uint8) to the object's responder address.
 // The ack value is application specific.
 // Unlike other protocols, like HTTP, Rhizome does not have universal response
@@ -142,6 +189,20 @@ func (obj *Object) PrintValues() {
 // Applications should have their own response APIs or built-in parsing or
 // conversion functionality to make sense of application-specific acks/nacks.
 func (obj *Object) RespondWithAck(ack uint8) error {
+	return obj.RespondWithAckContext(context.Background(), ack)
+}
+
+// RespondWithAckContext is RespondWithAck bounded by ctx, so an ack to a peer
+// that stopped reading does not block forever. See ConnResponder.WriteContext
+// for how ctx applies to the write and the errors it returns.
+func (obj *Object) RespondWithAckContext(ctx context.Context, ack uint8) error {
+	obj.checkReleased()
+	if obj.FragCount != 0 {
+		return errors.New(
+			"fragments are acknowledged once reassembled, not individually",
+		)
+	}
+
 	if obj.Responder != nil {
 		obj.Response.Ack = ack
 
@@ -150,7 +211,7 @@ func (obj *Object) RespondWithAck(ack uint8) error {
 			return err
 		}
 
-		return obj.Responder.Write(msg)
+		return obj.Responder.WriteContext(ctx, msg)
 	}
 
 	return errors.New("responder is nil")
@@ -160,12 +221,13 @@ func (obj *Object) RespondWithAck(ack uint8) error {
 func (obj *Object) EncodeResponse() ([]byte, error) {
 	switch obj.Version {
 
-	case ProtocolV1:
+	// Responses did not change in v2.
+	case ProtocolV1, ProtocolV2:
 		return EncodeResponseV1(*obj.Response), nil
 
 	default:
 		err := fmt.Errorf(
-			"unable to encode response for %s", obj.Responder.RemoteAddr(),
+			"unable to encode response for %s", obj.sender(),
 		)
 		return nil, err
 	}
@@ -185,6 +247,11 @@ func parseProtoVer(data []byte) (uint8, []byte, error) {
 // DecodeFrame takes an array of bytes and a *ConnResponder to construct a
 // *Object or error.
 func DecodeFrame(line []byte, resp *ConnResponder) (*Object, error) {
+	return decodeFrame(line, resp, defaultLimits())
+}
+
+// decodeFrame is DecodeFrame with the compression limits of its caller.
+func decodeFrame(line []byte, resp *ConnResponder, lim compressionLimits) (*Object, error) {
 	version, rest, err := parseProtoVer(line)
 	if err != nil {
 		err := fmt.Errorf("read protocol version: %v", err)
@@ -214,6 +281,14 @@ func DecodeFrame(line []byte, resp *ConnResponder) (*Object, error) {
 	case 1:
 		return decodeV1(rest, obj)
 
+	case 2:
+		return decodeV2(rest, obj, lim)
+
+	case FrameBatch:
+		return nil, errors.New(
+			"batch frames hold several objects, decode them with DecodeBatch",
+		)
+
 	default:
 		return nil, fmt.Errorf("unsupported protocol version: %d", obj.Version)
 	}
@@ -222,9 +297,17 @@ func DecodeFrame(line []byte, resp *ConnResponder) (*Object, error) {
 // EncodeFrame serializes an Object into a single byte slice suitable for sending
 // over the wire. It switches on obj.Version to remain forward-compatible.
 func EncodeFrame(obj *Object) ([]byte, error) {
+	return encodeFrame(obj, defaultLimits())
+}
+
+// encodeFrame is EncodeFrame with the compression limits of its caller.
+func encodeFrame(obj *Object, lim compressionLimits) ([]byte, error) {
+	obj.checkReleased()
 	switch obj.Version {
 	case ProtocolV1:
 		return encodeV1(obj)
+	case ProtocolV2:
+		return encodeV2(obj, lim)
 	default:
 		return nil, fmt.Errorf("unsupported protocol version: %d", obj.Version)
 	}
@@ -234,10 +317,10 @@ func EncodeFrame(obj *Object) ([]byte, error) {
 func EncodeResponse(obj *Object) ([]byte, error) {
 	switch obj.Version {
 
-	case uint8(1):
+	case uint8(1), uint8(2):
 		return EncodeResponseV1(*obj.Response), nil
 
 	default:
-		return nil, fmt.Errorf("unable to encode response for %s", obj.Responder.RemoteAddr())
+		return nil, fmt.Errorf("unable to encode response for %s", obj.sender())
 	}
 }
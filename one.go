@@ -2,6 +2,7 @@ package rhizome
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -12,20 +13,22 @@ import (
 // -----------------------------------------------------------------------------
 // *Note that this is a messaging protocol, not a file transfer protocol.
 // -----------------------------------------------------------------------------
-// The version 1 protocol looks as follows:
+// The version 1 protocol looks as follows. On a connection every object is
+// preceded by the u32 length prefix of its frame, see WriteFrame, which is not
+// part of the object itself.
 
 // # Fixed field sized header
-// +---------+--------+-------------+-------------+---------------+
-// | u32 len | u8 ver | u8 obj_type | u8 cmd_type | u8 ack policy |
-// +---------+--------+-------------+-------------+---------------+
+// +--------+-------------+-------------+---------------+
+// | u8 ver | u8 obj_type | u8 cmd_type | u8 ack policy |
+// +--------+-------------+-------------+---------------+
 
 // which is then followed by a variable field sized sub-header that contains a
-// UID and the sender's address for tracking purposes.
+// UID for tracking purposes.
 
 // # Tracking Sub-header
-// +-------------+---------------------+
-// | u8 len uid  | u16 len return addr |
-// +-------------+---------------------+
+// +------------+
+// | u8 len uid |
+// +------------+
 
 // which is then followed by 4 uint8 sized byte fields that act as arguments for
 // the object type in the fixed header.
@@ -48,6 +51,9 @@ import (
 // | u8 encoding type | u16 len payload |
 // +------------------+-----------------+
 
+// Every length prefixed field is followed by that many bytes. The golden
+// vectors in conformance/vectors.json pin this layout down byte for byte.
+
 // -----------------------------------------------------------------------------
 // Responses are a three-field message: message length prefix, corresponding
 // uid, and the ack/nack value.
@@ -86,7 +92,7 @@ func decodeV1(data []byte, obj *Object) (*Object, error) {
 	// Payload
 	payload, err := readBytesU16(r)
 	if err != nil {
-		msg := fmt.Sprintf("Unable to parse payload from %s: %s", obj.Responder.RemoteAddr(), err)
+		msg := fmt.Sprintf("Unable to parse payload from %s: %s", obj.sender(), err)
 		err := errors.New(msg)
 		return nil, err
 	}
@@ -146,7 +152,7 @@ func parseTrackingHeader(r io.Reader, cmd *Object) (*Object, error) {
 	if uid == "" {
 		err := fmt.Errorf(
 			"empty UID field from mesage: %s",
-			cmd.Responder.C.LocalAddr().String(),
+			cmd.sender(),
 		)
 		return nil, err
 	}
@@ -165,7 +171,7 @@ func parseArgError(pos int, fromAddr string, err error) error {
 // Parse the four argument fields from the reader.
 func parseArgumentFields(r io.Reader, cmd *Object) (*Object, error) {
 	arg1, err := readStringU8(r)
-	fromAddr := cmd.Responder.RemoteAddr()
+	fromAddr := cmd.sender()
 	if err != nil {
 		return nil, parseArgError(1, fromAddr, err)
 	}
@@ -194,7 +200,7 @@ func parseArgumentFields(r io.Reader, cmd *Object) (*Object, error) {
 
 func parsePayloadEncoding(r io.Reader, cmd *Object) (*Object, error) {
 	if err := readU8(r, (*uint8)(&cmd.PayloadEncoding)); err != nil {
-		err := fmt.Errorf("unable to parse payload encoding type from %s", cmd.Responder.RemoteAddr())
+		err := fmt.Errorf("unable to parse payload encoding type from %s", cmd.sender())
 		return nil, err
 	}
 	return cmd, nil
@@ -208,6 +214,21 @@ func parsePayloadEncoding(r io.Reader, cmd *Object) (*Object, error) {
 // [ u8 len uid ][ u8 len arg1 ][ u8 len arg2 ][ u8 len arg3 ][ u8 len arg4 ]
 // [ u8 encoding ][ u16 len payload ][ payload... ]
 func encodeV1(obj *Object) ([]byte, error) {
+	return appendV1(nil, obj)
+}
+
+// appendV1 appends the v1 message of obj to dst.
+func appendV1(dst []byte, obj *Object) ([]byte, error) {
+	dst, err := appendV1Header(dst, obj)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, obj.Payload...), nil
+}
+
+// appendV1Header appends everything of the v1 message of obj that comes before
+// the payload bytes to dst.
+func appendV1Header(dst []byte, obj *Object) ([]byte, error) {
 	// Basic validation to match decoder expectations.
 	if obj.UID == "" {
 		return nil, errors.New("encodeV1: UID must not be empty")
@@ -216,53 +237,59 @@ func encodeV1(obj *Object) ([]byte, error) {
 		return nil, fmt.Errorf("encodeV1: payload too large: %d bytes", len(obj.Payload))
 	}
 
-	body := bytes.NewBuffer(nil)
-
-	// Version
-	writeU8(body, ProtocolV1)
-
-	// Fixed header
-	writeU8(body, obj.ObjType)
-	writeU8(body, obj.CmdType)
-	writeU8(body, obj.AckPlcy)
+	// Version + fixed header
+	dst = append(dst, ProtocolV1, obj.ObjType, obj.CmdType, obj.AckPlcy)
 
 	// Tracking + arguments (all u8-len strings)
-	if err := writeString8(body, obj.UID); err != nil {
+	dst, err := appendString8(dst, obj.UID)
+	if err != nil {
 		return nil, fmt.Errorf("encodeV1: uid: %w", err)
 	}
-	if err := writeString8(body, obj.Arg1); err != nil {
-		return nil, fmt.Errorf("encodeV1: arg1: %w", err)
-	}
-	if err := writeString8(body, obj.Arg2); err != nil {
-		return nil, fmt.Errorf("encodeV1: arg2: %w", err)
-	}
-	if err := writeString8(body, obj.Arg3); err != nil {
-		return nil, fmt.Errorf("encodeV1: arg3: %w", err)
-	}
-	if err := writeString8(body, obj.Arg4); err != nil {
-		return nil, fmt.Errorf("encodeV1: arg4: %w", err)
-	}
-
-	// Payload encoding (u8) + payload (u16-len + bytes)
-	writeU8(body, uint8(obj.PayloadEncoding))
-	writeU16(body, uint16(len(obj.Payload)))
-	if len(obj.Payload) != 0 {
-		body.Write(obj.Payload)
+	for i, arg := range [...]string{obj.Arg1, obj.Arg2, obj.Arg3, obj.Arg4} {
+		if dst, err = appendString8(dst, arg); err != nil {
+			return nil, fmt.Errorf("encodeV1: arg%d: %w", i+1, err)
+		}
 	}
 
-	return body.Bytes(), nil
+	// Payload encoding (u8) + payload length (u16)
+	dst = append(dst, uint8(obj.PayloadEncoding))
+	return binary.BigEndian.AppendUint16(dst, uint16(len(obj.Payload))), nil
 }
 
 //--------Response--------------------------------------------------------------
 
 // EncodeResponseV1 encodes a protocol.Response object into []byte.
 func EncodeResponseV1(response Response) []byte {
-	body := bytes.NewBuffer(nil)
-	_ = writeString8(body, response.UID)
-	writeU8(body, response.Ack)
-
-	full := bytes.NewBuffer(nil)
-	writeU16(full, uint16(body.Len()))
-	full.Write(body.Bytes())
-	return full.Bytes()
+	return AppendResponse(nil, response)
+}
+
+// DecodeResponseV1 decodes a single response produced by EncodeResponseV1.
+// It returns the number of bytes consumed so that several responses written
+// back to back can be decoded in turn.
+func DecodeResponseV1(data []byte) (Response, int, error) {
+	const prefixLen = 2
+	if len(data) < prefixLen {
+		return Response{}, 0, io.ErrUnexpectedEOF
+	}
+	n := int(data[0])<<8 | int(data[1])
+	if len(data) < prefixLen+n {
+		return Response{}, 0, fmt.Errorf(
+			"response declares %d bytes, only %d available",
+			n, len(data)-prefixLen,
+		)
+	}
+
+	body := data[prefixLen : prefixLen+n]
+	if len(body) < 2 || len(body) != 1+int(body[0])+1 {
+		return Response{}, 0, fmt.Errorf(
+			"malformed response body of %d bytes", len(body),
+		)
+	}
+
+	uidLen := int(body[0])
+	response := Response{
+		UID: string(body[1 : 1+uidLen]),
+		Ack: body[1+uidLen],
+	}
+	return response, prefixLen + n, nil
 }
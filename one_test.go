@@ -33,6 +33,16 @@ func newResponder() *ConnResponder {
 
 // -------Helpers---------------------------------------------------------------
 
+// newDelivery returns a protocol v1 delivery of payload to "route", acked once
+// sent. Tests change the fields they depend on.
+func newDelivery(uid string, pe PayloadEncoding, payload []byte) *Object {
+	return NewObject(
+		ObjDelivery, CmdSend, AckPlcyOnsent,
+		uid, "route", "", "", "",
+		pe, payload,
+	)
+}
+
 func assertObjectsEqual(t *testing.T, want, got *Object) {
 	t.Helper()
 
@@ -294,3 +304,34 @@ func TestEncodeResponseV1_FrameIsExactlyPrefixPlusBody(t *testing.T) {
 		t.Fatalf("body = %v, want %v", body, want)
 	}
 }
+
+func TestDecodeResponseV1_RoundTrip(t *testing.T) {
+	want := Response{UID: "uid-7", Ack: AckChannelNotFound}
+	frame := EncodeResponseV1(want)
+
+	got, n, err := DecodeResponseV1(frame)
+	if err != nil {
+		t.Fatalf("DecodeResponseV1 error: %v", err)
+	}
+	if got != want {
+		t.Fatalf("DecodeResponseV1 = %+v, want %+v", got, want)
+	}
+	if n != len(frame) {
+		t.Fatalf("consumed %d bytes, want %d", n, len(frame))
+	}
+}
+
+func TestDecodeResponseV1_Malformed(t *testing.T) {
+	cases := map[string][]byte{
+		"empty":          nil,
+		"short prefix":   {0x00},
+		"short body":     {0x00, 0x05, 0x01},
+		"uid overruns":   {0x00, 0x02, 0x05, 0x01},
+		"trailing bytes": {0x00, 0x04, 0x01, 'a', 0x01, 0x02},
+	}
+	for name, in := range cases {
+		if _, _, err := DecodeResponseV1(in); err == nil {
+			t.Fatalf("%s: expected error, got nil", name)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package rhizome
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+// Object lifecycle.
+// -----------------------------------------------------------------------------
+// A broker decoding many objects a second can take them from an ObjectPool
+// instead of allocating each one. Sessions do so when SessionConfig.ObjectPool
+// is set. A pooled object belongs to the application until it calls Release,
+// normally after the final ack, after which neither the object nor its payload
+// may be used again.
+//
+// Using a released object is a bug the pool can only partly catch. Released
+// objects panic when they are acked, encoded, decoded into or released again,
+// but only until the pool hands them out anew. A pool in Debug mode never hands
+// them out again, overwrites their payload and reports where they were
+// released, which makes such bugs show up reliably at the cost of pooling.
+// -----------------------------------------------------------------------------
+
+// ObjectPool recycles Objects decoded with DecodeInto, so a busy receiver does
+// not allocate an Object, a Response and a payload buffer for every frame.
+// The zero value is ready to use.
+type ObjectPool struct {
+	// Debug trades pooling for catching uses of released objects.
+	Debug bool
+
+	pool sync.Pool
+}
+
+// maxPooledPayload caps the payload buffer an object keeps in the pool, so one
+// large payload does not pin its memory forever.
+const maxPooledPayload = 64 * BytesInKilobyte
+
+// Get returns a reset Object from the pool, or a new one if the pool is empty.
+// Release or Put hands it back.
+func (p *ObjectPool) Get() *Object {
+	obj, ok := p.pool.Get().(*Object)
+	if !ok {
+		obj = &Object{Response: &Response{}}
+	}
+	obj.pool = p
+	obj.released = false
+	return obj
+}
+
+// Put resets obj and returns it to the pool. Neither obj nor its payload may
+// be used after.
+func (p *ObjectPool) Put(obj *Object) {
+	obj.checkReleased()
+	obj.Reset()
+	obj.released = true
+
+	if p.Debug {
+		obj.releasedBy = debug.Stack()
+		// Leave the object to the garbage collector, still marked released.
+		return
+	}
+	p.pool.Put(obj)
+}
+
+// Decode decodes frame into an Object from the pool.
+func (p *ObjectPool) Decode(frame []byte, resp *ConnResponder, opts DecodeOptions) (*Object, error) {
+	obj := p.Get()
+	if err := DecodeInto(obj, frame, resp, opts); err != nil {
+		p.Put(obj)
+		return nil, err
+	}
+	return obj, nil
+}
+
+// Release hands an object taken from an ObjectPool back to it once the
+// application is done with it, usually after acking it. Objects that did not
+// come from a pool are left alone.
+func (obj *Object) Release() {
+	if obj.pool != nil {
+		obj.pool.Put(obj)
+	}
+}
+
+// Reset clears every field of obj so nothing of the object it held lingers,
+// the Responder, arguments and payload included. The Response and a payload
+// buffer obj owns are kept for reuse, emptied, while a payload aliasing a
+// frame is let go.
+func (obj *Object) Reset() {
+	response := obj.Response
+	if response != nil {
+		*response = Response{}
+	}
+
+	payload := obj.Payload
+	switch {
+	case obj.payloadAliased || cap(payload) > maxPooledPayload:
+		payload = nil
+	case obj.pool != nil && obj.pool.Debug:
+		// Code still holding the payload reads garbage rather than data that
+		// looks valid.
+		for i := range payload {
+			payload[i] = 0xDE
+		}
+		payload = nil
+	default:
+		payload = payload[:0]
+	}
+
+	*obj = Object{
+		Response: response,
+		Payload:  payload,
+		pool:     obj.pool,
+		released: obj.released,
+	}
+}
+
+// checkReleased panics if obj was released to its pool.
+func (obj *Object) checkReleased() {
+	if !obj.released {
+		return
+	}
+	if obj.releasedBy != nil {
+		panic(fmt.Sprintf(
+			"rhizome: object used after release, released at:\n%s",
+			obj.releasedBy,
+		))
+	}
+	panic("rhizome: object used after release")
+}
@@ -0,0 +1,154 @@
+package rhizome
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// mustPanic runs fn and returns what it panicked with.
+func mustPanic(t *testing.T, what string, fn func()) string {
+	t.Helper()
+
+	var recovered any
+	func() {
+		defer func() { recovered = recover() }()
+		fn()
+	}()
+	if recovered == nil {
+		t.Fatalf("%s did not panic", what)
+	}
+	return fmt.Sprint(recovered)
+}
+
+func TestObjectPool(t *testing.T) {
+	var pool ObjectPool
+	frame := newDecodeFrames(t)["v2"]
+
+	obj, err := pool.Decode(frame, newResponder(), DecodeOptions{AliasPayload: true})
+	if err != nil {
+		t.Fatalf("Decode error: %v", err)
+	}
+	if !bytes.Equal(obj.Payload, newAppendObject(ProtocolV2).Payload) {
+		t.Fatalf("pooled object has the wrong payload")
+	}
+
+	obj.Release()
+	if obj.Responder != nil || obj.Payload != nil || obj.UID != "" {
+		t.Fatalf("Release kept the object's fields: %+v", obj)
+	}
+	if _, err := pool.Decode(frame[:5], nil, DecodeOptions{}); err == nil {
+		t.Fatalf("expected error for a truncated frame")
+	}
+}
+
+func TestObject_Reset(t *testing.T) {
+	obj := newAppendObject(ProtocolV2)
+	obj.Responder = newResponder()
+	obj.FragIndex, obj.FragCount = 1, 2
+	response := obj.Response
+	buf := obj.Payload
+
+	obj.Reset()
+	if obj.Responder != nil || obj.UID != "" || obj.Arg1 != "" || obj.Arg4 != "" ||
+		obj.FragCount != 0 || obj.Version != 0 || len(obj.Payload) != 0 {
+		t.Fatalf("Reset left fields behind: %+v", obj)
+	}
+	if obj.Response != response || *response != (Response{}) {
+		t.Fatalf("Reset did not clear and keep the Response")
+	}
+	if cap(obj.Payload) != cap(buf) {
+		t.Fatalf("Reset dropped the payload buffer the object owns")
+	}
+
+	frame := newDecodeFrames(t)["v1"]
+	if err := DecodeInto(obj, frame, nil, DecodeOptions{AliasPayload: true}); err != nil {
+		t.Fatalf("DecodeInto error: %v", err)
+	}
+	obj.Reset()
+	if obj.Payload != nil {
+		t.Fatalf("Reset kept a payload aliasing the frame")
+	}
+}
+
+func TestObject_Release_NotPooled(t *testing.T) {
+	obj := newAppendObject(ProtocolV1)
+	obj.Release()
+	obj.Release()
+	if obj.UID != "uid-append" {
+		t.Fatalf("Release touched an object that is not pooled")
+	}
+}
+
+func TestObjectPool_UseAfterReleasePanics(t *testing.T) {
+	var pool ObjectPool
+	obj, err := pool.Decode(newDecodeFrames(t)["v1"], newResponder(), DecodeOptions{})
+	if err != nil {
+		t.Fatalf("Decode error: %v", err)
+	}
+	obj.Release()
+
+	mustPanic(t, "RespondWithAck", func() { _ = obj.RespondWithAck(AckSent) })
+	mustPanic(t, "EncodeFrame", func() { _, _ = EncodeFrame(obj) })
+	mustPanic(t, "DecodeInto", func() {
+		_ = DecodeInto(obj, newDecodeFrames(t)["v1"], nil, DecodeOptions{})
+	})
+	mustPanic(t, "second Release", obj.Release)
+}
+
+func TestObjectPool_Debug(t *testing.T) {
+	pool := &ObjectPool{Debug: true}
+	obj, err := pool.Decode(newDecodeFrames(t)["v1"], newResponder(), DecodeOptions{})
+	if err != nil {
+		t.Fatalf("Decode error: %v", err)
+	}
+	payload := obj.Payload
+
+	obj.Release()
+	if !bytes.Equal(payload, bytes.Repeat([]byte{0xDE}, len(payload))) {
+		t.Fatalf("payload held past Release was not overwritten")
+	}
+	if pool.Get() == obj {
+		t.Fatalf("debug pool handed out a released object")
+	}
+
+	msg := mustPanic(t, "RespondWithAck", func() { _ = obj.RespondWithAck(AckSent) })
+	if !strings.Contains(msg, "TestObjectPool_Debug") {
+		t.Fatalf("panic does not say where the object was released:\n%s", msg)
+	}
+}
+
+func TestSession_ObjectPool(t *testing.T) {
+	pool := &ObjectPool{Debug: true}
+	client, server := newSessionPair(t, SessionConfig{}, SessionConfig{
+		ObjectPool: pool,
+	})
+
+	small := newAppendObject(ProtocolV2)
+	large := newAppendObject(ProtocolV2)
+	large.UID = "uid-large"
+	large.Payload = bytes.Repeat([]byte("0123456789"), 10*BytesInKilobyte)
+
+	for _, want := range []*Object{small, large} {
+		go func() { _ = client.Send(want) }()
+
+		got, err := server.Receive()
+		if err != nil {
+			t.Fatalf("Receive error: %v", err)
+		}
+		if got.UID != want.UID || !bytes.Equal(got.Payload, want.Payload) {
+			t.Fatalf("received %q with %d payload bytes, want %q with %d",
+				got.UID, len(got.Payload), want.UID, len(want.Payload))
+		}
+		if err := got.RespondWithAck(AckSent); err != nil {
+			t.Fatalf("RespondWithAck error: %v", err)
+		}
+		got.Release()
+
+		resp, err := client.ReceiveResponse()
+		if err != nil || resp.UID != want.UID {
+			t.Fatalf("ReceiveResponse = %+v, %v", resp, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package rhizome_test
+
+import (
+	"testing"
+	"testing/quick"
+
+	"github.com/signal-weave/rhizome"
+	"github.com/signal-weave/rhizome/rhizometest"
+)
+
+// The properties live in an external test package, as rhizometest imports
+// rhizome.
+
+func TestProperty_RoundTrip(t *testing.T) {
+	err := quick.Check(func(o rhizometest.RandomObject) bool {
+		frame, err := rhizome.EncodeFrame(o.Object)
+		if err != nil {
+			t.Logf("EncodeFrame error: %v", err)
+			return false
+		}
+		got, err := rhizome.DecodeFrame(frame, nil)
+		if err != nil {
+			t.Logf("DecodeFrame error: %v", err)
+			return false
+		}
+		if diff := rhizometest.DiffObjects(o.Object, got); diff != "" {
+			t.Logf("round-trip differs:\n%s", diff)
+			return false
+		}
+		return true
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProperty_EncodedSize(t *testing.T) {
+	err := quick.Check(func(o rhizometest.RandomObject) bool {
+		frame, err := rhizome.EncodeFrame(o.Object)
+		if err != nil {
+			t.Logf("EncodeFrame error: %v", err)
+			return false
+		}
+		size, err := rhizome.EncodedSize(o.Object)
+		if err != nil || size != len(frame) {
+			t.Logf("EncodedSize = %d, %v, want %d", size, err, len(frame))
+			return false
+		}
+		return true
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,8 +1,29 @@
 package rhizome
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"os"
 	"sync"
+	"time"
+)
+
+var (
+	// ErrResponderClosed is returned by Write on an asynchronous
+	// ConnResponder after Close, and wraps the error of WriteContext when the
+	// connection is closed.
+	ErrResponderClosed = errors.New("responder closed")
+
+	// ErrResponderTimeout is wrapped by the error of WriteContext when the
+	// context's deadline passes before the write is done.
+	ErrResponderTimeout = errors.New("responder write timed out")
+
+	// ErrResponderOverflow is returned by ConnResponder.Write when its queue
+	// is full and the overflow policy dropped the write or the connection.
+	ErrResponderOverflow = errors.New("responder queue overflow")
 )
 
 // ConnResponder manages the net.Conn created by the server.
@@ -11,6 +32,9 @@ import (
 type ConnResponder struct {
 	C  net.Conn
 	mu sync.Mutex
+
+	// Nil unless created by NewAsyncConnResponder.
+	async *asyncWriter
 }
 
 func NewConnResponder(conn net.Conn) *ConnResponder {
@@ -19,15 +43,372 @@ func NewConnResponder(conn net.Conn) *ConnResponder {
 	}
 }
 
+// NewAsyncConnResponder returns a ConnResponder whose Write queues the bytes
+// and returns right away, while a goroutine of its own writes them to conn.
+// A slow consumer then only fills its own queue instead of stalling every
+// goroutine acking to it.
+//
+// Close stops the writer goroutine once the queue is drained, or closes the
+// connection if that takes longer than the CloseTimeout.
+func NewAsyncConnResponder(conn net.Conn, cfg ResponderConfig) *ConnResponder {
+	cr := &ConnResponder{
+		C:     conn,
+		async: newAsyncWriter(conn, cfg),
+	}
+	go cr.async.run()
+	return cr
+}
+
 // RemoteAddr is shorthand for ConnResponder.C.RemoteAddr().String()
 func (cr *ConnResponder) RemoteAddr() string {
 	return cr.C.RemoteAddr().String()
 }
 
 // Write sends the given payload back to the connection's return address.
+//
+// An asynchronous responder queues a copy of the payload instead, and only
+// returns errors from earlier writes or its overflow policy.
 func (cr *ConnResponder) Write(b []byte) error {
-	cr.mu.Lock()
-	defer cr.mu.Unlock()
-	_, err := cr.C.Write(b)
+	return cr.WriteContext(context.Background(), b)
+}
+
+// WriteContext is Write bounded by ctx. The context's deadline becomes the
+// connection's write deadline and cancelling it unblocks the write. Timeouts
+// return an error wrapping ErrResponderTimeout and context.DeadlineExceeded,
+// cancellation one wrapping context.Canceled, and a closed connection one
+// wrapping ErrResponderClosed.
+//
+// A write cut short may have sent part of b, after which the peer can no
+// longer make sense of the stream and the connection should be closed.
+//
+// An asynchronous responder only uses ctx while waiting for room in its queue.
+// A session's responder shares its connection with the session's other
+// writes. There ctx also bounds the wait for them to finish, the deadline only
+// applies while the response itself is written, and a response cut short
+// closes the session.
+func (cr *ConnResponder) WriteContext(ctx context.Context, b []byte) error {
+	if err := ctx.Err(); err != nil {
+		return contextWriteError(ctx)
+	}
+	if cr.async != nil {
+		return cr.async.write(ctx, b)
+	}
+
+	var err error
+	if cw, ok := cr.C.(contextWriter); ok {
+		err = cw.writeContext(ctx, b)
+	} else {
+		cr.mu.Lock()
+		err = writeConnContext(ctx, cr.C, func() error {
+			_, err := cr.C.Write(b)
+			return err
+		})
+		cr.mu.Unlock()
+	}
+	if err != nil && ctx.Done() != nil {
+		return writeError(ctx, err)
+	}
 	return err
 }
+
+// contextWriter is implemented by connections that bound writes by a context
+// themselves, because others share their write deadline.
+type contextWriter interface {
+	writeContext(ctx context.Context, b []byte) error
+}
+
+// writeConnContext runs write, which writes to conn, with the context's
+// deadline as conn's write deadline. Cancelling ctx moves the deadline into
+// the past, failing the write. The deadline is cleared before returning.
+func writeConnContext(ctx context.Context, conn net.Conn, write func() error) error {
+	if ctx.Done() == nil {
+		return write()
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	defer func() { _ = conn.SetWriteDeadline(time.Time{}) }()
+
+	cancelled := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetWriteDeadline(time.Unix(1, 0))
+		close(cancelled)
+	})
+	err := write()
+	if !stop() {
+		<-cancelled
+	}
+	return err
+}
+
+// writeError tells timeouts and cancellation apart from closed connections.
+func writeError(ctx context.Context, err error) error {
+	switch {
+	case ctx.Err() != nil:
+		return contextWriteError(ctx)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		// The connection's deadline may pass just before the context's.
+		return fmt.Errorf("%w: %w", ErrResponderTimeout, context.DeadlineExceeded)
+	case errors.Is(err, net.ErrClosed), errors.Is(err, io.ErrClosedPipe),
+		errors.Is(err, ErrMuxClosed), errors.Is(err, ErrSessionClosed):
+		return fmt.Errorf("%w: %w", ErrResponderClosed, err)
+	default:
+		return err
+	}
+}
+
+func contextWriteError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w: %w", ErrResponderTimeout, ctx.Err())
+	}
+	return fmt.Errorf("responder write cancelled: %w", ctx.Err())
+}
+
+// Close stops an asynchronous responder after writing what is still queued,
+// and returns the error that stopped it early, if any. The connection itself
+// is left open, unless the queue was not written out within the CloseTimeout
+// of the responder's config, see CloseContext. Close does nothing for a
+// synchronous responder.
+func (cr *ConnResponder) Close() error {
+	if cr.async == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cr.async.cfg.CloseTimeout)
+	defer cancel()
+	return cr.CloseContext(ctx)
+}
+
+// CloseContext is Close bounded by ctx instead of the CloseTimeout. A consumer
+// that stopped reading leaves the writer stuck in a write to the connection,
+// so once ctx is done what is still queued is dropped and the connection is
+// closed under the writer. The error then wraps ErrResponderTimeout or
+// context.Canceled, like that of WriteContext.
+func (cr *ConnResponder) CloseContext(ctx context.Context) error {
+	if cr.async != nil {
+		return cr.async.close(ctx)
+	}
+	return nil
+}
+
+// Stats returns the queue depth and counters of an asynchronous responder,
+// or zero for a synchronous one.
+func (cr *ConnResponder) Stats() ResponderStats {
+	if cr.async != nil {
+		return cr.async.stats()
+	}
+	return ResponderStats{}
+}
+
+//--------Asynchronous Writes---------------------------------------------------
+
+// OverflowPolicy decides what an asynchronous responder does with a write
+// that finds its queue full.
+type OverflowPolicy uint8
+
+const (
+	// OverflowBlock makes Write wait until the queue has room.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropOldest drops the oldest queued write to make room.
+	OverflowDropOldest
+
+	// OverflowDropNewest drops the write, which returns ErrResponderOverflow.
+	OverflowDropNewest
+
+	// OverflowDisconnect closes the connection, giving up on a consumer that
+	// can not keep up. The write returns ErrResponderOverflow.
+	OverflowDisconnect
+)
+
+// ResponderConfig controls an asynchronous ConnResponder.
+type ResponderConfig struct {
+	// How many writes may be queued. Defaults to 1024.
+	QueueSize int
+
+	// What to do with writes once the queue is full. Defaults to OverflowBlock.
+	Overflow OverflowPolicy
+
+	// Queued writes are coalesced into a single write to the connection of up
+	// to MaxCoalesce bytes. Defaults to 64KB.
+	MaxCoalesce int
+
+	// How long Close waits for the queue to be written before giving up on
+	// the consumer and closing the connection. Defaults to 5 seconds.
+	CloseTimeout time.Duration
+}
+
+// ResponderStats describes the queue of an asynchronous ConnResponder.
+type ResponderStats struct {
+	// Writes queued and not yet written to the connection.
+	Depth int
+
+	// Writes dropped by the overflow policy.
+	Dropped uint64
+
+	// Writes to the connection, each carrying one or more queued writes.
+	Flushes uint64
+}
+
+type asyncWriter struct {
+	conn net.Conn
+	cfg  ResponderConfig
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   [][]byte
+	closed  bool
+	err     error // sticky, from the connection or the overflow policy
+	dropped uint64
+	flushes uint64
+
+	stopped chan struct{}
+}
+
+func newAsyncWriter(conn net.Conn, cfg ResponderConfig) *asyncWriter {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 1024
+	}
+	if cfg.MaxCoalesce <= 0 {
+		cfg.MaxCoalesce = 64 * BytesInKilobyte
+	}
+	if cfg.CloseTimeout <= 0 {
+		cfg.CloseTimeout = 5 * time.Second
+	}
+
+	w := &asyncWriter{
+		conn:    conn,
+		cfg:     cfg,
+		stopped: make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	return w
+}
+
+func (w *asyncWriter) write(ctx context.Context, b []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if ctx.Done() != nil && w.cfg.Overflow == OverflowBlock {
+		stop := context.AfterFunc(ctx, func() {
+			w.mu.Lock()
+			w.cond.Broadcast()
+			w.mu.Unlock()
+		})
+		defer stop()
+	}
+
+	for {
+		switch {
+		case w.err != nil:
+			return w.err
+		case w.closed:
+			return ErrResponderClosed
+		case ctx.Err() != nil:
+			return contextWriteError(ctx)
+		case len(w.queue) < w.cfg.QueueSize:
+			w.queue = append(w.queue, append([]byte(nil), b...))
+			w.cond.Broadcast()
+			return nil
+		}
+
+		switch w.cfg.Overflow {
+		case OverflowDropOldest:
+			w.queue[0] = nil
+			w.queue = w.queue[1:]
+			w.dropped++
+		case OverflowDropNewest:
+			w.dropped++
+			return ErrResponderOverflow
+		case OverflowDisconnect:
+			w.dropped += uint64(len(w.queue)) + 1
+			w.queue = nil
+			w.err = ErrResponderOverflow
+			w.cond.Broadcast()
+			_ = w.conn.Close()
+			return ErrResponderOverflow
+		default:
+			w.cond.Wait()
+		}
+	}
+}
+
+// run writes queued writes to the connection until the writer is closed and
+// drained, or the connection fails.
+func (w *asyncWriter) run() {
+	defer close(w.stopped)
+
+	var buf []byte
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && !w.closed && w.err == nil {
+			w.cond.Wait()
+		}
+		if w.err != nil || len(w.queue) == 0 {
+			w.mu.Unlock()
+			return
+		}
+
+		// Take as many queued writes as fit, but at least one.
+		buf = append(buf[:0], w.queue[0]...)
+		n := 1
+		for n < len(w.queue) && len(buf)+len(w.queue[n]) <= w.cfg.MaxCoalesce {
+			buf = append(buf, w.queue[n]...)
+			n++
+		}
+		clear(w.queue[:n])
+		w.queue = w.queue[n:]
+		w.flushes++
+		w.cond.Broadcast()
+		w.mu.Unlock()
+
+		if _, err := w.conn.Write(buf); err != nil {
+			w.mu.Lock()
+			if w.err == nil {
+				w.err = err
+			}
+			w.queue = nil
+			w.cond.Broadcast()
+			w.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (w *asyncWriter) close(ctx context.Context) error {
+	w.mu.Lock()
+	w.closed = true
+	w.cond.Broadcast()
+	w.mu.Unlock()
+
+	select {
+	case <-w.stopped:
+	case <-ctx.Done():
+		w.mu.Lock()
+		w.dropped += uint64(len(w.queue))
+		w.queue = nil
+		if w.err == nil {
+			w.err = contextWriteError(ctx)
+		}
+		w.cond.Broadcast()
+		w.mu.Unlock()
+
+		_ = w.conn.Close()
+		<-w.stopped
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *asyncWriter) stats() ResponderStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return ResponderStats{
+		Depth:   len(w.queue),
+		Dropped: w.dropped,
+		Flushes: w.flushes,
+	}
+}
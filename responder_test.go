@@ -2,9 +2,15 @@ package rhizome
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
 	"sync"
 	"testing"
+	"testing/synctest"
 	"time"
 )
 
@@ -98,3 +104,448 @@ func TestConnResponder_Write_PropagatesUnderlyingError(t *testing.T) {
 		t.Fatalf("Write() returned %v, want %v", err, fc.writeErr)
 	}
 }
+
+// gatedConn is a fakeConn whose writes wait until the gate is opened.
+type gatedConn struct {
+	*fakeConn
+	gate chan struct{}
+}
+
+func newGatedConn() *gatedConn {
+	return &gatedConn{fakeConn: newFakeConn("1.2.3.4:5"), gate: make(chan struct{})}
+}
+
+func (c *gatedConn) Write(p []byte) (int, error) {
+	<-c.gate
+	return c.fakeConn.Write(p)
+}
+
+// newStalledResponder returns an async responder with a queue of two whose
+// writer is stuck writing "1".
+func newStalledResponder(t *testing.T, policy OverflowPolicy) (*ConnResponder, *gatedConn) {
+	t.Helper()
+
+	gc := newGatedConn()
+	cr := NewAsyncConnResponder(gc, ResponderConfig{QueueSize: 2, Overflow: policy})
+	if err := cr.Write([]byte("1")); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for cr.Stats().Depth != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("writer never picked up the first write")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, b := range []string{"2", "3"} {
+		if err := cr.Write([]byte(b)); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+	}
+	return cr, gc
+}
+
+func TestAsyncConnResponder_DoesNotBlockOnSlowConsumer(t *testing.T) {
+	cr, gc := newStalledResponder(t, OverflowBlock)
+
+	if got := cr.Stats().Depth; got != 2 {
+		t.Fatalf("Depth = %d, want 2", got)
+	}
+
+	close(gc.gate)
+	if err := cr.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if got := gc.buf.String(); got != "123" {
+		t.Fatalf("conn got %q, want %q", got, "123")
+	}
+	if flushes := cr.Stats().Flushes; flushes != 2 {
+		t.Fatalf("Flushes = %d, want the queued writes coalesced into one", flushes)
+	}
+	if err := cr.Write([]byte("4")); err != ErrResponderClosed {
+		t.Fatalf("Write after Close = %v, want ErrResponderClosed", err)
+	}
+}
+
+func TestAsyncConnResponder_OverflowBlock(t *testing.T) {
+	cr, gc := newStalledResponder(t, OverflowBlock)
+
+	written := make(chan error, 1)
+	go func() { written <- cr.Write([]byte("4")) }()
+	select {
+	case err := <-written:
+		t.Fatalf("Write returned %v with a full queue", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(gc.gate)
+	if err := <-written; err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	_ = cr.Close()
+	if got := gc.buf.String(); got != "1234" {
+		t.Fatalf("conn got %q, want %q", got, "1234")
+	}
+}
+
+func TestAsyncConnResponder_OverflowDropOldest(t *testing.T) {
+	cr, gc := newStalledResponder(t, OverflowDropOldest)
+
+	if err := cr.Write([]byte("4")); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if got := cr.Stats().Dropped; got != 1 {
+		t.Fatalf("Dropped = %d, want 1", got)
+	}
+
+	close(gc.gate)
+	_ = cr.Close()
+	if got := gc.buf.String(); got != "134" {
+		t.Fatalf("conn got %q, want %q", got, "134")
+	}
+}
+
+func TestAsyncConnResponder_OverflowDropNewest(t *testing.T) {
+	cr, gc := newStalledResponder(t, OverflowDropNewest)
+
+	if err := cr.Write([]byte("4")); err != ErrResponderOverflow {
+		t.Fatalf("Write error = %v, want ErrResponderOverflow", err)
+	}
+	if got := cr.Stats().Dropped; got != 1 {
+		t.Fatalf("Dropped = %d, want 1", got)
+	}
+
+	close(gc.gate)
+	_ = cr.Close()
+	if got := gc.buf.String(); got != "123" {
+		t.Fatalf("conn got %q, want %q", got, "123")
+	}
+}
+
+func TestAsyncConnResponder_OverflowDisconnect(t *testing.T) {
+	cr, gc := newStalledResponder(t, OverflowDisconnect)
+
+	if err := cr.Write([]byte("4")); err != ErrResponderOverflow {
+		t.Fatalf("Write error = %v, want ErrResponderOverflow", err)
+	}
+	gc.mu.Lock()
+	closed := gc.closed
+	gc.mu.Unlock()
+	if !closed {
+		t.Fatalf("connection left open after overflow")
+	}
+	if err := cr.Write([]byte("5")); err != ErrResponderOverflow {
+		t.Fatalf("Write after disconnect = %v, want ErrResponderOverflow", err)
+	}
+	if got := cr.Stats().Dropped; got != 3 {
+		t.Fatalf("Dropped = %d, want 3", got)
+	}
+	close(gc.gate)
+}
+
+func TestAsyncConnResponder_PropagatesUnderlyingError(t *testing.T) {
+	fc := newFakeConn("1.2.3.4:5")
+	fc.writeErr = errors.New("boom")
+	cr := NewAsyncConnResponder(fc, ResponderConfig{})
+
+	if err := cr.Write([]byte("queued")); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if err := cr.Close(); err == nil || err.Error() != "boom" {
+		t.Fatalf("Close error = %v, want boom", err)
+	}
+	if err := cr.Write([]byte("later")); err == nil || err.Error() != "boom" {
+		t.Fatalf("Write error = %v, want boom", err)
+	}
+}
+
+func TestSession_AsyncResponder(t *testing.T) {
+	serverCfg := SessionConfig{AsyncResponder: &ResponderConfig{}}
+	client, server := newSessionPair(t, SessionConfig{}, serverCfg)
+
+	for _, uid := range []string{"uid-1", "uid-2", "uid-3"} {
+		obj := NewObject(
+			ObjDelivery, CmdSend, AckPlcyOnsent,
+			uid, "", "", "", "",
+			EncodingNA, nil,
+		)
+		go func() { _ = client.Send(obj) }()
+		got, err := server.Receive()
+		if err != nil {
+			t.Fatalf("Receive error: %v", err)
+		}
+		if err := got.RespondWithAck(AckSent); err != nil {
+			t.Fatalf("RespondWithAck error: %v", err)
+		}
+		resp, err := client.ReceiveResponse()
+		if err != nil || resp.UID != uid {
+			t.Fatalf("ReceiveResponse = %+v, %v", resp, err)
+		}
+	}
+}
+
+func TestAsyncConnResponder_CloseGivesUpOnAPeerThatStoppedReading(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		c, peer := net.Pipe()
+		defer peer.Close()
+
+		cr := NewAsyncConnResponder(c, ResponderConfig{CloseTimeout: time.Second})
+		for _, b := range []string{"1", "2"} {
+			if err := cr.Write([]byte(b)); err != nil {
+				t.Fatalf("Write error: %v", err)
+			}
+			// The writer takes "1" and gets stuck, leaving "2" queued.
+			synctest.Wait()
+		}
+
+		start := time.Now()
+		err := cr.Close()
+		if elapsed := time.Since(start); elapsed != time.Second {
+			t.Fatalf("Close took %v, want the CloseTimeout", elapsed)
+		}
+		if !errors.Is(err, ErrResponderTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Close error = %v, want ErrResponderTimeout", err)
+		}
+		if got := cr.Stats().Dropped; got != 1 {
+			t.Fatalf("Dropped = %d, want the queued write dropped", got)
+		}
+		if _, err := c.Write([]byte("3")); !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("conn Write error = %v, want the connection closed", err)
+		}
+	})
+}
+
+func TestSession_AsyncResponder_CloseGivesUpOnAPeerThatStoppedReading(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		c, s := net.Pipe()
+		defer c.Close()
+
+		sessions := make(chan *Session, 1)
+		go func() {
+			server, err := NewSession(s, SessionConfig{
+				AsyncResponder: &ResponderConfig{},
+				CloseTimeout:   time.Second,
+			})
+			if err != nil {
+				t.Errorf("NewSession error: %v", err)
+			}
+			sessions <- server
+		}()
+
+		// The peer sends an object and never reads again.
+		agreement, err := Handshake(c, DefaultCapabilities())
+		if err != nil {
+			t.Fatalf("Handshake error: %v", err)
+		}
+		frame, err := agreement.EncodeFrame(NewObject(
+			ObjDelivery, CmdSend, AckPlcyOnsent,
+			"uid-1", "", "", "", "",
+			EncodingNA, nil,
+		))
+		if err != nil {
+			t.Fatalf("EncodeFrame error: %v", err)
+		}
+		if err := WriteFrame(c, frame); err != nil {
+			t.Fatalf("WriteFrame error: %v", err)
+		}
+
+		server := <-sessions
+		obj, err := server.Receive()
+		if err != nil {
+			t.Fatalf("Receive error: %v", err)
+		}
+		if err := obj.RespondWithAck(AckSent); err != nil {
+			t.Fatalf("RespondWithAck error: %v", err)
+		}
+		synctest.Wait()
+
+		start := time.Now()
+		_ = server.Close()
+		if elapsed := time.Since(start); elapsed != time.Second {
+			t.Fatalf("Close took %v, want the CloseTimeout", elapsed)
+		}
+		<-server.Done()
+		if !errors.Is(server.Err(), ErrSessionClosed) {
+			t.Fatalf("Err() = %v, want ErrSessionClosed", server.Err())
+		}
+	})
+}
+
+// newStuckResponder returns a responder over a pipe nobody reads from yet.
+func newStuckResponder(t *testing.T) (*ConnResponder, net.Conn) {
+	t.Helper()
+
+	c, peer := net.Pipe()
+	t.Cleanup(func() {
+		c.Close()
+		peer.Close()
+	})
+	return NewConnResponder(c), peer
+}
+
+func TestConnResponder_WriteContext_Deadline(t *testing.T) {
+	cr, peer := newStuckResponder(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := cr.WriteContext(ctx, []byte("stuck"))
+	if !errors.Is(err, ErrResponderTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WriteContext error = %v, want a timeout", err)
+	}
+	if errors.Is(err, ErrResponderClosed) {
+		t.Fatalf("timeout %v reported as a closed connection", err)
+	}
+
+	// The deadline does not outlive the write.
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+	time.Sleep(30 * time.Millisecond)
+	if err := cr.Write([]byte("later")); err != nil {
+		t.Fatalf("Write after timeout error: %v", err)
+	}
+}
+
+func TestConnResponder_WriteContext_Cancel(t *testing.T) {
+	cr, _ := newStuckResponder(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err := cr.WriteContext(ctx, []byte("stuck"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("WriteContext error = %v, want context.Canceled", err)
+	}
+	if errors.Is(err, ErrResponderTimeout) {
+		t.Fatalf("cancellation %v reported as a timeout", err)
+	}
+
+	if err := cr.WriteContext(ctx, []byte("again")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("WriteContext with a done context = %v, want context.Canceled", err)
+	}
+}
+
+func TestConnResponder_WriteContext_ClosedConn(t *testing.T) {
+	cr, peer := newStuckResponder(t)
+	_ = peer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := cr.WriteContext(ctx, []byte("gone"))
+	if !errors.Is(err, ErrResponderClosed) || errors.Is(err, ErrResponderTimeout) {
+		t.Fatalf("WriteContext error = %v, want ErrResponderClosed", err)
+	}
+}
+
+func TestSession_WriteContext_CancelLeavesSendAlone(t *testing.T) {
+	// Without credits the client's sends are only held back once the server
+	// stops reading, here after its queue filled up.
+	caps := DefaultCapabilities()
+	caps.Features &^= FeatureCredits
+	cfg := SessionConfig{Capabilities: caps}
+	client, server := newSessionPair(t, cfg, cfg)
+
+	const n = 100
+	sent := make(chan error, 1)
+	go func() {
+		for i := range n {
+			obj := NewObject(
+				ObjDelivery, CmdSend, AckPlcyNoreply,
+				"uid-"+strconv.Itoa(i), "", "", "", "",
+				EncodingNA, bytes.Repeat([]byte("x"), 100),
+			)
+			if err := client.Send(obj); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- nil
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// The response waits for the stuck Send, and gives up when cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	written := make(chan error, 1)
+	go func() {
+		written <- client.Responder.WriteContext(ctx, EncodeResponseV1(Response{UID: "uid-ack", Ack: AckSent}))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	if err := <-written; !errors.Is(err, context.Canceled) {
+		t.Fatalf("WriteContext error = %v, want context.Canceled", err)
+	}
+
+	received := make(chan error, 1)
+	go func() {
+		for i := range n {
+			obj, err := server.Receive()
+			if err != nil {
+				received <- fmt.Errorf("Receive %d error: %w", i, err)
+				return
+			}
+			if want := "uid-" + strconv.Itoa(i); obj.UID != want || len(obj.Payload) != 100 {
+				received <- fmt.Errorf("Receive %d = %s with %d bytes, want %s", i, obj.UID, len(obj.Payload), want)
+				return
+			}
+		}
+		received <- nil
+	}()
+	for range 2 {
+		select {
+		case err := <-sent:
+			if err != nil {
+				t.Fatalf("Send error: %v", err)
+			}
+		case err := <-received:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("objects sent before the cancelled write never arrived")
+		}
+	}
+	if err := client.Err(); err != nil {
+		t.Fatalf("client stopped: %v", err)
+	}
+}
+
+func TestAsyncConnResponder_WriteContext_FullQueue(t *testing.T) {
+	cr, gc := newStalledResponder(t, OverflowBlock)
+	defer close(gc.gate)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := cr.WriteContext(ctx, []byte("4"))
+	if !errors.Is(err, ErrResponderTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WriteContext error = %v, want a timeout", err)
+	}
+}
+
+func TestObject_RespondWithAckContext(t *testing.T) {
+	cr, peer := newStuckResponder(t)
+	obj := NewObject(
+		ObjDelivery, CmdSend, AckPlcyOnsent,
+		"uid-1", "", "", "", "",
+		EncodingNA, nil,
+	)
+	obj.Responder = cr
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := obj.RespondWithAckContext(ctx, AckSent); !errors.Is(err, ErrResponderTimeout) {
+		t.Fatalf("RespondWithAckContext error = %v, want a timeout", err)
+	}
+
+	got := make(chan Response, 1)
+	go func() {
+		msg := make([]byte, 64)
+		n, _ := peer.Read(msg)
+		resp, _, _ := DecodeResponseV1(msg[:n])
+		got <- resp
+	}()
+	if err := obj.RespondWithAckContext(context.Background(), AckSent); err != nil {
+		t.Fatalf("RespondWithAckContext error: %v", err)
+	}
+	if resp := <-got; resp.UID != "uid-1" || resp.Ack != AckSent {
+		t.Fatalf("peer got %+v", resp)
+	}
+}
@@ -0,0 +1,271 @@
+package rhizometest
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ConnConfig configures NewConnPair.
+type ConnConfig struct {
+	// The addresses of the two ends. Default to "client" and "server".
+	ClientAddr, ServerAddr string
+
+	// How many bytes each direction buffers before Write blocks until the
+	// other end reads. Zero buffers without limit, so writes never block.
+	Capacity int
+}
+
+// NewConnPair returns the two ends of an in-memory connection. Unlike
+// net.Pipe, writes are buffered, so a test can write to one end before reading
+// from the other, and a limited Capacity makes a slow reader stall writers the
+// way a full socket buffer does. Both ends support deadlines.
+func NewConnPair(cfg ConnConfig) (client, server *Conn) {
+	if cfg.ClientAddr == "" {
+		cfg.ClientAddr = "client"
+	}
+	if cfg.ServerAddr == "" {
+		cfg.ServerAddr = "server"
+	}
+
+	toServer := newHalfPipe(cfg.Capacity)
+	toClient := newHalfPipe(cfg.Capacity)
+	client = newConn(Addr(cfg.ClientAddr), Addr(cfg.ServerAddr), toClient, toServer)
+	server = newConn(Addr(cfg.ServerAddr), Addr(cfg.ClientAddr), toServer, toClient)
+	return client, server
+}
+
+// Addr is a net.Addr of the "rhizometest" network.
+type Addr string
+
+func (a Addr) Network() string { return "rhizometest" }
+func (a Addr) String() string  { return string(a) }
+
+// Conn is one end of a connection made by NewConnPair.
+type Conn struct {
+	local, remote Addr
+	in, out       *halfPipe
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newConn(local, remote Addr, in, out *halfPipe) *Conn {
+	return &Conn{
+		local:         local,
+		remote:        remote,
+		in:            in,
+		out:           out,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		closed:        make(chan struct{}),
+	}
+}
+
+// Read reads what the other end wrote, and returns io.EOF once the other end
+// is closed and everything it wrote was read.
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.in.read(b, c.closed, &c.readDeadline)
+}
+
+// Write buffers b for the other end, waiting for room if the buffer is full.
+// Writing to a connection whose other end is closed fails with
+// io.ErrClosedPipe.
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for {
+		if c.isClosed() {
+			return written, net.ErrClosed
+		}
+		if c.writeDeadline.passed() {
+			return written, os.ErrDeadlineExceeded
+		}
+
+		p := c.out
+		p.mu.Lock()
+		if p.broken {
+			p.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		n := len(b) - written
+		if p.capacity > 0 {
+			n = min(n, p.capacity-len(p.buf))
+		}
+		if n > 0 {
+			p.buf = append(p.buf, b[written:written+n]...)
+			written += n
+			p.signalLocked()
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		if written == len(b) {
+			return written, nil
+		}
+		if err := wait(changed, c.closed, &c.writeDeadline); err != nil {
+			return written, err
+		}
+	}
+}
+
+// wait blocks until changed or closed is closed, or the deadline passes.
+func wait(changed, closed <-chan struct{}, d *deadline) error {
+	at, moved := d.get()
+
+	var expired <-chan time.Time
+	if !at.IsZero() {
+		wait := time.Until(at)
+		if wait <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-changed:
+	case <-moved:
+	case <-closed:
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// Close closes both directions. The other end reads what was already written
+// and then io.EOF.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		c.in.mu.Lock()
+		c.in.broken = true
+		c.in.buf = nil
+		c.in.signalLocked()
+		c.in.mu.Unlock()
+
+		c.out.mu.Lock()
+		c.out.eof = true
+		c.out.signalLocked()
+		c.out.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *Conn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// halfPipe is the buffer carrying one direction of a connection.
+type halfPipe struct {
+	mu       sync.Mutex
+	buf      []byte
+	capacity int
+
+	// eof is set once the writing end is closed, broken once the reading end
+	// is.
+	eof, broken bool
+
+	// changed is closed and replaced whenever any of the above changes.
+	changed chan struct{}
+}
+
+func newHalfPipe(capacity int) *halfPipe {
+	return &halfPipe{capacity: capacity, changed: make(chan struct{})}
+}
+
+// read reads what was written to p for a connection that is closed once
+// closed is.
+func (p *halfPipe) read(b []byte, closed <-chan struct{}, d *deadline) (int, error) {
+	for {
+		select {
+		case <-closed:
+			return 0, net.ErrClosed
+		default:
+		}
+
+		p.mu.Lock()
+		if len(p.buf) > 0 {
+			n := copy(b, p.buf)
+			p.buf = p.buf[n:]
+			p.signalLocked()
+			p.mu.Unlock()
+			return n, nil
+		}
+		if p.eof {
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		if err := wait(changed, closed, d); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (p *halfPipe) signalLocked() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// deadline is a read or write deadline that wakes waiters when it moves.
+type deadline struct {
+	mu    sync.Mutex
+	at    time.Time
+	moved chan struct{}
+}
+
+func newDeadline() deadline {
+	return deadline{moved: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.at = t
+	close(d.moved)
+	d.moved = make(chan struct{})
+}
+
+func (d *deadline) get() (time.Time, <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.at, d.moved
+}
+
+func (d *deadline) passed() bool {
+	at, _ := d.get()
+	return !at.IsZero() && !time.Now().Before(at)
+}
@@ -0,0 +1,107 @@
+package rhizometest
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/signal-weave/rhizome"
+)
+
+func TestConnPair_BuffersWrites(t *testing.T) {
+	client, server := NewConnPair(ConnConfig{ClientAddr: "10.0.0.1:5000"})
+
+	// Nobody reads yet, and the write does not wait for them.
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(server, got); err != nil || string(got) != "hello" {
+		t.Fatalf("ReadFull = %q, %v", got, err)
+	}
+
+	if server.RemoteAddr().String() != "10.0.0.1:5000" || client.RemoteAddr().String() != "server" {
+		t.Fatalf("addresses are %v and %v", server.RemoteAddr(), client.RemoteAddr())
+	}
+}
+
+func TestConnPair_Close(t *testing.T) {
+	client, server := NewConnPair(ConnConfig{})
+
+	_, _ = client.Write([]byte("last words"))
+	_ = client.Close()
+
+	got, err := io.ReadAll(server)
+	if err != nil || string(got) != "last words" {
+		t.Fatalf("ReadAll = %q, %v", got, err)
+	}
+	if _, err := server.Write([]byte("anyone?")); err != io.ErrClosedPipe {
+		t.Fatalf("Write to closed peer = %v, want io.ErrClosedPipe", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Read after Close = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestConnPair_CapacityAndDeadlines(t *testing.T) {
+	client, server := NewConnPair(ConnConfig{Capacity: 4})
+
+	_ = client.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	n, err := client.Write([]byte("12345678"))
+	if n != 4 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write = %d, %v, want 4 bytes and a deadline error", n, err)
+	}
+
+	_ = server.SetReadDeadline(time.Now().Add(time.Hour))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = server.SetReadDeadline(time.Now())
+	}()
+	buf := make([]byte, 8)
+	if n, err := server.Read(buf); n != 4 || err != nil {
+		t.Fatalf("Read = %d, %v, want the 4 buffered bytes", n, err)
+	}
+	if _, err := server.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read error = %v, want the moved deadline to expire", err)
+	}
+}
+
+func TestConnPair_CarriesSessions(t *testing.T) {
+	client, server := NewConnPair(ConnConfig{})
+
+	sessions := make(chan *rhizome.Session, 1)
+	go func() {
+		s, err := rhizome.NewSession(server, rhizome.SessionConfig{})
+		if err != nil {
+			t.Errorf("server NewSession error: %v", err)
+		}
+		sessions <- s
+	}()
+	c, err := rhizome.NewSession(client, rhizome.SessionConfig{})
+	if err != nil {
+		t.Fatalf("client NewSession error: %v", err)
+	}
+	s := <-sessions
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+
+	want := rhizome.NewObject(
+		rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyOnsent,
+		"uid-1", "topic", "", "", "",
+		rhizome.EncodingNA, []byte("payload"),
+	)
+	if err := c.Send(want); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	got, err := s.Receive()
+	if err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	want.Version = got.Version
+	AssertObjectsEqual(t, want, got)
+}
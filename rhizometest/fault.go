@@ -0,0 +1,395 @@
+package rhizometest
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Fault is a misbehaviour a FaultConn injects into a read or write.
+type Fault int
+
+const (
+	FaultNone Fault = iota
+
+	// FaultPartialWrite sends only part of a write to the peer, and fails the
+	// write with io.ErrShortWrite.
+	FaultPartialWrite
+
+	// FaultShortRead returns fewer bytes from a read than the buffer holds,
+	// which is legal but easily mishandled.
+	FaultShortRead
+
+	// FaultCorrupt flips a bit of one of the bytes read or written.
+	FaultCorrupt
+
+	// FaultReset closes the connection and fails the operation, and every one
+	// after it, with a connection reset error.
+	FaultReset
+
+	// FaultStall blocks the operation for FaultConfig.StallFor, or until its
+	// deadline passes or the connection is closed.
+	FaultStall
+)
+
+var faultNames = map[Fault]string{
+	FaultNone:         "none",
+	FaultPartialWrite: "partial write",
+	FaultShortRead:    "short read",
+	FaultCorrupt:      "corrupt",
+	FaultReset:        "reset",
+	FaultStall:        "stall",
+}
+
+func (f Fault) String() string {
+	if name, ok := faultNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("fault(%d)", int(f))
+}
+
+// Op is the operation a fault is injected into.
+type Op int
+
+const (
+	OpRead Op = iota
+	OpWrite
+)
+
+func (op Op) String() string {
+	if op == OpRead {
+		return "read"
+	}
+	return "write"
+}
+
+// FaultStep injects Fault into the Nth read or write of a connection,
+// counting from 1.
+type FaultStep struct {
+	Op    Op
+	N     int
+	Fault Fault
+}
+
+// InjectedFault records a fault a FaultConn injected.
+type InjectedFault struct {
+	Op    Op
+	N     int
+	Fault Fault
+}
+
+// FaultConfig configures the faults a FaultConn injects.
+//
+// Random faults are drawn from generators seeded with Seed, one for reads and
+// one for writes, so a failing run can be replayed however its reads and writes
+// interleave. Each probability is per operation, and at most one fault is
+// injected into an operation, checked in the order reset, stall, corrupt,
+// partial write or short read. Script injects faults into given operations
+// instead, and takes precedence over random faults.
+type FaultConfig struct {
+	Seed int64
+
+	// Latency delays every read and write, plus up to Jitter more.
+	Latency, Jitter time.Duration
+
+	PartialWrite float64
+	ShortRead    float64
+	Corrupt      float64
+	Reset        float64
+	Stall        float64
+
+	// How long a stall lasts. Zero stalls until the deadline passes or the
+	// connection is closed.
+	StallFor time.Duration
+
+	Script []FaultStep
+}
+
+// FaultConn wraps a net.Conn and injects faults into its reads and writes, to
+// test how both ends of a connection cope with a misbehaving network. It can
+// stand in for the connection of a session, mux or responder on either side,
+// and NewFaultListener wraps the connections a server accepts.
+type FaultConn struct {
+	net.Conn
+	cfg FaultConfig
+
+	mu       sync.Mutex
+	rng      [2]*rand.Rand
+	count    [2]int
+	injected []InjectedFault
+	resetErr error
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewFaultConn returns conn injecting the faults cfg describes.
+func NewFaultConn(conn net.Conn, cfg FaultConfig) *FaultConn {
+	return &FaultConn{
+		Conn:          conn,
+		cfg:           cfg,
+		rng:           [2]*rand.Rand{newOpRand(cfg.Seed, OpRead), newOpRand(cfg.Seed, OpWrite)},
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		closed:        make(chan struct{}),
+	}
+}
+
+// newOpRand returns the generator of the faults injected into op.
+func newOpRand(seed int64, op Op) *rand.Rand {
+	h := fnv.New64a()
+	fmt.Fprint(h, op)
+	return rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+}
+
+// Injected returns the faults injected so far, in order.
+func (c *FaultConn) Injected() []InjectedFault {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]InjectedFault(nil), c.injected...)
+}
+
+// next counts an operation and picks its fault and latency.
+func (c *FaultConn) next(op Op) (Fault, time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.resetErr != nil {
+		return FaultNone, 0, c.resetErr
+	}
+	c.count[op]++
+	n := c.count[op]
+
+	delay := c.cfg.Latency
+	if c.cfg.Jitter > 0 {
+		delay += time.Duration(c.rng[op].Int63n(int64(c.cfg.Jitter) + 1))
+	}
+
+	fault := FaultNone
+	for _, step := range c.cfg.Script {
+		if step.Op == op && step.N == n {
+			fault = step.Fault
+		}
+	}
+	if fault == FaultNone {
+		fault = c.randomFault(op)
+	}
+	if fault != FaultNone {
+		c.injected = append(c.injected, InjectedFault{Op: op, N: n, Fault: fault})
+	}
+	return fault, delay, nil
+}
+
+func (c *FaultConn) randomFault(op Op) Fault {
+	cut, split := c.cfg.ShortRead, FaultShortRead
+	if op == OpWrite {
+		cut, split = c.cfg.PartialWrite, FaultPartialWrite
+	}
+	for _, f := range [...]struct {
+		p     float64
+		fault Fault
+	}{
+		{c.cfg.Reset, FaultReset},
+		{c.cfg.Stall, FaultStall},
+		{c.cfg.Corrupt, FaultCorrupt},
+		{cut, split},
+	} {
+		if f.p > 0 && c.rng[op].Float64() < f.p {
+			return f.fault
+		}
+	}
+	return FaultNone
+}
+
+// intn returns a random int in [0, n) drawn for op.
+func (c *FaultConn) intn(op Op, n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rng[op].Intn(n)
+}
+
+func (c *FaultConn) Read(b []byte) (int, error) {
+	fault, err := c.prepare(OpRead, &c.readDeadline)
+	if err != nil {
+		return 0, err
+	}
+
+	if fault == FaultShortRead && len(b) > 1 {
+		b = b[:1+c.intn(OpRead, len(b)-1)]
+	}
+	n, err := c.Conn.Read(b)
+	if fault == FaultCorrupt && n > 0 {
+		b[c.intn(OpRead, n)] ^= 1 << c.intn(OpRead, 8)
+	}
+	return n, err
+}
+
+func (c *FaultConn) Write(b []byte) (int, error) {
+	fault, err := c.prepare(OpWrite, &c.writeDeadline)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case fault == FaultPartialWrite && len(b) > 1:
+		n, err := c.Conn.Write(b[:1+c.intn(OpWrite, len(b)-1)])
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		return n, err
+
+	case fault == FaultCorrupt && len(b) > 0:
+		// Leave the caller's buffer alone.
+		corrupt := append([]byte(nil), b...)
+		corrupt[c.intn(OpWrite, len(b))] ^= 1 << c.intn(OpWrite, 8)
+		return c.Conn.Write(corrupt)
+	}
+	return c.Conn.Write(b)
+}
+
+// prepare picks the fault of an operation, and applies its latency and any
+// fault that keeps it from reaching the connection.
+func (c *FaultConn) prepare(op Op, d *deadline) (Fault, error) {
+	fault, delay, err := c.next(op)
+	if err != nil {
+		return fault, err
+	}
+	if delay > 0 {
+		if err := c.sleep(delay, d); err != nil {
+			return fault, err
+		}
+	}
+
+	switch fault {
+	case FaultReset:
+		return fault, c.reset(op)
+	case FaultStall:
+		if c.cfg.StallFor > 0 {
+			return fault, c.sleep(c.cfg.StallFor, d)
+		}
+		return fault, c.sleep(-1, d)
+	}
+	return fault, nil
+}
+
+// sleep waits for dur, forever if it is negative, unless the deadline passes
+// or the connection is closed first.
+func (c *FaultConn) sleep(dur time.Duration, d *deadline) error {
+	var done <-chan time.Time
+	if dur >= 0 {
+		timer := time.NewTimer(dur)
+		defer timer.Stop()
+		done = timer.C
+	}
+
+	for {
+		at, moved := d.get()
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if !at.IsZero() {
+			wait := time.Until(at)
+			if wait <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+
+		var err error
+		select {
+		case <-done:
+			return nil
+		case <-moved:
+		case <-c.closed:
+			err = net.ErrClosed
+		case <-expired:
+			err = os.ErrDeadlineExceeded
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *FaultConn) reset(op Op) error {
+	c.mu.Lock()
+	c.resetErr = &net.OpError{
+		Op:     op.String(),
+		Net:    c.LocalAddr().Network(),
+		Source: c.LocalAddr(),
+		Addr:   c.RemoteAddr(),
+		Err:    syscall.ECONNRESET,
+	}
+	err := c.resetErr
+	c.mu.Unlock()
+
+	_ = c.Close()
+	return err
+}
+
+func (c *FaultConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func (c *FaultConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *FaultConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *FaultConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// NewFaultListener wraps l so every connection it accepts is a FaultConn. The
+// nth connection accepted, counting from 0, draws its random faults from Seed
+// plus n.
+func NewFaultListener(l net.Listener, cfg FaultConfig) net.Listener {
+	return &faultListener{Listener: l, cfg: cfg}
+}
+
+type faultListener struct {
+	net.Listener
+	cfg FaultConfig
+
+	mu       sync.Mutex
+	accepted int64
+}
+
+func (l *faultListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	cfg := l.cfg
+	cfg.Seed += l.accepted
+	l.accepted++
+	l.mu.Unlock()
+
+	return NewFaultConn(conn, cfg), nil
+}
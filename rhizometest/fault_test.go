@@ -0,0 +1,273 @@
+package rhizometest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"syscall"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/signal-weave/rhizome"
+)
+
+func newFaultPair(cfg FaultConfig) (*FaultConn, *Conn) {
+	client, server := NewConnPair(ConnConfig{})
+	return NewFaultConn(client, cfg), server
+}
+
+func TestFaultConn_ScriptedReset(t *testing.T) {
+	fc, peer := newFaultPair(FaultConfig{
+		Script: []FaultStep{{Op: OpWrite, N: 2, Fault: FaultReset}},
+	})
+
+	if _, err := fc.Write([]byte("first")); err != nil {
+		t.Fatalf("first Write error: %v", err)
+	}
+	if _, err := fc.Write([]byte("second")); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("second Write error = %v, want a reset", err)
+	}
+	if _, err := fc.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("Read after reset = %v, want a reset", err)
+	}
+
+	got, err := io.ReadAll(peer)
+	if err != nil || string(got) != "first" {
+		t.Fatalf("peer read %q, %v", got, err)
+	}
+	want := []InjectedFault{{Op: OpWrite, N: 2, Fault: FaultReset}}
+	if !slices.Equal(fc.Injected(), want) {
+		t.Fatalf("Injected = %v, want %v", fc.Injected(), want)
+	}
+}
+
+func TestFaultConn_PartialWrite(t *testing.T) {
+	fc, peer := newFaultPair(FaultConfig{
+		Script: []FaultStep{{Op: OpWrite, N: 1, Fault: FaultPartialWrite}},
+	})
+
+	n, err := fc.Write([]byte("0123456789"))
+	if err != io.ErrShortWrite || n < 1 || n >= 10 {
+		t.Fatalf("Write = %d, %v, want a short write", n, err)
+	}
+	fc.Close()
+	if got, _ := io.ReadAll(peer); string(got) != "0123456789"[:n] {
+		t.Fatalf("peer read %q after a write of %d bytes", got, n)
+	}
+}
+
+func TestFaultConn_ShortReads(t *testing.T) {
+	fc, peer := newFaultPair(FaultConfig{Seed: 7, ShortRead: 1})
+
+	want := bytes.Repeat([]byte("abcdefgh"), 64)
+	peer.Write(want)
+	peer.Close()
+
+	n, err := fc.Read(make([]byte, len(want)))
+	if err != nil || n >= len(want) {
+		t.Fatalf("Read = %d, %v, want a short read", n, err)
+	}
+	rest, err := io.ReadAll(fc)
+	if err != nil || !bytes.Equal(rest, want[n:]) {
+		t.Fatalf("ReadAll = %d bytes, %v", len(rest), err)
+	}
+}
+
+func TestFaultConn_Corrupt(t *testing.T) {
+	fc, peer := newFaultPair(FaultConfig{
+		Script: []FaultStep{{Op: OpWrite, N: 1, Fault: FaultCorrupt}},
+	})
+
+	sent := []byte("pristine bytes")
+	if _, err := fc.Write(sent); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if string(sent) != "pristine bytes" {
+		t.Fatalf("Write corrupted the caller's buffer")
+	}
+
+	got := make([]byte, len(sent))
+	io.ReadFull(peer, got)
+	differ := 0
+	for i := range got {
+		if got[i] != sent[i] {
+			differ++
+		}
+	}
+	if differ != 1 {
+		t.Fatalf("peer read %q, %d bytes differ, want 1", got, differ)
+	}
+}
+
+func TestFaultConn_Stall(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		fc, peer := newFaultPair(FaultConfig{Stall: 1})
+
+		_ = fc.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+		if _, err := fc.Write([]byte("x")); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("stalled Write = %v, want the deadline to pass", err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := fc.Read(make([]byte, 1))
+			done <- err
+		}()
+		synctest.Wait()
+		select {
+		case err := <-done:
+			t.Fatalf("stalled Read returned %v before Close", err)
+		default:
+		}
+		fc.Close()
+		if err := <-done; !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("stalled Read = %v, want net.ErrClosed", err)
+		}
+
+		// Nothing stalled reached the peer.
+		if got, _ := io.ReadAll(peer); len(got) != 0 {
+			t.Fatalf("peer read %q", got)
+		}
+	})
+}
+
+func TestFaultConn_LatencyAndStallFor(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		fc, peer := newFaultPair(FaultConfig{
+			Latency:  10 * time.Millisecond,
+			StallFor: 20 * time.Millisecond,
+			Script:   []FaultStep{{Op: OpWrite, N: 1, Fault: FaultStall}},
+		})
+
+		start := time.Now()
+		if _, err := fc.Write([]byte("late")); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed != 30*time.Millisecond {
+			t.Fatalf("Write took %v, want 30ms", elapsed)
+		}
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(peer, got); err != nil || string(got) != "late" {
+			t.Fatalf("peer read %q, %v", got, err)
+		}
+	})
+}
+
+func TestFaultConn_SeedReplays(t *testing.T) {
+	cfg := FaultConfig{Seed: 42, Corrupt: 0.2, PartialWrite: 0.2}
+	run := func() []InjectedFault {
+		fc, _ := newFaultPair(cfg)
+		for range 50 {
+			fc.Write([]byte("payload"))
+		}
+		return fc.Injected()
+	}
+
+	first, second := run(), run()
+	if len(first) == 0 || !slices.Equal(first, second) {
+		t.Fatalf("runs injected %v and %v", first, second)
+	}
+}
+
+func TestFaultConn_ReadsDoNotChangeTheFaultsOfWrites(t *testing.T) {
+	cfg := FaultConfig{Seed: 42, Corrupt: 0.2, PartialWrite: 0.2, ShortRead: 0.5}
+	writeFaults := func(reads bool) []InjectedFault {
+		fc, server := newFaultPair(cfg)
+		buf := make([]byte, 16)
+		var faults []InjectedFault
+		for range 50 {
+			if reads {
+				server.Write([]byte("payload"))
+				fc.Read(buf)
+			}
+			fc.Write([]byte("payload"))
+		}
+		for _, f := range fc.Injected() {
+			if f.Op == OpWrite {
+				faults = append(faults, f)
+			}
+		}
+		return faults
+	}
+
+	alone, interleaved := writeFaults(false), writeFaults(true)
+	if len(alone) == 0 || !slices.Equal(alone, interleaved) {
+		t.Fatalf("writes alone injected %v, interleaved with reads %v", alone, interleaved)
+	}
+}
+
+// pairListener accepts the server ends of connection pairs.
+type pairListener struct {
+	conns chan net.Conn
+}
+
+func (l *pairListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (l *pairListener) Close() error   { return nil }
+func (l *pairListener) Addr() net.Addr { return Addr("server") }
+
+func TestFaultListener_SessionsSurviveLatencyAndShortReads(t *testing.T) {
+	chaos := FaultConfig{
+		Seed:      3,
+		Latency:   time.Millisecond,
+		Jitter:    time.Millisecond,
+		ShortRead: 0.5,
+	}
+
+	inner := &pairListener{conns: make(chan net.Conn, 1)}
+	l := NewFaultListener(inner, chaos)
+	client, server := NewConnPair(ConnConfig{})
+	inner.conns <- server
+
+	sessions := make(chan *rhizome.Session, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("Accept error: %v", err)
+		}
+		if _, ok := conn.(*FaultConn); !ok {
+			t.Errorf("accepted %T, want *FaultConn", conn)
+		}
+		s, err := rhizome.NewSession(conn, rhizome.SessionConfig{})
+		if err != nil {
+			t.Errorf("server NewSession error: %v", err)
+		}
+		sessions <- s
+	}()
+	c, err := rhizome.NewSession(NewFaultConn(client, chaos), rhizome.SessionConfig{})
+	if err != nil {
+		t.Fatalf("client NewSession error: %v", err)
+	}
+	s := <-sessions
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+
+	for _, uid := range []string{"a", "b", "c"} {
+		want := rhizome.NewObject(
+			rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyOnsent,
+			uid, "topic", "", "", "",
+			rhizome.EncodingJson, []byte(`{"n":1}`),
+		)
+		if err := c.Send(want); err != nil {
+			t.Fatalf("Send error: %v", err)
+		}
+		got, err := s.Receive()
+		if err != nil {
+			t.Fatalf("Receive error: %v", err)
+		}
+		want.Version = got.Version
+		AssertObjectsEqual(t, want, got)
+	}
+}
@@ -0,0 +1,101 @@
+package rhizometest
+
+import (
+	"math/rand"
+	"reflect"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// Largest payload a single frame carries uncompressed.
+const maxPayloadSize = 64*rhizome.BytesInKilobyte - 1
+
+// RandomObject is a random object that always encodes, for property based
+// tests with testing/quick:
+//
+//	quick.Check(func(o rhizometest.RandomObject) bool {
+//		frame, err := rhizome.EncodeFrame(o.Object)
+//		...
+//	}, nil)
+//
+// Fields favour their boundaries: empty and 255-byte arguments, every
+// PayloadEncoding, empty and maximum payloads, and for version 2 fragments and
+// every compression algorithm.
+type RandomObject struct {
+	*rhizome.Object
+}
+
+// Generate implements testing/quick.Generator. size is ignored, the fields
+// have fixed bounds.
+func (RandomObject) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(RandomObject{NewRandomObject(r)})
+}
+
+// NewRandomObject returns a random object as described for RandomObject.
+func NewRandomObject(r *rand.Rand) *rhizome.Object {
+	obj := rhizome.NewObject(
+		uint8(r.Intn(256)), uint8(r.Intn(256)), uint8(r.Intn(256)),
+		randomString(r, 1), randomString(r, 0), randomString(r, 0),
+		randomString(r, 0), randomString(r, 0),
+		rhizome.PayloadEncoding(r.Intn(int(rhizome.EncodingProtobuf)+1)),
+		randomPayload(r),
+	)
+
+	if r.Intn(2) == 0 {
+		return obj
+	}
+	obj.Version = rhizome.ProtocolV2
+	obj.Compression = rhizome.Compression(r.Intn(int(rhizome.CompressionZlib) + 1))
+	if r.Intn(4) == 0 {
+		obj.FragCount = uint16(1 + r.Intn(65535))
+		obj.FragIndex = uint16(r.Intn(int(obj.FragCount)))
+	}
+	return obj
+}
+
+// randomString returns a string of at least atLeast and at most 255 bytes.
+func randomString(r *rand.Rand, atLeast int) string {
+	var n int
+	switch r.Intn(4) {
+	case 0:
+		n = atLeast
+	case 1:
+		n = 255
+	default:
+		n = atLeast + r.Intn(256-atLeast)
+	}
+
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b)
+}
+
+// randomPayload returns a payload of up to maxPayloadSize bytes, some of them
+// repetitive enough to be worth compressing.
+func randomPayload(r *rand.Rand) []byte {
+	var n int
+	switch r.Intn(16) {
+	case 0:
+		return nil
+	case 1:
+		n = 0
+	case 2:
+		n = maxPayloadSize
+	case 3, 4, 5:
+		n = rhizome.CompressionThreshold + r.Intn(4*rhizome.CompressionThreshold)
+	default:
+		n = r.Intn(rhizome.CompressionThreshold)
+	}
+
+	b := make([]byte, n)
+	if r.Intn(2) == 0 {
+		r.Read(b)
+		return b
+	}
+	pattern := make([]byte, 1+r.Intn(16))
+	r.Read(pattern)
+	for i := range b {
+		b[i] = pattern[i%len(pattern)]
+	}
+	return b
+}
@@ -0,0 +1,59 @@
+package rhizometest
+
+import (
+	"math/rand"
+	"testing"
+	"testing/quick"
+
+	"github.com/signal-weave/rhizome"
+)
+
+func TestRandomObject_Encodes(t *testing.T) {
+	err := quick.Check(func(o RandomObject) bool {
+		_, err := rhizome.EncodeFrame(o.Object)
+		if err != nil {
+			t.Logf("EncodeFrame error: %v", err)
+		}
+		return err == nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewRandomObject_CoversBoundaries(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	seen := map[string]bool{}
+	for range 2000 {
+		obj := NewRandomObject(r)
+		for _, arg := range []string{obj.Arg1, obj.Arg2, obj.Arg3, obj.Arg4} {
+			seen["empty arg"] = seen["empty arg"] || arg == ""
+			seen["255-byte arg"] = seen["255-byte arg"] || len(arg) == 255
+		}
+		seen["255-byte UID"] = seen["255-byte UID"] || len(obj.UID) == 255
+		seen["empty payload"] = seen["empty payload"] || len(obj.Payload) == 0
+		seen["max payload"] = seen["max payload"] || len(obj.Payload) == maxPayloadSize
+		seen["encoding "+obj.PayloadEncoding.String()] = true
+		seen["fragment"] = seen["fragment"] || obj.FragCount != 0
+		if obj.Version == rhizome.ProtocolV2 {
+			seen["compression "+obj.Compression.String()] = true
+		}
+	}
+
+	want := []string{
+		"empty arg", "255-byte arg", "255-byte UID", "empty payload",
+		"max payload", "fragment",
+	}
+	for encoding := range rhizome.EncodingName {
+		want = append(want, "encoding "+encoding.String())
+	}
+	for compression := range rhizome.CompressionName {
+		want = append(want, "compression "+compression.String())
+	}
+	for _, w := range want {
+		if !seen[w] {
+			t.Errorf("never generated %s", w)
+		}
+	}
+}
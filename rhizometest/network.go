@@ -0,0 +1,499 @@
+package rhizometest
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Simulated network.
+// -----------------------------------------------------------------------------
+// A Network connects named addresses, like "broker-1:7000", without sockets, so
+// topologies of several brokers and clients run in a single test. Links
+// between hosts have a latency, bandwidth and loss, and can be partitioned.
+//
+// Connections are reliable ordered streams, like TCP. A lost write is not
+// dropped but retransmitted, arriving RetransmitDelay later and holding back
+// everything written after it. Data sent across a partition waits until the
+// partition heals. Writes never block, the network buffers without limit.
+//
+// All delays are measured with the time package. Inside a testing/synctest
+// bubble, time only moves once every goroutine in the bubble is blocked, so a
+// simulation is deterministic down to the nanosecond, and seconds of simulated
+// latency take no real time:
+//
+//	synctest.Test(t, func(t *testing.T) {
+//		network := rhizometest.NewNetwork(rhizometest.NetworkConfig{
+//			Link: rhizometest.LinkConfig{Latency: 50 * time.Millisecond},
+//		})
+//		l, _ := network.Listen("broker:7000")
+//		conn, _ := network.Dial("client", "broker:7000")
+//		...
+//	})
+// -----------------------------------------------------------------------------
+
+// LinkConfig describes the link between two hosts, in each direction.
+type LinkConfig struct {
+	// Latency delays everything sent over the link.
+	Latency time.Duration
+
+	// Bandwidth limits the link to that many bytes per second, shared by
+	// every connection between the two hosts. Zero is unlimited.
+	Bandwidth int64
+
+	// Loss is the probability a write is lost and has to be retransmitted.
+	Loss float64
+
+	// RetransmitDelay is how much later a lost write arrives. Defaults to
+	// three times the latency, and at least a millisecond.
+	RetransmitDelay time.Duration
+}
+
+func (cfg LinkConfig) retransmitDelay() time.Duration {
+	if cfg.RetransmitDelay > 0 {
+		return cfg.RetransmitDelay
+	}
+	return max(3*cfg.Latency, time.Millisecond)
+}
+
+// NetworkConfig configures NewNetwork.
+type NetworkConfig struct {
+	// Seed seeds the draws deciding which writes are lost. Each connection
+	// draws from its own generator, seeded with Seed and its addresses.
+	Seed int64
+
+	// Link is the link between hosts SetLink was not called for.
+	Link LinkConfig
+}
+
+// Network is an in-memory network of named addresses.
+type Network struct {
+	cfg NetworkConfig
+
+	mu        sync.Mutex
+	listeners map[string]*netListener
+	links     map[[2]string]*link
+	ports     map[string]int
+}
+
+// link is one direction of the link between two hosts.
+type link struct {
+	cfg         LinkConfig
+	partitioned bool
+	busyUntil   time.Time
+	flights     map[*flight]struct{}
+}
+
+// NewNetwork returns an empty network.
+func NewNetwork(cfg NetworkConfig) *Network {
+	return &Network{
+		cfg:       cfg,
+		listeners: make(map[string]*netListener),
+		links:     make(map[[2]string]*link),
+		ports:     make(map[string]int),
+	}
+}
+
+// linkLocked returns the link from host a to host b.
+func (n *Network) linkLocked(a, b string) *link {
+	l, ok := n.links[[2]string{a, b}]
+	if !ok {
+		l = &link{cfg: n.cfg.Link, flights: make(map[*flight]struct{})}
+		n.links[[2]string{a, b}] = l
+	}
+	return l
+}
+
+// SetLink configures the link between hosts a and b in both directions. It
+// applies to what is written from then on.
+func (n *Network) SetLink(a, b string, cfg LinkConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.linkLocked(a, b).cfg = cfg
+	n.linkLocked(b, a).cfg = cfg
+}
+
+// Partition cuts hosts a and b off from each other. Dials between them fail,
+// and what is sent between them waits until Heal.
+func (n *Network) Partition(a, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.linkLocked(a, b).partitioned = true
+	n.linkLocked(b, a).partitioned = true
+}
+
+// Heal ends a partition between hosts a and b. What waited for it arrives one
+// latency later.
+func (n *Network) Heal(a, b string) {
+	n.mu.Lock()
+	var waiting []*flight
+	for _, l := range [...]*link{n.linkLocked(a, b), n.linkLocked(b, a)} {
+		l.partitioned = false
+		for f := range l.flights {
+			waiting = append(waiting, f)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, f := range waiting {
+		f.resume()
+	}
+}
+
+func (n *Network) partitioned(l *link) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return l.partitioned
+}
+
+// Listen listens on addr, a host and port.
+func (n *Network) Listen(addr string) (net.Listener, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, n.opError("listen", Addr(addr), syscall.EADDRINUSE)
+	}
+	l := &netListener{
+		network: n,
+		addr:    Addr(addr),
+		conns:   make(chan net.Conn, 128),
+		closed:  make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// Dial connects host from to the listener at addr. Connecting takes a round
+// trip over the link.
+func (n *Network) Dial(from, addr string) (net.Conn, error) {
+	return n.DialContext(context.Background(), from, addr)
+}
+
+// DialContext is Dial, giving up once ctx is done.
+func (n *Network) DialContext(ctx context.Context, from, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	l := n.listeners[addr]
+	out, back := n.linkLocked(from, host), n.linkLocked(host, from)
+	cut := out.partitioned
+	rtt := out.cfg.Latency + back.cfg.Latency
+	n.ports[from]++
+	local := Addr(net.JoinHostPort(from, fmt.Sprint(49151+n.ports[from])))
+	n.mu.Unlock()
+
+	if cut {
+		return nil, n.opError("dial", Addr(addr), syscall.EHOSTUNREACH)
+	}
+	if l == nil {
+		return nil, n.opError("dial", Addr(addr), syscall.ECONNREFUSED)
+	}
+
+	timer := time.NewTimer(rtt)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil, n.opError("dial", Addr(addr), ctx.Err())
+	}
+
+	select {
+	case <-l.closed:
+		return nil, n.opError("dial", Addr(addr), syscall.ECONNREFUSED)
+	default:
+	}
+	client, server := n.connPair(local, l.addr, out, back)
+	select {
+	case l.conns <- server:
+		return client, nil
+	default:
+		// The backlog is full.
+		return nil, n.opError("dial", Addr(addr), syscall.ECONNREFUSED)
+	}
+}
+
+// Dialer returns a dial function for host from, with the signature of
+// net.Dialer.DialContext. The network argument is ignored.
+func (n *Network) Dialer(from string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return n.DialContext(ctx, from, addr)
+	}
+}
+
+func (n *Network) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: addr.Network(), Addr: addr, Err: err}
+}
+
+func (n *Network) connPair(local, remote Addr, out, back *link) (client, server *netConn) {
+	toServer := newHalfPipe(0)
+	toClient := newHalfPipe(0)
+	client = n.newConn(local, remote, toClient, toServer, out)
+	server = n.newConn(remote, local, toServer, toClient, back)
+	return client, server
+}
+
+// -----------------------------------------------------------------------------
+// Listeners.
+// -----------------------------------------------------------------------------
+
+type netListener struct {
+	network   *Network
+	addr      Addr
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (l *netListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, l.network.opError("accept", l.addr, net.ErrClosed)
+	}
+}
+
+func (l *netListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.network.mu.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *netListener) Addr() net.Addr { return l.addr }
+
+// -----------------------------------------------------------------------------
+// Connections.
+// -----------------------------------------------------------------------------
+
+// netConn is one end of a connection over a Network.
+type netConn struct {
+	local, remote Addr
+	in, out       *halfPipe
+	flight        *flight
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (n *Network) newConn(local, remote Addr, in, out *halfPipe, l *link) *netConn {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s>%s", local, remote)
+	f := &flight{
+		network: n,
+		link:    l,
+		to:      out,
+		rng:     rand.New(rand.NewSource(n.cfg.Seed ^ int64(h.Sum64()))),
+	}
+
+	n.mu.Lock()
+	l.flights[f] = struct{}{}
+	n.mu.Unlock()
+
+	return &netConn{
+		local:         local,
+		remote:        remote,
+		in:            in,
+		out:           out,
+		flight:        f,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		closed:        make(chan struct{}),
+	}
+}
+
+func (c *netConn) Read(b []byte) (int, error) {
+	return c.in.read(b, c.closed, &c.readDeadline)
+}
+
+// Write hands b to the network and returns at once, the other end receives it
+// once it crossed the link.
+func (c *netConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if c.writeDeadline.passed() {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	c.out.mu.Lock()
+	broken := c.out.broken
+	c.out.mu.Unlock()
+	if broken {
+		return 0, io.ErrClosedPipe
+	}
+
+	if len(b) > 0 {
+		c.flight.send(append([]byte(nil), b...), false)
+	}
+	return len(b), nil
+}
+
+// Close closes both directions. The other end reads what was already written
+// and then io.EOF, writing to it fails at once.
+func (c *netConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		c.in.mu.Lock()
+		c.in.broken = true
+		c.in.buf = nil
+		c.in.signalLocked()
+		c.in.mu.Unlock()
+
+		c.flight.send(nil, true)
+	})
+	return nil
+}
+
+func (c *netConn) LocalAddr() net.Addr  { return c.local }
+func (c *netConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *netConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *netConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *netConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// flight carries one direction of a connection across its link, in order.
+type flight struct {
+	network *Network
+	link    *link
+	to      *halfPipe
+
+	mu       sync.Mutex
+	rng      *rand.Rand
+	segments []segment
+	last     time.Time
+}
+
+// segment is a write, or the end of the stream, on its way.
+type segment struct {
+	at   time.Time
+	data []byte
+	fin  bool
+}
+
+// send puts data on the link, or the end of the stream if fin is set.
+func (f *flight) send(data []byte, fin bool) {
+	now := time.Now()
+
+	// The link sends one write at a time, at its bandwidth.
+	f.network.mu.Lock()
+	cfg := f.link.cfg
+	sent := now
+	if f.link.busyUntil.After(sent) {
+		sent = f.link.busyUntil
+	}
+	if cfg.Bandwidth > 0 {
+		sent = sent.Add(time.Duration(int64(len(data)) * int64(time.Second) / cfg.Bandwidth))
+		f.link.busyUntil = sent
+	}
+	f.network.mu.Unlock()
+
+	f.mu.Lock()
+	at := sent.Add(cfg.Latency)
+	if cfg.Loss > 0 && !fin && f.rng.Float64() < cfg.Loss {
+		at = at.Add(cfg.retransmitDelay())
+	}
+	// Nothing overtakes what was written before it.
+	if at.Before(f.last) {
+		at = f.last
+	}
+	f.last = at
+	f.segments = append(f.segments, segment{at: at, data: data, fin: fin})
+	f.mu.Unlock()
+
+	time.AfterFunc(at.Sub(now), f.deliver)
+}
+
+// deliver hands the segments that arrived to the other end, unless the link
+// is partitioned.
+func (f *flight) deliver() {
+	if f.network.partitioned(f.link) {
+		return
+	}
+
+	f.mu.Lock()
+	now := time.Now()
+	var due []segment
+	for len(f.segments) > 0 && !f.segments[0].at.After(now) {
+		due = append(due, f.segments[0])
+		f.segments = f.segments[1:]
+	}
+	f.mu.Unlock()
+
+	for _, s := range due {
+		f.to.mu.Lock()
+		if s.fin {
+			f.to.eof = true
+		} else if !f.to.broken {
+			f.to.buf = append(f.to.buf, s.data...)
+		}
+		f.to.signalLocked()
+		f.to.mu.Unlock()
+
+		if s.fin {
+			f.network.mu.Lock()
+			delete(f.link.flights, f)
+			f.network.mu.Unlock()
+		}
+	}
+}
+
+// resume delivers what waited for a partition to heal one latency from now.
+func (f *flight) resume() {
+	f.network.mu.Lock()
+	latency := f.link.cfg.Latency
+	f.network.mu.Unlock()
+
+	f.mu.Lock()
+	at := time.Now().Add(latency)
+	for i := range f.segments {
+		if f.segments[i].at.Before(at) {
+			f.segments[i].at = at
+		}
+	}
+	if f.last.Before(at) && len(f.segments) > 0 {
+		f.last = at
+	}
+	pending := len(f.segments) > 0
+	f.mu.Unlock()
+
+	if pending {
+		time.AfterFunc(latency, f.deliver)
+	}
+}
@@ -0,0 +1,264 @@
+package rhizometest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// dialPair returns a connection from host client to a listener on addr, and
+// the end the listener accepted.
+func dialPair(t *testing.T, n *Network, client, addr string) (net.Conn, net.Conn) {
+	t.Helper()
+
+	l, err := n.Listen(addr)
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	defer l.Close()
+
+	c, err := n.Dial(client, addr)
+	if err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept error: %v", err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c, s
+}
+
+// arrival writes msg to from and returns how long it took to reach to.
+func arrival(t *testing.T, from, to net.Conn, msg []byte) time.Duration {
+	t.Helper()
+
+	start := time.Now()
+	if _, err := from.Write(msg); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(to, got); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("ReadFull = %q, %v", got, err)
+	}
+	return time.Since(start)
+}
+
+func TestNetwork_LatencyAndBandwidth(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		n := NewNetwork(NetworkConfig{Link: LinkConfig{Latency: 50 * time.Millisecond}})
+		n.SetLink("client", "slow", LinkConfig{Latency: 10 * time.Millisecond, Bandwidth: 1000})
+
+		start := time.Now()
+		c, s := dialPair(t, n, "client", "broker:7000")
+		if rtt := time.Since(start); rtt != 100*time.Millisecond {
+			t.Fatalf("Dial took %v, want a 100ms round trip", rtt)
+		}
+		if got := arrival(t, c, s, []byte("ping")); got != 50*time.Millisecond {
+			t.Fatalf("arrived after %v, want 50ms", got)
+		}
+		if got := s.RemoteAddr().String(); got != "client:49152" {
+			t.Fatalf("RemoteAddr = %q", got)
+		}
+
+		c, s = dialPair(t, n, "client", "slow:7000")
+		if got := arrival(t, s, c, make([]byte, 500)); got != 510*time.Millisecond {
+			t.Fatalf("500 bytes at 1000B/s arrived after %v, want 510ms", got)
+		}
+	})
+}
+
+func TestNetwork_LossRetransmitsInOrder(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		n := NewNetwork(NetworkConfig{Link: LinkConfig{
+			Latency:         10 * time.Millisecond,
+			Loss:            1,
+			RetransmitDelay: 100 * time.Millisecond,
+		}})
+		c, s := dialPair(t, n, "client", "broker:7000")
+
+		start := time.Now()
+		c.Write([]byte("first "))
+		time.Sleep(time.Millisecond)
+		c.Write([]byte("second"))
+
+		got := make([]byte, 12)
+		if _, err := io.ReadFull(s, got); err != nil || string(got) != "first second" {
+			t.Fatalf("ReadFull = %q, %v", got, err)
+		}
+		if elapsed := time.Since(start); elapsed != 111*time.Millisecond {
+			t.Fatalf("arrived after %v, want 111ms", elapsed)
+		}
+	})
+}
+
+func TestNetwork_Partition(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		n := NewNetwork(NetworkConfig{Link: LinkConfig{Latency: 10 * time.Millisecond}})
+		c, s := dialPair(t, n, "client", "broker:7000")
+		l, _ := n.Listen("broker:7001")
+		defer l.Close()
+
+		n.Partition("client", "broker")
+		if _, err := n.Dial("client", "broker:7001"); !errors.Is(err, syscall.EHOSTUNREACH) {
+			t.Fatalf("Dial across a partition = %v", err)
+		}
+
+		c.Write([]byte("held"))
+		s.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := s.Read(make([]byte, 4)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Read across a partition = %v, want a timeout", err)
+		}
+
+		s.SetReadDeadline(time.Time{})
+		healed := time.Now()
+		n.Heal("client", "broker")
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(s, got); err != nil || string(got) != "held" {
+			t.Fatalf("ReadFull = %q, %v", got, err)
+		}
+		if elapsed := time.Since(healed); elapsed != 10*time.Millisecond {
+			t.Fatalf("arrived %v after healing, want 10ms", elapsed)
+		}
+	})
+}
+
+func TestNetwork_CloseAndRefuse(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		n := NewNetwork(NetworkConfig{Link: LinkConfig{Latency: time.Millisecond}})
+
+		if _, err := n.Dial("client", "nobody:7000"); !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("Dial without listener = %v", err)
+		}
+		l, _ := n.Listen("broker:7000")
+		if _, err := n.Listen("broker:7000"); !errors.Is(err, syscall.EADDRINUSE) {
+			t.Fatalf("second Listen = %v", err)
+		}
+		l.Close()
+		if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Accept after Close = %v", err)
+		}
+
+		c, s := dialPair(t, n, "client", "broker:7000")
+		c.Write([]byte("bye"))
+		c.Close()
+		if got, err := io.ReadAll(s); err != nil || string(got) != "bye" {
+			t.Fatalf("ReadAll = %q, %v", got, err)
+		}
+		if _, err := s.Write([]byte("x")); err != io.ErrClosedPipe {
+			t.Fatalf("Write to closed peer = %v", err)
+		}
+	})
+}
+
+// serveAcks acks every object arriving on conns accepted from l with ack,
+// through the standard ConnResponder and decode path.
+func serveAcks(l net.Listener, ack uint8, wg *sync.WaitGroup) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		wg.Go(func() {
+			defer conn.Close()
+			responder := rhizome.NewConnResponder(conn)
+			for obj, err := range rhizome.Frames(conn, rhizome.WithResponder(responder)) {
+				if err != nil {
+					return
+				}
+				obj.RespondWithAck(ack)
+			}
+		})
+	}
+}
+
+func TestNetwork_MultiBrokerTopology(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		n := NewNetwork(NetworkConfig{Link: LinkConfig{Latency: 5 * time.Millisecond}})
+		n.SetLink("client", "far", LinkConfig{Latency: 40 * time.Millisecond})
+
+		var brokers sync.WaitGroup
+		defer brokers.Wait()
+		for addr, ack := range map[string]uint8{
+			"near:7000": rhizome.AckSent,
+			"far:7000":  rhizome.AckRouteNotFound,
+		} {
+			l, err := n.Listen(addr)
+			if err != nil {
+				t.Fatalf("Listen error: %v", err)
+			}
+			brokers.Go(func() { serveAcks(l, ack, &brokers) })
+			defer l.Close()
+		}
+
+		for addr, want := range map[string]struct {
+			ack uint8
+			rtt time.Duration
+		}{
+			"near:7000": {rhizome.AckSent, 10 * time.Millisecond},
+			"far:7000":  {rhizome.AckRouteNotFound, 80 * time.Millisecond},
+		} {
+			conn, err := n.Dialer("client")(t.Context(), "tcp", addr)
+			if err != nil {
+				t.Fatalf("Dial error: %v", err)
+			}
+
+			start := time.Now()
+			obj := rhizome.NewObject(
+				rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyOnsent,
+				"uid-"+addr, "topic", "", "", "",
+				rhizome.EncodingJson, []byte(`{"n":1}`),
+			)
+			frame, _ := rhizome.EncodeFrame(obj)
+			rhizome.WriteFrame(conn, frame)
+			for resp, err := range rhizome.Responses(conn) {
+				if err != nil {
+					t.Fatalf("%s: Responses error: %v", addr, err)
+				}
+				if resp.Ack != want.ack || time.Since(start) != want.rtt {
+					t.Fatalf("%s: got ack %d after %v, want %d after %v",
+						addr, resp.Ack, time.Since(start), want.ack, want.rtt)
+				}
+				break
+			}
+			conn.Close()
+		}
+	})
+}
+
+func TestNetwork_Deterministic(t *testing.T) {
+	run := func() []time.Duration {
+		var arrivals []time.Duration
+		synctest.Test(t, func(t *testing.T) {
+			n := NewNetwork(NetworkConfig{Seed: 9, Link: LinkConfig{
+				Latency:   3 * time.Millisecond,
+				Bandwidth: 64 * 1024,
+				Loss:      0.3,
+			}})
+			c, s := dialPair(t, n, "client", "broker:7000")
+			for i := range 20 {
+				arrivals = append(arrivals, arrival(t, c, s, make([]byte, 100*i+1)))
+			}
+		})
+		return arrivals
+	}
+
+	first, second := run(), run()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("write %d arrived after %v and %v", i, first[i], second[i])
+		}
+	}
+}
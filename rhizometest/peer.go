@@ -0,0 +1,160 @@
+package rhizometest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// ScriptedPeer plays the other side of a plain, sessionless connection: it
+// reads the objects sent to it and checks each against the next step of a
+// script, replying with the ack the step calls for.
+//
+//	peer := rhizometest.NewScriptedPeer(t, server)
+//	peer.Expect(obj).Reply(rhizome.AckSent)
+//	peer.Start()
+//	... send obj over client ...
+//	peer.Wait(time.Second)
+//
+// Mismatches and unexpected objects fail the test.
+type ScriptedPeer struct {
+	t    testing.TB
+	conn net.Conn
+
+	mu      sync.Mutex
+	steps   []*Expectation
+	next    int
+	stopped chan struct{}
+	changed chan struct{}
+}
+
+// Expectation is a step of a ScriptedPeer's script.
+type Expectation struct {
+	desc  string
+	match func(*rhizome.Object) error
+	reply bool
+	ack   uint8
+}
+
+// NewScriptedPeer returns a peer reading from conn. The peer closes conn when
+// the test ends.
+func NewScriptedPeer(t testing.TB, conn net.Conn) *ScriptedPeer {
+	return &ScriptedPeer{
+		t:       t,
+		conn:    conn,
+		stopped: make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+}
+
+// Expect adds a step expecting an object equal to want, see DiffObjects.
+func (p *ScriptedPeer) Expect(want *rhizome.Object) *Expectation {
+	return p.ExpectFunc(fmt.Sprintf("object %q", want.UID), func(got *rhizome.Object) error {
+		if diff := DiffObjects(want, got); diff != "" {
+			return errors.New(diff)
+		}
+		return nil
+	})
+}
+
+// ExpectFunc adds a step expecting an object match accepts. desc names the
+// step in failure messages.
+func (p *ScriptedPeer) ExpectFunc(desc string, match func(*rhizome.Object) error) *Expectation {
+	e := &Expectation{desc: desc, match: match}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.steps = append(p.steps, e)
+	return e
+}
+
+// Reply makes the step ack the object with ack once it matched.
+func (e *Expectation) Reply(ack uint8) *Expectation {
+	e.reply = true
+	e.ack = ack
+	return e
+}
+
+// Start reads and checks objects on a goroutine of its own until the
+// connection is closed.
+func (p *ScriptedPeer) Start() {
+	p.t.Cleanup(func() {
+		_ = p.conn.Close()
+		<-p.stopped
+	})
+
+	go func() {
+		defer close(p.stopped)
+
+		responder := rhizome.NewConnResponder(p.conn)
+		frames := rhizome.Frames(p.conn, rhizome.WithResponder(responder))
+		for obj, err := range frames {
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) {
+					p.t.Errorf("scripted peer: %v", err)
+				}
+				return
+			}
+			p.handle(obj)
+		}
+	}()
+}
+
+func (p *ScriptedPeer) handle(obj *rhizome.Object) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.signalLocked()
+
+	if p.next == len(p.steps) {
+		p.t.Errorf("scripted peer: unexpected object %q after the script ended", obj.UID)
+		return
+	}
+	step := p.steps[p.next]
+	p.next++
+
+	if err := step.match(obj); err != nil {
+		p.t.Errorf("scripted peer: step %d, %s, does not match:\n%v", p.next, step.desc, err)
+		return
+	}
+	if step.reply {
+		if err := obj.RespondWithAck(step.ack); err != nil {
+			p.t.Errorf("scripted peer: step %d, %s, reply: %v", p.next, step.desc, err)
+		}
+	}
+}
+
+func (p *ScriptedPeer) signalLocked() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Wait waits for every step of the script to be played, and fails the test
+// if that takes longer than timeout or the connection closes first.
+func (p *ScriptedPeer) Wait(timeout time.Duration) {
+	p.t.Helper()
+
+	expired := time.After(timeout)
+	for {
+		p.mu.Lock()
+		next, total, changed := p.next, len(p.steps), p.changed
+		p.mu.Unlock()
+
+		if next == total {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-p.stopped:
+			p.t.Fatalf("scripted peer: connection closed after %d of %d steps", next, total)
+		case <-expired:
+			p.t.Fatalf("scripted peer: played %d of %d steps in %v", next, total, timeout)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package rhizometest
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// failureRecorder is a testing.TB that records failures instead of failing.
+type failureRecorder struct {
+	testing.TB
+
+	mu       sync.Mutex
+	failures []string
+}
+
+func (f *failureRecorder) Helper() {}
+
+func (f *failureRecorder) Errorf(format string, args ...any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, fmt.Sprintf(format, args...))
+}
+
+func (f *failureRecorder) Fatalf(format string, args ...any) {
+	f.Errorf(format, args...)
+	runtime.Goexit()
+}
+
+func (f *failureRecorder) failed() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.failures...)
+}
+
+// runFailing runs fn, which may call Fatalf on tb, to completion.
+func runFailing(fn func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	<-done
+}
+
+func sendFrame(t *testing.T, conn *Conn, obj *rhizome.Object) {
+	t.Helper()
+
+	frame, err := rhizome.EncodeFrame(obj)
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+	if err := rhizome.WriteFrame(conn, frame); err != nil {
+		t.Fatalf("WriteFrame error: %v", err)
+	}
+}
+
+func TestScriptedPeer(t *testing.T) {
+	client, server := NewConnPair(ConnConfig{})
+	first := rhizome.NewObject(
+		rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyOnsent,
+		"uid-1", "topic", "", "", "",
+		rhizome.EncodingJson, []byte(`{"n":1}`),
+	)
+	second := rhizome.NewObject(
+		rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyOnsent,
+		"uid-2", "topic", "", "", "",
+		rhizome.EncodingJson, []byte(`{"n":1}`),
+	)
+
+	peer := NewScriptedPeer(t, server)
+	peer.Expect(first).Reply(rhizome.AckSent)
+	peer.ExpectFunc("any object on topic", func(obj *rhizome.Object) error {
+		if obj.Arg1 != "topic" {
+			return fmt.Errorf("Arg1 is %q", obj.Arg1)
+		}
+		return nil
+	}).Reply(rhizome.AckRouteNotFound)
+	peer.Start()
+
+	sendFrame(t, client, first)
+	sendFrame(t, client, second)
+	peer.Wait(time.Second)
+
+	var got []rhizome.Response
+	for resp, err := range rhizome.Responses(client) {
+		if err != nil {
+			t.Fatalf("Responses error: %v", err)
+		}
+		got = append(got, resp)
+		if len(got) == 2 {
+			break
+		}
+	}
+	AssertResponses(t, got,
+		rhizome.Response{UID: "uid-1", Ack: rhizome.AckSent},
+		rhizome.Response{UID: "uid-2", Ack: rhizome.AckRouteNotFound},
+	)
+}
+
+func TestScriptedPeer_ReportsMismatches(t *testing.T) {
+	client, server := NewConnPair(ConnConfig{})
+	tb := &failureRecorder{TB: t}
+
+	want := rhizome.NewObject(
+		rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyOnsent,
+		"uid-1", "topic", "", "", "",
+		rhizome.EncodingJson, []byte(`{"n":1}`),
+	)
+
+	peer := NewScriptedPeer(tb, server)
+	peer.Expect(want)
+	peer.Start()
+
+	for _, uid := range []string{"uid-other", "uid-extra"} {
+		sendFrame(t, client, rhizome.NewObject(
+			rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyOnsent,
+			uid, "topic", "", "", "",
+			rhizome.EncodingJson, []byte(`{"n":1}`),
+		))
+	}
+	runFailing(func() { peer.Wait(time.Second) })
+
+	deadline := time.Now().Add(time.Second)
+	for len(tb.failed()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	failures := tb.failed()
+	if len(failures) != 2 ||
+		!strings.Contains(failures[0], `UID: got "uid-other", want "uid-1"`) ||
+		!strings.Contains(failures[1], "unexpected object") {
+		t.Fatalf("failures = %q", failures)
+	}
+}
+
+func TestScriptedPeer_WaitTimesOut(t *testing.T) {
+	_, server := NewConnPair(ConnConfig{})
+	tb := &failureRecorder{TB: t}
+
+	want := rhizome.NewObject(
+		rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyOnsent,
+		"uid-1", "topic", "", "", "",
+		rhizome.EncodingJson, []byte(`{"n":1}`),
+	)
+
+	peer := NewScriptedPeer(tb, server)
+	peer.Expect(want)
+	peer.Start()
+
+	runFailing(func() { peer.Wait(10 * time.Millisecond) })
+	if failures := tb.failed(); len(failures) != 1 || !strings.Contains(failures[0], "0 of 1") {
+		t.Fatalf("failures = %q", failures)
+	}
+}
+
+func TestAssertObjectsEqual(t *testing.T) {
+	want := rhizome.NewObject(
+		rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyOnsent,
+		"uid-1", "topic", "", "", "",
+		rhizome.EncodingJson, []byte(`{"n":1}`),
+	)
+	got := rhizome.NewObject(
+		rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyOnsent,
+		"uid-1", "topic", "", "", "",
+		rhizome.EncodingJson, []byte(`{"n":1}`),
+	)
+	AssertObjectsEqual(t, want, got)
+
+	got.Arg2 = "other"
+	got.Payload = []byte("different")
+	tb := &failureRecorder{TB: t}
+	runFailing(func() { AssertObjectsEqual(tb, want, got) })
+
+	failures := tb.failed()
+	if len(failures) != 1 || !strings.Contains(failures[0], "Arg2") ||
+		!strings.Contains(failures[0], "Payload") || strings.Contains(failures[0], "UID") {
+		t.Fatalf("failures = %q", failures)
+	}
+}
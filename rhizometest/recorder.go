@@ -0,0 +1,142 @@
+package rhizometest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// Recorder is a net.Conn that keeps everything written to it, standing in for
+// the connection of a ConnResponder so tests can check the responses sent
+// back. Reads return io.EOF.
+type Recorder struct {
+	local, remote Addr
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	writes   int
+	writeErr error
+	closed   bool
+	changed  chan struct{}
+}
+
+// NewRecorder returns a Recorder whose remote address is remoteAddr.
+func NewRecorder(remoteAddr string) *Recorder {
+	return &Recorder{
+		local:   Addr("recorder"),
+		remote:  Addr(remoteAddr),
+		changed: make(chan struct{}),
+	}
+}
+
+// Responder returns a ConnResponder writing to r.
+func (r *Recorder) Responder() *rhizome.ConnResponder {
+	return rhizome.NewConnResponder(r)
+}
+
+// FailWrites makes every later Write fail with err, or succeed again if err is
+// nil.
+func (r *Recorder) FailWrites(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeErr = err
+}
+
+func (r *Recorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return 0, net.ErrClosed
+	}
+	if r.writeErr != nil {
+		return 0, r.writeErr
+	}
+	r.writes++
+	r.buf.Write(b)
+	close(r.changed)
+	r.changed = make(chan struct{})
+	return len(b), nil
+}
+
+// Bytes returns a copy of everything written so far.
+func (r *Recorder) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return bytes.Clone(r.buf.Bytes())
+}
+
+// Writes returns how many times Write succeeded.
+func (r *Recorder) Writes() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writes
+}
+
+// Responses decodes everything written so far as responses.
+func (r *Recorder) Responses() ([]rhizome.Response, error) {
+	var responses []rhizome.Response
+	for response, err := range rhizome.Responses(bytes.NewReader(r.Bytes())) {
+		if err != nil {
+			return responses, err
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+// WaitForResponses waits until at least n responses were written, for
+// responders that write from a goroutine of their own, and returns them.
+func (r *Recorder) WaitForResponses(n int, timeout time.Duration) ([]rhizome.Response, error) {
+	expired := time.After(timeout)
+	for {
+		r.mu.Lock()
+		changed := r.changed
+		r.mu.Unlock()
+
+		responses, err := r.Responses()
+		if len(responses) >= n {
+			return responses, nil
+		}
+		// A response may still be partly written.
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return responses, err
+		}
+
+		select {
+		case <-changed:
+		case <-expired:
+			return responses, fmt.Errorf(
+				"got %d responses after %v, want %d", len(responses), timeout, n,
+			)
+		}
+	}
+}
+
+// Closed reports whether Close was called.
+func (r *Recorder) Closed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+func (r *Recorder) Read(b []byte) (int, error) { return 0, io.EOF }
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *Recorder) LocalAddr() net.Addr                { return r.local }
+func (r *Recorder) RemoteAddr() net.Addr               { return r.remote }
+func (r *Recorder) SetDeadline(t time.Time) error      { return nil }
+func (r *Recorder) SetReadDeadline(t time.Time) error  { return nil }
+func (r *Recorder) SetWriteDeadline(t time.Time) error { return nil }
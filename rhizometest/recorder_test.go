@@ -0,0 +1,90 @@
+package rhizometest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/signal-weave/rhizome"
+)
+
+func TestRecorder_Responses(t *testing.T) {
+	rec := NewRecorder("10.0.0.1:5000")
+	obj := rhizome.NewObject(
+		rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyOnsent,
+		"uid-1", "topic", "", "", "",
+		rhizome.EncodingJson, []byte(`{"n":1}`),
+	)
+	obj.Responder = rec.Responder()
+
+	if got := obj.Responder.RemoteAddr(); got != "10.0.0.1:5000" {
+		t.Fatalf("RemoteAddr = %q", got)
+	}
+	_ = obj.RespondWithAck(rhizome.AckSent)
+	_ = obj.RespondWithAck(rhizome.AckRouteNotFound)
+
+	got, err := rec.Responses()
+	if err != nil {
+		t.Fatalf("Responses error: %v", err)
+	}
+	AssertResponses(t, got,
+		rhizome.Response{UID: "uid-1", Ack: rhizome.AckSent},
+		rhizome.Response{UID: "uid-1", Ack: rhizome.AckRouteNotFound},
+	)
+	if rec.Writes() != 2 {
+		t.Fatalf("Writes = %d, want 2", rec.Writes())
+	}
+}
+
+func TestRecorder_FailWrites(t *testing.T) {
+	rec := NewRecorder("peer")
+	obj := rhizome.NewObject(
+		rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyOnsent,
+		"uid-1", "topic", "", "", "",
+		rhizome.EncodingJson, []byte(`{"n":1}`),
+	)
+	obj.Responder = rec.Responder()
+
+	boom := errors.New("boom")
+	rec.FailWrites(boom)
+	if err := obj.RespondWithAck(rhizome.AckSent); err != boom {
+		t.Fatalf("RespondWithAck error = %v, want boom", err)
+	}
+	rec.FailWrites(nil)
+	if err := obj.RespondWithAck(rhizome.AckSent); err != nil {
+		t.Fatalf("RespondWithAck error: %v", err)
+	}
+	if len(rec.Bytes()) == 0 || rec.Writes() != 1 {
+		t.Fatalf("recorded %d writes", rec.Writes())
+	}
+}
+
+func TestRecorder_WaitForResponses(t *testing.T) {
+	rec := NewRecorder("peer")
+	responder := rhizome.NewAsyncConnResponder(rec, rhizome.ResponderConfig{})
+	defer responder.Close()
+
+	for _, uid := range []string{"a", "b", "c"} {
+		obj := rhizome.NewObject(
+			rhizome.ObjDelivery, rhizome.CmdSend, rhizome.AckPlcyOnsent,
+			uid, "topic", "", "", "",
+			rhizome.EncodingJson, []byte(`{"n":1}`),
+		)
+		obj.Responder = responder
+		if err := obj.RespondWithAck(rhizome.AckSent); err != nil {
+			t.Fatalf("RespondWithAck error: %v", err)
+		}
+	}
+
+	got, err := rec.WaitForResponses(3, time.Second)
+	if err != nil {
+		t.Fatalf("WaitForResponses error: %v", err)
+	}
+	if len(got) != 3 || got[2].UID != "c" {
+		t.Fatalf("got %v", got)
+	}
+
+	if _, err := rec.WaitForResponses(4, 10*time.Millisecond); err == nil {
+		t.Fatalf("expected WaitForResponses to time out")
+	}
+}
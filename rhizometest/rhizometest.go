@@ -0,0 +1,91 @@
+// Package rhizometest provides helpers for testing code built on rhizome: an
+// in-memory connection pair, a Recorder capturing what a ConnResponder writes,
+// a ScriptedPeer playing the other side of a connection, and assertions.
+package rhizometest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// DiffObjects describes how got differs from want in the fields carried on the
+// wire, or returns an empty string if they agree. Compression is left out, as
+// payloads too small to compress are sent uncompressed whatever it says.
+func DiffObjects(want, got *rhizome.Object) string {
+	if want == nil || got == nil {
+		if want == got {
+			return ""
+		}
+		return fmt.Sprintf("got object %v, want %v", got, want)
+	}
+
+	var diffs []string
+	field := func(name string, got, want any) {
+		if got != want {
+			diffs = append(diffs, fmt.Sprintf("%s: got %v, want %v", name, got, want))
+		}
+	}
+	quoted := func(name, got, want string) {
+		if got != want {
+			diffs = append(diffs, fmt.Sprintf("%s: got %q, want %q", name, got, want))
+		}
+	}
+
+	field("Version", got.Version, want.Version)
+	field("ObjType", got.ObjType, want.ObjType)
+	field("CmdType", got.CmdType, want.CmdType)
+	field("AckPlcy", got.AckPlcy, want.AckPlcy)
+	quoted("UID", got.UID, want.UID)
+	quoted("Arg1", got.Arg1, want.Arg1)
+	quoted("Arg2", got.Arg2, want.Arg2)
+	quoted("Arg3", got.Arg3, want.Arg3)
+	quoted("Arg4", got.Arg4, want.Arg4)
+	field("PayloadEncoding", got.PayloadEncoding, want.PayloadEncoding)
+	field("FragIndex", got.FragIndex, want.FragIndex)
+	field("FragCount", got.FragCount, want.FragCount)
+	field("Streamed", got.Streamed(), want.Streamed())
+	if !bytes.Equal(got.Payload, want.Payload) {
+		diffs = append(diffs, fmt.Sprintf(
+			"Payload: got %d bytes %q, want %d bytes %q",
+			len(got.Payload), clip(got.Payload), len(want.Payload), clip(want.Payload),
+		))
+	}
+	return strings.Join(diffs, "\n")
+}
+
+// clip shortens payloads for failure messages.
+func clip(b []byte) []byte {
+	const limit = 64
+	if len(b) > limit {
+		return b[:limit]
+	}
+	return b
+}
+
+// AssertObjectsEqual fails the test if got differs from want, see DiffObjects.
+func AssertObjectsEqual(t testing.TB, want, got *rhizome.Object) {
+	t.Helper()
+
+	if diff := DiffObjects(want, got); diff != "" {
+		t.Fatalf("objects differ:\n%s", diff)
+	}
+}
+
+// AssertResponses fails the test unless got holds the responses in want, in
+// order.
+func AssertResponses(t testing.TB, got []rhizome.Response, want ...rhizome.Response) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d responses %v, want %d %v", len(got), got, len(want), want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("response %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
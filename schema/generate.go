@@ -0,0 +1,435 @@
+package schema
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Generate returns the Go code for s. source names the schema file in the
+// header marking the code as generated.
+//
+// For every command the code declares a struct holding its arguments and
+// payload, New and Parse functions converting it to and from a
+// rhizome.Object, a Validate function checking an object against the schema,
+// and the list of acks it may be answered with. A Client sends the commands
+// over a rhizome.Session and checks their acks, and Serve hands the commands
+// received on a session to a Handler.
+func Generate(s *Schema, source string) ([]byte, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := codeTemplate.Execute(&buf, newGenSchema(s, source)); err != nil {
+		return nil, fmt.Errorf("generate: %w", err)
+	}
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("generate: formatting the generated code: %w", err)
+	}
+	return code, nil
+}
+
+// genSchema is what the template renders.
+type genSchema struct {
+	Source   string
+	Package  string
+	Imports  []string
+	Acks     []Ack
+	Commands []genCommand
+}
+
+type genCommand struct {
+	Name, Doc        string
+	ObjType, CmdType string
+	Args             []genArg
+	Unused           []int
+
+	PayloadType   string
+	PayloadGoType string
+
+	// Whether the struct holds the payload encoding, or always uses
+	// Encoding.
+	EncodingField bool
+	Encoding      string
+
+	// The allowed encodings, empty if any is.
+	Encodings []string
+
+	Acks []string
+}
+
+type genArg struct {
+	Name, GoType, Tag, Doc string
+	Pos                    int
+	Optional               bool
+}
+
+func newGenSchema(s *Schema, source string) genSchema {
+	gs := genSchema{Source: source, Package: s.Package, Acks: s.Acks}
+	imports := map[string]bool{"fmt": true, "slices": true, "strconv": true}
+
+	for _, cmd := range s.Commands {
+		gc := genCommand{
+			Name:        cmd.Name,
+			Doc:         cmd.Doc,
+			ObjType:     codeExpr(cmd.ObjType),
+			CmdType:     codeExpr(cmd.CmdType),
+			PayloadType: cmd.Payload.Type,
+		}
+		if gc.PayloadType == "" {
+			gc.PayloadType = PayloadNone
+		}
+
+		for i, arg := range cmd.Args {
+			ga := genArg{
+				Name:     arg.Name,
+				GoType:   ArgTypes[arg.Type],
+				Tag:      "arg" + strconv.Itoa(i+1),
+				Doc:      arg.Doc,
+				Pos:      i + 1,
+				Optional: arg.Optional,
+			}
+			if ga.Optional {
+				ga.Tag += ",optional"
+			} else {
+				imports["errors"] = true
+			}
+			if strings.HasPrefix(ga.GoType, "time.") {
+				imports["time"] = true
+			}
+			gc.Args = append(gc.Args, ga)
+		}
+		for pos := len(cmd.Args) + 1; pos <= 4; pos++ {
+			gc.Unused = append(gc.Unused, pos)
+		}
+
+		for _, name := range cmd.Encodings {
+			gc.Encodings = append(gc.Encodings, "rhizome."+encodingConsts[name])
+		}
+		switch gc.PayloadType {
+		case PayloadJSON:
+			imports["encoding/json"] = true
+			gc.PayloadGoType = cmd.Payload.GoType
+			gc.Encoding = "rhizome.EncodingJson"
+			gc.Encodings = []string{gc.Encoding}
+		case PayloadBytes, PayloadString:
+			gc.PayloadGoType = "[]byte"
+			if gc.PayloadType == PayloadString {
+				gc.PayloadGoType = "string"
+			}
+			if len(gc.Encodings) == 1 {
+				gc.Encoding = gc.Encodings[0]
+			} else {
+				gc.EncodingField = true
+			}
+		default:
+			gc.Encoding = "rhizome.EncodingNA"
+			if len(gc.Encodings) > 0 {
+				gc.Encoding = gc.Encodings[0]
+			}
+		}
+
+		for _, name := range cmd.Acks {
+			if _, ok := standardAcks[name]; ok {
+				name = "rhizome." + name
+			}
+			gc.Acks = append(gc.Acks, name)
+		}
+		gs.Commands = append(gs.Commands, gc)
+	}
+
+	for imp := range imports {
+		gs.Imports = append(gs.Imports, imp)
+	}
+	slices.Sort(gs.Imports)
+	return gs
+}
+
+// codeExpr returns the Go expression for c.
+func codeExpr(c Code) string {
+	if c.Name != "" {
+		return "rhizome." + c.Name
+	}
+	return strconv.Itoa(int(c.Value))
+}
+
+// comment turns doc into a comment indented by indent.
+func comment(doc, indent string) string {
+	doc = strings.TrimSpace(doc)
+	if doc == "" {
+		return ""
+	}
+	var b strings.Builder
+	for line := range strings.Lines(doc) {
+		b.WriteString(strings.TrimRight(indent+"// "+strings.TrimRight(line, "\n"), " "))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+var codeTemplate = template.Must(template.New("code").Funcs(template.FuncMap{
+	"comment": comment,
+	"join":    strings.Join,
+}).Parse(`// Code generated by rhizomegen from {{.Source}}. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- range .Imports}}
+	"{{.}}"
+{{- end}}
+
+	"github.com/signal-weave/rhizome"
+)
+{{- if .Acks}}
+
+// Acks declared by the schema.
+const (
+{{- range $i, $ack := .Acks}}
+{{- if and $i $ack.Doc}}
+{{end}}
+{{comment $ack.Doc "\t"}}	{{$ack.Name}} uint8 = {{$ack.Value}}
+{{- end}}
+)
+{{- end}}
+{{- range .Commands}}
+{{template "command" .}}
+{{- end}}
+{{template "client" .}}
+{{template "server" .}}
+
+{{- define "command"}}
+{{if .Doc}}{{comment .Doc ""}}//
+{{end}}// {{.Name}} is sent with object type {{.ObjType}} and command type
+// {{.CmdType}}, and answered with one of {{.Name}}Acks.
+type {{.Name}} struct {
+{{- range .Args}}
+{{comment .Doc "\t"}}	{{.Name}} {{.GoType}} ` + "`" + `rhizome:"{{.Tag}}"` + "`" + `
+{{- end}}
+{{- if and .Args .PayloadGoType}}
+{{end}}
+{{- if .EncodingField}}
+	PayloadEncoding rhizome.PayloadEncoding
+{{- end}}
+{{- if .PayloadGoType}}
+	Payload {{.PayloadGoType}}
+{{- end}}
+}
+
+// {{.Name}}Acks are the acks {{.Name}} may be answered with.
+var {{.Name}}Acks = []uint8{ {{- join .Acks ", " -}} }
+
+// New{{.Name}} returns the object carrying cmd, with AckPlcyOnsent.
+func New{{.Name}}(uid string, cmd {{.Name}}) (*rhizome.Object, error) {
+	obj := rhizome.NewObject(
+		{{.ObjType}}, {{.CmdType}}, rhizome.AckPlcyOnsent,
+		uid, "", "", "", "",
+		{{if .EncodingField}}cmd.PayloadEncoding{{else}}{{.Encoding}}{{end}}, nil,
+	)
+	if err := rhizome.MarshalArgs(obj, &cmd); err != nil {
+		return nil, fmt.Errorf("{{.Name}}: %w", err)
+	}
+{{- if eq .PayloadType "bytes"}}
+	obj.Payload = cmd.Payload
+{{- else if eq .PayloadType "string"}}
+	obj.Payload = []byte(cmd.Payload)
+{{- else if eq .PayloadType "json"}}
+	payload, err := json.Marshal(cmd.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("{{.Name}}: payload: %w", err)
+	}
+	obj.Payload = payload
+{{- end}}
+	if err := Validate{{.Name}}(obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// Validate{{.Name}} reports why obj is not a valid {{.Name}}, if it is not.
+func Validate{{.Name}}(obj *rhizome.Object) error {
+	_, err := Parse{{.Name}}(obj)
+	return err
+}
+
+// Parse{{.Name}} checks obj against the schema of {{.Name}} and returns the
+// command it carries.
+func Parse{{.Name}}(obj *rhizome.Object) ({{.Name}}, error) {
+	var cmd {{.Name}}
+	if obj.ObjType != {{.ObjType}} || obj.CmdType != {{.CmdType}} {
+		return cmd, fmt.Errorf(
+			"{{.Name}}: %w: got object type %d and command type %d",
+			rhizome.ErrWrongCommand, obj.ObjType, obj.CmdType,
+		)
+	}
+{{- if .Encodings}}
+	switch obj.PayloadEncoding {
+	case {{join .Encodings ", "}}:
+	default:
+		return cmd, fmt.Errorf("{{.Name}}: payload encoding %s is not allowed", obj.PayloadEncoding)
+	}
+{{- end}}
+{{- range .Args}}
+{{- if not .Optional}}
+	if obj.Arg{{.Pos}} == "" {
+		return cmd, fmt.Errorf("{{$.Name}}: %w", &rhizome.ArgError{
+			Pos: {{.Pos}}, Name: "{{.Name}}", Err: errors.New("must not be empty"),
+		})
+	}
+{{- end}}
+{{- end}}
+{{- range .Unused}}
+	if obj.Arg{{.}} != "" {
+		return cmd, fmt.Errorf("{{$.Name}}: %w", &rhizome.ArgError{
+			Pos: {{.}}, Err: fmt.Errorf("unused, must be empty, got %q", obj.Arg{{.}}),
+		})
+	}
+{{- end}}
+	if err := rhizome.UnmarshalArgs(obj, &cmd); err != nil {
+		return cmd, fmt.Errorf("{{.Name}}: %w", err)
+	}
+{{- if .EncodingField}}
+	cmd.PayloadEncoding = obj.PayloadEncoding
+{{- end}}
+{{- if eq .PayloadType "none"}}
+	if len(obj.Payload) > 0 {
+		return cmd, fmt.Errorf("{{.Name}}: unexpected payload of %d bytes", len(obj.Payload))
+	}
+{{- else if eq .PayloadType "bytes"}}
+	cmd.Payload = obj.Payload
+{{- else if eq .PayloadType "string"}}
+	cmd.Payload = string(obj.Payload)
+{{- else if eq .PayloadType "json"}}
+	if err := json.Unmarshal(obj.Payload, &cmd.Payload); err != nil {
+		return cmd, fmt.Errorf("{{.Name}}: payload: %w", err)
+	}
+{{- end}}
+	return cmd, nil
+}
+{{- end}}
+
+{{- define "client"}}
+// Client sends commands over a session and waits for their acks. It sends one
+// command at a time, and expects to be the only reader of the session's
+// responses.
+type Client struct {
+	Session *rhizome.Session
+
+	// NewUID returns the UID of each command. Defaults to counting up from 1.
+	NewUID func() string
+
+	sent uint64
+}
+{{- range .Commands}}
+
+// {{.Name}} sends cmd and returns the ack it was answered with.
+func (c *Client) {{.Name}}(cmd {{.Name}}) (uint8, error) {
+	obj, err := New{{.Name}}(c.uid(), cmd)
+	if err != nil {
+		return rhizome.AckUnknown, err
+	}
+	return c.call(obj, {{.Name}}Acks)
+}
+{{- end}}
+
+func (c *Client) uid() string {
+	if c.NewUID != nil {
+		return c.NewUID()
+	}
+	c.sent++
+	return strconv.FormatUint(c.sent, 10)
+}
+
+// call sends obj and waits for its ack, which must be one of acks.
+func (c *Client) call(obj *rhizome.Object, acks []uint8) (uint8, error) {
+	if err := c.Session.Send(obj); err != nil {
+		return rhizome.AckUnknown, err
+	}
+	resp, err := c.Session.ReceiveResponse()
+	if err != nil {
+		return rhizome.AckUnknown, err
+	}
+	if resp.UID != obj.UID {
+		return resp.Ack, fmt.Errorf("%s: got the response for %s", obj.UID, resp.UID)
+	}
+	if !slices.Contains(acks, resp.Ack) {
+		return resp.Ack, fmt.Errorf("%s: answered with undeclared ack %d", obj.UID, resp.Ack)
+	}
+	return resp.Ack, nil
+}
+{{- end}}
+
+{{- define "server"}}
+// Handler handles commands, see Serve. Each method returns the ack to answer
+// the command with, which must be one the command declares.
+type Handler interface {
+{{- range .Commands}}
+	{{.Name}}(obj *rhizome.Object, cmd {{.Name}}) uint8
+{{- end}}
+}
+
+// Dispatch parses obj as the command its types name and hands it to h,
+// returning the ack h answered with. Objects that are no command, fail to
+// parse, or are answered with an ack their command does not declare, return
+// AckUnknown and an error.
+func Dispatch(h Handler, obj *rhizome.Object) (uint8, error) {
+	var ack uint8
+	var acks []uint8
+	switch [2]uint8{obj.ObjType, obj.CmdType} {
+{{- range .Commands}}
+	case [2]uint8{ {{- .ObjType}}, {{.CmdType -}} }:
+		cmd, err := Parse{{.Name}}(obj)
+		if err != nil {
+			return rhizome.AckUnknown, err
+		}
+		ack, acks = h.{{.Name}}(obj, cmd), {{.Name}}Acks
+{{- end}}
+	default:
+		return rhizome.AckUnknown, fmt.Errorf(
+			"%w: no command has object type %d and command type %d",
+			rhizome.ErrWrongCommand, obj.ObjType, obj.CmdType,
+		)
+	}
+	if !slices.Contains(acks, ack) {
+		return rhizome.AckUnknown, fmt.Errorf("%s: handler answered with undeclared ack %d", obj.UID, ack)
+	}
+	return ack, nil
+}
+
+// Serve dispatches the objects received on s to h and answers them with their
+// ack, unless the sender asked for none, until s stops. Objects that fail to
+// dispatch are answered with AckUnknown and handed to onError, if set, as are
+// the errors of objects that fail to decode, with a nil obj.
+// Serve returns why s stopped, io.EOF if the peer hung up.
+func Serve(s *rhizome.Session, h Handler, onError func(obj *rhizome.Object, err error)) error {
+	for {
+		obj, err := s.Receive()
+		if err != nil {
+			if s.Err() != nil {
+				return err
+			}
+			// The object failed to decode, the session goes on.
+			if onError != nil {
+				onError(nil, err)
+			}
+			continue
+		}
+		ack, err := Dispatch(h, obj)
+		if err != nil && onError != nil {
+			onError(obj, err)
+		}
+		if obj.AckPlcy != rhizome.AckPlcyNoreply {
+			if err := obj.RespondWithAck(ack); err != nil {
+				return err
+			}
+		}
+	}
+}
+{{- end}}
+`))
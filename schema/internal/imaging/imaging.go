@@ -0,0 +1,11 @@
+// Package imaging is an example application whose commands are generated from
+// imaging.json by rhizomegen.
+package imaging
+
+//go:generate go run github.com/signal-weave/rhizome/cmd/rhizomegen imaging.json
+
+// Job is the payload of a Submit.
+type Job struct {
+	Source string   `json:"source"`
+	Steps  []string `json:"steps"`
+}
@@ -0,0 +1,481 @@
+// Code generated by rhizomegen from imaging.json. DO NOT EDIT.
+
+package imaging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// Acks declared by the schema.
+const (
+	// AckTooLarge means the image exceeds the size limit.
+	AckTooLarge uint8 = 100
+
+	// AckQueueFull means the queue takes no more jobs for now.
+	AckQueueFull uint8 = 101
+
+	// AckJobNotFound means there is no job with the ID given.
+	AckJobNotFound uint8 = 102
+)
+
+// Resize scales the image in the payload to fit a box.
+//
+// Resize is sent with object type rhizome.ObjAction and command type
+// 60, and answered with one of ResizeAcks.
+type Resize struct {
+	// Width of the box, in pixels.
+	Width uint16 `rhizome:"arg1"`
+	// Height of the box, in pixels.
+	Height uint16 `rhizome:"arg2"`
+	// How long the resize may take. Zero leaves it to the server.
+	Within time.Duration `rhizome:"arg3,optional"`
+
+	PayloadEncoding rhizome.PayloadEncoding
+	Payload         []byte
+}
+
+// ResizeAcks are the acks Resize may be answered with.
+var ResizeAcks = []uint8{rhizome.AckSent, AckTooLarge, rhizome.AckTimeout}
+
+// NewResize returns the object carrying cmd, with AckPlcyOnsent.
+func NewResize(uid string, cmd Resize) (*rhizome.Object, error) {
+	obj := rhizome.NewObject(
+		rhizome.ObjAction, 60, rhizome.AckPlcyOnsent,
+		uid, "", "", "", "",
+		cmd.PayloadEncoding, nil,
+	)
+	if err := rhizome.MarshalArgs(obj, &cmd); err != nil {
+		return nil, fmt.Errorf("Resize: %w", err)
+	}
+	obj.Payload = cmd.Payload
+	if err := ValidateResize(obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// ValidateResize reports why obj is not a valid Resize, if it is not.
+func ValidateResize(obj *rhizome.Object) error {
+	_, err := ParseResize(obj)
+	return err
+}
+
+// ParseResize checks obj against the schema of Resize and returns the
+// command it carries.
+func ParseResize(obj *rhizome.Object) (Resize, error) {
+	var cmd Resize
+	if obj.ObjType != rhizome.ObjAction || obj.CmdType != 60 {
+		return cmd, fmt.Errorf(
+			"Resize: %w: got object type %d and command type %d",
+			rhizome.ErrWrongCommand, obj.ObjType, obj.CmdType,
+		)
+	}
+	switch obj.PayloadEncoding {
+	case rhizome.EncodingNA, rhizome.EncodingProtobuf:
+	default:
+		return cmd, fmt.Errorf("Resize: payload encoding %s is not allowed", obj.PayloadEncoding)
+	}
+	if obj.Arg1 == "" {
+		return cmd, fmt.Errorf("Resize: %w", &rhizome.ArgError{
+			Pos: 1, Name: "Width", Err: errors.New("must not be empty"),
+		})
+	}
+	if obj.Arg2 == "" {
+		return cmd, fmt.Errorf("Resize: %w", &rhizome.ArgError{
+			Pos: 2, Name: "Height", Err: errors.New("must not be empty"),
+		})
+	}
+	if obj.Arg4 != "" {
+		return cmd, fmt.Errorf("Resize: %w", &rhizome.ArgError{
+			Pos: 4, Err: fmt.Errorf("unused, must be empty, got %q", obj.Arg4),
+		})
+	}
+	if err := rhizome.UnmarshalArgs(obj, &cmd); err != nil {
+		return cmd, fmt.Errorf("Resize: %w", err)
+	}
+	cmd.PayloadEncoding = obj.PayloadEncoding
+	cmd.Payload = obj.Payload
+	return cmd, nil
+}
+
+// Submit queues a job.
+//
+// Submit is sent with object type rhizome.ObjAction and command type
+// 61, and answered with one of SubmitAcks.
+type Submit struct {
+	Queue    string            `rhizome:"arg1"`
+	Priority int8              `rhizome:"arg2,optional"`
+	Labels   map[string]string `rhizome:"arg3,optional"`
+
+	Payload Job
+}
+
+// SubmitAcks are the acks Submit may be answered with.
+var SubmitAcks = []uint8{rhizome.AckSent, AckQueueFull}
+
+// NewSubmit returns the object carrying cmd, with AckPlcyOnsent.
+func NewSubmit(uid string, cmd Submit) (*rhizome.Object, error) {
+	obj := rhizome.NewObject(
+		rhizome.ObjAction, 61, rhizome.AckPlcyOnsent,
+		uid, "", "", "", "",
+		rhizome.EncodingJson, nil,
+	)
+	if err := rhizome.MarshalArgs(obj, &cmd); err != nil {
+		return nil, fmt.Errorf("Submit: %w", err)
+	}
+	payload, err := json.Marshal(cmd.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("Submit: payload: %w", err)
+	}
+	obj.Payload = payload
+	if err := ValidateSubmit(obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// ValidateSubmit reports why obj is not a valid Submit, if it is not.
+func ValidateSubmit(obj *rhizome.Object) error {
+	_, err := ParseSubmit(obj)
+	return err
+}
+
+// ParseSubmit checks obj against the schema of Submit and returns the
+// command it carries.
+func ParseSubmit(obj *rhizome.Object) (Submit, error) {
+	var cmd Submit
+	if obj.ObjType != rhizome.ObjAction || obj.CmdType != 61 {
+		return cmd, fmt.Errorf(
+			"Submit: %w: got object type %d and command type %d",
+			rhizome.ErrWrongCommand, obj.ObjType, obj.CmdType,
+		)
+	}
+	switch obj.PayloadEncoding {
+	case rhizome.EncodingJson:
+	default:
+		return cmd, fmt.Errorf("Submit: payload encoding %s is not allowed", obj.PayloadEncoding)
+	}
+	if obj.Arg1 == "" {
+		return cmd, fmt.Errorf("Submit: %w", &rhizome.ArgError{
+			Pos: 1, Name: "Queue", Err: errors.New("must not be empty"),
+		})
+	}
+	if obj.Arg4 != "" {
+		return cmd, fmt.Errorf("Submit: %w", &rhizome.ArgError{
+			Pos: 4, Err: fmt.Errorf("unused, must be empty, got %q", obj.Arg4),
+		})
+	}
+	if err := rhizome.UnmarshalArgs(obj, &cmd); err != nil {
+		return cmd, fmt.Errorf("Submit: %w", err)
+	}
+	if err := json.Unmarshal(obj.Payload, &cmd.Payload); err != nil {
+		return cmd, fmt.Errorf("Submit: payload: %w", err)
+	}
+	return cmd, nil
+}
+
+// Cancel cancels a queued job.
+//
+// Cancel is sent with object type rhizome.ObjAction and command type
+// rhizome.CmdRemove, and answered with one of CancelAcks.
+type Cancel struct {
+	JobID string `rhizome:"arg1"`
+	// Only cancel the job if it is still queued at this time.
+	After time.Time `rhizome:"arg2,optional"`
+}
+
+// CancelAcks are the acks Cancel may be answered with.
+var CancelAcks = []uint8{rhizome.AckSent, AckJobNotFound}
+
+// NewCancel returns the object carrying cmd, with AckPlcyOnsent.
+func NewCancel(uid string, cmd Cancel) (*rhizome.Object, error) {
+	obj := rhizome.NewObject(
+		rhizome.ObjAction, rhizome.CmdRemove, rhizome.AckPlcyOnsent,
+		uid, "", "", "", "",
+		rhizome.EncodingNA, nil,
+	)
+	if err := rhizome.MarshalArgs(obj, &cmd); err != nil {
+		return nil, fmt.Errorf("Cancel: %w", err)
+	}
+	if err := ValidateCancel(obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// ValidateCancel reports why obj is not a valid Cancel, if it is not.
+func ValidateCancel(obj *rhizome.Object) error {
+	_, err := ParseCancel(obj)
+	return err
+}
+
+// ParseCancel checks obj against the schema of Cancel and returns the
+// command it carries.
+func ParseCancel(obj *rhizome.Object) (Cancel, error) {
+	var cmd Cancel
+	if obj.ObjType != rhizome.ObjAction || obj.CmdType != rhizome.CmdRemove {
+		return cmd, fmt.Errorf(
+			"Cancel: %w: got object type %d and command type %d",
+			rhizome.ErrWrongCommand, obj.ObjType, obj.CmdType,
+		)
+	}
+	if obj.Arg1 == "" {
+		return cmd, fmt.Errorf("Cancel: %w", &rhizome.ArgError{
+			Pos: 1, Name: "JobID", Err: errors.New("must not be empty"),
+		})
+	}
+	if obj.Arg3 != "" {
+		return cmd, fmt.Errorf("Cancel: %w", &rhizome.ArgError{
+			Pos: 3, Err: fmt.Errorf("unused, must be empty, got %q", obj.Arg3),
+		})
+	}
+	if obj.Arg4 != "" {
+		return cmd, fmt.Errorf("Cancel: %w", &rhizome.ArgError{
+			Pos: 4, Err: fmt.Errorf("unused, must be empty, got %q", obj.Arg4),
+		})
+	}
+	if err := rhizome.UnmarshalArgs(obj, &cmd); err != nil {
+		return cmd, fmt.Errorf("Cancel: %w", err)
+	}
+	if len(obj.Payload) > 0 {
+		return cmd, fmt.Errorf("Cancel: unexpected payload of %d bytes", len(obj.Payload))
+	}
+	return cmd, nil
+}
+
+// Annotate is sent with object type rhizome.ObjAction and command type
+// rhizome.CmdUpdate, and answered with one of AnnotateAcks.
+type Annotate struct {
+	JobID string `rhizome:"arg1"`
+
+	PayloadEncoding rhizome.PayloadEncoding
+	Payload         string
+}
+
+// AnnotateAcks are the acks Annotate may be answered with.
+var AnnotateAcks = []uint8{rhizome.AckSent, AckJobNotFound}
+
+// NewAnnotate returns the object carrying cmd, with AckPlcyOnsent.
+func NewAnnotate(uid string, cmd Annotate) (*rhizome.Object, error) {
+	obj := rhizome.NewObject(
+		rhizome.ObjAction, rhizome.CmdUpdate, rhizome.AckPlcyOnsent,
+		uid, "", "", "", "",
+		cmd.PayloadEncoding, nil,
+	)
+	if err := rhizome.MarshalArgs(obj, &cmd); err != nil {
+		return nil, fmt.Errorf("Annotate: %w", err)
+	}
+	obj.Payload = []byte(cmd.Payload)
+	if err := ValidateAnnotate(obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// ValidateAnnotate reports why obj is not a valid Annotate, if it is not.
+func ValidateAnnotate(obj *rhizome.Object) error {
+	_, err := ParseAnnotate(obj)
+	return err
+}
+
+// ParseAnnotate checks obj against the schema of Annotate and returns the
+// command it carries.
+func ParseAnnotate(obj *rhizome.Object) (Annotate, error) {
+	var cmd Annotate
+	if obj.ObjType != rhizome.ObjAction || obj.CmdType != rhizome.CmdUpdate {
+		return cmd, fmt.Errorf(
+			"Annotate: %w: got object type %d and command type %d",
+			rhizome.ErrWrongCommand, obj.ObjType, obj.CmdType,
+		)
+	}
+	if obj.Arg1 == "" {
+		return cmd, fmt.Errorf("Annotate: %w", &rhizome.ArgError{
+			Pos: 1, Name: "JobID", Err: errors.New("must not be empty"),
+		})
+	}
+	if obj.Arg2 != "" {
+		return cmd, fmt.Errorf("Annotate: %w", &rhizome.ArgError{
+			Pos: 2, Err: fmt.Errorf("unused, must be empty, got %q", obj.Arg2),
+		})
+	}
+	if obj.Arg3 != "" {
+		return cmd, fmt.Errorf("Annotate: %w", &rhizome.ArgError{
+			Pos: 3, Err: fmt.Errorf("unused, must be empty, got %q", obj.Arg3),
+		})
+	}
+	if obj.Arg4 != "" {
+		return cmd, fmt.Errorf("Annotate: %w", &rhizome.ArgError{
+			Pos: 4, Err: fmt.Errorf("unused, must be empty, got %q", obj.Arg4),
+		})
+	}
+	if err := rhizome.UnmarshalArgs(obj, &cmd); err != nil {
+		return cmd, fmt.Errorf("Annotate: %w", err)
+	}
+	cmd.PayloadEncoding = obj.PayloadEncoding
+	cmd.Payload = string(obj.Payload)
+	return cmd, nil
+}
+
+// Client sends commands over a session and waits for their acks. It sends one
+// command at a time, and expects to be the only reader of the session's
+// responses.
+type Client struct {
+	Session *rhizome.Session
+
+	// NewUID returns the UID of each command. Defaults to counting up from 1.
+	NewUID func() string
+
+	sent uint64
+}
+
+// Resize sends cmd and returns the ack it was answered with.
+func (c *Client) Resize(cmd Resize) (uint8, error) {
+	obj, err := NewResize(c.uid(), cmd)
+	if err != nil {
+		return rhizome.AckUnknown, err
+	}
+	return c.call(obj, ResizeAcks)
+}
+
+// Submit sends cmd and returns the ack it was answered with.
+func (c *Client) Submit(cmd Submit) (uint8, error) {
+	obj, err := NewSubmit(c.uid(), cmd)
+	if err != nil {
+		return rhizome.AckUnknown, err
+	}
+	return c.call(obj, SubmitAcks)
+}
+
+// Cancel sends cmd and returns the ack it was answered with.
+func (c *Client) Cancel(cmd Cancel) (uint8, error) {
+	obj, err := NewCancel(c.uid(), cmd)
+	if err != nil {
+		return rhizome.AckUnknown, err
+	}
+	return c.call(obj, CancelAcks)
+}
+
+// Annotate sends cmd and returns the ack it was answered with.
+func (c *Client) Annotate(cmd Annotate) (uint8, error) {
+	obj, err := NewAnnotate(c.uid(), cmd)
+	if err != nil {
+		return rhizome.AckUnknown, err
+	}
+	return c.call(obj, AnnotateAcks)
+}
+
+func (c *Client) uid() string {
+	if c.NewUID != nil {
+		return c.NewUID()
+	}
+	c.sent++
+	return strconv.FormatUint(c.sent, 10)
+}
+
+// call sends obj and waits for its ack, which must be one of acks.
+func (c *Client) call(obj *rhizome.Object, acks []uint8) (uint8, error) {
+	if err := c.Session.Send(obj); err != nil {
+		return rhizome.AckUnknown, err
+	}
+	resp, err := c.Session.ReceiveResponse()
+	if err != nil {
+		return rhizome.AckUnknown, err
+	}
+	if resp.UID != obj.UID {
+		return resp.Ack, fmt.Errorf("%s: got the response for %s", obj.UID, resp.UID)
+	}
+	if !slices.Contains(acks, resp.Ack) {
+		return resp.Ack, fmt.Errorf("%s: answered with undeclared ack %d", obj.UID, resp.Ack)
+	}
+	return resp.Ack, nil
+}
+
+// Handler handles commands, see Serve. Each method returns the ack to answer
+// the command with, which must be one the command declares.
+type Handler interface {
+	Resize(obj *rhizome.Object, cmd Resize) uint8
+	Submit(obj *rhizome.Object, cmd Submit) uint8
+	Cancel(obj *rhizome.Object, cmd Cancel) uint8
+	Annotate(obj *rhizome.Object, cmd Annotate) uint8
+}
+
+// Dispatch parses obj as the command its types name and hands it to h,
+// returning the ack h answered with. Objects that are no command, fail to
+// parse, or are answered with an ack their command does not declare, return
+// AckUnknown and an error.
+func Dispatch(h Handler, obj *rhizome.Object) (uint8, error) {
+	var ack uint8
+	var acks []uint8
+	switch [2]uint8{obj.ObjType, obj.CmdType} {
+	case [2]uint8{rhizome.ObjAction, 60}:
+		cmd, err := ParseResize(obj)
+		if err != nil {
+			return rhizome.AckUnknown, err
+		}
+		ack, acks = h.Resize(obj, cmd), ResizeAcks
+	case [2]uint8{rhizome.ObjAction, 61}:
+		cmd, err := ParseSubmit(obj)
+		if err != nil {
+			return rhizome.AckUnknown, err
+		}
+		ack, acks = h.Submit(obj, cmd), SubmitAcks
+	case [2]uint8{rhizome.ObjAction, rhizome.CmdRemove}:
+		cmd, err := ParseCancel(obj)
+		if err != nil {
+			return rhizome.AckUnknown, err
+		}
+		ack, acks = h.Cancel(obj, cmd), CancelAcks
+	case [2]uint8{rhizome.ObjAction, rhizome.CmdUpdate}:
+		cmd, err := ParseAnnotate(obj)
+		if err != nil {
+			return rhizome.AckUnknown, err
+		}
+		ack, acks = h.Annotate(obj, cmd), AnnotateAcks
+	default:
+		return rhizome.AckUnknown, fmt.Errorf(
+			"%w: no command has object type %d and command type %d",
+			rhizome.ErrWrongCommand, obj.ObjType, obj.CmdType,
+		)
+	}
+	if !slices.Contains(acks, ack) {
+		return rhizome.AckUnknown, fmt.Errorf("%s: handler answered with undeclared ack %d", obj.UID, ack)
+	}
+	return ack, nil
+}
+
+// Serve dispatches the objects received on s to h and answers them with their
+// ack, unless the sender asked for none, until s stops. Objects that fail to
+// dispatch are answered with AckUnknown and handed to onError, if set, as are
+// the errors of objects that fail to decode, with a nil obj.
+// Serve returns why s stopped, io.EOF if the peer hung up.
+func Serve(s *rhizome.Session, h Handler, onError func(obj *rhizome.Object, err error)) error {
+	for {
+		obj, err := s.Receive()
+		if err != nil {
+			if s.Err() != nil {
+				return err
+			}
+			// The object failed to decode, the session goes on.
+			if onError != nil {
+				onError(nil, err)
+			}
+			continue
+		}
+		ack, err := Dispatch(h, obj)
+		if err != nil && onError != nil {
+			onError(obj, err)
+		}
+		if obj.AckPlcy != rhizome.AckPlcyNoreply {
+			if err := obj.RespondWithAck(ack); err != nil {
+				return err
+			}
+		}
+	}
+}
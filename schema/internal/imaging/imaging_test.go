@@ -0,0 +1,205 @@
+package imaging
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/signal-weave/rhizome"
+	"github.com/signal-weave/rhizome/rhizometest"
+)
+
+// jobs is a Handler that records the commands it is handed.
+type jobs struct {
+	got []any
+}
+
+func (j *jobs) Resize(_ *rhizome.Object, cmd Resize) uint8 {
+	j.got = append(j.got, cmd)
+	if cmd.Width > 4096 {
+		return AckTooLarge
+	}
+	return rhizome.AckSent
+}
+
+func (j *jobs) Submit(_ *rhizome.Object, cmd Submit) uint8 {
+	j.got = append(j.got, cmd)
+	return rhizome.AckSent
+}
+
+func (j *jobs) Cancel(_ *rhizome.Object, cmd Cancel) uint8 {
+	j.got = append(j.got, cmd)
+	return AckJobNotFound
+}
+
+// Annotate answers with an ack Annotate does not declare.
+func (j *jobs) Annotate(_ *rhizome.Object, cmd Annotate) uint8 {
+	j.got = append(j.got, cmd)
+	return AckQueueFull
+}
+
+// serve serves h on a simulated network and returns a client connected to it,
+// and the channel the errors of Serve's onError arrive on. Call it inside a
+// synctest bubble.
+func serve(t *testing.T, h Handler) (*Client, <-chan error) {
+	t.Helper()
+
+	network := rhizometest.NewNetwork(rhizometest.NetworkConfig{})
+	l, err := network.Listen("server:7000")
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	errs := make(chan error, 8)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s, err := rhizome.NewSession(conn, rhizome.SessionConfig{})
+		if err != nil {
+			t.Errorf("server NewSession error: %v", err)
+			return
+		}
+		defer s.Close()
+		Serve(s, h, func(_ *rhizome.Object, err error) { errs <- err })
+	}()
+
+	conn, err := network.Dial("client", "server:7000")
+	if err != nil {
+		t.Fatalf("Dial error: %v", err)
+	}
+	s, err := rhizome.NewSession(conn, rhizome.SessionConfig{})
+	if err != nil {
+		t.Fatalf("NewSession error: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return &Client{Session: s}, errs
+}
+
+func TestClient_CommandsRoundTripThroughServe(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		h := &jobs{}
+		c, errs := serve(t, h)
+
+		after := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+		want := []any{
+			Resize{Width: 640, Height: 480, Within: time.Second, PayloadEncoding: rhizome.EncodingProtobuf, Payload: []byte{1, 2, 3}},
+			Resize{Width: 8000, Height: 1},
+			Submit{Queue: "thumbs", Priority: -2, Labels: map[string]string{"team": "a,b"}, Payload: Job{Source: "s3://in", Steps: []string{"crop"}}},
+			Cancel{JobID: "j1", After: after},
+		}
+		wantAcks := []uint8{rhizome.AckSent, AckTooLarge, rhizome.AckSent, AckJobNotFound}
+
+		for i, cmd := range want {
+			var ack uint8
+			var err error
+			switch cmd := cmd.(type) {
+			case Resize:
+				ack, err = c.Resize(cmd)
+			case Submit:
+				ack, err = c.Submit(cmd)
+			case Cancel:
+				ack, err = c.Cancel(cmd)
+			}
+			if err != nil || ack != wantAcks[i] {
+				t.Errorf("%T: ack = %d, %v, want %d", cmd, ack, err, wantAcks[i])
+			}
+		}
+
+		if !reflect.DeepEqual(h.got, want) {
+			t.Errorf("handler got %+v\nwant %+v", h.got, want)
+		}
+		if len(errs) != 0 {
+			t.Errorf("Serve reported %v", <-errs)
+		}
+	})
+}
+
+func TestClient_RejectsUndeclaredAck(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		c, errs := serve(t, &jobs{})
+
+		ack, err := c.Annotate(Annotate{JobID: "j1", Payload: "looks fine"})
+		if err == nil || ack != rhizome.AckUnknown {
+			t.Fatalf("Annotate ack = %d, %v, want AckUnknown and an error", ack, err)
+		}
+
+		synctest.Wait()
+		if err := <-errs; err == nil || !strings.Contains(err.Error(), "handler answered with undeclared ack 101") {
+			t.Errorf("Serve reported %v", err)
+		}
+	})
+}
+
+func TestServe_AnswersBadObjectsWithAckUnknown(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		h := &jobs{}
+		c, errs := serve(t, h)
+
+		for _, obj := range []*rhizome.Object{
+			// Width is missing.
+			rhizome.NewObject(rhizome.ObjAction, 60, rhizome.AckPlcyOnsent, "1", "", "1", "", "", rhizome.EncodingNA, nil),
+			// No command has these types.
+			rhizome.NewObject(rhizome.ObjAction, 99, rhizome.AckPlcyOnsent, "2", "", "", "", "", rhizome.EncodingNA, nil),
+		} {
+			if err := c.Session.Send(obj); err != nil {
+				t.Fatalf("Send error: %v", err)
+			}
+			resp, err := c.Session.ReceiveResponse()
+			if err != nil || resp.UID != obj.UID || resp.Ack != rhizome.AckUnknown {
+				t.Errorf("response = %+v, %v, want AckUnknown for %s", resp, err, obj.UID)
+			}
+			if err := <-errs; err == nil {
+				t.Errorf("Serve reported no error for %s", obj.UID)
+			}
+		}
+
+		var argErr *rhizome.ArgError
+		obj := rhizome.NewObject(rhizome.ObjAction, 60, rhizome.AckPlcyOnsent, "1", "", "1", "", "", rhizome.EncodingNA, nil)
+		if _, err := ParseResize(obj); !errors.As(err, &argErr) || argErr.Name != "Width" {
+			t.Errorf("ParseResize error = %v, want an ArgError for Width", err)
+		}
+		if len(h.got) != 0 {
+			t.Errorf("handler got %+v", h.got)
+		}
+	})
+}
+
+func TestNew_ChecksTheSchema(t *testing.T) {
+	for _, tc := range []struct {
+		build func() (*rhizome.Object, error)
+		want  string
+	}{
+		{
+			func() (*rhizome.Object, error) {
+				return NewResize("1", Resize{Width: 1, Height: 1, PayloadEncoding: rhizome.EncodingJson})
+			},
+			"Resize: payload encoding json is not allowed",
+		},
+		{
+			func() (*rhizome.Object, error) { return NewSubmit("1", Submit{Payload: Job{Source: "x"}}) },
+			"Submit: arg1 (Queue): must not be empty",
+		},
+	} {
+		if _, err := tc.build(); err == nil || err.Error() != tc.want {
+			t.Errorf("error = %v, want %s", err, tc.want)
+		}
+	}
+
+	obj, err := NewCancel("1", Cancel{JobID: "j1"})
+	if err != nil {
+		t.Fatalf("NewCancel error: %v", err)
+	}
+	obj.Payload = []byte("x")
+	if err := ValidateCancel(obj); err == nil || !strings.Contains(err.Error(), "unexpected payload") {
+		t.Errorf("ValidateCancel error = %v, want unexpected payload", err)
+	}
+	if _, err := ParseSubmit(obj); !errors.Is(err, rhizome.ErrWrongCommand) {
+		t.Errorf("ParseSubmit error = %v, want ErrWrongCommand", err)
+	}
+}
@@ -0,0 +1,410 @@
+// Package schema describes the commands of a Signal Weave application, what
+// their ObjType, CmdType, arguments, payload and acks mean, and generates
+// typed Go code for them, see Generate and cmd/rhizomegen.
+//
+// A schema is a JSON file:
+//
+//	{
+//	  "package": "imaging",
+//	  "acks": [
+//	    {"name": "AckTooLarge", "value": 100, "doc": "The image exceeds the size limit."}
+//	  ],
+//	  "commands": [
+//	    {
+//	      "name": "Resize",
+//	      "doc": "Resize scales an image to fit a box.",
+//	      "obj_type": "ObjAction",
+//	      "cmd_type": 60,
+//	      "args": [
+//	        {"name": "Width", "type": "uint16"},
+//	        {"name": "Height", "type": "uint16"},
+//	        {"name": "Within", "type": "duration", "optional": true}
+//	      ],
+//	      "payload": {"type": "bytes"},
+//	      "encodings": ["na", "protobuf"],
+//	      "acks": ["AckSent", "AckTooLarge"]
+//	    }
+//	  ]
+//	}
+//
+// Object and command types are given as numbers or by the names of their
+// constants in globals.go. Acks are named, either after a constant of
+// globals.go or after one of the acks the schema declares for all of its
+// commands.
+//
+// Arguments are bound to Arg1 through Arg4 in the order they are listed, and
+// have one of the types in ArgTypes. Arguments left out must be empty, and
+// arguments that are not optional must be set.
+//
+// A payload is of type "none", the default, "bytes", "string" or "json". JSON
+// payloads name the Go type they decode into with "go_type", which the
+// generated code expects to find in its package, and are always encoded as
+// json. The payloads of other types may be restricted to a list of
+// encodings, named as in rhizome.EncodingName.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/signal-weave/rhizome"
+)
+
+// Schema describes the commands of an application.
+type Schema struct {
+	// The Go package the code is generated for.
+	Package string `json:"package"`
+
+	// Acks the application defines in addition to those of globals.go. Their
+	// values may not be used by any other ack.
+	Acks []Ack `json:"acks,omitempty"`
+
+	Commands []Command `json:"commands"`
+}
+
+// Ack is an ack defined by the application.
+type Ack struct {
+	Name  string `json:"name"`
+	Value uint8  `json:"value"`
+	Doc   string `json:"doc,omitempty"`
+}
+
+// Command describes an (ObjType, CmdType) pair.
+type Command struct {
+	// Name is the exported Go name of the command.
+	Name string `json:"name"`
+	Doc  string `json:"doc,omitempty"`
+
+	ObjType Code `json:"obj_type"`
+	CmdType Code `json:"cmd_type"`
+
+	Args    []Arg   `json:"args,omitempty"`
+	Payload Payload `json:"payload"`
+
+	// The payload encodings the command may use. Empty allows every one.
+	Encodings []string `json:"encodings,omitempty"`
+
+	// The acks the command may be answered with, by name.
+	Acks []string `json:"acks"`
+}
+
+// Arg describes an argument of a command.
+type Arg struct {
+	// Name is the exported Go name of the argument.
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Optional bool   `json:"optional,omitempty"`
+	Doc      string `json:"doc,omitempty"`
+}
+
+// Payload describes the payload of a command.
+type Payload struct {
+	Type string `json:"type,omitempty"`
+
+	// The Go type a json payload decodes into.
+	GoType string `json:"go_type,omitempty"`
+}
+
+// Payload types.
+const (
+	PayloadNone   = "none"
+	PayloadBytes  = "bytes"
+	PayloadString = "string"
+	PayloadJSON   = "json"
+)
+
+// ArgTypes maps the argument types of a schema to the Go types they are
+// generated as.
+var ArgTypes = map[string]string{
+	"string":   "string",
+	"bool":     "bool",
+	"int":      "int",
+	"int8":     "int8",
+	"int16":    "int16",
+	"int32":    "int32",
+	"int64":    "int64",
+	"uint":     "uint",
+	"uint8":    "uint8",
+	"uint16":   "uint16",
+	"uint32":   "uint32",
+	"uint64":   "uint64",
+	"float32":  "float32",
+	"float64":  "float64",
+	"duration": "time.Duration",
+	"time":     "time.Time",
+	"map":      "map[string]string",
+}
+
+// Code is an ObjType or CmdType, given in JSON as a number or by the name of
+// its constant in globals.go.
+type Code struct {
+	Value uint8
+
+	// The name of the constant, if Value was given by name.
+	Name string
+}
+
+func (c *Code) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		for _, names := range []map[string]uint8{objTypes, cmdTypes} {
+			if v, ok := names[name]; ok {
+				*c = Code{Value: v, Name: name}
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown object or command type %q", name)
+	}
+
+	var v uint8
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("want a name or a number from 0 to 255, got %s", data)
+	}
+	*c = Code{Value: v}
+	return nil
+}
+
+func (c Code) MarshalJSON() ([]byte, error) {
+	if c.Name != "" {
+		return json.Marshal(c.Name)
+	}
+	return json.Marshal(c.Value)
+}
+
+func (c Code) String() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return strconv.Itoa(int(c.Value))
+}
+
+// The constants of globals.go, by name.
+var (
+	objTypes = map[string]uint8{
+		"ObjUnknown":     rhizome.ObjUnknown,
+		"ObjDelivery":    rhizome.ObjDelivery,
+		"ObjTransformer": rhizome.ObjTransformer,
+		"ObjSubscriber":  rhizome.ObjSubscriber,
+		"ObjChannel":     rhizome.ObjChannel,
+		"ObjGlobals":     rhizome.ObjGlobals,
+		"ObjAction":      rhizome.ObjAction,
+	}
+	cmdTypes = map[string]uint8{
+		"CmdUnknown": rhizome.CmdUnknown,
+		"CmdSend":    rhizome.CmdSend,
+		"CmdAdd":     rhizome.CmdAdd,
+		"CmdRemove":  rhizome.CmdRemove,
+		"CmdUpdate":  rhizome.CmdUpdate,
+		"CmdSigterm": rhizome.CmdSigterm,
+	}
+	standardAcks = map[string]uint8{
+		"AckUnknown":              rhizome.AckUnknown,
+		"AckSent":                 rhizome.AckSent,
+		"AckTimeout":              rhizome.AckTimeout,
+		"AckChannelNotFound":      rhizome.AckChannelNotFound,
+		"AckChannelAlreadyExists": rhizome.AckChannelAlreadyExists,
+		"AckRouteNotFound":        rhizome.AckRouteNotFound,
+	}
+)
+
+// Load reads and validates a schema.
+func Load(r io.Reader) (*Schema, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("load schema: %w", err)
+	}
+	return Parse(data)
+}
+
+// Parse decodes and validates a schema.
+func Parse(data []byte) (*Schema, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var s Schema
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("parse schema: %w", err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Validate checks that the schema is complete and consistent, and that the
+// code generated for it declares every name only once.
+func (s *Schema) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if !token.IsIdentifier(s.Package) {
+		fail("package %q is not a Go identifier", s.Package)
+	}
+
+	// Every identifier the generated code declares at package level.
+	declared := map[string]string{
+		"Client":   "the generated client",
+		"Handler":  "the generated handler",
+		"Dispatch": "the generated dispatcher",
+		"Serve":    "the generated server",
+	}
+	declare := func(name, by string) {
+		if prev, ok := declared[name]; ok {
+			fail("%s is declared by both %s and %s", name, prev, by)
+			return
+		}
+		declared[name] = by
+	}
+
+	// Acks are told apart by value on the wire, so values must be unique too.
+	acks := make(map[string]bool, len(standardAcks)+len(s.Acks))
+	values := make(map[uint8]string, len(standardAcks)+len(s.Acks))
+	for name, value := range standardAcks {
+		acks[name] = true
+		values[value] = name
+	}
+	for _, ack := range s.Acks {
+		if !token.IsExported(ack.Name) || !token.IsIdentifier(ack.Name) {
+			fail("ack %q is not an exported Go identifier", ack.Name)
+			continue
+		}
+		if acks[ack.Name] {
+			fail("ack %s is declared twice", ack.Name)
+			continue
+		}
+		if prev, ok := values[ack.Value]; ok {
+			fail("ack %s has value %d, as does %s", ack.Name, ack.Value, prev)
+			continue
+		}
+		acks[ack.Name] = true
+		values[ack.Value] = ack.Name
+		declare(ack.Name, "ack "+ack.Name)
+	}
+
+	if len(s.Commands) == 0 {
+		fail("no commands")
+	}
+	pairs := make(map[[2]uint8]string, len(s.Commands))
+	for _, cmd := range s.Commands {
+		if !token.IsExported(cmd.Name) || !token.IsIdentifier(cmd.Name) {
+			fail("command %q is not an exported Go identifier", cmd.Name)
+			continue
+		}
+		// Commands are also methods of the client.
+		if cmd.Name == "Session" || cmd.Name == "NewUID" {
+			fail("command %s clashes with the field of the generated client", cmd.Name)
+		}
+		for _, name := range []string{cmd.Name, "New" + cmd.Name, "Parse" + cmd.Name, "Validate" + cmd.Name, cmd.Name + "Acks"} {
+			declare(name, "command "+cmd.Name)
+		}
+
+		for _, err := range cmd.validate(acks) {
+			fail("command %s: %w", cmd.Name, err)
+		}
+		pair := [2]uint8{cmd.ObjType.Value, cmd.CmdType.Value}
+		if prev, ok := pairs[pair]; ok {
+			fail("commands %s and %s both use object type %s and command type %s", prev, cmd.Name, cmd.ObjType, cmd.CmdType)
+		}
+		pairs[pair] = cmd.Name
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid schema: %w", err)
+	}
+	return nil
+}
+
+func (cmd *Command) validate(acks map[string]bool) []error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, ok := cmdTypes[cmd.ObjType.Name]; ok {
+		fail("obj_type %s is a command type", cmd.ObjType.Name)
+	}
+	if _, ok := objTypes[cmd.CmdType.Name]; ok {
+		fail("cmd_type %s is an object type", cmd.CmdType.Name)
+	}
+
+	if len(cmd.Args) > 4 {
+		fail("%d args, objects carry at most 4", len(cmd.Args))
+	}
+	// The struct also holds the payload.
+	fields := map[string]bool{"Payload": true, "PayloadEncoding": true}
+	for _, arg := range cmd.Args {
+		if !token.IsExported(arg.Name) || !token.IsIdentifier(arg.Name) {
+			fail("arg %q is not an exported Go identifier", arg.Name)
+		} else if fields[arg.Name] {
+			fail("arg %s is declared twice or clashes with the payload", arg.Name)
+		}
+		fields[arg.Name] = true
+		if _, ok := ArgTypes[arg.Type]; !ok {
+			fail("arg %s: unknown type %q", arg.Name, arg.Type)
+		}
+	}
+
+	switch cmd.Payload.Type {
+	case "", PayloadNone, PayloadBytes, PayloadString:
+		if cmd.Payload.GoType != "" {
+			fail("go_type is only used with json payloads")
+		}
+	case PayloadJSON:
+		if cmd.Payload.GoType == "" {
+			fail("json payloads need a go_type")
+		} else if _, err := parser.ParseExpr(cmd.Payload.GoType); err != nil {
+			fail("go_type %q is not a Go type: %v", cmd.Payload.GoType, err)
+		}
+		if len(cmd.Encodings) > 0 && !slices.Equal(cmd.Encodings, []string{"json"}) {
+			fail("json payloads are encoded as json, not %s", strings.Join(cmd.Encodings, ", "))
+		}
+	default:
+		fail("unknown payload type %q", cmd.Payload.Type)
+	}
+
+	seen := make(map[string]bool, len(cmd.Encodings))
+	for _, name := range cmd.Encodings {
+		if _, ok := encodingConsts[name]; !ok {
+			fail("unknown encoding %q", name)
+		} else if seen[name] {
+			fail("encoding %s is listed twice", name)
+		}
+		seen[name] = true
+	}
+
+	if len(cmd.Acks) == 0 {
+		fail("no acks")
+	}
+	seen = make(map[string]bool, len(cmd.Acks))
+	for _, name := range cmd.Acks {
+		if !acks[name] {
+			fail("unknown ack %q", name)
+		} else if seen[name] {
+			fail("ack %s is listed twice", name)
+		}
+		seen[name] = true
+	}
+	return errs
+}
+
+// encodingConsts maps the names of rhizome.EncodingName to their constants.
+var encodingConsts = map[string]string{
+	"na":       "EncodingNA",
+	"json":     "EncodingJson",
+	"xml":      "EncodingXml",
+	"yaml":     "EncodingYaml",
+	"csv":      "EncodingCsv",
+	"toml":     "EncodingToml",
+	"ini":      "EncodingIni",
+	"protobuf": "EncodingProtobuf",
+}
@@ -0,0 +1,152 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The example generated from its schema, which go generate keeps up to date.
+const (
+	exampleSchema = "internal/imaging/imaging.json"
+	exampleCode   = "internal/imaging/imaging_gen.go"
+)
+
+func TestGenerate_ExampleIsUpToDate(t *testing.T) {
+	data, err := os.ReadFile(exampleSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	code, err := Generate(s, filepath.Base(exampleSchema))
+	if err != nil {
+		t.Fatalf("Generate error: %v", err)
+	}
+
+	want, err := os.ReadFile(exampleCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(code, want) {
+		t.Fatalf("%s is out of date, run go generate ./schema/...", exampleCode)
+	}
+}
+
+func TestCode_JSON(t *testing.T) {
+	var codes []Code
+	if err := json.Unmarshal([]byte(`["ObjAction", "CmdRemove", 200]`), &codes); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+	want := []Code{{Value: 50, Name: "ObjAction"}, {Value: 3, Name: "CmdRemove"}, {Value: 200}}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Errorf("code %d = %+v, want %+v", i, codes[i], want[i])
+		}
+	}
+
+	out, err := json.Marshal(codes)
+	if err != nil {
+		t.Fatalf("Marshal error: %v", err)
+	}
+	if string(out) != `["ObjAction","CmdRemove",200]` {
+		t.Errorf("Marshal = %s", out)
+	}
+
+	for _, bad := range []string{`"ObjMissing"`, `256`, `-1`, `true`} {
+		var c Code
+		if err := json.Unmarshal([]byte(bad), &c); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded with %+v", bad, c)
+		}
+	}
+}
+
+func TestParse_RejectsInvalidSchemas(t *testing.T) {
+	// valid is a schema that passes, which each case breaks.
+	const valid = `{
+		"package": "app",
+		"acks": [{"name": "AckBusy", "value": 100}],
+		"commands": [{
+			"name": "Ping", "obj_type": "ObjAction", "cmd_type": 60,
+			"args": [{"name": "Host", "type": "string"}],
+			"acks": ["AckSent", "AckBusy"]
+		}]
+	}`
+	if _, err := Parse([]byte(valid)); err != nil {
+		t.Fatalf("valid schema: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name, old, new, want string
+	}{
+		{"unknown field", `"package"`, `"pkg": "x", "package"`, `unknown field "pkg"`},
+		{"package", `"package": "app"`, `"package": "my-app"`, `package "my-app" is not a Go identifier`},
+		{"command name", `"name": "Ping"`, `"name": "ping"`, `command "ping" is not an exported Go identifier`},
+		{"reserved name", `"name": "Ping"`, `"name": "Client"`, "Client is declared by both the generated client and command Client"},
+		{"client field", `"name": "Ping"`, `"name": "Session"`, "command Session clashes with the field of the generated client"},
+		{"ack clash", `"name": "AckBusy"`, `"name": "NewPing"`, "NewPing is declared by both ack NewPing and command Ping"},
+		{"standard ack redeclared", `"name": "AckBusy"`, `"name": "AckSent"`, "ack AckSent is declared twice"},
+		{"standard ack value", `"value": 100`, `"value": 1`, "ack AckBusy has value 1, as does AckSent"},
+		{"ack value", `"value": 100}`, `"value": 100}, {"name": "AckIdle", "value": 100}`, "ack AckIdle has value 100, as does AckBusy"},
+		{"swapped types", `"cmd_type": 60`, `"cmd_type": "ObjAction"`, "cmd_type ObjAction is an object type"},
+		{"arg type", `"type": "string"`, `"type": "complex128"`, `arg Host: unknown type "complex128"`},
+		{"arg clash", `"name": "Host"`, `"name": "Payload"`, "arg Payload is declared twice or clashes with the payload"},
+		{"too many args", `"args": [`, `"args": [{"name": "A", "type": "int"}, {"name": "B", "type": "int"}, {"name": "C", "type": "int"}, {"name": "D", "type": "int"}, `, "5 args, objects carry at most 4"},
+		{"payload type", `"args"`, `"payload": {"type": "xml"}, "args"`, `unknown payload type "xml"`},
+		{"json without go type", `"args"`, `"payload": {"type": "json"}, "args"`, "json payloads need a go_type"},
+		{"bad go type", `"args"`, `"payload": {"type": "json", "go_type": "[]["}, "args"`, `go_type "[][" is not a Go type`},
+		{"go type without json", `"args"`, `"payload": {"type": "bytes", "go_type": "Job"}, "args"`, "go_type is only used with json payloads"},
+		{"json encoding", `"args"`, `"payload": {"type": "json", "go_type": "Job"}, "encodings": ["xml"], "args"`, "json payloads are encoded as json, not xml"},
+		{"encoding", `"args"`, `"encodings": ["jpeg"], "args"`, `unknown encoding "jpeg"`},
+		{"unknown ack", `"AckBusy"]`, `"AckIdle"]`, `unknown ack "AckIdle"`},
+		{"no acks", `"acks": ["AckSent", "AckBusy"]`, `"acks": []`, "command Ping: no acks"},
+		{"duplicate pair", `"commands": [{`, `"commands": [{"name": "Pong", "obj_type": 50, "cmd_type": 60, "acks": ["AckSent"]}, {`, "commands Pong and Ping both use object type ObjAction and command type 60"},
+	} {
+		data := strings.Replace(valid, tc.old, tc.new, 1)
+		if data == valid {
+			t.Fatalf("%s: %q not found in the valid schema", tc.name, tc.old)
+		}
+		_, err := Parse([]byte(data))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: error = %v, want %s", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestValidate_NoCommands(t *testing.T) {
+	s := &Schema{Package: "app"}
+	if err := s.Validate(); err == nil || !strings.Contains(err.Error(), "no commands") {
+		t.Fatalf("Validate error = %v, want no commands", err)
+	}
+}
+
+func TestGenerate_OnlyImportsWhatItUses(t *testing.T) {
+	s, err := Parse([]byte(`{
+		"package": "app",
+		"commands": [{
+			"name": "Ping", "obj_type": "ObjAction", "cmd_type": 60,
+			"args": [{"name": "Note", "type": "string", "optional": true}],
+			"acks": ["AckSent"]
+		}]
+	}`))
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	code, err := Generate(s, "app.json")
+	if err != nil {
+		t.Fatalf("Generate error: %v", err)
+	}
+	for _, unused := range []string{`"errors"`, `"time"`, `"encoding/json"`} {
+		if bytes.Contains(code, []byte(unused)) {
+			t.Errorf("generated code imports %s without using it", unused)
+		}
+	}
+	if !bytes.HasPrefix(code, []byte("// Code generated by rhizomegen from app.json. DO NOT EDIT.\n")) {
+		t.Errorf("generated code lacks the generated header:\n%s", code[:80])
+	}
+}
@@ -0,0 +1,766 @@
+package rhizome
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Sessions are connections that have completed the capability handshake.
+// -----------------------------------------------------------------------------
+// Every message on a session is a transport frame (see frame.go): objects are
+// sent as their encoded frame, and anything written through the session's
+// ConnResponder is wrapped in a FrameResponse frame. Either may also arrive
+// packed into batch frames, see batch.go.
+//
+// A session reads from its connection on a goroutine of its own, so frames
+// that are not meant for the application, like stream chunks, keep flowing
+// while the application is busy with an earlier object.
+// -----------------------------------------------------------------------------
+
+// ErrSessionClosed is returned by session methods after Close was called.
+var ErrSessionClosed = errors.New("session closed")
+
+// SessionConfig controls how a Session negotiates with its peer.
+type SessionConfig struct {
+	// What to advertise during the handshake.
+	// The zero value advertises DefaultCapabilities().
+	Capabilities Capabilities
+
+	// Payloads larger than FragmentSize bytes are split with Fragment when the
+	// agreed version supports it. Defaults to the largest payload that fits in
+	// a single frame.
+	FragmentSize int
+
+	// Bounds for reassembling fragmented objects sent by the peer.
+	// MaxObjectSize defaults to the session's MaxDecompressedSize. Objects
+	// still incomplete after Timeout are discarded even if the peer sends
+	// nothing more.
+	Reassembly ReassemblyConfig
+
+	// Payloads smaller than CompressionThreshold bytes are sent uncompressed.
+	// Defaults to the package's CompressionThreshold.
+	CompressionThreshold int
+
+	// The largest payload, in bytes, a compressed frame from the peer may
+	// inflate to. Defaults to the package's MaxDecompressedSize.
+	MaxDecompressedSize int
+
+	// The largest chunk, in bytes, SendStream puts in a single frame.
+	// Defaults to 32KB.
+	ChunkSize int
+
+	// How many chunks of an incoming stream are buffered before the session
+	// stops reading from the connection until the application catches up.
+	// Defaults to 16.
+	StreamBuffer int
+
+	// If set, responses written through the session's Responder are collected
+	// and sent as batch frames, provided the agreed version supports them.
+	// Each Write then returns before its responses are sent.
+	ResponseBatch *BatchConfig
+
+	// If set, the session's Responder queues writes and sends them from a
+	// goroutine of its own, see NewAsyncConnResponder.
+	AsyncResponder *ResponderConfig
+
+	// How long Close may spend sending queued or batched responses to a peer
+	// that stopped reading before closing the connection under them.
+	// Defaults to 5 seconds.
+	CloseTimeout time.Duration
+
+	// If set, objects are decoded into objects taken from the pool, which the
+	// application hands back with Object.Release.
+	ObjectPool *ObjectPool
+
+	// How often to ping the peer. Zero disables heartbeats, as does a peer
+	// that does not support them.
+	HeartbeatInterval time.Duration
+
+	// How many heartbeat intervals may pass without a frame from the peer
+	// before the session is closed with ErrHeartbeatTimeout. Defaults to 3.
+	MissedHeartbeats int
+
+	// With credit-based flow control agreed on, credits are only granted to
+	// the peer through GrantCredits instead of as objects are received.
+	ManualCredits bool
+
+	// With credit-based flow control agreed on, Send fails with ErrNoCredits
+	// instead of waiting for the peer to grant more.
+	FailWithoutCredits bool
+
+	// OnClose, if set, is called once the session stopped, with the reason
+	// it did. Acks still pending at that point will never arrive.
+	OnClose func(err error)
+}
+
+// received is an Object, or the error decoding it, waiting for Receive.
+type received struct {
+	obj *Object
+	err error
+}
+
+// Session is a net.Conn that has negotiated a common protocol version and
+// capabilities with its peer.
+// Objects sent through a Session are encoded with the best version both peers
+// support.
+//
+// Objects and responses from the peer are handed out in order by Receive and
+// ReceiveResponse. A session that stops consuming either of them eventually
+// stops reading from the connection altogether.
+type Session struct {
+	C net.Conn
+
+	// Responder is attached to every Object received on the session, so acks
+	// are framed and routed back over the same connection.
+	Responder *ConnResponder
+
+	agreement Agreement
+
+	fragmentSize int
+	chunkSize    int
+	streamBuffer int
+	limits       compressionLimits
+	reassembler  *Reassembler
+	pool         *ObjectPool
+
+	// Nil unless responses are batched.
+	responseBatch *batcher[Response]
+
+	heartbeat        time.Duration
+	missedHeartbeats int
+	framesRead       atomic.Uint64
+	stalled          atomic.Bool
+	pinging          atomic.Bool
+	ponging          atomic.Bool
+
+	onClose      func(err error)
+	closeTimeout time.Duration
+
+	// Nil unless credit-based flow control was agreed on.
+	credits *credits
+
+	// wmu is held by whoever writes to C. It is a channel so writers bound
+	// by a context can give up waiting for it.
+	wmu chan struct{}
+
+	objects   chan received
+	responses chan Response
+
+	// done is closed by Close, with closeErr as the reason, stopped once the
+	// read loop has exited, at which point err holds the reason.
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	stopped   chan struct{}
+	err       error
+
+	streamsMu sync.Mutex
+	inbound   map[string]*PayloadStream
+	outbound  map[string]chan struct{}
+}
+
+// NewSession performs the handshake over conn and returns the resulting
+// Session. On error the caller still owns conn and should close it.
+func NewSession(conn net.Conn, cfg SessionConfig) (*Session, error) {
+	caps := cfg.Capabilities
+	if caps.MaxVersion == 0 {
+		caps = DefaultCapabilities()
+	}
+
+	agreement, err := Handshake(conn, caps)
+	if err != nil {
+		return nil, err
+	}
+
+	fragmentSize := cfg.FragmentSize
+	if fragmentSize <= 0 {
+		fragmentSize = maxPayloadSize
+	}
+	chunkSize := cfg.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 32 * BytesInKilobyte
+	}
+	streamBuffer := cfg.StreamBuffer
+	if streamBuffer <= 0 {
+		streamBuffer = 16
+	}
+	missedHeartbeats := cfg.MissedHeartbeats
+	if missedHeartbeats <= 0 {
+		missedHeartbeats = 3
+	}
+	closeTimeout := cfg.CloseTimeout
+	if closeTimeout <= 0 {
+		closeTimeout = 5 * time.Second
+	}
+	limits := compressionLimits{
+		threshold:   cfg.CompressionThreshold,
+		maxInflated: cfg.MaxDecompressedSize,
+	}.withDefaults()
+	reassembly := cfg.Reassembly
+	if reassembly.MaxObjectSize <= 0 {
+		reassembly.MaxObjectSize = limits.maxInflated
+	}
+
+	s := &Session{
+		C:            conn,
+		agreement:    agreement,
+		fragmentSize: fragmentSize,
+		chunkSize:    chunkSize,
+		streamBuffer: streamBuffer,
+		limits:       limits,
+		reassembler:  NewReassembler(reassembly),
+		pool:         cfg.ObjectPool,
+
+		missedHeartbeats: missedHeartbeats,
+		onClose:          cfg.OnClose,
+		closeTimeout:     closeTimeout,
+
+		wmu:       make(chan struct{}, 1),
+		objects:   make(chan received, 64),
+		responses: make(chan Response, 64),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		inbound:   make(map[string]*PayloadStream),
+		outbound:  make(map[string]chan struct{}),
+	}
+	if agreement.SupportsFeature(FeatureHeartbeat) {
+		s.heartbeat = cfg.HeartbeatInterval
+	}
+	if agreement.SupportsFeature(FeatureCredits) {
+		s.credits = newCredits(agreement, cfg)
+	}
+	if cfg.AsyncResponder != nil {
+		s.Responder = NewAsyncConnResponder(
+			&responseConn{Conn: conn, s: s}, *cfg.AsyncResponder,
+		)
+	} else {
+		s.Responder = NewConnResponder(&responseConn{Conn: conn, s: s})
+	}
+	if cfg.ResponseBatch != nil && agreement.Version >= ProtocolV2 {
+		s.responseBatch = &batcher[Response]{
+			cfg:    s.capBatch(*cfg.ResponseBatch),
+			size:   func(r Response) int { return 2 + len(r.UID) },
+			encode: EncodeResponseBatch,
+			write:  s.writeFrame,
+		}
+	}
+
+	go s.readLoop()
+	if s.heartbeat > 0 {
+		go s.heartbeatLoop()
+	}
+	if agreement.Version >= ProtocolV2 {
+		go s.expireLoop()
+	}
+	return s, nil
+}
+
+// Agreement returns what was negotiated with the peer.
+func (s *Session) Agreement() Agreement {
+	return s.agreement
+}
+
+// Send encodes obj with the agreed protocol version and writes it to the peer.
+// Payloads too large for one frame are fragmented if the agreed version
+// supports it. Nothing is written if any fragment fails to encode.
+//
+// With credit-based flow control Send waits for credits from the peer first,
+// see credit.go.
+func (s *Session) Send(obj *Object) error {
+	objs := []*Object{obj}
+	if s.agreement.Version >= ProtocolV2 {
+		size, err := fragmentSize(
+			obj, s.agreement.MaxFrameSize, s.fragmentSize,
+		)
+		if err != nil {
+			return fmt.Errorf("session send %s: %w", obj.UID, err)
+		}
+		if objs, err = Fragment(obj, size); err != nil {
+			return fmt.Errorf("session send: %w", err)
+		}
+	}
+
+	frames := make([][]byte, 0, len(objs))
+	for _, o := range objs {
+		frame, err := s.agreement.encodeFrame(o, s.limits)
+		if err != nil {
+			return fmt.Errorf("session send %s: %w", obj.UID, err)
+		}
+		frames = append(frames, frame)
+	}
+
+	if err := s.acquireCredit(len(obj.Payload)); err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		if err := s.writeFrame(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewBatchWriter returns a BatchWriter that sends its batches over the session.
+// Batches need protocol v2, and their payload encodings must have been agreed
+// on. Batches never exceed the agreed frame size, and objects too large for a
+// batch of their own are sent with Send instead, once the batch queued before
+// them went out.
+func (s *Session) NewBatchWriter(cfg BatchConfig) (*BatchWriter, error) {
+	if s.agreement.Version < ProtocolV2 {
+		return nil, fmt.Errorf(
+			"session batch: batches need protocol v2, agreed on v%d",
+			s.agreement.Version,
+		)
+	}
+
+	bw := newBatchWriter(s.capBatch(cfg), s.writeFrame)
+	bw.check = func(obj *Object) error {
+		if !s.agreement.SupportsEncoding(obj.PayloadEncoding) {
+			return fmt.Errorf(
+				"%s: payload encoding %s was not agreed on",
+				obj.UID, obj.PayloadEncoding,
+			)
+		}
+		return s.acquireCredit(len(obj.Payload))
+	}
+	bw.oversize = s.Send
+	return bw, nil
+}
+
+// capBatch keeps batches within the agreed frame size.
+func (s *Session) capBatch(cfg BatchConfig) BatchConfig {
+	cfg = cfg.withDefaults()
+	cfg.MaxBytes = int(min(uint64(cfg.MaxBytes), uint64(s.agreement.MaxFrameSize)))
+	return cfg
+}
+
+// Receive returns the next Object sent by the peer.
+// Fragmented objects are only returned once fully reassembled, and streamed
+// objects as soon as their header arrived, see SendStream.
+// Received objects carry the session's Responder.
+//
+// An object that fails to decode is returned as an error without ending the
+// session. Once the connection is gone Receive returns the reason, io.EOF if
+// the peer hung up cleanly.
+func (s *Session) Receive() (*Object, error) {
+	var r received
+	select {
+	case r = <-s.objects:
+	case <-s.stopped:
+		select {
+		case r = <-s.objects:
+		default:
+			return nil, s.err
+		}
+	}
+
+	if r.obj != nil {
+		s.replenishCredit(r.obj)
+	}
+	return r.obj, r.err
+}
+
+// ReceiveResponse returns the next Response sent by the peer in reply to an
+// object sent with Send.
+func (s *Session) ReceiveResponse() (Response, error) {
+	select {
+	case r := <-s.responses:
+		return r, nil
+	case <-s.stopped:
+		select {
+		case r := <-s.responses:
+			return r, nil
+		default:
+			return Response{}, s.err
+		}
+	}
+}
+
+// Close closes the session and its underlying connection, sending any queued
+// or batched responses first. Responses the peer has not taken by the end of
+// the CloseTimeout are dropped.
+func (s *Session) Close() error {
+	s.drainResponses()
+	return s.closeWith(ErrSessionClosed)
+}
+
+// drainResponses sends the responses still queued or batched. Writes to a peer
+// that stopped reading only return once the connection closes, so the session
+// is closed under them once closeTimeout passed.
+func (s *Session) drainResponses() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.closeTimeout)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { _ = s.closeWith(ErrSessionClosed) })
+	defer stop()
+
+	// Responses wait in the responder queue before they are batched.
+	_ = s.Responder.CloseContext(ctx)
+	if s.responseBatch != nil {
+		_ = s.responseBatch.close()
+	}
+}
+
+// Done returns a channel that is closed once the session stopped, whether
+// because of Close, a failed connection or missed heartbeats.
+func (s *Session) Done() <-chan struct{} {
+	return s.stopped
+}
+
+// Err returns why the session stopped, or nil while it is still running.
+// A peer that hung up cleanly is reported as io.EOF.
+func (s *Session) Err() error {
+	select {
+	case <-s.stopped:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+func (s *Session) closeWith(reason error) error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.closeErr = reason
+		close(s.done)
+		err = s.C.Close()
+	})
+	return err
+}
+
+func (s *Session) writeFrame(frame []byte) error {
+	return s.writeFrameContext(context.Background(), frame)
+}
+
+// writeFrameContext writes frame unless ctx is done first, see
+// ConnResponder.WriteContext. Only the writer holding wmu touches C's write
+// deadline, so it never cuts short the frames of others. A frame it cuts
+// short itself leaves the peer unable to find the next one, which closes the
+// session.
+func (s *Session) writeFrameContext(ctx context.Context, frame []byte) error {
+	select {
+	case s.wmu <- struct{}{}:
+	case <-ctx.Done():
+		return contextWriteError(ctx)
+	}
+
+	w := &countingWriter{w: s.C}
+	err := writeConnContext(ctx, s.C, func() error {
+		return WriteFrame(w, frame)
+	})
+	<-s.wmu
+
+	if err != nil && w.n > 0 {
+		_ = s.closeWith(fmt.Errorf("session: frame cut short: %w", err))
+	}
+	return err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
+
+//--------Read Loop-------------------------------------------------------------
+
+func (s *Session) readLoop() {
+	err := s.readFrames()
+
+	select {
+	case <-s.done:
+		err = s.closeErr
+	default:
+	}
+	s.err = err
+	_ = s.C.Close()
+	_ = s.Responder.Close()
+
+	// Streams cut short by the connection must not look like they ended.
+	streamErr := err
+	if streamErr == io.EOF {
+		streamErr = io.ErrUnexpectedEOF
+	}
+	s.streamsMu.Lock()
+	for uid, ps := range s.inbound {
+		ps.finish(streamErr)
+		delete(s.inbound, uid)
+	}
+	s.streamsMu.Unlock()
+
+	close(s.stopped)
+	if s.onClose != nil {
+		s.onClose(err)
+	}
+}
+
+// readFrames dispatches frames until the connection fails or the peer breaks
+// the protocol.
+func (s *Session) readFrames() error {
+	for {
+		frame, err := ReadFrame(s.C, s.agreement.MaxFrameSize)
+		if err != nil {
+			return err
+		}
+		s.framesRead.Add(1)
+
+		switch kind := frame[0]; {
+		case kind == FrameResponse:
+			err = s.handleResponses(frame[1:])
+		case kind == FrameControl:
+			err = s.handleControl(frame[1:])
+		case kind == FrameChunk:
+			err = s.handleChunk(frame[1:])
+		case kind == FrameBatch && s.agreement.Version >= ProtocolV2:
+			err = s.handleBatch(frame)
+		case kind <= s.agreement.Version:
+			err = s.handleObject(frame)
+		default:
+			err = fmt.Errorf("session: unexpected frame kind %d", kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Session) handleResponses(body []byte) error {
+	defer s.stall()()
+
+	// A responder may flush several responses with one write.
+	for len(body) > 0 {
+		response, n, err := DecodeResponseV1(body)
+		if err != nil {
+			return fmt.Errorf("session: %w", err)
+		}
+		body = body[n:]
+
+		select {
+		case s.responses <- response:
+		case <-s.done:
+			return ErrSessionClosed
+		}
+	}
+	return nil
+}
+
+func (s *Session) handleBatch(frame []byte) error {
+	if len(frame) < 2 {
+		return errors.New("session: batch frame without batch kind")
+	}
+
+	switch kind := frame[1]; kind {
+	case batchResponses:
+		responses, err := DecodeResponseBatch(frame)
+		if err != nil {
+			return fmt.Errorf("session: %w", err)
+		}
+		for _, response := range responses {
+			select {
+			case s.responses <- response:
+			case <-s.done:
+				return ErrSessionClosed
+			}
+		}
+		return nil
+
+	case batchObjects:
+		objs, err := DecodeBatch(frame, s.Responder)
+		if err != nil {
+			return s.deliver(nil, err)
+		}
+		for _, obj := range objs {
+			if !s.agreement.SupportsEncoding(obj.PayloadEncoding) {
+				err = fmt.Errorf(
+					"session: payload encoding %s was not agreed on",
+					obj.PayloadEncoding,
+				)
+				if err := s.deliver(nil, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := s.deliver(obj, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("session: unexpected batch kind %d", kind)
+	}
+}
+
+func (s *Session) handleControl(body []byte) error {
+	if len(body) == 0 {
+		return errors.New("session: empty control frame")
+	}
+
+	switch id := body[0]; id {
+	case ctrlStreamCancel:
+		return s.handleStreamCancel(body[1:])
+	case ctrlPing:
+		return s.handlePing(body[1:])
+	case ctrlPong:
+		return s.handlePong(body[1:])
+	case ctrlCredit:
+		return s.handleCredit(body[1:])
+	default:
+		return fmt.Errorf("session: unexpected control frame %d", id)
+	}
+}
+
+func (s *Session) handleObject(frame []byte) error {
+	obj, err := s.decodeObject(frame)
+	if err == nil && obj == nil {
+		// Waiting on more fragments.
+		return nil
+	}
+
+	return s.deliver(obj, err)
+}
+
+// deliver hands obj, or the error decoding it, to Receive.
+// Objects that failed to decode are not paid for with credits.
+func (s *Session) deliver(obj *Object, err error) error {
+	if obj != nil {
+		if err := s.consumeCredit(obj); err != nil {
+			return err
+		}
+	}
+
+	defer s.stall()()
+	select {
+	case s.objects <- received{obj, err}:
+		return nil
+	case <-s.done:
+		return ErrSessionClosed
+	}
+}
+
+// decodeObject returns the object in frame, or nil if it is a fragment of an
+// object that is not complete yet.
+func (s *Session) decodeObject(frame []byte) (*Object, error) {
+	var obj *Object
+	var err error
+	if s.pool != nil {
+		// Every frame is read into a buffer of its own, so the payload can
+		// safely alias it.
+		obj, err = s.pool.Decode(frame, s.Responder, DecodeOptions{
+			AliasPayload:        true,
+			MaxDecompressedSize: s.limits.maxInflated,
+		})
+	} else {
+		obj, err = decodeFrame(frame, s.Responder, s.limits)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !s.agreement.SupportsEncoding(obj.PayloadEncoding) {
+		err := fmt.Errorf(
+			"session: payload encoding %s was not agreed on",
+			obj.PayloadEncoding,
+		)
+		obj.Release()
+		return nil, err
+	}
+
+	whole, err := s.reassembler.Add(obj)
+	if whole != obj {
+		// The reassembler keeps the payload of a fragment, not the fragment.
+		obj.Payload = nil
+		obj.Release()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("session: %w", err)
+	}
+	if whole != nil && whole.streamed {
+		if err := s.openInbound(whole); err != nil {
+			return nil, err
+		}
+	}
+	return whole, nil
+}
+
+// expireLoop discards the fragments of objects the peer never finished. The
+// reassembler only expires them itself as further fragments arrive, which an
+// idle peer never sends.
+func (s *Session) expireLoop() {
+	ticker := time.NewTicker(s.reassembler.cfg.Timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reassembler.Expire()
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+// responseConn is the net.Conn handed to a session's ConnResponder.
+// Each Write is sent to the peer as a single response frame, unless responses
+// are batched.
+//
+// The session shares the connection, so deadlines set through responseConn
+// are ignored. WriteContext bounds writes through writeContext instead.
+// Closing it, as an asynchronous responder gives up on the peer, closes the
+// session.
+type responseConn struct {
+	net.Conn
+	s *Session
+}
+
+func (rc *responseConn) Write(b []byte) (int, error) {
+	if err := rc.writeContext(context.Background(), b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (rc *responseConn) writeContext(ctx context.Context, b []byte) error {
+	if rc.s.responseBatch != nil {
+		_, err := rc.batch(b)
+		return err
+	}
+
+	frame := make([]byte, 1+len(b))
+	frame[0] = FrameResponse
+	copy(frame[1:], b)
+	return rc.s.writeFrameContext(ctx, frame)
+}
+
+func (rc *responseConn) Close() error {
+	return rc.s.closeWith(ErrSessionClosed)
+}
+
+func (rc *responseConn) SetDeadline(time.Time) error      { return nil }
+func (rc *responseConn) SetReadDeadline(time.Time) error  { return nil }
+func (rc *responseConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (rc *responseConn) batch(b []byte) (int, error) {
+	for rest := b; len(rest) > 0; {
+		response, n, err := DecodeResponseV1(rest)
+		if err != nil {
+			return 0, fmt.Errorf("session: batch response: %w", err)
+		}
+		if err := rc.s.responseBatch.add(response); err != nil {
+			return 0, err
+		}
+		rest = rest[n:]
+	}
+	return len(b), nil
+}
@@ -0,0 +1,160 @@
+package rhizome
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// newSessionPair handshakes two sessions over an in-memory pipe.
+func newSessionPair(t *testing.T, clientCfg, serverCfg SessionConfig) (client, server *Session) {
+	t.Helper()
+
+	c, s := net.Pipe()
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		server, err = NewSession(s, serverCfg)
+		done <- err
+	}()
+
+	client, err := NewSession(c, clientCfg)
+	if err != nil {
+		t.Fatalf("client NewSession error: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("server NewSession error: %v", err)
+	}
+	return client, server
+}
+
+func TestSession_SendReceiveAndAck(t *testing.T) {
+	client, server := newSessionPair(t, SessionConfig{}, SessionConfig{})
+
+	obj := NewObject(
+		ObjDelivery, CmdSend, AckPlcyOnsent,
+		"uid-42", "route", "", "", "",
+		EncodingJson, []byte(`{"a":1}`),
+	)
+
+	sent := make(chan error, 1)
+	go func() { sent <- client.Send(obj) }()
+
+	got, err := server.Receive()
+	if err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	obj.Version = client.Agreement().Version
+	assertObjectsEqual(t, obj, got)
+	if got.Responder != server.Responder {
+		t.Fatalf("received object does not carry the session responder")
+	}
+
+	acked := make(chan error, 1)
+	go func() { acked <- got.RespondWithAck(AckSent) }()
+
+	resp, err := client.ReceiveResponse()
+	if err != nil {
+		t.Fatalf("ReceiveResponse error: %v", err)
+	}
+	if err := <-acked; err != nil {
+		t.Fatalf("RespondWithAck error: %v", err)
+	}
+	if resp.UID != "uid-42" || resp.Ack != AckSent {
+		t.Fatalf("response = %+v, want uid-42/%d", resp, AckSent)
+	}
+}
+
+func TestSession_ReceiveResponse_SplitsCoalescedResponses(t *testing.T) {
+	client, server := newSessionPair(t, SessionConfig{}, SessionConfig{})
+
+	both := append(
+		EncodeResponseV1(Response{UID: "a", Ack: AckSent}),
+		EncodeResponseV1(Response{UID: "b", Ack: AckTimeout})...,
+	)
+	go func() { _ = server.Responder.Write(both) }()
+
+	for _, want := range []Response{{UID: "a", Ack: AckSent}, {UID: "b", Ack: AckTimeout}} {
+		got, err := client.ReceiveResponse()
+		if err != nil {
+			t.Fatalf("ReceiveResponse error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("response = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestSession_Send_RejectsUnagreedEncoding(t *testing.T) {
+	clientCfg := SessionConfig{Capabilities: DefaultCapabilities()}
+	serverCfg := SessionConfig{Capabilities: DefaultCapabilities()}
+	serverCfg.Capabilities.Encodings = []PayloadEncoding{EncodingNA}
+
+	client, _ := newSessionPair(t, clientCfg, serverCfg)
+
+	obj := NewObject(
+		ObjDelivery, CmdSend, AckPlcyNoreply,
+		"uid-1", "", "", "", "",
+		EncodingJson, []byte(`{}`),
+	)
+	if err := client.Send(obj); err == nil {
+		t.Fatalf("Send expected error for unagreed encoding")
+	}
+}
+
+func TestSession_RoutesObjectsAndResponsesSeparately(t *testing.T) {
+	client, server := newSessionPair(t, SessionConfig{}, SessionConfig{})
+
+	obj := NewObject(
+		ObjDelivery, CmdSend, AckPlcyNoreply,
+		"uid-obj", "", "", "", "",
+		EncodingNA, nil,
+	)
+	go func() {
+		_ = client.Responder.Write(EncodeResponseV1(Response{UID: "uid-resp", Ack: 1}))
+		_ = client.Send(obj)
+	}()
+
+	got, err := server.Receive()
+	if err != nil || got.UID != "uid-obj" {
+		t.Fatalf("Receive = %v, %v", got, err)
+	}
+	resp, err := server.ReceiveResponse()
+	if err != nil || resp.UID != "uid-resp" {
+		t.Fatalf("ReceiveResponse = %+v, %v", resp, err)
+	}
+}
+
+func TestSession_ReceiveAfterPeerHangsUp(t *testing.T) {
+	client, server := newSessionPair(t, SessionConfig{}, SessionConfig{})
+
+	obj := NewObject(
+		ObjDelivery, CmdSend, AckPlcyNoreply,
+		"uid-last", "", "", "", "",
+		EncodingNA, nil,
+	)
+	if err := client.Send(obj); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	_ = client.Close()
+
+	// Objects that arrived before the hang up are still handed out.
+	got, err := server.Receive()
+	if err != nil || got.UID != "uid-last" {
+		t.Fatalf("Receive = %v, %v", got, err)
+	}
+	if _, err := server.Receive(); err != io.EOF {
+		t.Fatalf("Receive after hang up = %v, want io.EOF", err)
+	}
+	if _, err := client.Receive(); err != ErrSessionClosed {
+		t.Fatalf("Receive after Close = %v, want ErrSessionClosed", err)
+	}
+}
@@ -0,0 +1,357 @@
+package rhizome
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// -----------------------------------------------------------------------------
+// Streaming payloads.
+// -----------------------------------------------------------------------------
+// A streamed object is sent in two parts. First the object itself, flagged with
+// FlagStream and without a payload, so the receiver can start handling it right
+// away. Then its payload, as a series of chunk frames carrying the object's UID.
+
+// # Chunk frame
+// +---------------+------------+----------+-----------------------+
+// | u8 FrameChunk | u8 len uid | u8 flags | data (rest of frame)  |
+// +---------------+------------+----------+-----------------------+
+
+// The last chunk carries chunkEnd, or chunkAbort if the sender gave up. A
+// receiver that is no longer interested sends a stream cancel control frame
+// carrying the UID, which stops the sender.
+
+// # Stream cancel control frame
+// +-----------------+-------------+------------+
+// | u8 FrameControl | u8 ctrl ID  | u8 len uid |
+// +-----------------+-------------+------------+
+// -----------------------------------------------------------------------------
+
+const (
+	ctrlStreamCancel uint8 = 2
+)
+
+// Chunk frame flags.
+const (
+	chunkEnd   uint8 = 1 << 0
+	chunkAbort uint8 = 1 << 1
+)
+
+var (
+	// ErrStreamAborted is returned by PayloadStream.Read when the sender gave
+	// up before sending the whole payload.
+	ErrStreamAborted = errors.New("stream aborted by sender")
+
+	// ErrStreamCanceled is returned by SendStream when the receiver closed the
+	// stream before reading all of it.
+	ErrStreamCanceled = errors.New("stream canceled by receiver")
+
+	// ErrStreamClosed is returned by PayloadStream.Read after Close.
+	ErrStreamClosed = errors.New("read from closed stream")
+)
+
+//--------Sending---------------------------------------------------------------
+
+// SendStream sends obj to the peer and then streams its payload from r until
+// r returns io.EOF. obj.Payload must be empty.
+//
+// SendStream returns ErrStreamCanceled if the receiver closes the stream early.
+// If ctx is done, or r fails, the receiver is told that the stream was aborted.
+// Reads from r that block are not interrupted by ctx.
+//
+// With credit-based flow control the object costs an object credit and every
+// chunk its length in byte credits, see credit.go.
+func (s *Session) SendStream(ctx context.Context, obj *Object, r io.Reader) error {
+	if s.agreement.Version < ProtocolV2 {
+		return fmt.Errorf(
+			"session stream %s: streams need protocol v2, agreed on v%d",
+			obj.UID, s.agreement.Version,
+		)
+	}
+	if len(obj.Payload) != 0 {
+		return fmt.Errorf(
+			"session stream %s: object already carries a payload", obj.UID,
+		)
+	}
+
+	canceled, err := s.openOutbound(obj.UID)
+	if err != nil {
+		return err
+	}
+	defer s.closeOutbound(obj.UID)
+
+	header := *obj
+	header.streamed = true
+	frame, err := s.agreement.encodeFrame(&header, s.limits)
+	if err != nil {
+		return fmt.Errorf("session stream %s: %w", obj.UID, err)
+	}
+	if err := s.acquireCredit(0); err != nil {
+		return err
+	}
+	if err := s.writeFrame(frame); err != nil {
+		return err
+	}
+
+	size := min(s.chunkSize, int(s.agreement.MaxFrameSize)-3-len(obj.UID))
+	buf := make([]byte, size)
+	for {
+		select {
+		case <-canceled:
+			return ErrStreamCanceled
+		case <-ctx.Done():
+			_ = s.writeChunk(obj.UID, chunkAbort, nil)
+			return ctx.Err()
+		default:
+		}
+
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := s.acquireChunkCredit(n); err != nil {
+				return err
+			}
+			if err := s.writeChunk(obj.UID, 0, buf[:n]); err != nil {
+				return err
+			}
+		}
+		switch {
+		case err == io.EOF:
+			return s.writeChunk(obj.UID, chunkEnd, nil)
+		case err != nil:
+			_ = s.writeChunk(obj.UID, chunkAbort, nil)
+			return fmt.Errorf("session stream %s: %w", obj.UID, err)
+		}
+	}
+}
+
+func (s *Session) writeChunk(uid string, flags uint8, data []byte) error {
+	body := bytes.NewBuffer(make([]byte, 0, 3+len(uid)+len(data)))
+	writeU8(body, FrameChunk)
+	if err := writeString8(body, uid); err != nil {
+		return err
+	}
+	writeU8(body, flags)
+	body.Write(data)
+	return s.writeFrame(body.Bytes())
+}
+
+func (s *Session) openOutbound(uid string) (chan struct{}, error) {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+
+	if _, ok := s.outbound[uid]; ok {
+		return nil, fmt.Errorf("session stream %s: already streaming", uid)
+	}
+	canceled := make(chan struct{})
+	s.outbound[uid] = canceled
+	return canceled, nil
+}
+
+func (s *Session) closeOutbound(uid string) {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	delete(s.outbound, uid)
+}
+
+func (s *Session) handleStreamCancel(body []byte) error {
+	uid, err := readStringU8(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("session: stream cancel: %w", err)
+	}
+
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	if canceled, ok := s.outbound[uid]; ok {
+		close(canceled)
+		delete(s.outbound, uid)
+	}
+	return nil
+}
+
+//--------Receiving-------------------------------------------------------------
+
+// PayloadStream is the payload of a streamed object as it arrives.
+//
+// Only a limited number of chunks is buffered. Once the buffer is full the
+// session stops reading from its connection, which in turn slows the sender
+// down, so streams should be read on their own goroutine while the session
+// keeps receiving.
+type PayloadStream struct {
+	s   *Session
+	uid string
+
+	chunks chan []byte
+	cur    []byte
+
+	// closed is closed by Close, ended once no more chunks will arrive, at
+	// which point err holds the reason.
+	closed    chan struct{}
+	closeOnce sync.Once
+	ended     chan struct{}
+	endOnce   sync.Once
+	err       error
+}
+
+// Read reads payload bytes, blocking until the next chunk arrives. It returns
+// io.EOF after the last chunk and ErrStreamAborted if the sender gave up.
+func (ps *PayloadStream) Read(p []byte) (int, error) {
+	select {
+	case <-ps.closed:
+		return 0, ErrStreamClosed
+	default:
+	}
+
+	for len(ps.cur) == 0 {
+		select {
+		case chunk := <-ps.chunks:
+			ps.take(chunk)
+		case <-ps.closed:
+			return 0, ErrStreamClosed
+		case <-ps.ended:
+			// Chunks sent before the end are still buffered.
+			select {
+			case chunk := <-ps.chunks:
+				ps.take(chunk)
+			default:
+				return 0, ps.err
+			}
+		}
+	}
+
+	n := copy(p, ps.cur)
+	ps.cur = ps.cur[n:]
+	return n, nil
+}
+
+// take makes chunk the one Read reads from, paying it back to the peer.
+func (ps *PayloadStream) take(chunk []byte) {
+	ps.cur = chunk
+	ps.s.replenishChunkCredit(len(chunk))
+}
+
+// discard drops the buffered chunks of a closed stream, paying them back to
+// the peer.
+func (ps *PayloadStream) discard() {
+	for {
+		select {
+		case chunk := <-ps.chunks:
+			ps.s.replenishChunkCredit(len(chunk))
+		default:
+			return
+		}
+	}
+}
+
+// Close stops the stream. If the payload has not been read to the end, the
+// sender is told to stop sending it and any chunks still on the way are
+// discarded.
+func (ps *PayloadStream) Close() error {
+	ps.closeOnce.Do(func() {
+		close(ps.closed)
+		ps.discard()
+
+		select {
+		case <-ps.ended:
+			return
+		default:
+		}
+
+		ps.s.streamsMu.Lock()
+		if ps.s.inbound[ps.uid] == ps {
+			delete(ps.s.inbound, ps.uid)
+		}
+		ps.s.streamsMu.Unlock()
+
+		body := bytes.NewBuffer(nil)
+		writeU8(body, FrameControl)
+		writeU8(body, ctrlStreamCancel)
+		_ = writeString8(body, ps.uid)
+		_ = ps.s.writeFrame(body.Bytes())
+	})
+	return nil
+}
+
+// finish marks the end of the stream, err is returned by Read once the
+// buffered chunks are drained.
+func (ps *PayloadStream) finish(err error) {
+	ps.endOnce.Do(func() {
+		ps.err = err
+		close(ps.ended)
+	})
+}
+
+func (s *Session) openInbound(obj *Object) error {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+
+	if _, ok := s.inbound[obj.UID]; ok {
+		return fmt.Errorf("session: stream %s is already open", obj.UID)
+	}
+
+	ps := &PayloadStream{
+		s:      s,
+		uid:    obj.UID,
+		chunks: make(chan []byte, s.streamBuffer),
+		closed: make(chan struct{}),
+		ended:  make(chan struct{}),
+	}
+	s.inbound[obj.UID] = ps
+	obj.Stream = ps
+	return nil
+}
+
+func (s *Session) handleChunk(body []byte) error {
+	r := bytes.NewReader(body)
+	uid, err := readStringU8(r)
+	if err != nil {
+		return fmt.Errorf("session: chunk uid: %w", err)
+	}
+	var flags uint8
+	if err := readU8(r, &flags); err != nil {
+		return fmt.Errorf("session: chunk flags: %w", err)
+	}
+	data := body[len(body)-r.Len():]
+
+	s.streamsMu.Lock()
+	ps, ok := s.inbound[uid]
+	if ok && flags&(chunkEnd|chunkAbort) != 0 {
+		delete(s.inbound, uid)
+	}
+	s.streamsMu.Unlock()
+
+	s.consumeChunkCredit(len(data))
+	if !ok {
+		// Closed by the receiver, the sender has not seen the cancel yet.
+		s.replenishChunkCredit(len(data))
+		return nil
+	}
+
+	if len(data) != 0 {
+		defer s.stall()()
+		select {
+		case ps.chunks <- data:
+			// Close may have emptied the buffer just before.
+			select {
+			case <-ps.closed:
+				ps.discard()
+			default:
+			}
+		case <-ps.closed:
+			s.replenishChunkCredit(len(data))
+		case <-s.done:
+			return ErrSessionClosed
+		}
+	}
+
+	switch {
+	case flags&chunkAbort != 0:
+		ps.finish(ErrStreamAborted)
+	case flags&chunkEnd != 0:
+		ps.finish(io.EOF)
+	}
+	return nil
+}
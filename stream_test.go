@@ -0,0 +1,238 @@
+package rhizome
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingReader produces an endless stream of bytes and counts how many were
+// read.
+type countingReader struct{ n atomic.Int64 }
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(i)
+	}
+	r.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func TestSession_SendStream_ReceiverStartsBeforeLastChunk(t *testing.T) {
+	cfg := SessionConfig{ChunkSize: 1024}
+	client, server := newSessionPair(t, cfg, cfg)
+
+	first := bytes.Repeat([]byte("first,"), 1000)
+	rest := bytes.Repeat([]byte("rest,"), 20000)
+
+	src, srcW := io.Pipe()
+	sent := make(chan error, 1)
+	go func() { sent <- client.SendStream(context.Background(), newDelivery("uid-s", EncodingCsv, nil), src) }()
+	go func() { _, _ = srcW.Write(first) }()
+
+	obj, err := server.Receive()
+	if err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	if !obj.Streamed() || obj.Stream == nil {
+		t.Fatalf("received object is not streamed")
+	}
+
+	// The first part is readable while the sender is still waiting on more.
+	head := make([]byte, len(first))
+	if _, err := io.ReadFull(obj.Stream, head); err != nil {
+		t.Fatalf("reading first part: %v", err)
+	}
+	if !bytes.Equal(head, first) {
+		t.Fatalf("first part differs")
+	}
+
+	go func() {
+		_, _ = srcW.Write(rest)
+		_ = srcW.Close()
+	}()
+	tail, err := io.ReadAll(obj.Stream)
+	if err != nil {
+		t.Fatalf("reading rest: %v", err)
+	}
+	if !bytes.Equal(tail, rest) {
+		t.Fatalf("rest differs: got %d bytes, want %d", len(tail), len(rest))
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("SendStream error: %v", err)
+	}
+
+	// The object is acknowledged like any other.
+	go func() { _ = obj.RespondWithAck(AckSent) }()
+	if resp, err := client.ReceiveResponse(); err != nil || resp.UID != "uid-s" {
+		t.Fatalf("ReceiveResponse = %+v, %v", resp, err)
+	}
+}
+
+func TestSession_SendStream_Backpressure(t *testing.T) {
+	cfg := SessionConfig{ChunkSize: 100, StreamBuffer: 2}
+	client, server := newSessionPair(t, cfg, cfg)
+
+	src := &countingReader{}
+	sent := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { sent <- client.SendStream(ctx, newDelivery("uid-bp", EncodingCsv, nil), src) }()
+
+	obj, err := server.Receive()
+	if err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+
+	// Nobody reads the stream, so the sender soon has to stop.
+	time.Sleep(50 * time.Millisecond)
+	before := src.n.Load()
+	time.Sleep(50 * time.Millisecond)
+	if after := src.n.Load(); after != before {
+		t.Fatalf("sender kept going without a reader: %d -> %d bytes", before, after)
+	}
+	if before > 10*100 {
+		t.Fatalf("sender got %d bytes ahead of the reader", before)
+	}
+
+	// Reading lets it continue.
+	if _, err := io.ReadFull(obj.Stream, make([]byte, 5000)); err != nil {
+		t.Fatalf("reading stream: %v", err)
+	}
+	if src.n.Load() <= before {
+		t.Fatalf("sender did not continue after the reader caught up")
+	}
+	_ = obj.Stream.Close()
+
+	select {
+	case err := <-sent:
+		if !errors.Is(err, ErrStreamCanceled) {
+			t.Fatalf("SendStream error = %v, want ErrStreamCanceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("SendStream did not stop after the receiver closed the stream")
+	}
+	if _, err := obj.Stream.Read(make([]byte, 1)); err != ErrStreamClosed {
+		t.Fatalf("Read after Close = %v, want ErrStreamClosed", err)
+	}
+}
+
+func TestSession_SendStream_ContextCancelAbortsReceiver(t *testing.T) {
+	client, server := newSessionPair(t, SessionConfig{}, SessionConfig{})
+
+	src, srcW := io.Pipe()
+	t.Cleanup(func() { _ = src.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	sent := make(chan error, 1)
+	go func() { sent <- client.SendStream(ctx, newDelivery("uid-abort", EncodingCsv, nil), src) }()
+
+	obj, err := server.Receive()
+	if err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+
+	cancel()
+	// Wakes the sender up if it is already waiting on src.
+	go func() { _, _ = srcW.Write([]byte("last words")) }()
+
+	if _, err := io.ReadAll(obj.Stream); !errors.Is(err, ErrStreamAborted) {
+		t.Fatalf("ReadAll error = %v, want ErrStreamAborted", err)
+	}
+	if err := <-sent; !errors.Is(err, context.Canceled) {
+		t.Fatalf("SendStream error = %v, want context.Canceled", err)
+	}
+}
+
+func TestSession_Stream_PeerHangsUpMidStream(t *testing.T) {
+	client, server := newSessionPair(t, SessionConfig{}, SessionConfig{})
+
+	src, srcW := io.Pipe()
+	t.Cleanup(func() { _ = src.Close() })
+	go func() { _ = client.SendStream(context.Background(), newDelivery("uid-cut", EncodingCsv, nil), src) }()
+	go func() { _, _ = srcW.Write([]byte("partial")) }()
+
+	obj, err := server.Receive()
+	if err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	if _, err := io.ReadFull(obj.Stream, make([]byte, len("partial"))); err != nil {
+		t.Fatalf("reading partial data: %v", err)
+	}
+
+	_ = client.Close()
+	if _, err := obj.Stream.Read(make([]byte, 1)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Read after hang up = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestSession_SendStream_Rejections(t *testing.T) {
+	v1 := SessionConfig{Capabilities: DefaultCapabilities()}
+	v1.Capabilities.MaxVersion = ProtocolV1
+	client, _ := newSessionPair(t, v1, SessionConfig{})
+
+	err := client.SendStream(context.Background(), newDelivery("uid", EncodingCsv, nil), bytes.NewReader(nil))
+	if err == nil {
+		t.Fatalf("expected error streaming over a v1 session")
+	}
+
+	client, _ = newSessionPair(t, SessionConfig{}, SessionConfig{})
+	withPayload := newDelivery("uid", EncodingCsv, []byte("inline"))
+	if err := client.SendStream(context.Background(), withPayload, bytes.NewReader(nil)); err == nil {
+		t.Fatalf("expected error streaming an object with an inline payload")
+	}
+}
+
+func TestEncodeV2_StreamFlag(t *testing.T) {
+	obj := newDelivery("uid-flag", EncodingCsv, nil)
+	obj.Version = ProtocolV2
+	obj.streamed = true
+
+	frame, err := EncodeFrame(obj)
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+	if frame[1]&FlagStream == 0 {
+		t.Fatalf("FlagStream not set")
+	}
+	got, err := DecodeFrame(frame, newResponder())
+	if err != nil {
+		t.Fatalf("DecodeFrame error: %v", err)
+	}
+	if !got.Streamed() {
+		t.Fatalf("decoded object is not marked as streamed")
+	}
+
+	obj.Payload = []byte("inline")
+	if _, err := EncodeFrame(obj); err == nil {
+		t.Fatalf("expected error encoding a streamed object with a payload")
+	}
+}
+
+func TestPayloadStream_ReadAfterCloseDropsBufferedChunks(t *testing.T) {
+	// A stream that ended with chunks still buffered, so Close has nothing to
+	// tell the sender.
+	ps := &PayloadStream{
+		s:      &Session{},
+		chunks: make(chan []byte, 2),
+		closed: make(chan struct{}),
+		ended:  make(chan struct{}),
+	}
+	ps.chunks <- []byte("first")
+	ps.chunks <- []byte("second")
+	ps.finish(io.EOF)
+
+	if n, err := ps.Read(make([]byte, 2)); n != 2 || err != nil {
+		t.Fatalf("Read = %d, %v", n, err)
+	}
+	_ = ps.Close()
+
+	for range 2 {
+		if n, err := ps.Read(make([]byte, 16)); n != 0 || err != ErrStreamClosed {
+			t.Fatalf("Read after Close = %d, %v, want ErrStreamClosed", n, err)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package rhizome
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// -----------------------------------------------------------------------------
+// Version 2 object decoding.
+// -----------------------------------------------------------------------------
+// Version 2 keeps the v1 layout but adds a flags byte after the version, which
+// signals optional sub-headers, and widens the payload length to a u32.
+
+// # Fixed field sized header
+// +--------+----------+-------------+-------------+---------------+
+// | u8 ver | u8 flags | u8 obj_type | u8 cmd_type | u8 ack policy |
+// +--------+----------+-------------+-------------+---------------+
+
+// # Tracking and Argument Sub-Headers, unchanged from v1
+// +------------+-------------+-------------+-------------+-------------+
+// | u8 len uid | u8 len arg1 | u8 len arg2 | u8 len arg3 | u8 len arg4 |
+// +------------+-------------+-------------+-------------+-------------+
+
+// # Payload Encoding, unchanged from v1
+// +------------------+
+// | u8 encoding type |
+// +------------------+
+
+// # Fragment Sub-Header, only present if FlagFragment is set
+// +-----------+-----------+
+// | u16 index | u16 count |
+// +-----------+-----------+
+
+// # Compression Sub-Header, only present if FlagCompressed is set
+// +--------------+----------------------+
+// | u8 algorithm | u32 decompressed len |
+// +--------------+----------------------+
+
+// # Payload
+// +-----------------+
+// | u32 len payload |
+// +-----------------+
+
+// Uncompressed payloads keep the v1 limit of 64KB - 1. Compressed payloads may
+// inflate past it, up to MaxDecompressedSize or the limit the session or
+// DecodeOptions set, which is checked against the declared size before any
+// decompression happens.
+// -----------------------------------------------------------------------------
+
+// Version 2 flags.
+const (
+	// FlagCompressed signals the compression sub-header and a compressed
+	// payload.
+	FlagCompressed uint8 = 1 << 0
+
+	// FlagFragment signals the fragment sub-header, the payload is one piece
+	// of a larger payload shared by every fragment with the same UID.
+	FlagFragment uint8 = 1 << 1
+
+	// FlagStream signals an object without payload whose payload follows as a
+	// series of chunk frames, see stream.go.
+	FlagStream uint8 = 1 << 2
+
+	knownFlagsV2 = FlagCompressed | FlagFragment | FlagStream
+)
+
+// maxPayloadSize is the largest uncompressed payload a single frame carries.
+const maxPayloadSize = 64*BytesInKilobyte - 1
+
+//--------Decoding--------------------------------------------------------------
+
+func decodeV2(data []byte, obj *Object, lim compressionLimits) (*Object, error) {
+	r := bytes.NewReader(data)
+
+	var flags uint8
+	if err := readU8(r, &flags); err != nil {
+		return nil, fmt.Errorf("unable to parse u8 flags field: %s", err)
+	}
+	if flags&^knownFlagsV2 != 0 {
+		return nil, fmt.Errorf("unknown v2 flags: %08b", flags&^knownFlagsV2)
+	}
+
+	// ObjType + CmdType + AckPlcy
+	obj, err := parseBaseHeader(r, obj)
+	if err != nil {
+		return nil, err
+	}
+	// UID
+	obj, err = parseTrackingHeader(r, obj)
+	if err != nil {
+		return nil, err
+	}
+	// Arg fields
+	obj, err = parseArgumentFields(r, obj)
+	if err != nil {
+		return nil, err
+	}
+	// PayloadEncoding
+	obj, err = parsePayloadEncoding(r, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fragment position
+	if flags&FlagFragment != 0 {
+		if err := binary.Read(r, binary.BigEndian, &obj.FragIndex); err != nil {
+			return nil, fmt.Errorf("unable to parse fragment index: %s", err)
+		}
+		if err := binary.Read(r, binary.BigEndian, &obj.FragCount); err != nil {
+			return nil, fmt.Errorf("unable to parse fragment count: %s", err)
+		}
+		if obj.FragIndex >= obj.FragCount {
+			return nil, fmt.Errorf(
+				"fragment index %d out of range for count %d",
+				obj.FragIndex, obj.FragCount,
+			)
+		}
+	}
+
+	// Compression
+	var size uint32
+	if flags&FlagCompressed != 0 {
+		if err := readU8(r, (*uint8)(&obj.Compression)); err != nil {
+			return nil, fmt.Errorf("unable to parse compression algorithm: %s", err)
+		}
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, fmt.Errorf("unable to parse decompressed length: %s", err)
+		}
+		if uint64(size) > uint64(lim.maxInflated) {
+			return nil, fmt.Errorf(
+				"declared decompressed length %d exceeds %d byte limit",
+				size, lim.maxInflated,
+			)
+		}
+	}
+
+	// Payload
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, fmt.Errorf("unable to parse payload length: %s", err)
+	}
+	if flags&FlagCompressed == 0 && n > maxPayloadSize {
+		return nil, errors.New("declared length exceeds 64KB safety limit")
+	}
+	if uint64(n) > uint64(r.Len()) {
+		return nil, fmt.Errorf(
+			"Unable to parse payload from %s: declared %d bytes, %d remain",
+			obj.sender(), n, r.Len(),
+		)
+	}
+	if n != 0 {
+		obj.Payload = make([]byte, n)
+		_, _ = r.Read(obj.Payload)
+	}
+
+	if flags&FlagCompressed != 0 {
+		payload, err := decompress(obj.Compression, obj.Payload, int(size))
+		if err != nil {
+			return nil, err
+		}
+		obj.Payload = payload
+	}
+
+	if flags&FlagStream != 0 {
+		if len(obj.Payload) != 0 {
+			return nil, errors.New("streamed object carries an inline payload")
+		}
+		obj.streamed = true
+	}
+
+	// Response
+	obj.Response = &Response{
+		UID: obj.UID,
+		Ack: AckUnknown,
+	}
+
+	if r.Len() != 0 {
+		return nil, errors.New("unaccounted data in reader")
+	}
+
+	return obj, nil
+}
+
+//--------Encoding--------------------------------------------------------------
+
+// encodeV2 builds a v2 message, compressing the payload with obj.Compression if
+// it is at least lim.threshold bytes long and compressing actually makes it
+// smaller.
+func encodeV2(obj *Object, lim compressionLimits) ([]byte, error) {
+	return appendV2(nil, obj, lim)
+}
+
+// appendV2 appends the v2 message of obj to dst.
+func appendV2(dst []byte, obj *Object, lim compressionLimits) ([]byte, error) {
+	flags, payload, err := prepareV2(obj, lim)
+	if err != nil {
+		return nil, err
+	}
+	if dst, err = appendV2Header(dst, obj, flags, payload); err != nil {
+		return nil, err
+	}
+	return append(dst, payload...), nil
+}
+
+// prepareV2 works out the flags of the v2 message of obj and the payload it
+// carries, compressed if that pays off.
+func prepareV2(obj *Object, lim compressionLimits) (uint8, []byte, error) {
+	if obj.UID == "" {
+		return 0, nil, errors.New("encodeV2: UID must not be empty")
+	}
+
+	payload := obj.Payload
+	var flags uint8
+
+	if obj.FragCount != 0 {
+		if obj.FragIndex >= obj.FragCount {
+			return 0, nil, fmt.Errorf(
+				"encodeV2: fragment index %d out of range for count %d",
+				obj.FragIndex, obj.FragCount,
+			)
+		}
+		flags |= FlagFragment
+	}
+	if obj.streamed {
+		if len(payload) != 0 {
+			return 0, nil, errors.New(
+				"encodeV2: streamed object carries an inline payload",
+			)
+		}
+		flags |= FlagStream
+	}
+
+	if obj.Compression != CompressionNone &&
+		len(payload) >= lim.threshold {
+
+		if len(payload) > lim.maxInflated {
+			return 0, nil, fmt.Errorf(
+				"encodeV2: payload too large: %d bytes", len(payload),
+			)
+		}
+		compressed, err := compress(obj.Compression, payload)
+		if err != nil {
+			return 0, nil, fmt.Errorf("encodeV2: %w", err)
+		}
+		if len(compressed) < len(payload) {
+			flags |= FlagCompressed
+			payload = compressed
+		}
+	}
+
+	if flags&FlagCompressed == 0 && len(payload) > maxPayloadSize {
+		return 0, nil, fmt.Errorf(
+			"encodeV2: payload too large: %d bytes", len(payload),
+		)
+	}
+	return flags, payload, nil
+}
+
+// appendV2Header appends everything of the v2 message of obj that comes before
+// the payload bytes to dst.
+func appendV2Header(dst []byte, obj *Object, flags uint8, payload []byte) ([]byte, error) {
+	// Version + flags + fixed header
+	dst = append(dst, ProtocolV2, flags, obj.ObjType, obj.CmdType, obj.AckPlcy)
+
+	// Tracking + arguments (all u8-len strings)
+	dst, err := appendString8(dst, obj.UID)
+	if err != nil {
+		return nil, fmt.Errorf("encodeV2: uid: %w", err)
+	}
+	for i, arg := range [...]string{obj.Arg1, obj.Arg2, obj.Arg3, obj.Arg4} {
+		if dst, err = appendString8(dst, arg); err != nil {
+			return nil, fmt.Errorf("encodeV2: arg%d: %w", i+1, err)
+		}
+	}
+
+	// Payload encoding (u8)
+	dst = append(dst, uint8(obj.PayloadEncoding))
+
+	// Fragment sub-header
+	if flags&FlagFragment != 0 {
+		dst = binary.BigEndian.AppendUint16(dst, obj.FragIndex)
+		dst = binary.BigEndian.AppendUint16(dst, obj.FragCount)
+	}
+
+	// Compression sub-header
+	if flags&FlagCompressed != 0 {
+		dst = append(dst, uint8(obj.Compression))
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(obj.Payload)))
+	}
+
+	// Payload length (u32)
+	return binary.BigEndian.AppendUint32(dst, uint32(len(payload))), nil
+}
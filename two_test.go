@@ -0,0 +1,113 @@
+package rhizome
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeV2_RoundTrip_Basic(t *testing.T) {
+	obj := NewObject(
+		ObjChannel, CmdAdd, AckPlcyOnsent,
+		"uid-v2", "route", "channel", "", "4",
+		EncodingJson, []byte(`{"hello":"world"}`),
+	)
+	obj.Version = ProtocolV2
+
+	encoded, err := EncodeFrame(obj)
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+	if encoded[0] != ProtocolV2 || encoded[1] != 0 {
+		t.Fatalf("expected version 2 and no flags, got %v", encoded[:2])
+	}
+
+	got, err := DecodeFrame(encoded, newResponder())
+	if err != nil {
+		t.Fatalf("DecodeFrame error: %v", err)
+	}
+	assertObjectsEqual(t, obj, got)
+	if got.Response == nil || got.Response.UID != obj.UID {
+		t.Fatalf("decoded object has no matching Response: %+v", got.Response)
+	}
+}
+
+func TestEncodeV2_EmptyPayload(t *testing.T) {
+	obj := NewObject(
+		ObjChannel, CmdRemove, AckPlcyNoreply,
+		"uid-empty", "", "", "", "",
+		EncodingNA, nil,
+	)
+	obj.Version = ProtocolV2
+
+	encoded, err := EncodeFrame(obj)
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+	got, err := DecodeFrame(encoded, newResponder())
+	if err != nil {
+		t.Fatalf("DecodeFrame error: %v", err)
+	}
+	assertObjectsEqual(t, obj, got)
+}
+
+func TestEncodeV2_Rejections(t *testing.T) {
+	noUID := NewObject(0, 0, 0, "", "", "", "", "", EncodingNA, nil)
+	noUID.Version = ProtocolV2
+	if _, err := EncodeFrame(noUID); err == nil {
+		t.Fatalf("expected error for empty UID")
+	}
+
+	longArg := NewObject(0, 0, 0, "uid", "", "", string(bytes.Repeat([]byte{'x'}, 256)), "", EncodingNA, nil)
+	longArg.Version = ProtocolV2
+	if _, err := EncodeFrame(longArg); err == nil {
+		t.Fatalf("expected error for arg over 255 bytes")
+	}
+
+	big := NewObject(0, 0, 0, "uid", "", "", "", "", EncodingNA, make([]byte, maxPayloadSize+1))
+	big.Version = ProtocolV2
+	if _, err := EncodeFrame(big); err == nil {
+		t.Fatalf("expected error for payload over 64KB")
+	}
+}
+
+func TestDecodeV2_Rejections(t *testing.T) {
+	obj := NewObject(
+		ObjDelivery, CmdSend, AckPlcyNoreply,
+		"uid", "", "", "", "",
+		EncodingNA, []byte("abc"),
+	)
+	obj.Version = ProtocolV2
+	valid, err := EncodeFrame(obj)
+	if err != nil {
+		t.Fatalf("EncodeFrame error: %v", err)
+	}
+
+	unknownFlags := bytes.Clone(valid)
+	unknownFlags[1] = 0x80
+	if _, err := DecodeFrame(unknownFlags, newResponder()); err == nil {
+		t.Fatalf("expected error for unknown flags")
+	}
+
+	trailing := append(bytes.Clone(valid), 0x00)
+	if _, err := DecodeFrame(trailing, newResponder()); err == nil {
+		t.Fatalf("expected error for trailing data")
+	}
+
+	truncated := valid[:len(valid)-1]
+	if _, err := DecodeFrame(truncated, newResponder()); err == nil {
+		t.Fatalf("expected error for truncated payload")
+	}
+}
+
+func TestEncodeResponse_V2_MatchesV1(t *testing.T) {
+	resp := Response{UID: "uid-v2", Ack: AckSent}
+	obj := &Object{Version: ProtocolV2, Response: &resp}
+
+	got, err := EncodeResponse(obj)
+	if err != nil {
+		t.Fatalf("EncodeResponse error: %v", err)
+	}
+	if !bytes.Equal(got, EncodeResponseV1(resp)) {
+		t.Fatalf("v2 response bytes differ from v1")
+	}
+}